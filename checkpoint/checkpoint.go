@@ -0,0 +1,165 @@
+package checkpoint
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"sort"
+	"time"
+	"reflect"
+	"io/ioutil"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+	"github.com/asgaines/msgextract/unpack"
+)
+
+// Checkpoint records how far an extraction went, for an interrupted run to
+// be resumed rather than started over
+type Checkpoint struct {
+	// Absolute path of the archive extracted. Its size, modification time
+	// and SHA-256 tell whether it is the same archive, wherever it was
+	// moved since
+	Archive string `json:"archive"`
+	ArchiveSize int64 `json:"archive_size"`
+	ArchiveModTime time.Time `json:"archive_mod_time"`
+	ArchiveHash string `json:"archive_hash"`
+	// Options the output depends on, which a resumed run must share: the
+	// output fields and the options given, by name, such as where
+	Format string `json:"format"`
+	Fields []string `json:"fields"`
+	Options map[string]string `json:"options"`
+	// Position in the tar archive past the last entry written out
+	Position unpack.Position `json:"position"`
+	// Messages written, and size of the output holding them
+	Messages int `json:"messages"`
+	OutputSize int64 `json:"output_size"`
+	Time time.Time `json:"time"`
+}
+
+// Path is the sidecar file keeping the checkpoint of an output
+func Path(outputPath string) string {
+	return outputPath + ".checkpoint"
+}
+
+// New starts the checkpoint of an extraction of the archive
+func New(archivePath, format string, fields []string, options map[string]string) (*Checkpoint, error) {
+	absPath, err := filepath.Abs(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(absPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	hash, err := hashFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Checkpoint{
+		Archive: absPath,
+		ArchiveSize: info.Size(),
+		ArchiveModTime: info.ModTime().UTC(),
+		ArchiveHash: hash,
+		Format: format,
+		Fields: fields,
+		Options: options,
+	}, nil
+}
+
+// hashFile is the SHA-256 of the whole content read, so that an archive
+// changed anywhere is told apart
+func hashFile(reader io.Reader) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, reader); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Read reads the checkpoint from its file
+func Read(path string) (*Checkpoint, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var c Checkpoint
+	if err := json.Unmarshal(content, &c); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return &c, nil
+}
+
+// Resume carries the progress of the saved checkpoint over, if it was
+// written by an extraction of the same archive with the same options
+func (c *Checkpoint) Resume(saved *Checkpoint) error {
+	switch {
+	case saved.ArchiveSize != c.ArchiveSize || !saved.ArchiveModTime.Equal(c.ArchiveModTime) || saved.ArchiveHash != c.ArchiveHash:
+		return fmt.Errorf("checkpoint of %v (%v bytes, modified %v), not of this archive", saved.Archive, saved.ArchiveSize, saved.ArchiveModTime)
+	case saved.Format != c.Format:
+		return fmt.Errorf("checkpoint of %v output, not %v", saved.Format, c.Format)
+	case !reflect.DeepEqual(saved.Fields, c.Fields):
+		return fmt.Errorf("checkpoint of an extraction with other fields")
+	}
+	for _, name := range optionNames(saved.Options, c.Options) {
+		if saved.Options[name] != c.Options[name] {
+			return fmt.Errorf("checkpoint of an extraction with -%v %q, not %q", name, saved.Options[name], c.Options[name])
+		}
+	}
+
+	c.Position = saved.Position
+	c.Messages = saved.Messages
+	c.OutputSize = saved.OutputSize
+	return nil
+}
+
+// optionNames lists the names of the options of either, sorted
+func optionNames(a, b map[string]string) []string {
+	var names []string
+	for name := range a {
+		names = append(names, name)
+	}
+	for name := range b {
+		if _, ok := a[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Write replaces the file with the checkpoint, so that a crash leaves
+// either the previous checkpoint or this one
+func (c *Checkpoint) Write(path string) error {
+	c.Time = time.Now().UTC()
+	content, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(content, '\n'))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,126 @@
+package checkpoint
+
+import (
+	"os"
+	"time"
+	"bytes"
+	"strings"
+	"testing"
+	"io/ioutil"
+	"path/filepath"
+	"github.com/asgaines/msgextract/unpack"
+)
+
+const gzippedArchive = "../test_files/targzs/testEmails.tar.gz"
+
+func TestCheckpoint(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("../test_files", "tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	path := Path(filepath.Join(tmpDir, "output.jsonl"))
+
+	// Copies of the archive, as it was and with a byte changed, of the same
+	// size and modification time
+	original, err := ioutil.ReadFile(gzippedArchive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(gzippedArchive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved := filepath.Join(tmpDir, "moved.tar.gz")
+	recopied := filepath.Join(tmpDir, "recopied.tar.gz")
+	changed := append([]byte{}, original...)
+	changed[len(changed) / 2] ^= 0xff
+	for archive, content := range map[string][]byte{moved: original, recopied: changed} {
+		if err := ioutil.WriteFile(archive, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(archive, info.ModTime(), info.ModTime()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fields := []string{"Date", "From", "Subject"}
+	options := func() map[string]string {
+		return map[string]string{"format": "jsonl", "where": "has(Subject)", "sieve-sha256": "e3b0c442"}
+	}
+	c, err := New(gzippedArchive, "jsonl", fields, options())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Position = unpack.Position{Entries: 1, Offset: 12800}
+	c.Messages = 1
+	c.OutputSize = 230
+	if err := c.Write(path); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left: %v", err)
+	}
+	if !filepath.IsAbs(saved.Archive) {
+		t.Errorf("archive recorded as %v", saved.Archive)
+	}
+
+	cases := []struct {
+		name string
+		archive string
+		change func(*Checkpoint)
+		err string
+	}{
+		{"same extraction", gzippedArchive, func(*Checkpoint) {}, ""},
+		{"archive moved", moved, func(*Checkpoint) {}, ""},
+		{"archive copied over, same size and time", recopied, func(*Checkpoint) {}, "not of this archive"},
+		{"archive changed", gzippedArchive, func(c *Checkpoint) { c.ArchiveModTime = c.ArchiveModTime.Add(time.Second) }, "not of this archive"},
+		{"other format", gzippedArchive, func(c *Checkpoint) { c.Format = "es-bulk" }, "checkpoint of jsonl output, not es-bulk"},
+		{"other fields", gzippedArchive, func(c *Checkpoint) { c.Fields = append(fields, "body_text") }, "other fields"},
+		{"other filter", gzippedArchive, func(c *Checkpoint) { c.Options["where"] = "" }, `-where "has(Subject)", not ""`},
+		{"other sieve script", gzippedArchive, func(c *Checkpoint) { c.Options["sieve-sha256"] = "4a5e1e4b" }, `-sieve-sha256 "e3b0c442", not "4a5e1e4b"`},
+		{"option added", gzippedArchive, func(c *Checkpoint) { c.Options["snippet-length"] = "50" }, `-snippet-length "", not "50"`},
+		{"option dropped", gzippedArchive, func(c *Checkpoint) { delete(c.Options, "format") }, `-format "jsonl", not ""`},
+	}
+
+	for _, tc := range cases {
+		current, err := New(tc.archive, "jsonl", fields, options())
+		if err != nil {
+			t.Fatal(err)
+		}
+		tc.change(current)
+
+		err = current.Resume(saved)
+		if tc.err == "" && err != nil || tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%v: resuming gave %v, expected %q", tc.name, err, tc.err)
+		}
+		if tc.err == "" && (current.Position != c.Position || current.Messages != 1 || current.OutputSize != 230) {
+			t.Errorf("%v: resumed %+v", tc.name, current)
+		}
+		if tc.err != "" && current.Messages != 0 {
+			t.Errorf("%v: resumed %+v", tc.name, current)
+		}
+	}
+}
+
+func TestHashFile(t *testing.T) {
+	content := make([]byte, 3 << 20)
+	whole, err := hashFile(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every byte counts, the middle of the archive as well as its ends
+	for _, i := range []int{0, len(content) / 2, len(content) - 1} {
+		content[i] ^= 1
+		if changed, _ := hashFile(bytes.NewReader(content)); changed == whole {
+			t.Errorf("byte %v not hashed", i)
+		}
+		content[i] ^= 1
+	}
+}
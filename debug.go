@@ -0,0 +1,47 @@
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+	"net/http"
+	"net/http/pprof"
+	"github.com/asgaines/msgextract/metrics"
+)
+
+// serveDebug serves the metrics on metricsAddr and the runtime profiles on
+// pprofAddr in the background, each unless its address is empty. Both may
+// share an address, kept apart from the API
+func serveDebug(metricsAddr string, registry *metrics.Registry, pprofAddr string) {
+	muxes := map[string]*http.ServeMux{}
+	mux := func(addr string) *http.ServeMux {
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
+		}
+		return muxes[addr]
+	}
+
+	if metricsAddr != "" {
+		mux(metricsAddr).Handle("/metrics", registry)
+	}
+	if pprofAddr != "" {
+		profiles := mux(pprofAddr)
+		profiles.HandleFunc("/debug/pprof/", pprof.Index)
+		profiles.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		profiles.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		profiles.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		profiles.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	for addr, handler := range muxes {
+		// Failing to listen stops the program before it starts working
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			log.Fatal(server.Serve(listener))
+		}()
+	}
+}
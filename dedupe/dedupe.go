@@ -0,0 +1,148 @@
+package dedupe
+
+import (
+	"io"
+	"fmt"
+	"regexp"
+	"hash"
+	"strings"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/textproto"
+)
+
+// What makes two messages the same
+const (
+	// Same Message-ID header
+	ByMessageID = "message-id"
+	// Same originator, recipient and identification headers, ignoring the
+	// trace headers added along each delivery
+	ByHeaders = "headers"
+	// Same headers as above and same body, byte for byte
+	ByContent = "content"
+)
+
+var ValidKeys = map[string]bool{
+	ByMessageID: true,
+	ByHeaders: true,
+	ByContent: true,
+}
+
+// Headers set by the author's mailer, as opposed to Received, Delivered-To
+// and other fields which differ between copies of a message
+var identityHeaders = []string{
+	"Message-Id",
+	"Date",
+	"From",
+	"Sender",
+	"Reply-To",
+	"To",
+	"Cc",
+	"Subject",
+	"In-Reply-To",
+	"References",
+}
+
+var idPattern = regexp.MustCompile(`<[^<>\s]+>`)
+
+// Detector remembers the messages seen so far by key. Only the reference of
+// the first message under each key is held, plus the members of groups
+// which turned out to be duplicated, so memory grows with the number of
+// distinct messages rather than with their size
+type Detector struct {
+	first map[string]string
+	groups map[string][]string
+	// Keys of duplicated groups, in order of their first duplicate
+	order []string
+}
+
+// Group is a set of messages sharing a key
+type Group struct {
+	Key string `json:"key"`
+	// References of the messages, in the order they were checked
+	Messages []string `json:"messages"`
+}
+
+func NewDetector() *Detector {
+	return &Detector{
+		first: make(map[string]string),
+		groups: make(map[string][]string),
+	}
+}
+
+// Check records the message under key, returning the reference of the first
+// message checked with the same key, if any. Empty keys never match
+func (d *Detector) Check(key, ref string) (string, bool) {
+	if key == "" {
+		return "", false
+	}
+
+	first, seen := d.first[key]
+	if !seen {
+		d.first[key] = ref
+		return "", false
+	}
+
+	if _, grouped := d.groups[key]; !grouped {
+		d.groups[key] = []string{first}
+		d.order = append(d.order, key)
+	}
+	d.groups[key] = append(d.groups[key], ref)
+
+	return first, true
+}
+
+// Groups lists the sets of duplicated messages
+func (d *Detector) Groups() []Group {
+	groups := []Group{}
+	for _, key := range d.order {
+		groups = append(groups, Group{Key: key, Messages: d.groups[key]})
+	}
+	return groups
+}
+
+// MessageIDKey is the Message-ID of the message, or empty if it has none
+func MessageIDKey(header textproto.MIMEHeader) string {
+	return idPattern.FindString(header.Get("Message-Id"))
+}
+
+// HeaderKey hashes the identity headers of the message, with whitespace
+// collapsed so that refolding by a relay does not matter
+func HeaderKey(header textproto.MIMEHeader) string {
+	hash := sha256.New()
+	writeIdentityHeaders(hash, header)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// ContentHasher hashes the identity headers of a message along with its raw
+// body, which is written to it as it streams by
+type ContentHasher struct {
+	hash hash.Hash
+}
+
+func NewContentHasher(header textproto.MIMEHeader) *ContentHasher {
+	hasher := &ContentHasher{hash: sha256.New()}
+	writeIdentityHeaders(hasher.hash, header)
+
+	// Separates the headers from the body as in the message itself
+	io.WriteString(hasher.hash, "\n")
+
+	return hasher
+}
+
+func (c *ContentHasher) Write(p []byte) (int, error) {
+	return c.hash.Write(p)
+}
+
+// Key of the message, once all of its body was written
+func (c *ContentHasher) Key() string {
+	return hex.EncodeToString(c.hash.Sum(nil))
+}
+
+func writeIdentityHeaders(writer io.Writer, header textproto.MIMEHeader) {
+	for _, key := range identityHeaders {
+		for _, value := range header[key] {
+			fmt.Fprintf(writer, "%v: %v\n", key, strings.Join(strings.Fields(value), " "))
+		}
+	}
+}
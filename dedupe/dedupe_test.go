@@ -0,0 +1,107 @@
+package dedupe
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"reflect"
+	"net/textproto"
+)
+
+func TestDetectorCheck(t *testing.T) {
+	detector := NewDetector()
+
+	cases := []struct {
+		key string
+		ref string
+		first string
+		duplicate bool
+	}{
+		{"a", "one.msg", "", false},
+		{"b", "two.msg", "", false},
+		{"a", "three.msg", "one.msg", true},
+		{"", "four.msg", "", false},
+		{"", "five.msg", "", false},
+		{"b", "six.msg", "two.msg", true},
+		{"a", "seven.msg", "one.msg", true},
+	}
+
+	for _, c := range cases {
+		first, duplicate := detector.Check(c.key, c.ref)
+		if first != c.first || duplicate != c.duplicate {
+			t.Errorf("%v %v returned %v %v, wanted %v %v", c.key, c.ref, first, duplicate, c.first, c.duplicate)
+		}
+	}
+
+	want := []Group{
+		{"a", []string{"one.msg", "three.msg", "seven.msg"}},
+		{"b", []string{"two.msg", "six.msg"}},
+	}
+
+	if groups := detector.Groups(); !reflect.DeepEqual(groups, want) {
+		t.Errorf("Received %v, wanted %v", groups, want)
+	}
+
+	if groups := NewDetector().Groups(); groups == nil || len(groups) != 0 {
+		t.Errorf("Received %v, wanted no groups", groups)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	original := textproto.MIMEHeader{
+		"Message-Id": {"<a@x>"},
+		"From": {"ron@example.com"},
+		"Subject": {"Friday lunch"},
+		"Received": {"from a by b"},
+	}
+
+	// Delivered elsewhere, the subject refolded by a relay
+	copied := textproto.MIMEHeader{
+		"Message-Id": {"<a@x>"},
+		"From": {"ron@example.com"},
+		"Subject": {"Friday  lunch"},
+		"Received": {"from c by d"},
+		"Delivered-To": {"harry@example.com"},
+	}
+
+	// Same Message-ID, different content
+	resent := textproto.MIMEHeader{
+		"Message-Id": {"<a@x>"},
+		"From": {"ron@example.com"},
+		"Subject": {"Saturday lunch"},
+	}
+
+	if MessageIDKey(textproto.MIMEHeader{"Message-Id": {"<a@x> (comment)"}}) != "<a@x>" || MessageIDKey(original) != "<a@x>" || MessageIDKey(copied) != "<a@x>" || MessageIDKey(resent) != "<a@x>" {
+		t.Error("MessageIDKey differs between messages with the same Message-ID")
+	}
+
+	if MessageIDKey(textproto.MIMEHeader{}) != "" {
+		t.Error("MessageIDKey of a message without Message-ID is not empty")
+	}
+
+	if HeaderKey(original) != HeaderKey(copied) {
+		t.Error("HeaderKey differs between copies of a message")
+	}
+
+	if HeaderKey(original) == HeaderKey(resent) {
+		t.Error("HeaderKey matches messages with different subjects")
+	}
+
+	contentKey := func(header textproto.MIMEHeader, body string) string {
+		hasher := NewContentHasher(header)
+		io.Copy(hasher, strings.NewReader(body))
+		return hasher.Key()
+	}
+
+	if contentKey(original, "Hello\n") != contentKey(copied, "Hello\n") {
+		t.Error("ContentHasher differs between copies of a message")
+	}
+
+	if contentKey(original, "Hello\n") == contentKey(copied, "Hello!\n") {
+		t.Error("ContentHasher matches messages with different bodies")
+	}
+
+	if contentKey(original, "") == HeaderKey(original) {
+		t.Error("ContentHasher ignores the separation of headers and body")
+	}
+}
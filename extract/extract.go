@@ -0,0 +1,116 @@
+package extract
+
+import (
+	"io"
+	"os"
+	"log"
+	"regexp"
+	"strings"
+	"io/ioutil"
+	"path/filepath"
+	"github.com/asgaines/msgextract/parse"
+)
+
+// Extensions worth keeping from the claimed filename; anything else is dropped
+var safeExtension = regexp.MustCompile(`^\.[a-z0-9]{1,10}$`)
+
+// Dir stores attachments under names derived from their SHA-256, so that
+// nothing in a message decides where a file lands and identical content is
+// only written once
+type Dir struct {
+	path string
+	// Parts larger than this many decoded bytes are inventoried, not written
+	maxSize int64
+}
+
+func NewDir(path string, maxSize int64) (*Dir, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+	return &Dir{path: path, maxSize: maxSize}, nil
+}
+
+// Attachment inventories the part like parse.NewAttachment while writing its
+// decoded content to the directory. Path is left empty when the part was not
+// written, e.g. for being oversized
+func (d *Dir) Attachment(message string, part parse.Part, body io.Reader) (parse.Attachment, error) {
+	// Content is hashed as it streams by, so the final name is only known
+	// once everything has been written
+	partial, err := ioutil.TempFile(d.path, ".partial-")
+	if err != nil {
+		return parse.Attachment{}, err
+	}
+	defer os.Remove(partial.Name())
+
+	limited := &limitWriter{writer: partial, remaining: d.maxSize}
+
+	attachment, err := parse.NewAttachment(message, part, io.TeeReader(body, limited))
+	if closeErr := partial.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = limited.err
+	}
+	if err != nil {
+		return attachment, err
+	}
+
+	if limited.exceeded {
+		log.Printf("%v: not extracting %q, larger than %v bytes", message, attachment.Filename, d.maxSize)
+		return attachment, nil
+	}
+
+	path := filepath.Join(d.path, attachment.SHA256 + extension(attachment.Filename))
+
+	// Identical content was already extracted, from this or another message
+	if _, err := os.Stat(path); err == nil {
+		attachment.Path = path
+		return attachment, nil
+	}
+
+	if err := os.Rename(partial.Name(), path); err != nil {
+		return attachment, err
+	}
+	attachment.Path = path
+
+	return attachment, nil
+}
+
+// extension of the claimed filename, if it is harmless to reuse
+func extension(filename string) string {
+	// Filenames from Windows mailers may use either separator
+	filename = strings.Replace(filename, "\\", "/", -1)
+
+	ext := strings.ToLower(filepath.Ext(filepath.Base(filename)))
+	if !safeExtension.MatchString(ext) {
+		return ""
+	}
+	return ext
+}
+
+// limitWriter writes up to remaining bytes, then quietly discards the rest
+// so the attachment can still be sized and hashed in full
+type limitWriter struct {
+	writer io.Writer
+	remaining int64
+	exceeded bool
+	// First error of the underlying writer, kept aside so reading continues
+	err error
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if l.exceeded || l.err != nil {
+		return len(p), nil
+	}
+
+	if int64(len(p)) > l.remaining {
+		l.exceeded = true
+		return len(p), nil
+	}
+
+	if _, err := l.writer.Write(p); err != nil {
+		l.err = err
+	}
+	l.remaining -= int64(len(p))
+	return len(p), nil
+}
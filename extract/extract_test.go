@@ -0,0 +1,169 @@
+package extract
+
+import (
+	"io"
+	"os"
+	"log"
+	"bufio"
+	"strings"
+	"testing"
+	"reflect"
+	"io/ioutil"
+	"path/filepath"
+	"github.com/asgaines/msgextract/parse"
+)
+
+func init() {
+	// Deactivate the logging of skipped attachments to screen
+	log.SetOutput(ioutil.Discard)
+}
+
+// extractAll walks the raw message, extracting every attachment into dir
+func extractAll(t *testing.T, dir *Dir, raw string) []parse.Attachment {
+	reader := bufio.NewReader(strings.NewReader(raw))
+
+	var headerLines []string
+	for {
+		line, _ := reader.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		headerLines = append(headerLines, line)
+	}
+
+	var attachments []parse.Attachment
+	_, err := parse.WalkMIME(headerLines, reader, func(part parse.Part, body io.Reader) error {
+		if !part.IsAttachment() {
+			return nil
+		}
+
+		attachment, err := dir.Attachment("test.msg", part, body)
+		attachments = append(attachments, attachment)
+		return err
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	return attachments
+}
+
+func TestDirAttachment(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("../test_files", "tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dir, err := NewDir(filepath.Join(tmpDir, "attachments"), 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw := "Content-Type: multipart/mixed; boundary=b\n\n" +
+		"--b\nContent-Disposition: attachment; filename=\"../../../etc/passwd.TXT\"\n" +
+		"Content-Transfer-Encoding: base64\n\naGVsbG8=\n" +
+		"--b\nContent-Disposition: attachment; filename=\"copy.exe; rm -rf\"\n\nhello\n" +
+		"--b\nContent-Disposition: attachment; filename=\"..\\\\..\\\\boot.ini\"\n\nhi\n" +
+		"--b\nContent-Disposition: attachment; filename=big.bin\n\nwell past eight bytes\n" +
+		"--b--\n"
+
+	attachments := extractAll(t, dir, raw)
+
+	hello := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	hi := "8f434346648f6b96df89dda901c5176b10a6d83961dd3c1ac88b59b2dc327aa4"
+
+	paths := []string{
+		filepath.Join(tmpDir, "attachments", hello + ".txt"),
+		filepath.Join(tmpDir, "attachments", hello),
+		filepath.Join(tmpDir, "attachments", hi + ".ini"),
+		"",
+	}
+
+	var received []string
+	for _, attachment := range attachments {
+		received = append(received, attachment.Path)
+	}
+
+	if !reflect.DeepEqual(received, paths) {
+		t.Errorf("Extracted to %v, wanted %v", received, paths)
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(tmpDir, "attachments"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing else, including leftovers of oversized parts, is written
+	if len(files) != 3 {
+		t.Errorf("Extraction directory holds %v files, wanted 3", len(files))
+	}
+
+	for _, path := range paths[:3] {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Error(err)
+		}
+		if string(content) != "hello" && string(content) != "hi" {
+			t.Errorf("%v holds %q", path, content)
+		}
+	}
+
+	if attachments[3].Size != 21 {
+		t.Errorf("Oversized attachment sized %v, wanted 21", attachments[3].Size)
+	}
+}
+
+func TestDirAttachmentDuplicate(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("../test_files", "tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dir, err := NewDir(tmpDir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw := "Content-Type: multipart/mixed; boundary=b\n\n" +
+		"--b\nContent-Disposition: attachment; filename=a.txt\n\nsame\n" +
+		"--b\nContent-Disposition: attachment; filename=b.txt\n\nsame\n" +
+		"--b--\n"
+
+	attachments := extractAll(t, dir, raw)
+
+	if attachments[0].Path != attachments[1].Path {
+		t.Errorf("Identical content extracted to %v and %v", attachments[0].Path, attachments[1].Path)
+	}
+
+	files, _ := ioutil.ReadDir(tmpDir)
+	if len(files) != 1 {
+		t.Errorf("Extraction directory holds %v files, wanted 1", len(files))
+	}
+}
+
+func TestExtension(t *testing.T) {
+	cases := []struct {
+		in string
+		want string
+	}{
+		{"report.pdf", ".pdf"},
+		{"REPORT.PDF", ".pdf"},
+		{"archive.tar.gz", ".gz"},
+		{"no_extension", ""},
+		{"../../etc/passwd", ""},
+		{"..\\..\\windows\\win.ini", ".ini"},
+		{"evil.p/../hp", ""},
+		{"payload.exe ", ""},
+		{"trailing.", ""},
+		{"", ""},
+	}
+
+	for _, c := range cases {
+		if out := extension(c.in); out != c.want {
+			t.Errorf("%q returned %q, wanted %q", c.in, out, c.want)
+		}
+	}
+}
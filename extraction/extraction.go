@@ -0,0 +1,795 @@
+package extraction
+
+import (
+	"io"
+	"os"
+	"log"
+	"fmt"
+	"time"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/asgaines/msgextract/unpack"
+	"github.com/asgaines/msgextract/parse"
+	"github.com/asgaines/msgextract/output"
+	"github.com/asgaines/msgextract/extract"
+	"github.com/asgaines/msgextract/thread"
+	"github.com/asgaines/msgextract/dedupe"
+	"github.com/asgaines/msgextract/filter"
+	"github.com/asgaines/msgextract/sieve"
+	"github.com/asgaines/msgextract/checkpoint"
+	"github.com/asgaines/msgextract/state"
+	"github.com/asgaines/msgextract/progress"
+	"github.com/asgaines/msgextract/metrics"
+)
+
+// Messages read ahead of those being output
+const messageQueueSize = 256
+
+// Options of an extraction, as given on the command line. Options implying
+// others, such as Body implying Full, are applied by Run
+type Options struct {
+	// Output format, one of those of -format, and the fields output
+	Format string
+	Fields []string
+	// Full-text index of subjects in sqlite output
+	SubjectIndex bool
+	// Compression of parquet or avro output
+	Compression string
+	// Messages per row group, record batch, block or request to ESURL
+	BatchSize int
+	ESIndex string
+	ESURL string
+	// File to write the XML Schema of xml output to
+	XSDPath string
+	// Templates replacing Format, with those executed before and after the
+	// messages
+	TemplatePath string
+	TemplateHeaderPath string
+	TemplateFooterPath string
+
+	// Read past the header, summarizing the MIME structure
+	Full bool
+	Attachments bool
+	// Directory to decode attachments into, up to the size given
+	ExtractPath string
+	MaxAttachmentSize int64
+	Body bool
+	SnippetLength int
+	URLs bool
+
+	Threads bool
+	ThreadTreePath string
+	// Duplicates found by the key, dropped, flagged or reported
+	DedupeKey string
+	DuplicateMode string
+	Where string
+	// Sieve script dry-run against each message
+	SievePath string
+
+	CheckpointInterval time.Duration
+	Resume bool
+	// Options given, by name, which a resumed run must share
+	Given map[string]string
+
+	// State of the messages output by earlier runs, with what they are
+	// known by and how long unseen ones are kept
+	StatePath string
+	StateKey string
+	StatePrune time.Duration
+
+	// Directory the archive is unpacked under, in a temporary directory
+	// removed once done. The system's temporary directory when empty
+	TmpDir string
+
+	// Reports progress, unless nil
+	Progress *progress.Reporter
+}
+
+// message pairs the header lines of an MSG file with whatever was derived
+// from its body, if the body was read at all
+type message struct {
+	name string
+	headerLines []string
+	bodyFields map[string]string
+	attachments []parse.Attachment
+	body parse.Body
+	urls []parse.URL
+	// Position in the archive past the message's entry
+	position unpack.Position
+	// Key the message is known by in the -incremental state
+	stateKey string
+}
+
+// The walk of the archive was stopped, output having failed
+var errStopped = errors.New("extraction stopped")
+
+// pipeline is an extraction under way: messages are read from the archive
+// by one goroutine and filtered and written out by another
+type pipeline struct {
+	options Options
+	outputPath string
+	fields []string
+	reporter *progress.Reporter
+
+	templates *output.Templates
+	where *filter.Expr
+	sieveScript *sieve.Script
+	extractDir *extract.Dir
+	duplicates *dedupe.Detector
+	seen *state.Store
+
+	checkpoint *checkpoint.Checkpoint
+	checkpointPath string
+	checkpointed time.Time
+
+	writer output.MessageWriter
+	// Messages kept to be written at the end, by formats written at once or
+	// when threading
+	messages []output.Message
+
+	// Times of the output, and of the walk apart from waiting for room in
+	// the queue
+	timings metrics.Timings
+	walkTimings metrics.Timings
+}
+
+// Run extracts the messages of the gzipped archive to the output, as
+// msgextract does
+func Run(gzippedArchivePath, outputPath string, options Options) error {
+	p := &pipeline{options: options, outputPath: outputPath, reporter: options.Progress}
+	if err := p.prepare(gzippedArchivePath); err != nil {
+		return err
+	}
+	if p.seen != nil {
+		defer p.seen.Close()
+	}
+
+	tmpDir, err := ioutil.TempDir(options.TmpDir, "tmp")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	archivePath := unpack.CreateArchiveName(tmpDir, gzippedArchivePath)
+
+	gzippedInfo, err := os.Stat(gzippedArchivePath)
+	if err != nil {
+		return err
+	}
+	p.reporter.Phase(progress.Unpacking, 0, gzippedInfo.Size())
+	unpacked := time.Now()
+	if err := unpack.GzipProgress(gzippedArchivePath, archivePath, p.reporter.SetBytes); err != nil {
+		p.reporter.Abort(metrics.FailureReason(err))
+		return err
+	}
+	p.timings.Unpack += time.Since(unpacked)
+
+	if err := p.newWriter(); err != nil {
+		return err
+	}
+	defer func() {
+		// Unless finish closed it
+		if p.writer != nil {
+			p.writer.Close()
+		}
+	}()
+	if err := p.extract(archivePath); err != nil {
+		return err
+	}
+	return p.finish()
+}
+
+// prepare reads the files named by the options and works out the fields
+// output, resuming from the checkpoint if asked to
+func (p *pipeline) prepare(gzippedArchivePath string) error {
+	o := &p.options
+
+	// Guard against checkpoints of output which cannot be appended to, or
+	// of runs holding state beyond the output
+	if o.Resume && o.CheckpointInterval <= 0 {
+		o.CheckpointInterval = time.Minute
+	}
+	if o.CheckpointInterval > 0 && (o.Format != "jsonl" && o.Format != "es-bulk" || o.TemplatePath != "" || o.Threads || o.ThreadTreePath != "" || o.DedupeKey != "" || o.StatePath != "") {
+		return errors.New("Checkpoints need jsonl or es-bulk output, without -template, -threads, -dedupe or -incremental")
+	}
+
+	// Rather than once the whole archive is read
+	if o.Format == "sqlite" && o.SubjectIndex {
+		if err := output.CheckSubjectIndex(); err != nil {
+			return err
+		}
+	}
+
+	if o.XSDPath != "" {
+		if err := ioutil.WriteFile(o.XSDPath, []byte(output.XMLSchema), 0644); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	if o.TemplatePath != "" {
+		if p.templates, err = output.ParseTemplates(o.TemplatePath, o.TemplateHeaderPath, o.TemplateFooterPath); err != nil {
+			return err
+		}
+	}
+
+	if o.Where != "" {
+		if p.where, err = filter.Parse(o.Where); err != nil {
+			return fmt.Errorf("-where: %v", err)
+		}
+	}
+
+	var sieveSource []byte
+	if o.SievePath != "" {
+		if sieveSource, err = ioutil.ReadFile(o.SievePath); err != nil {
+			return err
+		}
+		if p.sieveScript, err = sieve.Parse(string(sieveSource)); err != nil {
+			return fmt.Errorf("%v: %v", o.SievePath, err)
+		}
+	}
+
+	if o.ExtractPath != "" {
+		if p.extractDir, err = extract.NewDir(o.ExtractPath, o.MaxAttachmentSize); err != nil {
+			return err
+		}
+		o.Attachments = true
+	}
+
+	fields := append([]string{}, o.Fields...)
+	if o.Attachments {
+		o.Full = true
+		// Reference attachments back to their message
+		fields = withMessageField(fields)
+	}
+
+	if o.Body {
+		o.Full = true
+		fields = append(fields, parse.BodyFields...)
+	}
+
+	if o.URLs {
+		o.Full = true
+		// Reference links back to their message
+		fields = withMessageField(fields)
+	}
+
+	if o.Full {
+		fields = append(fields, parse.PartSummaryFields...)
+	}
+
+	if o.ThreadTreePath != "" {
+		o.Threads = true
+	}
+
+	if o.Threads {
+		fields = append(fields, thread.Fields...)
+	}
+
+	if p.sieveScript != nil {
+		fields = append(fields, sieve.Fields...)
+	}
+
+	if o.DedupeKey != "" {
+		p.duplicates = dedupe.NewDetector()
+
+		if o.DuplicateMode == "flag" {
+			// Reference duplicates back to the first copy
+			fields = append(withMessageField(fields), "duplicate_of")
+		}
+	}
+	p.fields = fields
+
+	p.checkpointPath = checkpoint.Path(p.outputPath)
+	if o.CheckpointInterval > 0 {
+		p.checkpoint, err = checkpoint.New(gzippedArchivePath, o.Format, fields, checkpointOptions(o.Given, sieveSource))
+		if err != nil {
+			return err
+		}
+
+		if o.Resume {
+			saved, err := checkpoint.Read(p.checkpointPath)
+			if err != nil {
+				return err
+			}
+			if err := p.checkpoint.Resume(saved); err != nil {
+				return fmt.Errorf("%v: %v", p.checkpointPath, err)
+			}
+			log.Printf("Resuming after %v messages, at entry %v of the archive", p.checkpoint.Messages, p.checkpoint.Position.Entries)
+		}
+	}
+
+	// Messages seen are recorded once the output is complete
+	if o.StatePath != "" {
+		if p.seen, err = state.Open(o.StatePath, o.StateKey, gzippedArchivePath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkpointOptions are the options given which the output depends on, the
+// Sieve script being recorded by its content as well as its path
+func checkpointOptions(given map[string]string, sieveSource []byte) map[string]string {
+	options := map[string]string{}
+	for name, value := range given {
+		options[name] = value
+	}
+	if sieveSource != nil {
+		sum := sha256.Sum256(sieveSource)
+		options["sieve-sha256"] = hex.EncodeToString(sum[:])
+	}
+	return options
+}
+
+// newWriter creates the writer of formats written message by message, fed
+// as messages arrive unless threading needs all of them first. Other
+// formats are written at once by finish
+func (p *pipeline) newWriter() error {
+	o := p.options
+
+	var resumeAt int64
+	if p.checkpoint != nil {
+		resumeAt = p.checkpoint.OutputSize
+	}
+
+	var err error
+	switch {
+	case p.templates != nil:
+		p.writer, err = output.NewTemplateWriter(p.outputPath, p.fields, p.templates)
+	case o.Format == "parquet":
+		p.writer, err = output.NewParquetWriter(p.outputPath, p.fields, output.ParquetOptions{
+			Compression: o.Compression,
+			RowGroupSize: o.BatchSize,
+		})
+	case o.Format == "arrow" || o.Format == "arrows":
+		p.writer, err = output.NewArrowWriter(p.outputPath, p.fields, output.ArrowOptions{
+			BatchSize: o.BatchSize,
+			Stream: o.Format == "arrows",
+		})
+	case o.Format == "avro":
+		p.writer, err = output.NewAvroWriter(p.outputPath, p.fields, output.AvroOptions{
+			Compression: o.Compression,
+			BlockSize: o.BatchSize,
+		})
+	case o.Format == "xml":
+		p.writer, err = output.NewXMLWriter(p.outputPath, p.fields)
+	case o.Format == "xlsx":
+		p.writer, err = output.NewXLSXWriter(p.outputPath, p.fields)
+	case o.Format == "es-bulk":
+		p.writer, err = output.NewESBulkWriter(p.outputPath, p.fields, output.ESBulkOptions{
+			Index: o.ESIndex,
+			URL: o.ESURL,
+			BatchSize: o.BatchSize,
+			ResumeAt: resumeAt,
+		})
+	case o.Format == "jsonl":
+		p.writer, err = output.NewJSONLFileWriter(p.outputPath, p.fields, resumeAt)
+	}
+	return err
+}
+
+// extract walks the archive, outputting its messages as they are read. If
+// the output fails, the walk is stopped before returning
+func (p *pipeline) extract(archivePath string) error {
+	// Channel to be fed the messages as they are processed by the walk
+	msgChan := make(chan message, messageQueueSize)
+	p.reporter.SetQueue(func() int { return len(msgChan) })
+	stop := make(chan struct{})
+
+	var position unpack.Position
+	if p.checkpoint != nil {
+		position = p.checkpoint.Position
+	}
+
+	archiveInfo, err := os.Stat(archivePath)
+	if err != nil {
+		return err
+	}
+	p.reporter.Phase(progress.Extracting, position.Offset, archiveInfo.Size())
+
+	walked := make(chan error, 1)
+	go func() {
+		walked <- p.walk(archivePath, &position, msgChan, stop)
+		// Close the channel, releasing the blockage
+		close(msgChan)
+	}()
+
+	for msg := range msgChan {
+		if err := p.add(msg); err != nil {
+			close(stop)
+			for range msgChan {
+			}
+			return err
+		}
+	}
+	if err := <-walked; err != nil {
+		p.reporter.Abort(metrics.FailureReason(err))
+		return err
+	}
+	return nil
+}
+
+// walk reads the messages of the archive from the position on, sending
+// those not dropped as duplicates until told to stop
+func (p *pipeline) walk(archivePath string, position *unpack.Position, msgChan chan<- message, stop <-chan struct{}) error {
+	walked := time.Now()
+	err := unpack.WalkFrom(archivePath, position, func(name string, headerLines []string, body io.Reader) error {
+		entered := time.Now()
+		p.walkTimings.Unpack += entered.Sub(walked)
+		var queued time.Duration
+		defer func() {
+			walked = time.Now()
+			p.walkTimings.Parse += walked.Sub(entered) - queued
+		}()
+
+		at := *position
+		msg, keep, err := p.read(name, headerLines, body)
+		if err != nil || !keep {
+			return err
+		}
+		msg.position = at
+
+		sent := time.Now()
+		select {
+		case msgChan <- msg:
+		case <-stop:
+			return errStopped
+		}
+		queued = time.Since(sent)
+		return nil
+	})
+	p.walkTimings.Unpack += time.Since(walked)
+	return err
+}
+
+// read derives what the options ask for from the message, unless it is a
+// duplicate to drop
+func (p *pipeline) read(name string, headerLines []string, body io.Reader) (message, bool, error) {
+	o := p.options
+	msg := message{name: name, headerLines: headerLines, bodyFields: map[string]string{}}
+
+	// Duplicates found by their header alone are dropped before their body
+	// is read
+	var duplicateOf string
+	var contentHasher *dedupe.ContentHasher
+	if p.duplicates != nil {
+		header := parse.MIMEHeaderFromLines(headerLines)
+
+		var key string
+		switch o.DedupeKey {
+		case dedupe.ByMessageID:
+			key = dedupe.MessageIDKey(header)
+		case dedupe.ByHeaders:
+			key = dedupe.HeaderKey(header)
+		case dedupe.ByContent:
+			contentHasher = dedupe.NewContentHasher(header)
+			body = io.TeeReader(body, contentHasher)
+		}
+
+		if contentHasher == nil {
+			var duplicate bool
+			duplicateOf, duplicate = p.duplicates.Check(key, name)
+			if duplicate && o.DuplicateMode == "drop" {
+				p.reporter.Skip()
+				return msg, false, nil
+			}
+		}
+	}
+
+	var stateHasher *dedupe.ContentHasher
+	if p.seen != nil {
+		header := parse.MIMEHeaderFromLines(headerLines)
+
+		switch o.StateKey {
+		case dedupe.ByMessageID:
+			msg.stateKey = dedupe.MessageIDKey(header)
+		case dedupe.ByHeaders:
+			msg.stateKey = dedupe.HeaderKey(header)
+		case dedupe.ByContent:
+			stateHasher = dedupe.NewContentHasher(header)
+			body = io.TeeReader(body, stateHasher)
+		}
+	}
+
+	// The size test of Sieve needs the whole message to be read
+	var bodySize byteCounter
+	if p.sieveScript != nil {
+		body = io.TeeReader(body, &bodySize)
+	}
+
+	if o.Attachments {
+		msg.attachments = []parse.Attachment{}
+	}
+
+	partFn := func(part parse.Part, body io.Reader) error {
+		if !part.IsAttachment() {
+			if o.Body || o.URLs {
+				return msg.body.AddPart(part, body)
+			}
+			return nil
+		}
+
+		if !o.Attachments {
+			return nil
+		}
+
+		var attachment parse.Attachment
+		var err error
+		if p.extractDir != nil {
+			attachment, err = p.extractDir.Attachment(name, part, body)
+		} else {
+			attachment, err = parse.NewAttachment(name, part, body)
+		}
+		if err != nil {
+			return err
+		}
+		msg.attachments = append(msg.attachments, attachment)
+		return nil
+	}
+
+	if o.Full {
+		summary, err := parse.WalkMIME(headerLines, body, partFn)
+		if err != nil {
+			// Keep the message, summarizing what could be walked
+			log.Printf("%v: %v", name, err)
+			p.reporter.Fail()
+		}
+		for field, value := range summary.Fields() {
+			msg.bodyFields[field] = value
+		}
+		for _, charset := range msg.body.UnknownCharsets() {
+			log.Printf("%v: unknown charset %q, read as UTF-8", name, charset)
+		}
+
+		if o.Body {
+			for field, value := range msg.body.Fields(o.SnippetLength) {
+				msg.bodyFields[field] = value
+			}
+		}
+		if o.URLs {
+			msg.urls = msg.body.URLs(name)
+		}
+	}
+
+	if contentHasher != nil || stateHasher != nil || p.sieveScript != nil {
+		// Hash or count whatever the MIME walk left unread, or all of it
+		if _, err := io.Copy(ioutil.Discard, body); err != nil {
+			return msg, false, err
+		}
+	}
+
+	if stateHasher != nil {
+		msg.stateKey = stateHasher.Key()
+	}
+
+	if contentHasher != nil {
+		var duplicate bool
+		duplicateOf, duplicate = p.duplicates.Check(contentHasher.Key(), name)
+		if duplicate && o.DuplicateMode == "drop" {
+			p.reporter.Skip()
+			return msg, false, nil
+		}
+	}
+
+	if o.DuplicateMode == "flag" {
+		msg.bodyFields["duplicate_of"] = duplicateOf
+	}
+
+	if p.sieveScript != nil {
+		result := p.sieveScript.Evaluate(parse.MIMEHeaderFromLines(headerLines), headerSize(headerLines) + int64(bodySize))
+		for field, value := range result.Fields() {
+			msg.bodyFields[field] = value
+		}
+	}
+
+	return msg, true, nil
+}
+
+// add outputs the message unless filtered out or seen before, or keeps it
+// to be written at the end
+func (p *pipeline) add(msg message) error {
+	if p.checkpoint != nil {
+		// Every message before this one is written
+		if time.Since(p.checkpointed) >= p.options.CheckpointInterval {
+			p.checkpointed = time.Now()
+			if err := p.saveCheckpoint(); err != nil {
+				return err
+			}
+			p.timings.Output += time.Since(p.checkpointed)
+		}
+		p.checkpoint.Position = msg.position
+	}
+	p.reporter.SetBytes(msg.position.Offset)
+
+	parsed := time.Now()
+	headers := parse.MapFromHeaderLines(msg.headerLines)
+	headers["message"] = msg.name
+	for field, value := range msg.bodyFields {
+		headers[field] = value
+	}
+
+	if p.where != nil {
+		// Output fields are matched alongside every occurrence of each
+		// header
+		record := parse.MIMEHeaderFromLines(msg.headerLines)
+		record.Set("message", msg.name)
+		for field, value := range msg.bodyFields {
+			record.Set(field, value)
+		}
+		if !p.where.Match(record) {
+			p.timings.Parse += time.Since(parsed)
+			p.reporter.Skip()
+			return nil
+		}
+	}
+
+	// Only messages output are recorded as seen
+	if p.seen != nil {
+		old, err := p.seen.Seen(msg.stateKey)
+		if err != nil {
+			return err
+		}
+		if old {
+			p.timings.Parse += time.Since(parsed)
+			p.reporter.Skip()
+			return nil
+		}
+	}
+	p.timings.Parse += time.Since(parsed)
+
+	message := output.Message{
+		Headers: headers,
+		HeaderLines: msg.headerLines,
+		Attachments: msg.attachments,
+		URLs: msg.urls,
+	}
+	p.reporter.Message()
+	if p.writer != nil && !p.options.Threads {
+		written := time.Now()
+		if err := p.writer.Write(message); err != nil {
+			return err
+		}
+		p.timings.Output += time.Since(written)
+		if p.checkpoint != nil {
+			p.checkpoint.Messages++
+		}
+		return nil
+	}
+	p.messages = append(p.messages, message)
+	return nil
+}
+
+// saveCheckpoint writes out the output, then records how far it went
+func (p *pipeline) saveCheckpoint() error {
+	size, err := p.writer.(output.Checkpointer).Checkpoint()
+	if err != nil {
+		return err
+	}
+	p.checkpoint.OutputSize = size
+	return p.checkpoint.Write(p.checkpointPath)
+}
+
+// finish writes the messages kept and the reports asked for, then records
+// the messages output as seen
+func (p *pipeline) finish() error {
+	o := p.options
+	p.reporter.Phase(progress.Writing, 0, 0)
+
+	if o.Threads {
+		var records []map[string]string
+		for _, message := range p.messages {
+			records = append(records, message.Headers)
+		}
+
+		// Thread fields are set on the records in place
+		threads := thread.Thread(records)
+		thread.Annotate(threads)
+
+		if o.ThreadTreePath != "" {
+			if err := output.WriteThreadTree(o.ThreadTreePath, threads); err != nil {
+				return err
+			}
+		}
+	}
+
+	written := time.Now()
+	var err error
+	if p.writer != nil {
+		// Closed by WriteAll, whether it fails or not
+		writer := p.writer
+		p.writer = nil
+		err = output.WriteAll(writer, p.messages)
+		if err == nil && p.checkpoint != nil {
+			// The output is complete
+			os.Remove(p.checkpointPath)
+		}
+	} else if o.Format == "sqlite" {
+		err = output.WriteSQLite(p.outputPath, p.messages, p.fields, o.SubjectIndex)
+	} else {
+		err = output.WriteMessages(p.outputPath, p.messages, p.fields, o.Format)
+	}
+	if err != nil {
+		return err
+	}
+
+	if p.duplicates != nil && o.DuplicateMode == "report" {
+		format := o.Format
+		if p.templates != nil {
+			// Templates lay out messages only
+			format = "json"
+		}
+		reportPath := filepath.Join(filepath.Dir(p.outputPath), "duplicates." + format)
+		// Reports posted to -es-url go to an index of their own
+		err := output.WriteDuplicateGroups(reportPath, p.duplicates.Groups(), format, output.ESBulkOptions{
+			Index: o.ESIndex + "-duplicates",
+			URL: o.ESURL,
+			BatchSize: o.BatchSize,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	p.timings.Output += time.Since(written)
+
+	p.timings.Add(p.walkTimings)
+	p.reporter.SetStageSeconds(p.timings.Seconds())
+	p.reporter.Finish()
+
+	if p.seen != nil {
+		return commitState(p.seen, o.StatePath, o.StatePrune)
+	}
+	return nil
+}
+
+// commitState records the messages of a complete run as seen, forgetting
+// those no run saw for the prune period if given
+func commitState(seen *state.Store, path string, prune time.Duration) error {
+	var pruned int64
+	if prune > 0 {
+		var err error
+		if pruned, err = seen.Prune(prune); err != nil {
+			return fmt.Errorf("%v: %v", path, err)
+		}
+	}
+	if err := seen.Commit(); err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+
+	log.Printf("%v new messages, %v skipped as seen before", seen.New, seen.Skipped)
+	if pruned > 0 {
+		log.Printf("%v messages no run saw for %v pruned from %v", pruned, prune, path)
+	}
+	return nil
+}
+
+// withMessageField puts the field naming the archive entry of each message
+// first, unless it is already output
+func withMessageField(fields []string) []string {
+	for _, field := range fields {
+		if field == "message" {
+			return fields
+		}
+	}
+	return append([]string{"message"}, fields...)
+}
+
+// byteCounter counts the bytes written to it
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// headerSize is the size of the header as written, up to and including the
+// blank line ending it, given the CRLF line endings of RFC 5322
+func headerSize(headerLines []string) int64 {
+	size := int64(2)
+	for _, line := range headerLines {
+		size += int64(len(line)) + 2
+	}
+	return size
+}
@@ -0,0 +1,374 @@
+package extraction
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+	"bufio"
+	"strings"
+	"testing"
+	"net/http"
+	"net/http/httptest"
+	"io/ioutil"
+	"archive/tar"
+	"path/filepath"
+	"compress/gzip"
+	"encoding/json"
+	"github.com/asgaines/msgextract/checkpoint"
+)
+
+func newTestDir(t *testing.T) string {
+	tmpDir, err := ioutil.TempDir("../test_files", "tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	return tmpDir
+}
+
+// writeArchive gzips a tar archive of the test messages under the entry
+// names given, mapped to the file of test_files/msgs they hold
+func writeArchive(t *testing.T, path string, entries [][2]string) {
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	zipped := gzip.NewWriter(file)
+	archive := tar.NewWriter(zipped)
+
+	for _, entry := range entries {
+		content, err := ioutil.ReadFile(filepath.Join("../test_files/msgs", entry[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := archive.WriteHeader(&tar.Header{Name: entry[0], Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := archive.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zipped.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readJSONL(t *testing.T, path string) []map[string]string {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var records []map[string]string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record map[string]string
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+// Entries of the archive extracted, the first two being copies
+var testEntries = [][2]string{
+	{"a.msg", "subject_date_from.msg"},
+	{"b.msg", "dirdepth1/subject_date_from.msg"},
+	{"c.msg", "return_x-orig_received.msg"},
+}
+
+func TestRun(t *testing.T) {
+	tmpDir := newTestDir(t)
+	archivePath := filepath.Join(tmpDir, "archive.tar.gz")
+	writeArchive(t, archivePath, testEntries)
+
+	sievePath := filepath.Join(tmpDir, "discard.sieve")
+	if err := ioutil.WriteFile(sievePath, []byte(`if header :contains "From" "darty" { discard; }`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		options Options
+		// Fields of each message output, of those checked
+		expected []map[string]string
+	}{
+		{"every message", Options{}, []map[string]string{
+			{"message": "a.msg", "From": `"Darty" <infos@contact-darty.com>`},
+			{"message": "b.msg"},
+			{"message": "c.msg", "From": ""},
+		}},
+		{"filtered", Options{Where: `From.domain == "contact-darty.com"`}, []map[string]string{
+			{"message": "a.msg"},
+			{"message": "b.msg"},
+		}},
+		{"duplicates dropped", Options{DedupeKey: "content", DuplicateMode: "drop"}, []map[string]string{
+			{"message": "a.msg"},
+			{"message": "c.msg"},
+		}},
+		{"duplicates flagged", Options{DedupeKey: "headers", DuplicateMode: "flag"}, []map[string]string{
+			{"message": "a.msg", "duplicate_of": ""},
+			{"message": "b.msg", "duplicate_of": "a.msg"},
+			{"message": "c.msg", "duplicate_of": ""},
+		}},
+		{"sieve", Options{SievePath: sievePath}, []map[string]string{
+			{"message": "a.msg", "sieve_discard": "true", "sieve_keep": "false"},
+			{"message": "b.msg", "sieve_discard": "true"},
+			{"message": "c.msg", "sieve_discard": "false", "sieve_keep": "true"},
+		}},
+		{"body", Options{Body: true, SnippetLength: 10}, []map[string]string{
+			{"message": "a.msg", "part_types": "text/html", "snippet": "Si cet ema"},
+			{"message": "b.msg", "snippet": "Si cet ema"},
+			{"message": "c.msg", "part_count": "1"},
+		}},
+	}
+
+	for _, tc := range cases {
+		outputPath := filepath.Join(tmpDir, "output.jsonl")
+		tc.options.Format = "jsonl"
+		tc.options.Fields = []string{"message", "From"}
+		tc.options.TmpDir = tmpDir
+		if err := Run(archivePath, outputPath, tc.options); err != nil {
+			t.Errorf("%v: %v", tc.name, err)
+			continue
+		}
+
+		records := readJSONL(t, outputPath)
+		if len(records) != len(tc.expected) {
+			t.Errorf("%v: output %v, expected %v", tc.name, records, tc.expected)
+			continue
+		}
+		for i, expected := range tc.expected {
+			for field, value := range expected {
+				if got, ok := records[i][field]; !ok || got != value {
+					t.Errorf("%v: message %v has %v %q, expected %q", tc.name, i, field, got, value)
+				}
+			}
+		}
+	}
+}
+
+func TestRunIncremental(t *testing.T) {
+	tmpDir := newTestDir(t)
+	archivePath := filepath.Join(tmpDir, "archive.tar.gz")
+	options := Options{Format: "jsonl", Fields: []string{"message"}, StatePath: filepath.Join(tmpDir, "state.db"), StateKey: "headers"}
+
+	runs := []struct {
+		entries [][2]string
+		expected int
+	}{
+		{testEntries[:1], 1},
+		// The copy is known by its headers
+		{testEntries, 1},
+		{testEntries, 0},
+	}
+
+	for i, run := range runs {
+		writeArchive(t, archivePath, run.entries)
+		outputPath := filepath.Join(tmpDir, "output.jsonl")
+		if err := Run(archivePath, outputPath, options); err != nil {
+			t.Fatal(err)
+		}
+		if records := readJSONL(t, outputPath); len(records) != run.expected {
+			t.Errorf("run %v: output %v, expected %v messages", i, records, run.expected)
+		}
+	}
+}
+
+func TestRunCheckpoint(t *testing.T) {
+	tmpDir := newTestDir(t)
+	archivePath := filepath.Join(tmpDir, "archive.tar.gz")
+	writeArchive(t, archivePath, testEntries)
+	outputPath := filepath.Join(tmpDir, "output.jsonl")
+
+	options := Options{Format: "jsonl", Fields: []string{"message"}, CheckpointInterval: 1}
+	if err := Run(archivePath, outputPath, options); err != nil {
+		t.Fatal(err)
+	}
+	if records := readJSONL(t, outputPath); len(records) != 3 {
+		t.Errorf("output %v", records)
+	}
+	if _, err := os.Stat(outputPath + ".checkpoint"); !os.IsNotExist(err) {
+		t.Errorf("checkpoint of complete output kept: %v", err)
+	}
+}
+
+// bulkMessages is the archive entry of each document of a _bulk body,
+// skipping the actions before them
+func bulkMessages(t *testing.T, body io.Reader) []string {
+	var messages []string
+	scanner := bufio.NewScanner(body)
+	for i := 0; scanner.Scan(); i++ {
+		if i % 2 == 0 {
+			continue
+		}
+		var document map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &document); err != nil {
+			t.Fatal(err)
+		}
+		message, _ := document["message"].(string)
+		messages = append(messages, message)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return messages
+}
+
+// TestRunResume fails es-bulk output part way through, then resumes it
+func TestRunResume(t *testing.T) {
+	tmpDir := newTestDir(t)
+	archivePath := filepath.Join(tmpDir, "archive.tar.gz")
+	writeArchive(t, archivePath, testEntries)
+	outputPath := filepath.Join(tmpDir, "output.ndjson")
+
+	// Indexing the first document, then refusing the others while failing
+	var mu sync.Mutex
+	failing := true
+	var indexed []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		messages := bulkMessages(t, r.Body)
+		if failing && len(indexed) > 0 {
+			http.Error(w, "no", http.StatusBadRequest)
+			return
+		}
+
+		var items []map[string]interface{}
+		for _, message := range messages {
+			indexed = append(indexed, message)
+			items = append(items, map[string]interface{}{"index": map[string]interface{}{"status": http.StatusCreated}})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"items": items})
+	}))
+	defer server.Close()
+
+	options := Options{Format: "es-bulk", Fields: []string{"message"}, ESURL: server.URL, BatchSize: 1, CheckpointInterval: time.Nanosecond}
+	if err := Run(archivePath, outputPath, options); err == nil || !strings.Contains(err.Error(), "400 Bad Request") {
+		t.Fatalf("error %v, expected the output to fail", err)
+	}
+
+	// The checkpoint holds the message indexed, not the one refused
+	saved, err := checkpoint.Read(checkpoint.Path(outputPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Messages != 1 || saved.Position.Entries != 1 {
+		t.Errorf("checkpoint after %v messages, %v entries, expected 1", saved.Messages, saved.Position.Entries)
+	}
+
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	options.Resume = true
+	if err := Run(archivePath, outputPath, options); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(checkpoint.Path(outputPath)); !os.IsNotExist(err) {
+		t.Errorf("checkpoint of complete output kept: %v", err)
+	}
+
+	// Each message is output and indexed once
+	file, err := os.Open(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	expected := []string{"a.msg", "b.msg", "c.msg"}
+	if output := bulkMessages(t, file); strings.Join(output, " ") != strings.Join(expected, " ") {
+		t.Errorf("output %v, expected %v", output, expected)
+	}
+	if strings.Join(indexed, " ") != strings.Join(expected, " ") {
+		t.Errorf("indexed %v, expected %v", indexed, expected)
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	tmpDir := newTestDir(t)
+	archivePath := filepath.Join(tmpDir, "archive.tar.gz")
+	writeArchive(t, archivePath, testEntries)
+
+	// Gzipped, but not a tar archive
+	notTarPath := filepath.Join(tmpDir, "not-tar.tar.gz")
+	file, err := os.Create(notTarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zipped := gzip.NewWriter(file)
+	zipped.Write([]byte(strings.Repeat("not a tar archive\n", 100)))
+	zipped.Close()
+	file.Close()
+
+	// Refusing every document, failing the output part way through
+	refusing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no", http.StatusBadRequest)
+	}))
+	defer refusing.Close()
+
+	outputPath := filepath.Join(tmpDir, "output.jsonl")
+	// Output in a directory which is not there fails once written at the
+	// end, after the whole archive was read
+	missingPath := filepath.Join(tmpDir, "missing", "output")
+	// Leaving no room for the report of duplicates
+	if err := os.MkdirAll(filepath.Join(tmpDir, "report", "duplicates.json"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		archive string
+		output string
+		options Options
+		err string
+	}{
+		{"missing archive", filepath.Join(tmpDir, "missing.tar.gz"), outputPath, Options{Format: "json"}, "no such file"},
+		{"not a tar archive", notTarPath, outputPath, Options{Format: "json"}, ""},
+		{"invalid filter", archivePath, outputPath, Options{Format: "json", Where: "Subject =="}, "-where:"},
+		{"missing sieve script", archivePath, outputPath, Options{Format: "json", SievePath: filepath.Join(tmpDir, "missing.sieve")}, "missing.sieve"},
+		{"checkpoint of json", archivePath, outputPath, Options{Format: "json", CheckpointInterval: 1}, "Checkpoints need jsonl or es-bulk output"},
+		{"checkpoint with dedupe", archivePath, outputPath, Options{Format: "jsonl", Resume: true, DedupeKey: "content"}, "Checkpoints need"},
+		{"output failing", archivePath, outputPath, Options{Format: "es-bulk", ESURL: refusing.URL, BatchSize: 1}, "es-bulk: 400 Bad Request"},
+		{"resume without checkpoint", archivePath, outputPath, Options{Format: "jsonl", Resume: true}, "output.jsonl.checkpoint"},
+		{"json output failing", archivePath, missingPath, Options{Format: "json"}, "no such file"},
+		{"sqlite output failing", archivePath, missingPath, Options{Format: "sqlite"}, ""},
+		{"thread tree failing", archivePath, outputPath, Options{Format: "jsonl", ThreadTreePath: missingPath}, "no such file"},
+		{"duplicate report failing", archivePath, filepath.Join(tmpDir, "report", "output.json"), Options{Format: "json", DedupeKey: "headers", DuplicateMode: "report"}, "is a directory"},
+		{"json output full", archivePath, "/dev/full", Options{Format: "json"}, "no space left"},
+		{"tsv output full", archivePath, "/dev/full", Options{Format: "tsv"}, "no space left"},
+	}
+
+	unpackDir := filepath.Join(tmpDir, "unpack")
+	if err := os.Mkdir(unpackDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range cases {
+		if _, err := os.Stat(tc.output); tc.output == "/dev/full" && err != nil {
+			continue
+		}
+		tc.options.TmpDir = unpackDir
+		err := Run(tc.archive, tc.output, tc.options)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%v: error %v, expected %q", tc.name, err, tc.err)
+		}
+
+		// The archive unpacked is removed on errors too
+		if left, _ := ioutil.ReadDir(unpackDir); len(left) > 0 {
+			t.Errorf("%v: left %v", tc.name, left[0].Name())
+			for _, dir := range left {
+				os.RemoveAll(filepath.Join(unpackDir, dir.Name()))
+			}
+		}
+	}
+}
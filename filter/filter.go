@@ -0,0 +1,233 @@
+package filter
+
+import (
+	"time"
+	"regexp"
+	"strconv"
+	"strings"
+	"net/mail"
+	"net/textproto"
+	"github.com/asgaines/msgextract/parse"
+)
+
+// Expr is a parsed filter expression
+type Expr struct {
+	root node
+}
+
+// Parse compiles an expression selecting messages by their fields, e.g.
+//
+//	From.domain == "contact-darty.com" && Date >= 2011-04-01 && Subject =~ /euros/i
+//
+// Fields are header names, matched regardless of case, or output fields
+// such as part_count. A field occurring several times (e.g. Received) or
+// holding several addresses (e.g. To) matches when any of its values does;
+// != and !~ match when none does. Values are compared as strings, numbers
+// or RFC 5322 dates, following the literal they are compared with.
+// A *SyntaxError locates the first problem found
+func Parse(expr string) (*Expr, error) {
+	tokens, err := lex(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := parser{tokens: tokens}
+	if p.peek().kind == tokenEOF {
+		return nil, p.errorf(p.peek(), "empty expression")
+	}
+
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, p.errorf(t, "expected && or ||, found %v", t)
+	}
+
+	return &Expr{root: root}, nil
+}
+
+// Match reports whether the record satisfies the expression
+func (e *Expr) Match(record textproto.MIMEHeader) bool {
+	return e.root.eval(record)
+}
+
+type node interface {
+	eval(record textproto.MIMEHeader) bool
+}
+
+type andNode struct {
+	left, right node
+}
+
+func (n andNode) eval(record textproto.MIMEHeader) bool {
+	return n.left.eval(record) && n.right.eval(record)
+}
+
+type orNode struct {
+	left, right node
+}
+
+func (n orNode) eval(record textproto.MIMEHeader) bool {
+	return n.left.eval(record) || n.right.eval(record)
+}
+
+type notNode struct {
+	operand node
+}
+
+func (n notNode) eval(record textproto.MIMEHeader) bool {
+	return !n.operand.eval(record)
+}
+
+type hasNode struct {
+	field field
+}
+
+func (n hasNode) eval(record textproto.MIMEHeader) bool {
+	return len(n.field.values(record)) > 0
+}
+
+type operand interface {
+	values(record textproto.MIMEHeader) []string
+}
+
+// field is a header or output field, optionally narrowed to the address,
+// display name or domain of the addresses it holds
+type field struct {
+	name string
+	accessor string
+}
+
+func (f field) values(record textproto.MIMEHeader) []string {
+	var values []string
+
+	for _, value := range record.Values(f.name) {
+		if f.accessor == "" {
+			values = append(values, parse.DecodeHeader(value))
+			continue
+		}
+
+		for _, address := range parse.Addresses(value) {
+			switch f.accessor {
+			case "address":
+				values = append(values, address.Address)
+			case "name":
+				if address.Name != "" {
+					values = append(values, address.Name)
+				}
+			case "domain":
+				if at := strings.LastIndex(address.Address, "@"); at != -1 {
+					values = append(values, strings.ToLower(address.Address[at + 1:]))
+				}
+			}
+		}
+	}
+
+	return values
+}
+
+// countOperand is the number of values of the field
+type countOperand struct {
+	field field
+}
+
+func (c countOperand) values(record textproto.MIMEHeader) []string {
+	return []string{strconv.Itoa(len(c.field.values(record)))}
+}
+
+type literal struct {
+	text string
+	regex *regexp.Regexp
+	number float64
+	isNumber bool
+	// Period named by a date literal
+	start, end time.Time
+	isDate bool
+}
+
+type compareNode struct {
+	left operand
+	op string
+	right literal
+}
+
+func (n compareNode) eval(record textproto.MIMEHeader) bool {
+	op := n.op
+	negated := op == "!=" || op == "!~"
+	switch op {
+	case "!=":
+		op = "=="
+	case "!~":
+		op = "=~"
+	}
+
+	for _, value := range n.left.values(record) {
+		if n.right.compare(op, value) {
+			return !negated
+		}
+	}
+	return negated
+}
+
+// compare the value with the literal. Values which cannot be read as the
+// type of the literal never match
+func (l literal) compare(op, value string) bool {
+	switch {
+	case l.regex != nil:
+		return l.regex.MatchString(value)
+	case l.isNumber:
+		number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return false
+		}
+		return ordered(op, compareFloats(number, l.number))
+	case l.isDate:
+		date, err := mail.ParseDate(strings.TrimSpace(value))
+		if err != nil {
+			return false
+		}
+		switch op {
+		case "==":
+			return !date.Before(l.start) && date.Before(l.end)
+		case "<":
+			return date.Before(l.start)
+		case "<=":
+			return date.Before(l.end)
+		case ">":
+			return !date.Before(l.end)
+		case ">=":
+			return !date.Before(l.start)
+		}
+		return false
+	}
+
+	return ordered(op, strings.Compare(value, l.text))
+}
+
+// ordered applies the operator to the result of a three-way comparison
+func ordered(op string, cmp int) bool {
+	switch op {
+	case "==":
+		return cmp == 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,113 @@
+package filter
+
+import (
+	"testing"
+	"net/textproto"
+)
+
+func TestMatch(t *testing.T) {
+	darty := textproto.MIMEHeader{
+		"From": {`"Darty" <infos@Contact-Darty.com>`},
+		"To": {"ron@example.com, Harry Potter <harry@hogwarts.example>"},
+		"Subject": {"Cuit Vapeur 29.90 euros, Nintendo 3DS 239 euros"},
+		"Date": {"01 Apr 2011 16:17:41 +0200"},
+		"Received": {"from a by b", "from b by c", "from c by d", "from d by e"},
+		"Part_count": {"3"},
+	}
+
+	lunch := textproto.MIMEHeader{
+		"From": {"=?iso-8859-1?q?Ren=E9e?= <renee@example.com>"},
+		"Subject": {"=?utf-8?q?Caf=C3=A9?= lunch"},
+		"Date": {"Thu, 31 Mar 2011 23:59:59 +0000"},
+		"List-Id": {"<lunch.example.com>"},
+		"Received": {"from a by b"},
+	}
+
+	cases := []struct {
+		expr string
+		darty bool
+		lunch bool
+	}{
+		{`From.domain == "contact-darty.com" && Date >= 2011-04-01 && Subject =~ /euros/i`, true, false},
+		{`has(List-Id)`, false, true},
+		{`has(list-id)`, false, true},
+		{`!has(List-Id)`, true, false},
+		{`count(Received) > 3`, true, false},
+		{`count(Received) == 1`, false, true},
+		{`count(To.address) == 2`, true, false},
+		{`To.domain == "hogwarts.example"`, true, false},
+		{`To.domain != "hogwarts.example"`, false, true},
+		{`To.name == "Harry Potter"`, true, false},
+		{`From.name == "Renée"`, false, true},
+		{`Subject =~ /^café/i`, false, true},
+		{`Subject !~ /euros/`, false, true},
+		{`Date == 2011-04-01`, true, false},
+		{`Date < 2011-04-01`, false, true},
+		{`Date <= 2011-03-31T23:59:59Z`, false, true},
+		{`Date > 2011-04-01T14:17:40Z`, true, false},
+		{`Date >= 2011-03`, true, true},
+		{`part_count >= 2.5`, true, false},
+		{`part_count == "3"`, true, false},
+		{`Subject == 3`, false, false},
+		{`Missing == ""`, false, false},
+		{`Missing != ""`, true, true},
+		{`has(List-Id) || From.domain == "contact-darty.com"`, true, true},
+		{`!(has(List-Id) || Date < 2011-04-01) && has(Received)`, true, false},
+		{`has(List-Id) && Date < 2011-04-01 || count(Received) > 3`, true, true},
+	}
+
+	for _, c := range cases {
+		expr, err := Parse(c.expr)
+		if err != nil {
+			t.Errorf("%v: %v", c.expr, err)
+			continue
+		}
+
+		if match := expr.Match(darty); match != c.darty {
+			t.Errorf("%v returned %v for darty, wanted %v", c.expr, match, c.darty)
+		}
+		if match := expr.Match(lunch); match != c.lunch {
+			t.Errorf("%v returned %v for lunch, wanted %v", c.expr, match, c.lunch)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := []struct {
+		expr string
+		err string
+	}{
+		{``, "column 1: empty expression"},
+		{`From ==`, "column 8: expected string, number, date or /regex/, found end of expression"},
+		{`From == "darty`, "column 9: unterminated string"},
+		{`Subject =~ /euros`, "column 12: unterminated regex"},
+		{`Subject =~ "euros"`, `column 9: "=~" needs a /regex/ to match against`},
+		{`Subject == /euros/`, `column 9: a regex is matched with =~ or !~, not "=="`},
+		{`Subject =~ /euros/x`, `column 12: unknown regex flags "x", expected i, m or s`},
+		{`Subject =~ /(euros/`, "column 12: invalid regex: error parsing regexp: missing closing ): `(euros`"},
+		{`Date >= 2011-13-01`, `column 9: invalid number or date "2011-13-01", dates are written 2006-01-02 or 2006-01-02T15:04:05`},
+		{`From.domian == "x"`, `column 6: expected address, name or domain after "From.", found "domian"`},
+		{`size(Received) > 3`, `column 1: unknown function "size", expected has or count`},
+		{`count(Received) > "3"`, "column 1: count() is compared with a number"},
+		{`has(List-Id`, `column 12: expected ")", found end of expression`},
+		{`"x" == From`, "column 1: expected field or function, found string \"x\""},
+		{`From`, `column 5: expected comparison after "From", found end of expression`},
+		{`From == "x" Subject == "y"`, `column 13: expected && or ||, found "Subject"`},
+		{`(has(To)`, `column 9: expected ")", found end of expression`},
+		{`From = "x"`, `column 6: unexpected character '='`},
+	}
+
+	for _, c := range cases {
+		_, err := Parse(c.expr)
+		if err == nil {
+			t.Errorf("%v parsed, wanted %v", c.expr, c.err)
+			continue
+		}
+		if err.Error() != c.err {
+			t.Errorf("%v returned %v, wanted %v", c.expr, err, c.err)
+		}
+		if _, ok := err.(*SyntaxError); !ok {
+			t.Errorf("%v returned %T, wanted *SyntaxError", c.expr, err)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package filter
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	// Numbers and dates, told apart by the parser
+	tokenLiteral
+	tokenRegex
+	tokenOperator
+	tokenLeftParen
+	tokenRightParen
+	tokenDot
+)
+
+// Operators, longest first so that "==" is not taken for two "="
+var operators = []string{"&&", "||", "==", "!=", "=~", "!~", "<=", ">=", "<", ">", "!"}
+
+type token struct {
+	kind tokenKind
+	// Source text of the token, regex flags included
+	text string
+	// Byte offset of the token in the expression
+	pos int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of expression"
+	case tokenString:
+		return "string " + t.text
+	case tokenRegex:
+		return "regex " + t.text
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// lex splits the expression into tokens, ending with tokenEOF
+func lex(expr string) ([]token, error) {
+	var tokens []token
+
+	for pos := 0; pos < len(expr); {
+		c := expr[pos]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			pos++
+			continue
+		case c == '(':
+			tokens = append(tokens, token{tokenLeftParen, "(", pos})
+			pos++
+			continue
+		case c == ')':
+			tokens = append(tokens, token{tokenRightParen, ")", pos})
+			pos++
+			continue
+		case c == '.':
+			tokens = append(tokens, token{tokenDot, ".", pos})
+			pos++
+			continue
+		case c == '"':
+			end, err := scanQuoted(expr, pos, '"')
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{tokenString, expr[pos:end], pos})
+			pos = end
+			continue
+		case c == '/':
+			end, err := scanQuoted(expr, pos, '/')
+			if err != nil {
+				return nil, err
+			}
+			// Flags directly follow the closing slash
+			for end < len(expr) && isLetter(expr[end]) {
+				end++
+			}
+			tokens = append(tokens, token{tokenRegex, expr[pos:end], pos})
+			pos = end
+			continue
+		case isLetter(c) || c == '_':
+			end := pos
+			for end < len(expr) && (isLetter(expr[end]) || isDigit(expr[end]) || expr[end] == '_' || expr[end] == '-') {
+				end++
+			}
+			tokens = append(tokens, token{tokenIdent, expr[pos:end], pos})
+			pos = end
+			continue
+		case isDigit(c) || (c == '-' && pos + 1 < len(expr) && isDigit(expr[pos + 1])):
+			// Dates and times such as 2011-04-01T16:17:41+02:00 lex as one
+			end := pos + 1
+			for end < len(expr) && (isLetter(expr[end]) || isDigit(expr[end]) || strings.IndexByte(":.+-", expr[end]) != -1) {
+				end++
+			}
+			tokens = append(tokens, token{tokenLiteral, expr[pos:end], pos})
+			pos = end
+			continue
+		}
+
+		var operator string
+		for _, op := range operators {
+			if strings.HasPrefix(expr[pos:], op) {
+				operator = op
+				break
+			}
+		}
+		if operator == "" {
+			r, _ := utf8.DecodeRuneInString(expr[pos:])
+			return nil, &SyntaxError{Pos: pos, Msg: fmt.Sprintf("unexpected character %q", r)}
+		}
+		tokens = append(tokens, token{tokenOperator, operator, pos})
+		pos += len(operator)
+	}
+
+	return append(tokens, token{tokenEOF, "", len(expr)}), nil
+}
+
+// scanQuoted returns the offset past the quote closing the one at start,
+// skipping quotes escaped with a backslash
+func scanQuoted(expr string, start int, quote byte) (int, error) {
+	for pos := start + 1; pos < len(expr); pos++ {
+		switch expr[pos] {
+		case '\\':
+			pos++
+		case quote:
+			return pos + 1, nil
+		}
+	}
+
+	kind := "string"
+	if quote == '/' {
+		kind = "regex"
+	}
+	return 0, &SyntaxError{Pos: start, Msg: "unterminated " + kind}
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
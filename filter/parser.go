@@ -0,0 +1,256 @@
+package filter
+
+import (
+	"fmt"
+	"time"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SyntaxError locates the first problem found in an expression
+type SyntaxError struct {
+	// Byte offset in the expression
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("column %d: %s", e.Pos + 1, e.Msg)
+}
+
+// Accessors of the addresses in a field, e.g. From.domain
+var accessors = map[string]bool{
+	"address": true,
+	"name": true,
+	"domain": true,
+}
+
+// Layouts of date literals, each standing for the period it names, so that
+// 2011-04-01 covers the whole day
+var dateLayouts = []struct {
+	layout string
+	end func(time.Time) time.Time
+}{
+	{"2006-01", func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }},
+	{"2006-01-02", func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }},
+	{"2006-01-02T15:04", func(t time.Time) time.Time { return t.Add(time.Minute) }},
+	{"2006-01-02T15:04Z07:00", func(t time.Time) time.Time { return t.Add(time.Minute) }},
+	{"2006-01-02T15:04:05", func(t time.Time) time.Time { return t.Add(time.Second) }},
+	{time.RFC3339, func(t time.Time) time.Time { return t.Add(time.Second) }},
+}
+
+type parser struct {
+	tokens []token
+	pos int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) accept(kind tokenKind, text string) bool {
+	if t := p.peek(); t.kind == kind && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(kind tokenKind, text string) error {
+	if !p.accept(kind, text) {
+		return p.errorf(p.peek(), "expected %q, found %v", text, p.peek())
+	}
+	return nil
+}
+
+func (p *parser) errorf(at token, format string, args ...interface{}) error {
+	return &SyntaxError{Pos: at.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// or: and ("||" and)*
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.accept(tokenOperator, "||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+
+	return left, nil
+}
+
+// and: not ("&&" not)*
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.accept(tokenOperator, "&&") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+
+	return left, nil
+}
+
+// not: "!" not | "(" or ")" | predicate
+func (p *parser) parseNot() (node, error) {
+	if p.accept(tokenOperator, "!") {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand}, nil
+	}
+
+	if p.accept(tokenLeftParen, "(") {
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokenRightParen, ")"); err != nil {
+			return nil, err
+		}
+		return inner, nil
+	}
+
+	return p.parsePredicate()
+}
+
+// predicate: "has" "(" field ")" | operand comparison literal
+func (p *parser) parsePredicate() (node, error) {
+	start := p.peek()
+	if start.kind != tokenIdent {
+		return nil, p.errorf(start, "expected field or function, found %v", start)
+	}
+
+	var left operand
+	if p.tokens[p.pos + 1].kind == tokenLeftParen {
+		p.next()
+		p.next()
+
+		f, err := p.parseField()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokenRightParen, ")"); err != nil {
+			return nil, err
+		}
+
+		switch start.text {
+		case "has":
+			return hasNode{f}, nil
+		case "count":
+			left = countOperand{f}
+		default:
+			return nil, p.errorf(start, "unknown function %q, expected has or count", start.text)
+		}
+	} else {
+		f, err := p.parseField()
+		if err != nil {
+			return nil, err
+		}
+		left = f
+	}
+
+	op := p.next()
+	if op.kind != tokenOperator || op.text == "&&" || op.text == "||" || op.text == "!" {
+		return nil, p.errorf(op, "expected comparison after %q, found %v", start.text, op)
+	}
+
+	lit, err := p.parseLiteral()
+	if err != nil {
+		return nil, err
+	}
+
+	isRegex := op.text == "=~" || op.text == "!~"
+	switch {
+	case isRegex && lit.regex == nil:
+		return nil, p.errorf(op, "%v needs a /regex/ to match against", op)
+	case !isRegex && lit.regex != nil:
+		return nil, p.errorf(op, "a regex is matched with =~ or !~, not %v", op)
+	}
+
+	if _, ok := left.(countOperand); ok && !lit.isNumber {
+		return nil, p.errorf(start, "count() is compared with a number")
+	}
+
+	return compareNode{left, op.text, lit}, nil
+}
+
+// field: ident ("." accessor)?
+func (p *parser) parseField() (field, error) {
+	t := p.next()
+	if t.kind != tokenIdent {
+		return field{}, p.errorf(t, "expected field, found %v", t)
+	}
+
+	f := field{name: t.text}
+	if p.accept(tokenDot, ".") {
+		accessor := p.next()
+		if accessor.kind != tokenIdent || !accessors[strings.ToLower(accessor.text)] {
+			return field{}, p.errorf(accessor, "expected address, name or domain after \"%v.\", found %v", t.text, accessor)
+		}
+		f.accessor = strings.ToLower(accessor.text)
+	}
+
+	return f, nil
+}
+
+func (p *parser) parseLiteral() (literal, error) {
+	t := p.next()
+
+	switch t.kind {
+	case tokenString:
+		value, err := strconv.Unquote(t.text)
+		if err != nil {
+			return literal{}, p.errorf(t, "invalid string %v", t.text)
+		}
+		return literal{text: value}, nil
+	case tokenRegex:
+		end := strings.LastIndexByte(t.text, '/')
+		pattern := strings.Replace(t.text[1:end], `\/`, "/", -1)
+		if flags := t.text[end + 1:]; flags != "" {
+			if strings.Trim(flags, "ims") != "" {
+				return literal{}, p.errorf(t, "unknown regex flags %q, expected i, m or s", flags)
+			}
+			pattern = "(?" + flags + ")" + pattern
+		}
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return literal{}, p.errorf(t, "invalid regex: %v", err)
+		}
+		return literal{text: t.text, regex: regex}, nil
+	case tokenLiteral:
+		if number, err := strconv.ParseFloat(t.text, 64); err == nil {
+			return literal{text: t.text, number: number, isNumber: true}, nil
+		}
+		for _, layout := range dateLayouts {
+			if start, err := time.Parse(layout.layout, t.text); err == nil {
+				return literal{text: t.text, start: start, end: layout.end(start), isDate: true}, nil
+			}
+		}
+		return literal{}, p.errorf(t, "invalid number or date %q, dates are written 2006-01-02 or 2006-01-02T15:04:05", t.text)
+	}
+
+	return literal{}, p.errorf(t, "expected string, number, date or /regex/, found %v", t)
+}
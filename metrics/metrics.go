@@ -0,0 +1,265 @@
+package metrics
+
+import (
+	"io"
+	"fmt"
+	"sort"
+	"sync"
+	"bufio"
+	"strings"
+	"strconv"
+	"net/http"
+	"sync/atomic"
+)
+
+// Registry holds metrics, served in the Prometheus text format
+type Registry struct {
+	mu sync.Mutex
+	metrics []metric
+}
+
+// metric writes its samples, after their help and type
+type metric interface {
+	write(w io.Writer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// Write writes the metrics in the Prometheus text format, version 0.0.4
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	metrics := append([]metric{}, r.metrics...)
+	r.mu.Unlock()
+
+	buffered := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(buffered)
+	}
+	return buffered.Flush()
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.Write(w)
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+}
+
+// labels lays out label pairs, values escaped, e.g. {stage="parse",le="1"}
+func labels(pairs ...string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%v="%v"`, pairs[i], escape.Replace(pairs[i + 1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Counter counts up, e.g. messages or bytes
+type Counter struct {
+	value int64
+}
+
+func (c *Counter) Add(n int64) {
+	atomic.AddInt64(&c.value, n)
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.value)
+}
+
+type namedCounter struct {
+	Counter
+	name string
+	help string
+}
+
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &namedCounter{name: name, help: help}
+	r.register(c)
+	return &c.Counter
+}
+
+func (c *namedCounter) write(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	fmt.Fprintf(w, "%v %v\n", c.name, c.Value())
+}
+
+// CounterVec is a counter per value of a label
+type CounterVec struct {
+	name string
+	help string
+	label string
+
+	mu sync.Mutex
+	counters map[string]*Counter
+}
+
+// NewCounterVec registers a counter per value of the label, those given
+// being written out from the start
+func (r *Registry) NewCounterVec(name, help, label string, values ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, label: label, counters: map[string]*Counter{}}
+	for _, value := range values {
+		c.With(value)
+	}
+	r.register(c)
+	return c
+}
+
+// With is the counter of the label value
+func (c *CounterVec) With(value string) *Counter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counter, ok := c.counters[value]
+	if !ok {
+		counter = &Counter{}
+		c.counters[value] = counter
+	}
+	return counter
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	values := make([]string, 0, len(c.counters))
+	for value := range c.counters {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	for _, value := range values {
+		fmt.Fprintf(w, "%v%v %v\n", c.name, labels(c.label, value), c.counters[value].Value())
+	}
+}
+
+// Gauge goes up and down, e.g. the length of a queue
+type Gauge struct {
+	name string
+	help string
+	value int64
+}
+
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := &Gauge{name: name, help: help}
+	r.register(g)
+	return g
+}
+
+func (g *Gauge) Add(n int64) {
+	atomic.AddInt64(&g.value, n)
+}
+
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.value)
+}
+
+func (g *Gauge) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%v %v\n", g.name, g.Value())
+}
+
+// Histogram counts observations, e.g. durations, in buckets of their
+// upper bounds
+type Histogram struct {
+	mu sync.Mutex
+	buckets []float64
+	counts []int64
+	sum float64
+	count int64
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// HistogramVec is a histogram per value of a label
+type HistogramVec struct {
+	name string
+	help string
+	label string
+	buckets []float64
+
+	mu sync.Mutex
+	histograms map[string]*Histogram
+}
+
+// NewHistogramVec registers a histogram per value of the label, over the
+// buckets given in increasing order, those values given being written out
+// from the start
+func (r *Registry) NewHistogramVec(name, help, label string, buckets []float64, values ...string) *HistogramVec {
+	h := &HistogramVec{name: name, help: help, label: label, buckets: buckets, histograms: map[string]*Histogram{}}
+	for _, value := range values {
+		h.With(value)
+	}
+	r.register(h)
+	return h
+}
+
+// With is the histogram of the label value
+func (h *HistogramVec) With(value string) *Histogram {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	histogram, ok := h.histograms[value]
+	if !ok {
+		histogram = &Histogram{buckets: h.buckets, counts: make([]int64, len(h.buckets))}
+		h.histograms[value] = histogram
+	}
+	return histogram
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	values := make([]string, 0, len(h.histograms))
+	for value := range h.histograms {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	for _, value := range values {
+		histogram := h.histograms[value]
+		histogram.mu.Lock()
+		for i, bound := range histogram.buckets {
+			fmt.Fprintf(w, "%v_bucket%v %v\n", h.name, labels(h.label, value, "le", formatFloat(bound)), histogram.counts[i])
+		}
+		fmt.Fprintf(w, "%v_bucket%v %v\n", h.name, labels(h.label, value, "le", "+Inf"), histogram.count)
+		fmt.Fprintf(w, "%v_sum%v %v\n", h.name, labels(h.label, value), formatFloat(histogram.sum))
+		fmt.Fprintf(w, "%v_count%v %v\n", h.name, labels(h.label, value), histogram.count)
+		histogram.mu.Unlock()
+	}
+}
@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"io"
+	"bytes"
+	"errors"
+	"testing"
+	"archive/tar"
+	"compress/gzip"
+	"compress/flate"
+)
+
+func TestWrite(t *testing.T) {
+	r := NewRegistry()
+	messages := r.NewCounter("test_messages_total", "Messages.")
+	failures := r.NewCounterVec("test_failures_total", "Failures, by \\ reason.", "reason", "gzip")
+	queue := r.NewGauge("test_queue", "Queue.")
+	stages := r.NewHistogramVec("test_seconds", "Stages.", "stage", []float64{.5, 1})
+
+	messages.Add(3)
+	messages.Inc()
+	failures.With("say \"what\"\n").Inc()
+	queue.Add(5)
+	queue.Add(-2)
+	stages.With("parse").Observe(.5)
+	stages.With("parse").Observe(2)
+
+	var b bytes.Buffer
+	if err := r.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP test_messages_total Messages.
+# TYPE test_messages_total counter
+test_messages_total 4
+# HELP test_failures_total Failures, by \\ reason.
+# TYPE test_failures_total counter
+test_failures_total{reason="gzip"} 0
+test_failures_total{reason="say \"what\"\n"} 1
+# HELP test_queue Queue.
+# TYPE test_queue gauge
+test_queue 3
+# HELP test_seconds Stages.
+# TYPE test_seconds histogram
+test_seconds_bucket{stage="parse",le="0.5"} 1
+test_seconds_bucket{stage="parse",le="1"} 1
+test_seconds_bucket{stage="parse",le="+Inf"} 2
+test_seconds_sum{stage="parse"} 2.5
+test_seconds_count{stage="parse"} 2
+`
+	if b.String() != expected {
+		t.Errorf("wrote\n%v\nexpected\n%v", b.String(), expected)
+	}
+}
+
+func TestFailureReason(t *testing.T) {
+	cases := []struct {
+		err error
+		reason string
+	}{
+		{gzip.ErrChecksum, Gzip},
+		{flate.CorruptInputError(12), Gzip},
+		{tar.ErrHeader, Tar},
+		{io.ErrUnexpectedEOF, Truncated},
+		{errors.New("disk full"), Other},
+	}
+
+	for _, c := range cases {
+		if reason := FailureReason(c.err); reason != c.reason {
+			t.Errorf("%v: reason %v, expected %v", c.err, reason, c.reason)
+		}
+	}
+}
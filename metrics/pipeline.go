@@ -0,0 +1,130 @@
+package metrics
+
+import (
+	"io"
+	"time"
+	"errors"
+	"context"
+	"archive/tar"
+	"compress/gzip"
+	"compress/flate"
+)
+
+// Stages of an extraction: reading the archive, parsing the messages out
+// of it and writing them out
+const (
+	Unpack = "unpack"
+	Parse = "parse"
+	Output = "output"
+)
+
+// Reasons messages or archives failed to be parsed
+const (
+	// The gzip stream is corrupt
+	Gzip = "gzip"
+	// The tar archive is corrupt
+	Tar = "tar"
+	// The archive ends early
+	Truncated = "truncated"
+	// The MIME structure of a message could not be walked whole
+	MIME = "mime"
+	Other = "other"
+)
+
+// Outcomes of the extraction of an archive
+const (
+	Done = "done"
+	Failed = "failed"
+	Canceled = "canceled"
+)
+
+// Per-archive durations of stages, from milliseconds to an hour
+var StageBuckets = []float64{.001, .01, .1, .5, 1, 5, 10, 30, 60, 300, 900, 3600}
+
+// Pipeline is the metrics of the extractions of a long-running process
+type Pipeline struct {
+	Messages *Counter
+	ParseFailures *CounterVec
+	BytesRead *Counter
+	Stages *HistogramVec
+	// Header lines of messages read from archives but not yet handled
+	HeaderQueue *Gauge
+	Archives *CounterVec
+}
+
+// NewPipeline registers the metrics of extractions
+func NewPipeline(r *Registry) *Pipeline {
+	return &Pipeline{
+		Messages: r.NewCounter("msgextract_messages_processed_total", "Messages read from archives, output or filtered out."),
+		ParseFailures: r.NewCounterVec("msgextract_parse_failures_total", "Archives or messages which could not be parsed, by reason.", "reason", Gzip, Tar, Truncated, MIME, Other),
+		BytesRead: r.NewCounter("msgextract_bytes_read_total", "Bytes of archives read, as uploaded or stored, gzipped or not."),
+		Stages: r.NewHistogramVec("msgextract_archive_stage_seconds", "Time the extraction of each archive spent in each stage, in total over its messages.", "stage", StageBuckets, Unpack, Parse, Output),
+		HeaderQueue: r.NewGauge("msgextract_header_queue_depth", "Messages read from archives waiting to be parsed and output."),
+		Archives: r.NewCounterVec("msgextract_archives_total", "Archives extracted, by outcome.", "outcome", Done, Failed, Canceled),
+	}
+}
+
+// Timings adds up the time an extraction spends in each stage
+type Timings struct {
+	Unpack time.Duration
+	Parse time.Duration
+	Output time.Duration
+}
+
+func (t *Timings) Add(other Timings) {
+	t.Unpack += other.Unpack
+	t.Parse += other.Parse
+	t.Output += other.Output
+}
+
+// Seconds are the timings by stage
+func (t Timings) Seconds() map[string]float64 {
+	return map[string]float64{
+		Unpack: t.Unpack.Seconds(),
+		Parse: t.Parse.Seconds(),
+		Output: t.Output.Seconds(),
+	}
+}
+
+// Finish records the extraction of an archive, which spent the seconds
+// given in each stage and ended with err
+func (p *Pipeline) Finish(stageSeconds map[string]float64, err error) {
+	for stage, seconds := range stageSeconds {
+		p.Stages.With(stage).Observe(seconds)
+	}
+
+	switch {
+	case err == nil:
+		p.Archives.With(Done).Inc()
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		p.Archives.With(Canceled).Inc()
+	default:
+		p.Archives.With(Failed).Inc()
+	}
+}
+
+// FailureReason is why reading an archive failed with err
+func FailureReason(err error) string {
+	var corrupt flate.CorruptInputError
+	switch {
+	case errors.Is(err, gzip.ErrHeader) || errors.Is(err, gzip.ErrChecksum) || errors.As(err, &corrupt):
+		return Gzip
+	case errors.Is(err, tar.ErrHeader) || errors.Is(err, tar.ErrFieldTooLong):
+		return Tar
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return Truncated
+	}
+	return Other
+}
+
+// CountingReader adds the bytes read through it to a counter
+type CountingReader struct {
+	Reader io.Reader
+	Counter *Counter
+}
+
+func (r CountingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.Counter.Add(int64(n))
+	return n, err
+}
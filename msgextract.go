@@ -5,28 +5,99 @@ import (
 	"os"
 	"log"
 	"flag"
-	"io/ioutil"
-	"github.com/asgaines/msgextract/unpack"
-	"github.com/asgaines/msgextract/parse"
+	"time"
 	"github.com/asgaines/msgextract/output"
+	"github.com/asgaines/msgextract/dedupe"
+	"github.com/asgaines/msgextract/progress"
+	"github.com/asgaines/msgextract/extraction"
 )
 
 func main() {
-	fields := []string{"Date", "From", "Subject"}
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		serve(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "watch" {
+		watchDir(os.Args[2:])
+		return
+	}
 
 	var ValidFormats = map[string]bool {
 		"json": true,
 		"tsv": true,
+		"sqlite": true,
+		"parquet": true,
+		"arrow": true,
+		"arrows": true,
+		"avro": true,
+		"xml": true,
+		"html": true,
+		"xlsx": true,
+		"es-bulk": true,
+		"jsonl": true,
 	}
 
-	var outputFormat string
+	var ValidDuplicateModes = map[string]bool {
+		"drop": true,
+		"flag": true,
+		"report": true,
+	}
+
+	var options extraction.Options
+	var progressMode string
+	var progressInterval time.Duration
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [opt args] gzipped-archive.tar.gz output.json\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s serve [opt args], see %s serve -h\n", os.Args[0], os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s watch [opt args] in-dir out-dir [opt args], see %s watch -h\n", os.Args[0], os.Args[0])
 		flag.PrintDefaults()
 	}
 
-	flag.StringVar(&outputFormat, "format", "json", "Formatting for the output file. Valid options: json, tsv")
+	flag.StringVar(&options.Format, "format", "json", "Formatting for the output file. Valid options: json, tsv, sqlite, parquet, arrow, arrows, avro, xml, html, xlsx, es-bulk, jsonl")
+	flag.BoolVar(&options.SubjectIndex, "fts", false, "Add an FTS5 full-text index of subjects to sqlite output")
+	flag.StringVar(&options.Compression, "compression", "snappy", "Compression of parquet output (none, snappy or gzip) or avro output (none, deflate or snappy)")
+	flag.StringVar(&options.TemplatePath, "template", "", "Go text/template executed for each message, replacing -format")
+	flag.StringVar(&options.TemplateHeaderPath, "template-header", "", "Template executed once before the messages (with -template)")
+	flag.StringVar(&options.TemplateFooterPath, "template-footer", "", "Template executed once after the messages (with -template)")
+	flag.StringVar(&options.XSDPath, "xsd", "", "File to write the XML Schema of xml output to")
+	flag.IntVar(&options.BatchSize, "batch-size", 10000, "Messages per row group of parquet output, record batch of arrow output, block of avro output or request to -es-url")
+	flag.StringVar(&options.ESIndex, "es-index", "msgextract", "Index named in the actions of es-bulk output")
+	flag.StringVar(&options.ESURL, "es-url", "", "Elasticsearch or OpenSearch endpoint to also post es-bulk output to, e.g. http://localhost:9200")
+
+	flag.BoolVar(&options.Full, "full", false, "Read past the header and summarize the MIME structure of each message")
+
+	flag.BoolVar(&options.Attachments, "attachments", false, "List the attachments of each message with their sizes and hashes (implies -full)")
+
+	flag.StringVar(&options.ExtractPath, "extract-attachments", "", "Directory to decode attachments into, named by their SHA-256 (implies -attachments)")
+	flag.Int64Var(&options.MaxAttachmentSize, "max-attachment-size", 25 << 20, "Attachments larger than this many bytes are listed but not extracted")
+
+	flag.BoolVar(&options.Body, "body", false, "Add the decoded body_text, body_html and a snippet of the text to the output (implies -full)")
+	flag.IntVar(&options.SnippetLength, "snippet-length", 200, "Number of characters of body text kept in the snippet")
+
+	flag.BoolVar(&options.URLs, "urls", false, "List the distinct links in each message body, unwrapping SafeLinks and URLDefense rewrites (implies -full)")
+
+	flag.BoolVar(&options.Threads, "threads", false, "Thread messages by Message-ID, References and subject, adding thread_id, parent_id and depth")
+	flag.StringVar(&options.ThreadTreePath, "thread-tree", "", "File to write the threads to as nested JSON (implies -threads)")
+
+	flag.StringVar(&options.DedupeKey, "dedupe", "", "Detect duplicate messages by message-id, headers or content")
+	flag.StringVar(&options.DuplicateMode, "duplicates", "drop", "What to do with duplicates: drop them, flag them in a duplicate_of column, or report the groups")
+
+	flag.StringVar(&options.Where, "where", "", "Only output messages matching the expression, e.g. 'From.domain == \"example.com\" && Date >= 2011-04-01'")
+
+	flag.StringVar(&options.SievePath, "sieve", "", "Sieve script to dry-run against each message, adding the resulting actions to the output")
+
+	flag.DurationVar(&options.CheckpointInterval, "checkpoint-interval", 0, "How often to record how far jsonl or es-bulk output went in output.checkpoint, for -resume")
+	flag.BoolVar(&options.Resume, "resume", false, "Resume an interrupted run from output.checkpoint, appending to the output (checkpointing every minute unless -checkpoint-interval is given)")
+
+	flag.StringVar(&options.StatePath, "incremental", "", "SQLite file of the messages output by earlier runs, to only output new ones")
+	flag.StringVar(&options.StateKey, "incremental-key", "headers", "What messages are known by in the -incremental state: message-id, headers or content")
+	flag.DurationVar(&options.StatePrune, "incremental-prune", 0, "Forget messages of the -incremental state no run saw for this long, e.g. 2160h")
+
+	flag.StringVar(&options.TmpDir, "tmp-dir", ".", "Directory the archive is unpacked under, in a temporary directory removed once done")
+
+	flag.StringVar(&progressMode, "progress", progress.Auto, "Report progress on stderr: auto (when a terminal), always, never, or json for an event per line")
+	flag.DurationVar(&progressInterval, "progress-interval", time.Second, "How often progress is reported")
 
 	flag.Parse()
 
@@ -39,46 +110,73 @@ func main() {
 	}
 
 	// Guard against invalid output file formats
-	if !ValidFormats[outputFormat] {
+	if !ValidFormats[options.Format] {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Guard against invalid compression, before the archive is unpacked
+	validCompression := true
+	switch options.Format {
+	case "parquet":
+		_, validCompression = output.ParquetCodecs[options.Compression]
+	case "avro":
+		_, validCompression = output.AvroCodecs[options.Compression]
+	}
+	if !validCompression {
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	gzippedArchivePath := posArgs[0]
+	// Guard against invalid duplicate detection
+	if options.DedupeKey != "" && (!dedupe.ValidKeys[options.DedupeKey] || !ValidDuplicateModes[options.DuplicateMode]) {
+		flag.Usage()
+		os.Exit(1)
+	}
 
-	tmpDir, err := ioutil.TempDir(".", "tmp")
-	if err != nil {
-		log.Fatal(err)
+	if options.SnippetLength < 0 {
+		flag.Usage()
+		os.Exit(1)
 	}
-	defer os.RemoveAll(tmpDir)
 
-	archivePath := unpack.CreateArchiveName(tmpDir, gzippedArchivePath)
-	outputPath := posArgs[1]
+	if !progress.Modes[progressMode] || progressInterval <= 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
 
-	err = unpack.Gzip(gzippedArchivePath, archivePath)
-	if err != nil {
-		log.Fatal(err)
+	if options.StatePath != "" && !dedupe.ValidKeys[options.StateKey] {
+		flag.Usage()
+		os.Exit(1)
 	}
 
-	// Channel to be fed the email header lines as they are
-	// processed by tar function
-	headerChan := make(chan []string)
+	options.Fields = []string{"Date", "From", "Subject"}
+	options.Given = checkpointOptions()
 
-	go func() {
-		err = unpack.Tar(archivePath, headerChan)
-		if err != nil {
-			log.Fatal(err)
-		}
-		// Close the channel, releasing the blockage
-		close(headerChan)
-	}()
-
-	// Parse through the header lines received through channel
-	var parsedHeaders []map[string]string
-	for headers := range headerChan {
-		parsedHeaders = append(parsedHeaders, parse.MapFromHeaderLines(headers))
+	// Log lines are kept off the progress display
+	options.Progress = progress.New(progressMode, os.Stderr, progressInterval)
+	log.SetOutput(options.Progress.Log(os.Stderr))
+
+	if err := extraction.Run(posArgs[0], posArgs[1], options); err != nil {
+		log.Fatal(err)
 	}
+}
 
-	output.WriteFields(outputPath, parsedHeaders, fields, outputFormat)
+// Options which leave the output as it is, left out of checkpoints
+var checkpointIgnored = map[string]bool{
+	"resume": true,
+	"checkpoint-interval": true,
+	"progress": true,
+	"progress-interval": true,
+	"tmp-dir": true,
 }
 
+// checkpointOptions are the options given which the output depends on
+func checkpointOptions() map[string]string {
+	options := map[string]string{}
+	flag.Visit(func(f *flag.Flag) {
+		if !checkpointIgnored[f.Name] {
+			options[f.Name] = f.Value.String()
+		}
+	})
+	return options
+}
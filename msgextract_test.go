@@ -1 +1,37 @@
 package main
+
+import (
+	"bytes"
+	"testing"
+	"github.com/asgaines/msgextract/metrics"
+)
+
+func TestEventWriter(t *testing.T) {
+	registry := metrics.NewRegistry()
+	pipeline := metrics.NewPipeline(registry)
+	var out bytes.Buffer
+	w := &eventWriter{pipeline: pipeline, out: &out, archiveSize: 100}
+
+	w.Write([]byte(`{"phase":"extracting","bytes":10,"messages":2,"failed":1,"queue_depth":3}` + "\n" + "log line\n"))
+	w.Write([]byte(`{"phase":"failed","bytes":40,"messages":3,"failed":1,"fail`))
+	w.Write([]byte(`ure_reason":"tar"}` + "\n"))
+	w.finish(nil)
+
+	if out.String() != "log line\n" {
+		t.Errorf("passed on %q", out.String())
+	}
+	counts := map[string]int64{
+		metrics.MIME: pipeline.ParseFailures.With(metrics.MIME).Value(),
+		metrics.Tar: pipeline.ParseFailures.With(metrics.Tar).Value(),
+		metrics.Gzip: pipeline.ParseFailures.With(metrics.Gzip).Value(),
+	}
+	if counts[metrics.MIME] != 1 || counts[metrics.Tar] != 1 || counts[metrics.Gzip] != 0 {
+		t.Errorf("parse failures %v", counts)
+	}
+	if messages := pipeline.Messages.Value(); messages != 3 {
+		t.Errorf("%v messages processed", messages)
+	}
+	if queued := pipeline.HeaderQueue.Value(); queued != 0 {
+		t.Errorf("%v queued once finished", queued)
+	}
+}
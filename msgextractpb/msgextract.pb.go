@@ -0,0 +1,297 @@
+// gRPC interface of msgextract serve, answered on the same address as the
+// HTTP API over HTTP/2 (cleartext, h2c)
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: msgextract.proto
+
+package msgextractpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type ExtractRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Header fields to return, every one of them when empty. Read from the
+	// first request only
+	Fields []string `protobuf:"bytes,1,rep,name=fields,proto3" json:"fields,omitempty"`
+	// Only return the messages matching the expression, as -where does. Read
+	// from the first request only
+	Where string `protobuf:"bytes,2,opt,name=where,proto3" json:"where,omitempty"`
+	// Whether to return every occurrence of every header field in headers.
+	// Read from the first request only
+	IncludeHeaders bool `protobuf:"varint,3,opt,name=include_headers,json=includeHeaders,proto3" json:"include_headers,omitempty"`
+	// Next part of the archive, of any size up to 4 MiB
+	Chunk         []byte `protobuf:"bytes,4,opt,name=chunk,proto3" json:"chunk,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ExtractRequest) Reset() {
+	*x = ExtractRequest{}
+	mi := &file_msgextract_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ExtractRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ExtractRequest) ProtoMessage() {}
+
+func (x *ExtractRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_msgextract_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ExtractRequest.ProtoReflect.Descriptor instead.
+func (*ExtractRequest) Descriptor() ([]byte, []int) {
+	return file_msgextract_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *ExtractRequest) GetFields() []string {
+	if x != nil {
+		return x.Fields
+	}
+	return nil
+}
+
+func (x *ExtractRequest) GetWhere() string {
+	if x != nil {
+		return x.Where
+	}
+	return ""
+}
+
+func (x *ExtractRequest) GetIncludeHeaders() bool {
+	if x != nil {
+		return x.IncludeHeaders
+	}
+	return false
+}
+
+func (x *ExtractRequest) GetChunk() []byte {
+	if x != nil {
+		return x.Chunk
+	}
+	return nil
+}
+
+// Header is one occurrence of a header field, continuation lines unfolded
+type Header struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Canonical name, e.g. "Message-Id"
+	Name          string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Value         string `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Header) Reset() {
+	*x = Header{}
+	mi := &file_msgextract_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Header) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Header) ProtoMessage() {}
+
+func (x *Header) ProtoReflect() protoreflect.Message {
+	mi := &file_msgextract_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Header.ProtoReflect.Descriptor instead.
+func (*Header) Descriptor() ([]byte, []int) {
+	return file_msgextract_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Header) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Header) GetValue() string {
+	if x != nil {
+		return x.Value
+	}
+	return ""
+}
+
+type Message struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Archive entry of the message
+	Name string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	// Header fields asked for which the message has, as in the JSON output
+	Fields map[string]string `protobuf:"bytes,2,rep,name=fields,proto3" json:"fields,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	// Every header field in the order it occurs, if asked for
+	Headers       []*Header `protobuf:"bytes,3,rep,name=headers,proto3" json:"headers,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Message) Reset() {
+	*x = Message{}
+	mi := &file_msgextract_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Message) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Message) ProtoMessage() {}
+
+func (x *Message) ProtoReflect() protoreflect.Message {
+	mi := &file_msgextract_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Message.ProtoReflect.Descriptor instead.
+func (*Message) Descriptor() ([]byte, []int) {
+	return file_msgextract_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Message) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Message) GetFields() map[string]string {
+	if x != nil {
+		return x.Fields
+	}
+	return nil
+}
+
+func (x *Message) GetHeaders() []*Header {
+	if x != nil {
+		return x.Headers
+	}
+	return nil
+}
+
+var File_msgextract_proto protoreflect.FileDescriptor
+
+const file_msgextract_proto_rawDesc = "" +
+	"\n" +
+	"\x10msgextract.proto\x12\n" +
+	"msgextract\"}\n" +
+	"\x0eExtractRequest\x12\x16\n" +
+	"\x06fields\x18\x01 \x03(\tR\x06fields\x12\x14\n" +
+	"\x05where\x18\x02 \x01(\tR\x05where\x12'\n" +
+	"\x0finclude_headers\x18\x03 \x01(\bR\x0eincludeHeaders\x12\x14\n" +
+	"\x05chunk\x18\x04 \x01(\fR\x05chunk\"2\n" +
+	"\x06Header\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value\"\xbf\x01\n" +
+	"\aMessage\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x127\n" +
+	"\x06fields\x18\x02 \x03(\v2\x1f.msgextract.Message.FieldsEntryR\x06fields\x12,\n" +
+	"\aheaders\x18\x03 \x03(\v2\x12.msgextract.HeaderR\aheaders\x1a9\n" +
+	"\vFieldsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x012K\n" +
+	"\tExtractor\x12>\n" +
+	"\aExtract\x12\x1a.msgextract.ExtractRequest\x1a\x13.msgextract.Message(\x010\x01BO\n" +
+	"\x1ecom.github.asgaines.msgextractP\x01Z+github.com/asgaines/msgextract/msgextractpbb\x06proto3"
+
+var (
+	file_msgextract_proto_rawDescOnce sync.Once
+	file_msgextract_proto_rawDescData []byte
+)
+
+func file_msgextract_proto_rawDescGZIP() []byte {
+	file_msgextract_proto_rawDescOnce.Do(func() {
+		file_msgextract_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_msgextract_proto_rawDesc), len(file_msgextract_proto_rawDesc)))
+	})
+	return file_msgextract_proto_rawDescData
+}
+
+var file_msgextract_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_msgextract_proto_goTypes = []any{
+	(*ExtractRequest)(nil), // 0: msgextract.ExtractRequest
+	(*Header)(nil),         // 1: msgextract.Header
+	(*Message)(nil),        // 2: msgextract.Message
+	nil,                    // 3: msgextract.Message.FieldsEntry
+}
+var file_msgextract_proto_depIdxs = []int32{
+	3, // 0: msgextract.Message.fields:type_name -> msgextract.Message.FieldsEntry
+	1, // 1: msgextract.Message.headers:type_name -> msgextract.Header
+	0, // 2: msgextract.Extractor.Extract:input_type -> msgextract.ExtractRequest
+	2, // 3: msgextract.Extractor.Extract:output_type -> msgextract.Message
+	3, // [3:4] is the sub-list for method output_type
+	2, // [2:3] is the sub-list for method input_type
+	2, // [2:2] is the sub-list for extension type_name
+	2, // [2:2] is the sub-list for extension extendee
+	0, // [0:2] is the sub-list for field type_name
+}
+
+func init() { file_msgextract_proto_init() }
+func file_msgextract_proto_init() {
+	if File_msgextract_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_msgextract_proto_rawDesc), len(file_msgextract_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   4,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_msgextract_proto_goTypes,
+		DependencyIndexes: file_msgextract_proto_depIdxs,
+		MessageInfos:      file_msgextract_proto_msgTypes,
+	}.Build()
+	File_msgextract_proto = out.File
+	file_msgextract_proto_goTypes = nil
+	file_msgextract_proto_depIdxs = nil
+}
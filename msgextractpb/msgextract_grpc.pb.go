@@ -0,0 +1,132 @@
+// gRPC interface of msgextract serve, answered on the same address as the
+// HTTP API over HTTP/2 (cleartext, h2c)
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.6.1
+// - protoc             (unknown)
+// source: msgextract.proto
+
+package msgextractpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Extractor_Extract_FullMethodName = "/msgextract.Extractor/Extract"
+)
+
+// ExtractorClient is the client API for Extractor service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Extractor reads the header fields of the messages in an archive
+type ExtractorClient interface {
+	// Extract reads an archive, gzipped or not, sent in chunks and streams
+	// back each message as soon as its header is read. Failures end the
+	// stream with a status: INVALID_ARGUMENT for a malformed request or
+	// archive, RESOURCE_EXHAUSTED for an archive larger than the server
+	// accepts and UNAVAILABLE when the server is busy or shutting down
+	Extract(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[ExtractRequest, Message], error)
+}
+
+type extractorClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewExtractorClient(cc grpc.ClientConnInterface) ExtractorClient {
+	return &extractorClient{cc}
+}
+
+func (c *extractorClient) Extract(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[ExtractRequest, Message], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Extractor_ServiceDesc.Streams[0], Extractor_Extract_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ExtractRequest, Message]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Extractor_ExtractClient = grpc.BidiStreamingClient[ExtractRequest, Message]
+
+// ExtractorServer is the server API for Extractor service.
+// All implementations must embed UnimplementedExtractorServer
+// for forward compatibility.
+//
+// Extractor reads the header fields of the messages in an archive
+type ExtractorServer interface {
+	// Extract reads an archive, gzipped or not, sent in chunks and streams
+	// back each message as soon as its header is read. Failures end the
+	// stream with a status: INVALID_ARGUMENT for a malformed request or
+	// archive, RESOURCE_EXHAUSTED for an archive larger than the server
+	// accepts and UNAVAILABLE when the server is busy or shutting down
+	Extract(grpc.BidiStreamingServer[ExtractRequest, Message]) error
+	mustEmbedUnimplementedExtractorServer()
+}
+
+// UnimplementedExtractorServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedExtractorServer struct{}
+
+func (UnimplementedExtractorServer) Extract(grpc.BidiStreamingServer[ExtractRequest, Message]) error {
+	return status.Error(codes.Unimplemented, "method Extract not implemented")
+}
+func (UnimplementedExtractorServer) mustEmbedUnimplementedExtractorServer() {}
+func (UnimplementedExtractorServer) testEmbeddedByValue()                   {}
+
+// UnsafeExtractorServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ExtractorServer will
+// result in compilation errors.
+type UnsafeExtractorServer interface {
+	mustEmbedUnimplementedExtractorServer()
+}
+
+func RegisterExtractorServer(s grpc.ServiceRegistrar, srv ExtractorServer) {
+	// If the following call panics, it indicates UnimplementedExtractorServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Extractor_ServiceDesc, srv)
+}
+
+func _Extractor_Extract_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ExtractorServer).Extract(&grpc.GenericServerStream[ExtractRequest, Message]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Extractor_ExtractServer = grpc.BidiStreamingServer[ExtractRequest, Message]
+
+// Extractor_ServiceDesc is the grpc.ServiceDesc for Extractor service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Extractor_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "msgextract.Extractor",
+	HandlerType: (*ExtractorServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Extract",
+			Handler:       _Extractor_Extract_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "msgextract.proto",
+}
@@ -0,0 +1,78 @@
+package output
+
+import (
+	"os"
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+)
+
+// ArrowOptions tune the Arrow output. Zero values choose the defaults
+type ArrowOptions struct {
+	// Messages per record batch, 10000 by default
+	BatchSize int
+	// Write the IPC stream format, readable from a pipe, rather than the
+	// file format (Feather v2)
+	Stream bool
+}
+
+// ArrowWriter streams messages to an Arrow IPC file or stream, holding no
+// more than a record batch in memory. The archive entry and derived fields
+// are utf8, header fields are list<utf8> holding every occurrence, and dates
+// are timestamp[ms, tz=UTC]
+type ArrowWriter struct {
+	file *os.File
+	batches *arrowBatches
+	writer interface {
+		Write(record arrow.Record) error
+		Close() error
+	}
+}
+
+func NewArrowWriter(outputPath string, fields []string, options ArrowOptions) (*ArrowWriter, error) {
+	if options.BatchSize <= 0 {
+		options.BatchSize = 10000
+	}
+
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &ArrowWriter{file: file, batches: newArrowBatches(fields, options.BatchSize)}
+	if options.Stream {
+		w.writer = ipc.NewWriter(file, ipc.WithSchema(w.batches.schema))
+	} else {
+		w.writer, err = ipc.NewFileWriter(file, ipc.WithSchema(w.batches.schema))
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func (w *ArrowWriter) Write(message Message) error {
+	return w.write(w.batches.add(message))
+}
+
+// Close writes the last record batch and ends the stream, followed in the
+// file format by the footer indexing the record batches
+func (w *ArrowWriter) Close() error {
+	err := w.write(w.batches.flush())
+	if closeErr := w.writer.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	w.batches.release()
+	return err
+}
+
+func (w *ArrowWriter) write(record arrow.Record) error {
+	if record == nil {
+		return nil
+	}
+	defer record.Release()
+	return w.writer.Write(record)
+}
@@ -0,0 +1,102 @@
+package output
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"io/ioutil"
+	"strings"
+	"path/filepath"
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+)
+
+func TestArrowWriter(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("../test_files", "tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, stream := range []bool{false, true} {
+		path := filepath.Join(tmpDir, "output.arrow")
+
+		writer, err := NewArrowWriter(path, parquetFields, ArrowOptions{BatchSize: 2, Stream: stream})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := WriteAll(writer, parquetMessages); err != nil {
+			t.Fatal(err)
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+
+		var schema *arrow.Schema
+		var records []arrow.Record
+		if stream {
+			reader, err := ipc.NewReader(file)
+			if err != nil {
+				t.Fatalf("stream: %v", err)
+			}
+			schema = reader.Schema()
+			for reader.Next() {
+				record := reader.Record()
+				record.Retain()
+				records = append(records, record)
+			}
+			if err := reader.Err(); err != nil {
+				t.Errorf("stream: %v", err)
+			}
+			reader.Release()
+		} else {
+			reader, err := ipc.NewFileReader(file)
+			if err != nil {
+				t.Fatalf("file: %v", err)
+			}
+			schema = reader.Schema()
+			for i := 0; i < reader.NumRecords(); i++ {
+				record, err := reader.Record(i)
+				if err != nil {
+					t.Fatalf("file: %v", err)
+				}
+				record.Retain()
+				records = append(records, record)
+			}
+			reader.Close()
+		}
+
+		if schema.Field(0).Nullable {
+			t.Errorf("stream %v: nullable message", stream)
+		}
+		expectedSchema := "message: utf8, Date: timestamp[ms, tz=UTC], From: list<item: utf8, nullable>, Subject: list<item: utf8, nullable>, Received: list<item: utf8, nullable>, part_count: utf8"
+		var actualSchema []string
+		for _, field := range schema.Fields() {
+			actualSchema = append(actualSchema, field.Name + ": " + field.Type.String())
+		}
+		if strings.Join(actualSchema, ", ") != expectedSchema {
+			t.Errorf("stream %v: schema %v, expected %v", stream, strings.Join(actualSchema, ", "), expectedSchema)
+		}
+		if len(records) != 2 {
+			t.Errorf("stream %v: %d record batches, expected 2", stream, len(records))
+		}
+
+		var rows [][]interface{}
+		for _, record := range records {
+			for i := 0; i < int(record.NumRows()); i++ {
+				var row []interface{}
+				for _, column := range record.Columns() {
+					row = append(row, arrowValue(column, i))
+				}
+				rows = append(rows, row)
+			}
+			record.Release()
+		}
+		if !reflect.DeepEqual(rows, parquetRows) {
+			t.Errorf("stream %v: rows %#v, expected %#v", stream, rows, parquetRows)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package output
+
+import (
+	"os"
+	"fmt"
+	"regexp"
+	"encoding/json"
+	"github.com/hamba/avro/v2"
+	"github.com/hamba/avro/v2/ocf"
+)
+
+// AvroCodecs are the codecs of Avro object container files, by the name of
+// the compression
+var AvroCodecs = map[string]ocf.CodecName{
+	"none": ocf.Null,
+	"deflate": ocf.Deflate,
+	"snappy": ocf.Snappy,
+}
+
+// Characters other than those allowed in Avro names
+var avroNameInvalid = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// AvroOptions tune the Avro output. Zero values choose the defaults
+type AvroOptions struct {
+	// none, deflate or snappy (the default)
+	Compression string
+	// Messages per block, 10000 by default
+	BlockSize int
+}
+
+// AvroWriter streams messages to an Avro object container file, holding no
+// more than a block in memory. The schema is derived from the fields: the
+// archive entry is a string and derived fields nullable strings, header
+// fields nullable arrays holding every occurrence and dates nullable
+// timestamp-millis. Header names are made valid Avro names, "Message-Id"
+// becoming "Message_Id", the original name being kept as the field's doc
+type AvroWriter struct {
+	file *os.File
+	columns []column
+	encoder *ocf.Encoder
+}
+
+func NewAvroWriter(outputPath string, fields []string, options AvroOptions) (*AvroWriter, error) {
+	if options.Compression == "" {
+		options.Compression = "snappy"
+	}
+	codec, ok := AvroCodecs[options.Compression]
+	if !ok {
+		return nil, fmt.Errorf("unknown avro compression %q, expected none, deflate or snappy", options.Compression)
+	}
+	if options.BlockSize <= 0 {
+		options.BlockSize = 10000
+	}
+
+	w := &AvroWriter{columns: columnsFor(fields)}
+	schema, err := json.Marshal(w.schema())
+	if err != nil {
+		return nil, err
+	}
+
+	w.file, err = os.Create(outputPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// The schema differs with the fields, so it is not cached globally by
+	// its name, and is written whole, keeping the docs of the header names
+	w.encoder, err = ocf.NewEncoder(string(schema), w.file,
+		ocf.WithCodec(codec),
+		ocf.WithBlockLength(options.BlockSize),
+		ocf.WithEncoderSchemaCache(&avro.SchemaCache{}),
+		ocf.WithSchemaMarshaler(ocf.FullSchemaMarshaler))
+	if err != nil {
+		w.file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// schema of the records, as JSON
+func (w *AvroWriter) schema() map[string]interface{} {
+	var fields []map[string]interface{}
+
+	for _, c := range w.columns {
+		field := map[string]interface{}{"name": avroName(c.name)}
+		if avroName(c.name) != c.name {
+			field["doc"] = c.name
+		}
+
+		switch {
+		case c.required:
+			field["type"] = "string"
+		case c.kind == repeatedColumn:
+			field["type"] = []interface{}{"null", map[string]string{"type": "array", "items": "string"}}
+		case c.kind == timestampColumn:
+			field["type"] = []interface{}{"null", map[string]string{"type": "long", "logicalType": "timestamp-millis"}}
+		default:
+			field["type"] = []interface{}{"null", "string"}
+		}
+		if !c.required {
+			field["default"] = nil
+		}
+
+		fields = append(fields, field)
+	}
+
+	return map[string]interface{}{
+		"type": "record",
+		"name": "Message",
+		"namespace": "msgextract",
+		"fields": fields,
+	}
+}
+
+// avroName replaces the characters Avro names do not allow by underscores
+func avroName(name string) string {
+	name = avroNameInvalid.ReplaceAllString(name, "_")
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+func (w *AvroWriter) Write(message Message) error {
+	record := map[string]interface{}{}
+	for _, c := range w.columns {
+		var value interface{}
+		switch c.kind {
+		case stringColumn:
+			if v, ok := c.value(message); ok {
+				value = validUTF8(v)
+			}
+		case repeatedColumn:
+			if values := c.values(message); len(values) > 0 {
+				var valid []string
+				for _, v := range values {
+					valid = append(valid, validUTF8(v))
+				}
+				value = valid
+			}
+		case timestampColumn:
+			if date, ok := c.timestamp(message); ok {
+				value = date
+			}
+		}
+		record[avroName(c.name)] = value
+	}
+	return w.encoder.Encode(record)
+}
+
+// Close writes the last block, leaving the file to be closed here
+func (w *AvroWriter) Close() error {
+	err := w.encoder.Close()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
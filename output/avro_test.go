@@ -0,0 +1,157 @@
+package output
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"io/ioutil"
+	"path/filepath"
+	"encoding/json"
+	"time"
+	"github.com/hamba/avro/v2"
+	"github.com/hamba/avro/v2/ocf"
+)
+
+// Messages written to Avro in the tests, in blocks of two
+var avroMessages = append(append([]Message{}, sqliteMessages...), Message{
+	Headers: map[string]string{
+		"message": "msgs/raw.msg",
+		"part_count": "2",
+	},
+	HeaderLines: []string{
+		"Date: Mon, 4 Apr 2011 18:17:41 +0200",
+		"Message-Id: <raw@example.com>",
+		"Subject: Caf\xe9",
+	},
+})
+
+var avroFields = []string{"Date", "From", "Subject", "Message-Id", "message", "part_count"}
+
+// Records of avroMessages, fields in schema order, arrays as slices and
+// nulls as nil
+var avroRecords = [][]interface{}{
+	{
+		"msgs/darty.msg",
+		nil,
+		[]string{`"Darty" <infos@Contact-Darty.com>`},
+		[]string{"Cuit Vapeur 29.90 euros"},
+		nil,
+		nil,
+	},
+	{
+		"msgs/lunch.msg",
+		nil,
+		[]string{"hermione@example.com"},
+		[]string{"=?utf-8?q?Caf=C3=A9?= lunch"},
+		nil,
+		nil,
+	},
+	{
+		"msgs/raw.msg",
+		int64(1301933861000),
+		nil,
+		[]string{"Caf�"},
+		[]string{"<raw@example.com>"},
+		"2",
+	},
+}
+
+func TestAvroWriter(t *testing.T) {
+	expectedFields := []interface{}{
+		map[string]interface{}{"name": "message", "type": "string"},
+		map[string]interface{}{"name": "Date", "default": nil, "type": []interface{}{"null", map[string]interface{}{"type": "long", "logicalType": "timestamp-millis"}}},
+		map[string]interface{}{"name": "From", "default": nil, "type": []interface{}{"null", map[string]interface{}{"type": "array", "items": "string"}}},
+		map[string]interface{}{"name": "Subject", "default": nil, "type": []interface{}{"null", map[string]interface{}{"type": "array", "items": "string"}}},
+		map[string]interface{}{"name": "Message_Id", "doc": "Message-Id", "default": nil, "type": []interface{}{"null", map[string]interface{}{"type": "array", "items": "string"}}},
+		map[string]interface{}{"name": "part_count", "default": nil, "type": []interface{}{"null", "string"}},
+	}
+
+	tmpDir, err := ioutil.TempDir("../test_files", "tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for compression, codec := range AvroCodecs {
+		path := filepath.Join(tmpDir, compression + ".avro")
+
+		writer, err := NewAvroWriter(path, avroFields, AvroOptions{Compression: compression, BlockSize: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := WriteAll(writer, avroMessages); err != nil {
+			t.Fatal(err)
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+
+		decoder, err := ocf.NewDecoder(file)
+		if err != nil {
+			t.Fatalf("%v: %v", compression, err)
+		}
+		schema, ok := decoder.Schema().(*avro.RecordSchema)
+		if !ok {
+			t.Fatalf("%v: schema %v", compression, decoder.Schema())
+		}
+
+		if actualCodec := string(decoder.Metadata()["avro.codec"]); actualCodec != string(codec) {
+			t.Errorf("%v: codec %v, expected %v", compression, actualCodec, codec)
+		}
+		var schemaJSON map[string]interface{}
+		if err := json.Unmarshal(decoder.Metadata()["avro.schema"], &schemaJSON); err != nil {
+			t.Fatal(err)
+		}
+		if schemaJSON["name"] != "msgextract.Message" || !reflect.DeepEqual(schemaJSON["fields"], expectedFields) {
+			t.Errorf("%v: schema %v, expected fields %v", compression, schemaJSON, expectedFields)
+		}
+
+		var records [][]interface{}
+		for decoder.HasNext() {
+			var decoded map[string]interface{}
+			if err := decoder.Decode(&decoded); err != nil {
+				t.Fatalf("%v: %v", compression, err)
+			}
+
+			var record []interface{}
+			for _, field := range schema.Fields() {
+				record = append(record, avroValue(decoded[field.Name()]))
+			}
+			records = append(records, record)
+		}
+		if err := decoder.Error(); err != nil {
+			t.Errorf("%v: %v", compression, err)
+		}
+
+		if !reflect.DeepEqual(records, avroRecords) {
+			t.Errorf("%v: records %#v, expected %#v", compression, records, avroRecords)
+		}
+	}
+
+	if _, err := NewAvroWriter(filepath.Join(tmpDir, "gzip.avro"), avroFields, AvroOptions{Compression: "gzip"}); err == nil {
+		t.Error("gzip compression accepted")
+	}
+}
+
+// avroValue is a value decoded by hamba/avro in the shape of avroRecords.
+// Branches of unions other than null may come keyed by their type name
+func avroValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for _, branch := range value {
+			return avroValue(branch)
+		}
+	case time.Time:
+		return value.UnixMilli()
+	case []interface{}:
+		var strs []string
+		for _, item := range value {
+			strs = append(strs, item.(string))
+		}
+		return strs
+	}
+	return value
+}
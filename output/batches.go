@@ -0,0 +1,89 @@
+package output
+
+import (
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+)
+
+// arrowBatches builds the messages into record batches of the columns of
+// the fields, for the Arrow and Parquet outputs
+type arrowBatches struct {
+	columns []column
+	schema *arrow.Schema
+	builder *array.RecordBuilder
+	batchSize int
+	// Rows added to the current batch
+	rows int
+}
+
+func newArrowBatches(fields []string, batchSize int) *arrowBatches {
+	b := &arrowBatches{columns: columnsFor(fields), batchSize: batchSize}
+
+	var schemaFields []arrow.Field
+	for _, c := range b.columns {
+		field := arrow.Field{Name: c.name, Type: arrow.BinaryTypes.String, Nullable: !c.required}
+		switch c.kind {
+		case repeatedColumn:
+			field.Type = arrow.ListOf(arrow.BinaryTypes.String)
+		case timestampColumn:
+			field.Type = &arrow.TimestampType{Unit: arrow.Millisecond, TimeZone: "UTC"}
+		}
+		schemaFields = append(schemaFields, field)
+	}
+	b.schema = arrow.NewSchema(schemaFields, nil)
+	b.builder = array.NewRecordBuilder(memory.DefaultAllocator, b.schema)
+	return b
+}
+
+// add appends the message to the current batch, returning the batch once
+// it is full
+func (b *arrowBatches) add(message Message) arrow.Record {
+	for i, c := range b.columns {
+		switch builder := b.builder.Field(i).(type) {
+		case *array.StringBuilder:
+			if value, ok := c.value(message); ok {
+				builder.Append(validUTF8(value))
+			} else {
+				builder.AppendNull()
+			}
+		case *array.ListBuilder:
+			// Messages lacking the header have a null list, not an empty one
+			values := c.values(message)
+			if len(values) == 0 {
+				builder.AppendNull()
+				continue
+			}
+			builder.Append(true)
+			items := builder.ValueBuilder().(*array.StringBuilder)
+			for _, value := range values {
+				items.Append(validUTF8(value))
+			}
+		case *array.TimestampBuilder:
+			if date, ok := c.timestamp(message); ok {
+				builder.Append(arrow.Timestamp(date.UnixNano() / 1e6))
+			} else {
+				builder.AppendNull()
+			}
+		}
+	}
+
+	b.rows++
+	if b.rows == b.batchSize {
+		return b.flush()
+	}
+	return nil
+}
+
+// flush returns the rows added since the last batch, nil if there are none
+func (b *arrowBatches) flush() arrow.Record {
+	if b.rows == 0 {
+		return nil
+	}
+	b.rows = 0
+	return b.builder.NewRecord()
+}
+
+func (b *arrowBatches) release() {
+	b.builder.Release()
+}
@@ -0,0 +1,116 @@
+package output
+
+import (
+	"time"
+	"strings"
+	"net/mail"
+	"net/textproto"
+	"github.com/asgaines/msgextract/parse"
+)
+
+// MessageWriter writes messages one at a time, so that formats laid out in
+// batches need not hold the whole archive in memory
+type MessageWriter interface {
+	Write(message Message) error
+	// Close flushes the last batch and completes the file
+	Close() error
+}
+
+// Checkpointer is a MessageWriter whose output can be resumed. Checkpoint
+// writes out every message given so far and returns the size of the
+// output, which a later run can append after, discarding what followed
+type Checkpointer interface {
+	MessageWriter
+	Checkpoint() (int64, error)
+}
+
+type columnKind int
+
+const (
+	// Single value of a derived field, e.g. part_count
+	stringColumn columnKind = iota
+	// Every occurrence of a header field, e.g. Received
+	repeatedColumn
+	// Header field holding a date, normalized to UTC
+	timestampColumn
+)
+
+// column of the typed, columnar formats
+type column struct {
+	name string
+	kind columnKind
+	// Set for the archive entry, which every message has
+	required bool
+}
+
+// columnsFor lays out the columns of the typed formats: the archive entry
+// first, then a column per field. Header fields, named in their canonical
+// form (e.g. "Message-Id"), hold every occurrence of the header, dates
+// being normalized to timestamps. Derived fields, named in lower case
+// (e.g. "part_count"), hold their single value
+func columnsFor(fields []string) []column {
+	columns := []column{{name: "message", kind: stringColumn, required: true}}
+
+	for _, field := range fields {
+		switch {
+		case field == "message":
+			continue
+		case !isHeaderField(field):
+			columns = append(columns, column{name: field, kind: stringColumn})
+		case strings.HasSuffix(field, "Date"):
+			// Date, Resent-Date, Delivery-Date and the like
+			columns = append(columns, column{name: field, kind: timestampColumn})
+		default:
+			columns = append(columns, column{name: field, kind: repeatedColumn})
+		}
+	}
+
+	return columns
+}
+
+func isHeaderField(field string) bool {
+	return field != "" && field[0] >= 'A' && field[0] <= 'Z'
+}
+
+// value of a string column, and whether it is set at all
+func (c column) value(message Message) (string, bool) {
+	value, ok := message.Headers[c.name]
+	return value, ok || c.required
+}
+
+// values of a repeated column, in the order they occur in the header
+func (c column) values(message Message) []string {
+	// Messages built from parsed headers alone only know the flattened value
+	if message.HeaderLines == nil {
+		if value := message.Headers[c.name]; value != "" {
+			return []string{value}
+		}
+		return nil
+	}
+
+	var values []string
+	name := textproto.CanonicalMIMEHeaderKey(c.name)
+	for _, field := range parse.HeaderFields(message.HeaderLines) {
+		if field.Name == name {
+			values = append(values, field.Value)
+		}
+	}
+	return values
+}
+
+// timestamp of a date column, from the first occurrence of the header that
+// parses as an RFC 5322 date
+func (c column) timestamp(message Message) (time.Time, bool) {
+	for _, value := range c.values(message) {
+		if date, err := mail.ParseDate(value); err == nil {
+			return date.UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// validUTF8 replaces invalid bytes, e.g. raw 8-bit headers, as the typed
+// formats declare their strings UTF-8
+func validUTF8(value string) string {
+	return strings.ToValidUTF8(value, "�")
+}
@@ -0,0 +1,286 @@
+package output
+
+import (
+	"os"
+	"fmt"
+	"bufio"
+	"time"
+	"strings"
+	"testing"
+	"net/http"
+	"io/ioutil"
+	"path/filepath"
+	"encoding/json"
+	"net/http/httptest"
+	"github.com/asgaines/msgextract/dedupe"
+)
+
+var esMessages = []Message{
+	{
+		Headers: map[string]string{"message": "msgs/darty.msg", "From": "infos@contact-darty.com", "Subject": "Cuit Vapeur"},
+		HeaderLines: []string{"From: infos@contact-darty.com", "Subject: Cuit Vapeur"},
+	},
+	{
+		Headers: map[string]string{"message": "msgs/lunch.msg", "From": "hermione@example.com", "Subject": "Caf\xe9"},
+		HeaderLines: []string{"From: hermione@example.com", "Subject: Caf\xe9"},
+	},
+	{
+		Headers: map[string]string{"message": "msgs/copy.msg", "From": "hermione@example.com", "Subject": "Caf\xe9"},
+		HeaderLines: []string{"From: hermione@example.com", "Subject: Caf\xe9"},
+	},
+}
+
+// esLines reads NDJSON into its actions and documents
+func esLines(t *testing.T, content string) ([]map[string]map[string]string, []map[string]interface{}) {
+	var actions []map[string]map[string]string
+	var documents []map[string]interface{}
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for i := 0; scanner.Scan(); i++ {
+		var err error
+		if i % 2 == 0 {
+			var action map[string]map[string]string
+			err = json.Unmarshal(scanner.Bytes(), &action)
+			actions = append(actions, action)
+		} else {
+			var document map[string]interface{}
+			err = json.Unmarshal(scanner.Bytes(), &document)
+			documents = append(documents, document)
+		}
+		if err != nil {
+			t.Fatalf("line %d: %v", i + 1, err)
+		}
+	}
+	if len(actions) != len(documents) {
+		t.Fatalf("%d actions for %d documents", len(actions), len(documents))
+	}
+	return actions, documents
+}
+
+func TestESBulkWriter(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("../test_files", "tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var ids []string
+	for run := 0; run < 2; run++ {
+		path := filepath.Join(tmpDir, fmt.Sprintf("output%d.ndjson", run))
+		writer, err := NewESBulkWriter(path, []string{"From", "Subject"}, ESBulkOptions{Index: "mail-2011"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := WriteAll(writer, esMessages); err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actions, documents := esLines(t, string(content))
+		if len(actions) != len(esMessages) {
+			t.Fatalf("%d actions, expected %d", len(actions), len(esMessages))
+		}
+
+		for i, action := range actions {
+			if action["index"]["_index"] != "mail-2011" {
+				t.Errorf("action %d: %v", i, action)
+			}
+			if len(action["index"]["_id"]) != 64 {
+				t.Errorf("action %d: id %q", i, action["index"]["_id"])
+			}
+			if run == 0 {
+				ids = append(ids, action["index"]["_id"])
+			} else if action["index"]["_id"] != ids[i] {
+				t.Errorf("action %d: id %v changed from %v", i, action["index"]["_id"], ids[i])
+			}
+		}
+		if ids[1] == ids[2] {
+			t.Error("messages of different entries share an id")
+		}
+
+		expected := map[string]interface{}{"message": "msgs/lunch.msg", "From": "hermione@example.com", "Subject": "Caf�"}
+		if fmt.Sprint(documents[1]) != fmt.Sprint(expected) {
+			t.Errorf("document %v, expected %v", documents[1], expected)
+		}
+	}
+}
+
+func TestESBulkWriterPost(t *testing.T) {
+	type response struct {
+		status int
+		// Status of each document, for successful requests
+		items []int
+	}
+	cases := []struct {
+		name string
+		responses []response
+		// Documents posted by each request
+		posted []int
+		err string
+	}{
+		{
+			name: "accepted",
+			responses: []response{{200, []int{201, 201}}, {200, []int{201}}},
+			posted: []int{2, 1},
+		},
+		{
+			name: "cluster busy, then documents refused",
+			responses: []response{{429, nil}, {503, nil}, {200, []int{201, 429}}, {200, []int{200}}, {200, []int{201}}},
+			posted: []int{2, 2, 2, 1, 1},
+		},
+		{
+			name: "mapping conflict",
+			responses: []response{{200, []int{201, 400}}, {200, []int{201}}},
+			posted: []int{2, 1},
+		},
+		{
+			name: "bad request",
+			responses: []response{{400, nil}},
+			posted: []int{2},
+			err: "es-bulk: 400 Bad Request",
+		},
+		{
+			name: "still busy",
+			responses: []response{{429, nil}, {429, nil}, {429, nil}, {429, nil}},
+			posted: []int{2, 2, 2, 2},
+			err: "es-bulk: 2 documents not indexed after 4 attempts: 429 Too Many Requests",
+		},
+	}
+
+	tmpDir, err := ioutil.TempDir("../test_files", "tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, c := range cases {
+		var posted []int
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" || r.URL.Path != "/_bulk" || r.Header.Get("Content-Type") != "application/x-ndjson" {
+				t.Errorf("%v: %v %v %v", c.name, r.Method, r.URL.Path, r.Header.Get("Content-Type"))
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			actions, _ := esLines(t, string(body))
+			posted = append(posted, len(actions))
+
+			if len(posted) > len(c.responses) {
+				t.Errorf("%v: unexpected request %d", c.name, len(posted))
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			next := c.responses[len(posted) - 1]
+			if next.status != 200 {
+				w.WriteHeader(next.status)
+				return
+			}
+
+			var items []map[string]interface{}
+			for i, status := range next.items {
+				result := map[string]interface{}{"_id": actions[i]["index"]["_id"], "status": status}
+				if status == 400 {
+					result["error"] = map[string]string{"type": "mapper_parsing_exception", "reason": "failed to parse field [Date]"}
+				}
+				items = append(items, map[string]interface{}{"index": result})
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"errors": true, "items": items})
+		}))
+
+		writer, err := NewESBulkWriter(filepath.Join(tmpDir, "output.ndjson"), []string{"From"}, ESBulkOptions{
+			URL: server.URL + "/",
+			BatchSize: 2,
+			Retries: 3,
+			Backoff: time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, message := range esMessages {
+			if err = writer.Write(message); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = writer.Close()
+		}
+		server.Close()
+
+		if c.err == "" && err != nil || c.err != "" && (err == nil || !strings.HasPrefix(err.Error(), c.err)) {
+			t.Errorf("%v: error %v, expected %q", c.name, err, c.err)
+		}
+		if fmt.Sprint(posted) != fmt.Sprint(c.posted) {
+			t.Errorf("%v: posted %v, expected %v", c.name, posted, c.posted)
+		}
+	}
+}
+
+func TestESBulkWriterTimeout(t *testing.T) {
+	// Answering no request until the test is over
+	hang := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	}))
+	defer server.Close()
+	defer close(hang)
+
+	tmpDir, err := ioutil.TempDir("../test_files", "tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	writer, err := NewESBulkWriter(filepath.Join(tmpDir, "output.ndjson"), []string{"From"}, ESBulkOptions{
+		URL: server.URL,
+		Retries: 1,
+		Backoff: time.Millisecond,
+		Timeout: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteAll(writer, esMessages); err == nil || !strings.Contains(err.Error(), "not indexed after 2 attempts") || !strings.Contains(err.Error(), "Timeout") {
+		t.Errorf("error %v, expected the requests to time out", err)
+	}
+}
+
+func TestWriteDuplicateGroupsESBulk(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("../test_files", "tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var posted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		posted = append(posted, string(body))
+		var items []interface{}
+		for i := 0; i < strings.Count(string(body), "\n") / 2; i++ {
+			items = append(items, map[string]interface{}{"index": map[string]int{"status": 201}})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"errors": false, "items": items})
+	}))
+	defer server.Close()
+
+	outputPath := filepath.Join(tmpDir, "duplicates.es-bulk")
+	err = WriteDuplicateGroups(outputPath, []dedupe.Group{
+		{Key: "<a@x>", Messages: []string{"one.msg", "three.msg"}},
+	}, "es-bulk", ESBulkOptions{Index: "mail-duplicates", URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions, documents := esLines(t, string(content))
+	if len(actions) != 2 || actions[0]["index"]["_index"] != "mail-duplicates" || documents[1]["message"] != "three.msg" {
+		t.Errorf("Received %q", content)
+	}
+	if len(posted) != 1 || posted[0] != string(content) {
+		t.Errorf("Posted %q, wanted %q", posted, content)
+	}
+}
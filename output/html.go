@@ -0,0 +1,173 @@
+package output
+
+import (
+	"os"
+	"time"
+	"strings"
+	"net/mail"
+	"html/template"
+	"github.com/asgaines/msgextract/parse"
+)
+
+// htmlReport lays out the report: summary counts, then a table of the
+// fields which sorts on clicking a column and filters on typing. Everything
+// is inline, so the file can be mailed or opened from disk
+var htmlReport = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>msgextract report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+dl { display: flex; gap: 2em; }
+dt { font-size: smaller; color: #666; }
+dd { margin: 0; font-size: larger; }
+input { width: 30em; padding: 0.3em; margin-bottom: 1em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border: 1px solid #ddd; padding: 0.3em 0.5em; text-align: left; vertical-align: top; }
+th { background: #f4f4f4; cursor: pointer; position: sticky; top: 0; }
+th.asc::after { content: " \25B2"; }
+th.desc::after { content: " \25BC"; }
+tr:nth-child(even) td { background: #fafafa; }
+</style>
+</head>
+<body>
+<h1>msgextract report</h1>
+<dl>
+<div><dt>Messages</dt><dd>{{.Messages}}</dd></div>
+<div><dt>Senders</dt><dd>{{.Senders}}</dd></div>
+<div><dt>First date</dt><dd>{{.First}}</dd></div>
+<div><dt>Last date</dt><dd>{{.Last}}</dd></div>
+</dl>
+<input id="filter" type="search" placeholder="Filter messages"> <span id="shown"></span>
+<table id="messages">
+<thead><tr>{{range .Fields}}<th>{{.}}</th>{{end}}</tr></thead>
+<tbody>
+{{range .Rows}}<tr>{{range .}}<td{{if .Sort}} data-sort="{{.Sort}}"{{end}}{{if ne .Title .Text}} title="{{.Title}}"{{end}}>{{.Text}}</td>{{end}}</tr>
+{{end}}</tbody>
+</table>
+<script>
+(function() {
+	var table = document.getElementById("messages");
+	var body = table.tBodies[0];
+	var rows = Array.prototype.slice.call(body.rows);
+	var filter = document.getElementById("filter");
+	var shown = document.getElementById("shown");
+
+	function key(row, column) {
+		var cell = row.cells[column];
+		return cell.getAttribute("data-sort") || cell.textContent;
+	}
+
+	Array.prototype.forEach.call(table.tHead.rows[0].cells, function(th, column) {
+		th.addEventListener("click", function() {
+			var descending = th.className == "asc";
+			Array.prototype.forEach.call(th.parentNode.cells, function(other) { other.className = ""; });
+			th.className = descending ? "desc" : "asc";
+
+			rows.sort(function(a, b) {
+				var x = key(a, column), y = key(b, column);
+				var order = x !== "" && y !== "" && !isNaN(x) && !isNaN(y) ? x - y : x.localeCompare(y);
+				return descending ? -order : order;
+			});
+			rows.forEach(function(row) { body.appendChild(row); });
+		});
+	});
+
+	function update() {
+		var words = filter.value.toLowerCase().split(/\s+/).filter(Boolean);
+		var count = 0;
+		rows.forEach(function(row) {
+			var text = row.textContent.toLowerCase();
+			var match = words.every(function(word) { return text.indexOf(word) != -1; });
+			row.style.display = match ? "" : "none";
+			count += match;
+		});
+		shown.textContent = count + " of " + rows.length + " shown";
+	}
+	filter.addEventListener("input", update);
+	update();
+})();
+</script>
+</body>
+</html>
+`))
+
+type htmlCell struct {
+	// Value as shown, header values being decoded
+	Text string
+	// Value as found, shown on hovering when it differs
+	Title string
+	// Key sorting dates chronologically
+	Sort string
+}
+
+// WriteHTML writes a self-contained HTML report of the messages: the
+// number of messages and distinct senders, the range of dates, and a
+// sortable, filterable table of the fields
+func WriteHTML(outputPath string, messages []Message, fields []string) error {
+	writer, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+
+	senders := map[string]bool{}
+	var first, last time.Time
+	var rows [][]htmlCell
+
+	for _, message := range messages {
+		for _, address := range parse.Addresses(message.Headers["From"]) {
+			senders[strings.ToLower(address.Address)] = true
+		}
+		if date, err := mail.ParseDate(message.Headers["Date"]); err == nil {
+			if first.IsZero() || date.Before(first) {
+				first = date
+			}
+			if last.IsZero() || date.After(last) {
+				last = date
+			}
+		}
+
+		var row []htmlCell
+		for _, field := range fields {
+			value := message.Headers[field]
+			cell := htmlCell{Text: value, Title: value}
+			if isHeaderField(field) {
+				cell.Text = parse.DecodeHeader(value)
+			}
+			if date, err := mail.ParseDate(value); err == nil && strings.HasSuffix(field, "Date") {
+				cell.Sort = date.UTC().Format(time.RFC3339)
+			}
+			row = append(row, cell)
+		}
+		rows = append(rows, row)
+	}
+
+	report := struct {
+		Messages int
+		Senders int
+		First, Last string
+		Fields []string
+		Rows [][]htmlCell
+	}{
+		Messages: len(messages),
+		Senders: len(senders),
+		First: htmlDate(first),
+		Last: htmlDate(last),
+		Fields: fields,
+		Rows: rows,
+	}
+
+	err = htmlReport.Execute(writer, report)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func htmlDate(date time.Time) string {
+	if date.IsZero() {
+		return "-"
+	}
+	return date.UTC().Format("2006-01-02 15:04 MST")
+}
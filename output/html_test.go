@@ -0,0 +1,65 @@
+package output
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"io/ioutil"
+	"path/filepath"
+)
+
+func TestWriteHTML(t *testing.T) {
+	messages := []Message{
+		{Headers: map[string]string{
+			"Date": "Fri, 1 Apr 2011 16:17:41 +0200",
+			"From": `"Darty" <infos@Contact-Darty.com>`,
+			"Subject": "<script>alert(1)</script>",
+		}},
+		{Headers: map[string]string{
+			"Date": "Mon, 4 Apr 2011 09:00:00 -0400",
+			"From": "INFOS@contact-darty.com",
+			"Subject": "=?utf-8?q?Caf=C3=A9?= & co",
+		}},
+		{Headers: map[string]string{
+			"Date": "sometime",
+			"From": "hermione@example.com",
+		}},
+	}
+	fields := []string{"Date", "From", "Subject"}
+
+	tmpDir, err := ioutil.TempDir("../test_files", "tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "report.html")
+	if err := WriteHTML(path, messages, fields); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"<dt>Messages</dt><dd>3</dd>",
+		"<dt>Senders</dt><dd>2</dd>",
+		"<dt>First date</dt><dd>2011-04-01 14:17 UTC</dd>",
+		"<dt>Last date</dt><dd>2011-04-04 13:00 UTC</dd>",
+		"<th>Date</th><th>From</th><th>Subject</th>",
+		`<td data-sort="2011-04-01T14:17:41Z">Fri, 1 Apr 2011 16:17:41 &#43;0200</td>`,
+		"<td>&lt;script&gt;alert(1)&lt;/script&gt;</td>",
+		`<td title="=?utf-8?q?Caf=C3=A9?= &amp; co">Café &amp; co</td>`,
+		"<td>sometime</td>",
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(report), e) {
+			t.Errorf("report lacks %v", e)
+		}
+	}
+	if strings.Contains(string(report), "<script>alert") {
+		t.Error("header value not escaped")
+	}
+}
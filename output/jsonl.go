@@ -0,0 +1,102 @@
+package output
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"bufio"
+	"encoding/json"
+)
+
+// JSONLWriter streams messages as JSON Lines, an object per message holding
+// the same fields as the JSON output. It writes to any writer, leaving it
+// open on Close
+type JSONLWriter struct {
+	encoder *json.Encoder
+	fields []string
+}
+
+func NewJSONLWriter(writer io.Writer, fields []string) *JSONLWriter {
+	return &JSONLWriter{encoder: json.NewEncoder(writer), fields: fields}
+}
+
+func (w *JSONLWriter) Write(message Message) error {
+	return w.encoder.Encode(jsonRecord(message, w.fields))
+}
+
+func (w *JSONLWriter) Close() error {
+	return nil
+}
+
+// JSONLFileWriter writes JSON Lines to a file, which can be resumed after a
+// checkpoint
+type JSONLFileWriter struct {
+	*JSONLWriter
+	file *os.File
+	writer *bufio.Writer
+}
+
+// NewJSONLFileWriter creates the output or, when resumeAt is not 0, appends
+// to it after its first resumeAt bytes
+func NewJSONLFileWriter(outputPath string, fields []string, resumeAt int64) (*JSONLFileWriter, error) {
+	file, err := openResumed(outputPath, resumeAt)
+	if err != nil {
+		return nil, err
+	}
+
+	writer := bufio.NewWriter(file)
+	return &JSONLFileWriter{JSONLWriter: NewJSONLWriter(writer, fields), file: file, writer: writer}, nil
+}
+
+func (w *JSONLFileWriter) Checkpoint() (int64, error) {
+	return syncOutput(w.file, w.writer)
+}
+
+func (w *JSONLFileWriter) Close() error {
+	err := w.writer.Flush()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// openResumed opens the output for writing after its first resumeAt bytes,
+// creating it anew when resumeAt is 0
+func openResumed(outputPath string, resumeAt int64) (*os.File, error) {
+	if resumeAt == 0 {
+		return os.Create(outputPath)
+	}
+
+	file, err := os.OpenFile(outputPath, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err == nil && info.Size() < resumeAt {
+		err = fmt.Errorf("%v is shorter than the %v bytes to resume after", outputPath, resumeAt)
+	}
+	if err == nil {
+		// Whatever was written after the checkpoint is written again
+		err = file.Truncate(resumeAt)
+	}
+	if err == nil {
+		_, err = file.Seek(resumeAt, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// syncOutput writes out the buffer to the disk, returning the size of the
+// file
+func syncOutput(file *os.File, writer *bufio.Writer) (int64, error) {
+	if err := writer.Flush(); err != nil {
+		return 0, err
+	}
+	if err := file.Sync(); err != nil {
+		return 0, err
+	}
+	return file.Seek(0, io.SeekCurrent)
+}
@@ -0,0 +1,79 @@
+package output
+
+import (
+	"os"
+	"bytes"
+	"testing"
+	"io/ioutil"
+	"path/filepath"
+	"github.com/asgaines/msgextract/parse"
+)
+
+func TestJSONLWriter(t *testing.T) {
+	messages := []Message{
+		{
+			Headers: map[string]string{"message": "msgs/darty.msg", "Subject": "Cuit Vapeur"},
+			URLs: []parse.URL{{Message: "msgs/darty.msg", URL: "http://www.darty.com/", Domain: "www.darty.com"}},
+		},
+		{Headers: map[string]string{"message": "msgs/lunch.msg", "From": "hermione@example.com"}},
+	}
+
+	var buffer bytes.Buffer
+	if err := WriteAll(NewJSONLWriter(&buffer, []string{"From", "Subject"}), messages); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"From":"","Subject":"Cuit Vapeur","urls":[{"message":"msgs/darty.msg","url":"http://www.darty.com/","domain":"www.darty.com","wrapped":""}]}
+{"From":"hermione@example.com","Subject":""}
+`
+	if buffer.String() != expected {
+		t.Errorf("wrote %v, expected %v", buffer.String(), expected)
+	}
+}
+
+func TestJSONLFileWriterResume(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("../test_files", "tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "output.jsonl")
+
+	darty := Message{Headers: map[string]string{"message": "msgs/darty.msg"}}
+	lunch := Message{Headers: map[string]string{"message": "msgs/lunch.msg"}}
+
+	// A run stopped after its checkpoint
+	writer, err := NewJSONLFileWriter(path, []string{"message"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write(darty)
+	size, err := writer.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write(lunch)
+	writer.Close()
+
+	// The run resumed writes again what followed the checkpoint
+	writer, err = NewJSONLFileWriter(path, []string{"message"}, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteAll(writer, []Message{lunch}); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"message":"msgs/darty.msg"}` + "\n" + `{"message":"msgs/lunch.msg"}` + "\n"
+	if string(content) != expected || size != 29 {
+		t.Errorf("wrote %q with a checkpoint at %v, expected %q", content, size, expected)
+	}
+
+	if _, err := NewJSONLFileWriter(path, []string{"message"}, 1000); err == nil {
+		t.Errorf("resumed after the end of the output")
+	}
+}
@@ -8,6 +8,9 @@ import (
 	"path/filepath"
 	"io/ioutil"
 	"encoding/json"
+	"github.com/asgaines/msgextract/parse"
+	"github.com/asgaines/msgextract/thread"
+	"github.com/asgaines/msgextract/dedupe"
 )
 
 func TestWriteFieldsJSON(t *testing.T) {
@@ -90,7 +93,9 @@ func TestWriteFieldsJSON(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		WriteFields(outputPath, c.parsedHeaders, fields, "json")
+		if err := WriteFields(outputPath, c.parsedHeaders, fields, "json"); err != nil {
+			t.Fatal(err)
+		}
 
 		reader, err := ioutil.ReadFile(outputPath)
 		if err != nil {
@@ -175,7 +180,9 @@ func TestWriteFieldsTSV(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		WriteFields(outputPath, c.parsedHeaders, fields, "tsv")
+		if err := WriteFields(outputPath, c.parsedHeaders, fields, "tsv"); err != nil {
+			t.Fatal(err)
+		}
 
 		reader, err := os.Open(outputPath)
 		if err != nil {
@@ -195,3 +202,244 @@ func TestWriteFieldsTSV(t *testing.T) {
 	}
 }
 
+
+func TestWriteMessagesAttachments(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("../test_files", "tmp")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	fields := []string{"message", "Subject"}
+
+	attachment := parse.Attachment{
+		Message: "lunch.msg",
+		Filename: "menu.pdf",
+		DeclaredType: "application/octet-stream",
+		SniffedType: "application/pdf",
+		Size: 54,
+		MD5: "c187743d96b1fc5915cfc1e6a6b5a306",
+		SHA256: "3a321354e9231a5c8b78f4961c5f12fcbc9c11dc1c519be13cdc4e6b63153f1d",
+		Path: "attachments/3a321354e9231a5c8b78f4961c5f12fcbc9c11dc1c519be13cdc4e6b63153f1d.pdf",
+	}
+
+	messages := []Message{
+		{
+			Headers: map[string]string{"message": "lunch.msg", "Subject": "Friday lunch"},
+			Attachments: []parse.Attachment{attachment},
+		},
+		{
+			Headers: map[string]string{"message": "plain.msg", "Subject": "No attachments"},
+			Attachments: []parse.Attachment{},
+		},
+	}
+
+	jsonPath := filepath.Join(tmpDir, "output.json")
+	if err := WriteMessages(jsonPath, messages, fields, "json"); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := ioutil.ReadFile(jsonPath)
+	if err != nil {
+		t.Error(err)
+	}
+
+	var results []struct {
+		Message string
+		Subject string
+		Attachments []parse.Attachment
+	}
+	json.Unmarshal(reader, &results)
+
+	if len(results) != 2 {
+		t.Fatalf("Received %v messages, wanted 2", len(results))
+	}
+	if !reflect.DeepEqual(results[0].Attachments, []parse.Attachment{attachment}) {
+		t.Errorf("Received %v, wanted %v", results[0].Attachments, attachment)
+	}
+	if results[1].Attachments == nil || len(results[1].Attachments) != 0 {
+		t.Errorf("Received %v, wanted empty attachments array", results[1].Attachments)
+	}
+
+	if err := WriteMessages(filepath.Join(tmpDir, "output.tsv"), messages, fields, "tsv"); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err = ioutil.ReadFile(filepath.Join(tmpDir, "attachments.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "message\tfilename\tdeclared_type\tsniffed_type\tsize\tmd5\tsha256\tpath\n" +
+		"lunch.msg\tmenu.pdf\tapplication/octet-stream\tapplication/pdf\t54\t" +
+		"c187743d96b1fc5915cfc1e6a6b5a306\t" +
+		"3a321354e9231a5c8b78f4961c5f12fcbc9c11dc1c519be13cdc4e6b63153f1d\t" +
+		"attachments/3a321354e9231a5c8b78f4961c5f12fcbc9c11dc1c519be13cdc4e6b63153f1d.pdf\n"
+
+	if string(reader) != want {
+		t.Errorf("Received %q, wanted %q", reader, want)
+	}
+}
+
+func TestWriteMessagesURLs(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("../test_files", "tmp")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	fields := []string{"message", "Subject"}
+
+	messages := []Message{
+		{
+			Headers: map[string]string{"message": "lunch.msg", "Subject": "Friday lunch"},
+			URLs: []parse.URL{
+				{Message: "lunch.msg", URL: "http://example.com/menu", Domain: "example.com"},
+				{
+					Message: "lunch.msg",
+					URL: "https://example.com/order",
+					Domain: "example.com",
+					Wrapped: "https://eur01.safelinks.protection.outlook.com/?url=https%3A%2F%2Fexample.com%2Forder",
+				},
+			},
+		},
+		{
+			Headers: map[string]string{"message": "plain.msg", "Subject": "No links"},
+			URLs: []parse.URL{},
+		},
+	}
+
+	jsonPath := filepath.Join(tmpDir, "output.json")
+	if err := WriteMessages(jsonPath, messages, fields, "json"); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := ioutil.ReadFile(jsonPath)
+	if err != nil {
+		t.Error(err)
+	}
+
+	var results []struct {
+		URLs []parse.URL
+	}
+	json.Unmarshal(reader, &results)
+
+	if len(results) != 2 || !reflect.DeepEqual(results[0].URLs, messages[0].URLs) {
+		t.Errorf("Received %v, wanted %v", results, messages)
+	}
+
+	if err := WriteMessages(filepath.Join(tmpDir, "output.tsv"), messages, fields, "tsv"); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err = ioutil.ReadFile(filepath.Join(tmpDir, "urls.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "message\turl\tdomain\twrapped\n" +
+		"lunch.msg\thttp://example.com/menu\texample.com\t\n" +
+		"lunch.msg\thttps://example.com/order\texample.com\t" +
+		"https://eur01.safelinks.protection.outlook.com/?url=https%3A%2F%2Fexample.com%2Forder\n"
+
+	if string(reader) != want {
+		t.Errorf("Received %q, wanted %q", reader, want)
+	}
+}
+
+func TestWriteFieldsTSVWithoutAttachments(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("../test_files", "tmp")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err := WriteFields(filepath.Join(tmpDir, "output.tsv"), []map[string]string{{"Subject": "Hi"}}, []string{"Subject"}, "tsv"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(tmpDir, "attachments.tsv")); !os.IsNotExist(err) {
+		t.Error("attachments.tsv written although attachments were not inventoried")
+	}
+
+	if _, err := os.Stat(filepath.Join(tmpDir, "urls.tsv")); !os.IsNotExist(err) {
+		t.Error("urls.tsv written although links were not extracted")
+	}
+}
+
+func TestWriteThreadTree(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("../test_files", "tmp")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	outputPath := filepath.Join(tmpDir, "threads.json")
+
+	records := []map[string]string{
+		{"Message-ID": "<a@x>", "Subject": "Lunch"},
+		{"Message-ID": "<b@x>", "Subject": "Re: Lunch", "In-Reply-To": "<a@x>"},
+		{"Message-ID": "<c@x>", "Subject": "Dinner"},
+	}
+
+	if err := WriteThreadTree(outputPath, thread.Thread(records)); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := ioutil.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var results []struct {
+		MessageID string `json:"message_id"`
+		Children []struct {
+			MessageID string `json:"message_id"`
+		}
+	}
+	json.Unmarshal(reader, &results)
+
+	if len(results) != 2 || len(results[0].Children) != 1 || results[0].Children[0].MessageID != "<b@x>" || results[1].MessageID != "<c@x>" {
+		t.Errorf("Received %s", reader)
+	}
+}
+
+func TestWriteDuplicateGroups(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("../test_files", "tmp")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	groups := []dedupe.Group{
+		{Key: "<a@x>", Messages: []string{"one.msg", "three.msg"}},
+		{Key: "<b@x>", Messages: []string{"two.msg", "four.msg"}},
+	}
+
+	if err := WriteDuplicateGroups(filepath.Join(tmpDir, "duplicates.json"), groups, "json", ESBulkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := ioutil.ReadFile(filepath.Join(tmpDir, "duplicates.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var results []dedupe.Group
+	json.Unmarshal(reader, &results)
+
+	if !reflect.DeepEqual(results, groups) {
+		t.Errorf("Received %v, wanted %v", results, groups)
+	}
+
+	if err := WriteDuplicateGroups(filepath.Join(tmpDir, "duplicates.tsv"), groups, "tsv", ESBulkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err = ioutil.ReadFile(filepath.Join(tmpDir, "duplicates.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "key\tmessage\n<a@x>\tone.msg\n<a@x>\tthree.msg\n<b@x>\ttwo.msg\n<b@x>\tfour.msg\n"
+	if string(reader) != want {
+		t.Errorf("Received %q, wanted %q", reader, want)
+	}
+}
@@ -0,0 +1,87 @@
+package output
+
+import (
+	"os"
+	"fmt"
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/parquet"
+	"github.com/apache/arrow-go/v18/parquet/pqarrow"
+	"github.com/apache/arrow-go/v18/parquet/compress"
+)
+
+// ParquetCodecs are the compression codecs of Parquet, by name
+var ParquetCodecs = map[string]compress.Compression{
+	"none": compress.Codecs.Uncompressed,
+	"snappy": compress.Codecs.Snappy,
+	"gzip": compress.Codecs.Gzip,
+}
+
+// ParquetOptions tune the Parquet output. Zero values choose the defaults
+type ParquetOptions struct {
+	// none, snappy (the default) or gzip
+	Compression string
+	// Messages per row group, 10000 by default
+	RowGroupSize int
+}
+
+// ParquetWriter streams messages to a Parquet file, holding no more than a
+// row group in memory. The schema is that of the Arrow output, stored in the
+// file so that Arrow readers get it back: the archive entry and derived
+// fields are UTF-8 strings, header fields are lists of strings holding every
+// occurrence, and dates are timestamps in milliseconds since the epoch, UTC
+type ParquetWriter struct {
+	batches *arrowBatches
+	writer *pqarrow.FileWriter
+}
+
+func NewParquetWriter(outputPath string, fields []string, options ParquetOptions) (*ParquetWriter, error) {
+	if options.Compression == "" {
+		options.Compression = "snappy"
+	}
+	codec, ok := ParquetCodecs[options.Compression]
+	if !ok {
+		return nil, fmt.Errorf("unknown parquet compression %q, expected none, snappy or gzip", options.Compression)
+	}
+	if options.RowGroupSize <= 0 {
+		options.RowGroupSize = 10000
+	}
+
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return nil, err
+	}
+
+	batches := newArrowBatches(fields, options.RowGroupSize)
+	// Each batch written makes a row group
+	writer, err := pqarrow.NewFileWriter(batches.schema, file,
+		parquet.NewWriterProperties(parquet.WithCompression(codec), parquet.WithMaxRowGroupLength(int64(options.RowGroupSize))),
+		pqarrow.NewArrowWriterProperties(pqarrow.WithStoreSchema()))
+	if err != nil {
+		file.Close()
+		batches.release()
+		return nil, err
+	}
+	return &ParquetWriter{batches: batches, writer: writer}, nil
+}
+
+func (w *ParquetWriter) Write(message Message) error {
+	return w.write(w.batches.add(message))
+}
+
+// Close writes the last row group and the footer, closing the file
+func (w *ParquetWriter) Close() error {
+	err := w.write(w.batches.flush())
+	if closeErr := w.writer.Close(); err == nil {
+		err = closeErr
+	}
+	w.batches.release()
+	return err
+}
+
+func (w *ParquetWriter) write(record arrow.Record) error {
+	if record == nil {
+		return nil
+	}
+	defer record.Release()
+	return w.writer.Write(record)
+}
@@ -0,0 +1,173 @@
+package output
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"io/ioutil"
+	"path/filepath"
+	"context"
+	"strings"
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/apache/arrow-go/v18/parquet/file"
+	"github.com/apache/arrow-go/v18/parquet/pqarrow"
+)
+
+// Messages written to Parquet in the tests, in row groups of two
+var parquetMessages = append(append([]Message{}, sqliteMessages...), Message{
+	Headers: map[string]string{
+		"message": "msgs/raw.msg",
+		"part_count": "2",
+	},
+	HeaderLines: []string{
+		"Date: Mon, 4 Apr 2011 18:17:41 +0200",
+		"Received: from e",
+		"Subject: Caf\xe9",
+	},
+})
+
+var parquetFields = []string{"Date", "From", "Subject", "Received", "message", "part_count"}
+
+// Rows of parquetMessages, in Parquet or Arrow: the columns in schema order,
+// repeated ones as slices and missing values as nil
+var parquetRows = [][]interface{}{
+	{
+		"msgs/darty.msg",
+		nil,
+		[]string{`"Darty" <infos@Contact-Darty.com>`},
+		[]string{"Cuit Vapeur 29.90 euros"},
+		[]string{"from a by b", "from c by d"},
+		nil,
+	},
+	{
+		"msgs/lunch.msg",
+		nil,
+		[]string{"hermione@example.com"},
+		[]string{"=?utf-8?q?Caf=C3=A9?= lunch"},
+		nil,
+		nil,
+	},
+	{
+		"msgs/raw.msg",
+		int64(1301933861000),
+		nil,
+		[]string{"Caf�"},
+		[]string{"from e"},
+		"2",
+	},
+}
+
+func TestParquetWriterCompression(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("../test_files", "tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if _, err := NewParquetWriter(filepath.Join(tmpDir, "lz4.parquet"), nil, ParquetOptions{Compression: "lz4"}); err == nil {
+		t.Error("lz4 compression accepted")
+	}
+}
+
+func TestParquetWriter(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("../test_files", "tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, compression := range []string{"none", "snappy", "gzip"} {
+		path := filepath.Join(tmpDir, compression + ".parquet")
+
+		writer, err := NewParquetWriter(path, parquetFields, ParquetOptions{Compression: compression, RowGroupSize: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := WriteAll(writer, parquetMessages); err != nil {
+			t.Fatal(err)
+		}
+
+		reader, err := file.OpenParquetFile(path, false)
+		if err != nil {
+			t.Fatalf("%v: %v", compression, err)
+		}
+		defer reader.Close()
+		if reader.NumRowGroups() != 2 || reader.NumRows() != int64(len(parquetRows)) {
+			t.Errorf("%v: %v rows in %v row groups", compression, reader.NumRows(), reader.NumRowGroups())
+		}
+		chunk, err := reader.MetaData().RowGroup(0).ColumnChunk(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chunk.Compression() != ParquetCodecs[compression] {
+			t.Errorf("%v: compressed with %v", compression, chunk.Compression())
+		}
+
+		tableReader, err := pqarrow.NewFileReader(reader, pqarrow.ArrowReadProperties{}, memory.DefaultAllocator)
+		if err != nil {
+			t.Fatal(err)
+		}
+		table, err := tableReader.ReadTable(context.Background())
+		if err != nil {
+			t.Fatalf("%v: %v", compression, err)
+		}
+		defer table.Release()
+
+		if table.Schema().Field(0).Nullable {
+			t.Errorf("%v: nullable message", compression)
+		}
+		// Lists are laid out as the Parquet format specifies, with items named
+		// element
+		expectedSchema := "message: utf8, Date: timestamp[ms, tz=UTC], From: list<element: utf8, nullable>, Subject: list<element: utf8, nullable>, Received: list<element: utf8, nullable>, part_count: utf8"
+		var actualSchema []string
+		for _, field := range table.Schema().Fields() {
+			actualSchema = append(actualSchema, field.Name + ": " + field.Type.String())
+		}
+		if strings.Join(actualSchema, ", ") != expectedSchema {
+			t.Errorf("%v: schema %v, expected %v", compression, strings.Join(actualSchema, ", "), expectedSchema)
+		}
+
+		rows := make([][]interface{}, table.NumRows())
+		for i := range rows {
+			rows[i] = make([]interface{}, table.NumCols())
+		}
+		for col := 0; col < int(table.NumCols()); col++ {
+			row := 0
+			for _, chunk := range table.Column(col).Data().Chunks() {
+				for i := 0; i < chunk.Len(); i, row = i + 1, row + 1 {
+					rows[row][col] = arrowValue(chunk, i)
+				}
+			}
+		}
+		if !reflect.DeepEqual(rows, parquetRows) {
+			t.Errorf("%v: rows %#v, expected %#v", compression, rows, parquetRows)
+		}
+	}
+}
+
+// arrowValue is the value at i of an array read by Arrow, in the shape of
+// parquetRows
+func arrowValue(values arrow.Array, i int) interface{} {
+	if values.IsNull(i) {
+		return nil
+	}
+	switch values := values.(type) {
+	case *array.String:
+		return values.Value(i)
+	case *array.Timestamp:
+		return int64(values.Value(i))
+	case *array.List:
+		start, end := values.ValueOffsets(i)
+		if start == end {
+			return nil
+		}
+		var list []string
+		for j := start; j < end; j++ {
+			list = append(list, values.ListValues().(*array.String).Value(int(j)))
+		}
+		return list
+	}
+	return values.ValueStr(i)
+}
@@ -0,0 +1,280 @@
+package output
+
+import (
+	"os"
+	"fmt"
+	"strings"
+	"database/sql"
+	"github.com/asgaines/msgextract/parse"
+	"github.com/asgaines/msgextract/dedupe"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Header fields holding addresses, listed in the addresses table
+var addressFields = []string{"From", "Sender", "Reply-To", "To", "Cc", "Bcc"}
+
+// Tables of the normalized schema, referencing messages by their id
+const sqliteSchema = `
+CREATE TABLE headers (
+	message_id INTEGER NOT NULL REFERENCES messages(id),
+	position INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	value TEXT NOT NULL
+);
+CREATE INDEX headers_message ON headers(message_id);
+CREATE INDEX headers_name_value ON headers(name, value);
+
+CREATE TABLE addresses (
+	message_id INTEGER NOT NULL REFERENCES messages(id),
+	field TEXT NOT NULL,
+	position INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	address TEXT NOT NULL,
+	domain TEXT NOT NULL
+);
+CREATE INDEX addresses_message ON addresses(message_id);
+CREATE INDEX addresses_address ON addresses(address);
+CREATE INDEX addresses_domain ON addresses(domain);
+
+CREATE TABLE attachments (
+	message_id INTEGER NOT NULL REFERENCES messages(id),
+	filename TEXT NOT NULL,
+	declared_type TEXT NOT NULL,
+	sniffed_type TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	md5 TEXT NOT NULL,
+	sha256 TEXT NOT NULL,
+	path TEXT NOT NULL
+);
+CREATE INDEX attachments_message ON attachments(message_id);
+CREATE INDEX attachments_sha256 ON attachments(sha256);
+
+CREATE TABLE urls (
+	message_id INTEGER NOT NULL REFERENCES messages(id),
+	url TEXT NOT NULL,
+	domain TEXT NOT NULL,
+	wrapped TEXT NOT NULL
+);
+CREATE INDEX urls_message ON urls(message_id);
+CREATE INDEX urls_domain ON urls(domain);
+`
+
+// WriteSQLite writes the messages into an SQLite database, replacing any
+// file at outputPath. The messages table has a column per field; every
+// occurrence of every header, the addresses of the From, Sender, Reply-To,
+// To, Cc and Bcc headers, attachments and links go to tables of their own,
+// referencing messages.id. subjectIndex adds subject_fts, an FTS5 index of
+// the decoded subjects whose rowid is the message id
+func WriteSQLite(outputPath string, messages []Message, fields []string, subjectIndex bool) error {
+	// The archive entry always identifies the message
+	columns := []string{"message"}
+	for _, field := range fields {
+		if field != "message" {
+			columns = append(columns, field)
+		}
+	}
+
+	var definitions, placeholders []string
+	for _, column := range columns {
+		definitions = append(definitions, quoteIdentifier(column) + " TEXT")
+		placeholders = append(placeholders, "?")
+	}
+
+	statements := []string{
+		"CREATE TABLE messages (id INTEGER PRIMARY KEY, " + strings.Join(definitions, ", ") + ")",
+		"CREATE INDEX messages_message ON messages(message)",
+		sqliteSchema,
+	}
+	if subjectIndex {
+		statements = append(statements, "CREATE VIRTUAL TABLE subject_fts USING fts5(subject)")
+	}
+
+	return writeSQLite(outputPath, statements, func(tx *sql.Tx) error {
+		insertMessage, err := tx.Prepare("INSERT INTO messages (id, " + quoteIdentifiers(columns) + ") VALUES (?, " + strings.Join(placeholders, ", ") + ")")
+		if err != nil {
+			return err
+		}
+		insertHeader, err := tx.Prepare("INSERT INTO headers VALUES (?, ?, ?, ?)")
+		if err != nil {
+			return err
+		}
+		insertAddress, err := tx.Prepare("INSERT INTO addresses VALUES (?, ?, ?, ?, ?, ?)")
+		if err != nil {
+			return err
+		}
+		insertAttachment, err := tx.Prepare("INSERT INTO attachments VALUES (?, ?, ?, ?, ?, ?, ?, ?)")
+		if err != nil {
+			return err
+		}
+		insertURL, err := tx.Prepare("INSERT INTO urls VALUES (?, ?, ?, ?)")
+		if err != nil {
+			return err
+		}
+		var insertSubject *sql.Stmt
+		if subjectIndex {
+			if insertSubject, err = tx.Prepare("INSERT INTO subject_fts (rowid, subject) VALUES (?, ?)"); err != nil {
+				return err
+			}
+		}
+
+		for i, message := range messages {
+			id := i + 1
+
+			values := []interface{}{id}
+			for _, column := range columns {
+				values = append(values, message.Headers[column])
+			}
+			if _, err := insertMessage.Exec(values...); err != nil {
+				return err
+			}
+
+			headerFields := parse.HeaderFields(message.HeaderLines)
+			for position, field := range headerFields {
+				if _, err := insertHeader.Exec(id, position, field.Name, field.Value); err != nil {
+					return err
+				}
+			}
+
+			for _, name := range addressFields {
+				position := 0
+				for _, field := range headerFields {
+					if field.Name != name {
+						continue
+					}
+					for _, address := range parse.Addresses(field.Value) {
+						if _, err := insertAddress.Exec(id, name, position, address.Name, address.Address, domain(address.Address)); err != nil {
+							return err
+						}
+						position++
+					}
+				}
+			}
+
+			for _, attachment := range message.Attachments {
+				_, err := insertAttachment.Exec(id, attachment.Filename, attachment.DeclaredType, attachment.SniffedType,
+					attachment.Size, attachment.MD5, attachment.SHA256, attachment.Path)
+				if err != nil {
+					return err
+				}
+			}
+
+			for _, u := range message.URLs {
+				if _, err := insertURL.Exec(id, u.URL, u.Domain, u.Wrapped); err != nil {
+					return err
+				}
+			}
+
+			if insertSubject != nil {
+				var subject string
+				for _, field := range headerFields {
+					if field.Name == "Subject" {
+						subject = parse.DecodeHeader(field.Value)
+						break
+					}
+				}
+				if _, err := insertSubject.Exec(id, subject); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// CheckSubjectIndex tells whether SQLite can index subjects, as FTS5 is
+// only built in with the sqlite_fts5 tag, before anything is extracted
+func CheckSubjectIndex() error {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if _, err := db.Exec("CREATE VIRTUAL TABLE subject_fts USING fts5(subject)"); err != nil {
+		return ftsError(err)
+	}
+	return nil
+}
+
+// ftsError explains the errors of indexing without FTS5
+func ftsError(err error) error {
+	if strings.Contains(err.Error(), "fts5") {
+		return fmt.Errorf("%v: build with -tags sqlite_fts5 to index subjects", err)
+	}
+	return err
+}
+
+// writeDuplicatesSQLite stores the groups of duplicates, one row per message
+func writeDuplicatesSQLite(outputPath string, groups []dedupe.Group) error {
+	statements := []string{
+		"CREATE TABLE duplicates (key TEXT NOT NULL, message TEXT NOT NULL)",
+		"CREATE INDEX duplicates_key ON duplicates(key)",
+	}
+
+	return writeSQLite(outputPath, statements, func(tx *sql.Tx) error {
+		insert, err := tx.Prepare("INSERT INTO duplicates VALUES (?, ?)")
+		if err != nil {
+			return err
+		}
+		for _, group := range groups {
+			for _, message := range group.Messages {
+				if _, err := insert.Exec(group.Key, message); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// writeSQLite replaces any file at outputPath with a database created by
+// the statements, then filled by fill in the same transaction
+func writeSQLite(outputPath string, statements []string, fill func(*sql.Tx) error) error {
+	if err := os.Remove(outputPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	db, err := sql.Open("sqlite3", outputPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return ftsError(err)
+		}
+	}
+	if err := fill(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// quoteIdentifier quotes a column name, as fields such as "From" are SQL
+// keywords
+func quoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+func quoteIdentifiers(names []string) string {
+	var quoted []string
+	for _, name := range names {
+		quoted = append(quoted, quoteIdentifier(name))
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// domain of an address, lower-cased
+func domain(address string) string {
+	if at := strings.LastIndex(address, "@"); at != -1 {
+		return strings.ToLower(address[at + 1:])
+	}
+	return ""
+}
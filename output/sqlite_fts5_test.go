@@ -0,0 +1,37 @@
+//go:build sqlite_fts5
+// +build sqlite_fts5
+
+package output
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"io/ioutil"
+	"path/filepath"
+)
+
+func TestWriteSQLiteSubjectIndex(t *testing.T) {
+	if err := CheckSubjectIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpDir, err := ioutil.TempDir("../test_files", "tmp")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	outputPath := filepath.Join(tmpDir, "output.sqlite")
+
+	if err := WriteSQLite(outputPath, sqliteMessages, []string{"message", "Subject"}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// Subjects are indexed decoded
+	query := `SELECT m.message FROM subject_fts JOIN messages m ON m.id = subject_fts.rowid
+		WHERE subject_fts MATCH 'café'`
+	want := [][]string{{"msgs/lunch.msg"}}
+	if rows := querySQLite(t, outputPath, query); !reflect.DeepEqual(rows, want) {
+		t.Errorf("Received %q, wanted %q", rows, want)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !sqlite_fts5
+// +build !sqlite_fts5
+
+package output
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckSubjectIndex(t *testing.T) {
+	err := CheckSubjectIndex()
+	if err == nil || !strings.Contains(err.Error(), "-tags sqlite_fts5") {
+		t.Errorf("Received %v, wanted an error asking for the sqlite_fts5 tag", err)
+	}
+}
@@ -0,0 +1,168 @@
+package output
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"io/ioutil"
+	"path/filepath"
+	"database/sql"
+	"github.com/asgaines/msgextract/parse"
+	"github.com/asgaines/msgextract/dedupe"
+)
+
+var sqliteMessages = []Message{
+	{
+		Headers: map[string]string{
+			"message": "msgs/darty.msg",
+			"From": `"Darty" <infos@Contact-Darty.com>`,
+			"Subject": "Cuit Vapeur 29.90 euros",
+		},
+		HeaderLines: []string{
+			"Received: from a",
+			"\tby b",
+			"Received: from c by d",
+			`From: "Darty" <infos@Contact-Darty.com>`,
+			"To: ron@example.com, Harry Potter <harry@hogwarts.example>",
+			"Subject: Cuit Vapeur 29.90 euros",
+		},
+		Attachments: []parse.Attachment{
+			{Message: "msgs/darty.msg", Filename: "promo.pdf", DeclaredType: "application/pdf", Size: 54, SHA256: "3a32"},
+		},
+		URLs: []parse.URL{
+			{Message: "msgs/darty.msg", URL: "http://www.darty.com/promo", Domain: "www.darty.com"},
+		},
+	},
+	{
+		Headers: map[string]string{
+			"message": "msgs/lunch.msg",
+			"From": "hermione@example.com",
+			"Subject": "=?utf-8?q?Caf=C3=A9?= lunch",
+		},
+		HeaderLines: []string{
+			"From: hermione@example.com",
+			"Subject: =?utf-8?q?Caf=C3=A9?= lunch",
+		},
+	},
+}
+
+// querySQLite returns the rows of the query as strings
+func querySQLite(t *testing.T, path, query string) [][]string {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	columns, _ := rows.Columns()
+	var results [][]string
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			t.Fatal(err)
+		}
+
+		var row []string
+		for _, value := range values {
+			row = append(row, value.String)
+		}
+		results = append(results, row)
+	}
+	return results
+}
+
+func TestWriteSQLite(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("../test_files", "tmp")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	outputPath := filepath.Join(tmpDir, "output.sqlite")
+
+	// Left over from an earlier run, to be replaced
+	ioutil.WriteFile(outputPath, []byte("stale"), 0644)
+
+	if err := WriteMessages(outputPath, sqliteMessages, []string{"message", "From", "Subject"}, "sqlite"); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		query string
+		rows [][]string
+	}{
+		{
+			`SELECT id, message, "From", Subject FROM messages`,
+			[][]string{
+				{"1", "msgs/darty.msg", `"Darty" <infos@Contact-Darty.com>`, "Cuit Vapeur 29.90 euros"},
+				{"2", "msgs/lunch.msg", "hermione@example.com", "=?utf-8?q?Caf=C3=A9?= lunch"},
+			},
+		},
+		{
+			`SELECT position, value FROM headers WHERE message_id = 1 AND name = 'Received'`,
+			[][]string{{"0", "from a by b"}, {"1", "from c by d"}},
+		},
+		{
+			`SELECT m.message, a.field, a.position, a.name, a.address, a.domain
+			FROM addresses a JOIN messages m ON m.id = a.message_id ORDER BY a.message_id, a.field, a.position`,
+			[][]string{
+				{"msgs/darty.msg", "From", "0", "Darty", "infos@Contact-Darty.com", "contact-darty.com"},
+				{"msgs/darty.msg", "To", "0", "", "ron@example.com", "example.com"},
+				{"msgs/darty.msg", "To", "1", "Harry Potter", "harry@hogwarts.example", "hogwarts.example"},
+				{"msgs/lunch.msg", "From", "0", "", "hermione@example.com", "example.com"},
+			},
+		},
+		{
+			`SELECT m.message, a.filename, a.size FROM attachments a JOIN messages m ON m.id = a.message_id`,
+			[][]string{{"msgs/darty.msg", "promo.pdf", "54"}},
+		},
+		{
+			`SELECT message_id, url, domain, wrapped FROM urls`,
+			[][]string{{"1", "http://www.darty.com/promo", "www.darty.com", ""}},
+		},
+		{
+			`SELECT name FROM sqlite_master WHERE type = 'index' AND name LIKE 'addresses%' ORDER BY name`,
+			[][]string{{"addresses_address"}, {"addresses_domain"}, {"addresses_message"}},
+		},
+		{
+			`SELECT count(*) FROM sqlite_master WHERE name = 'subject_fts'`,
+			[][]string{{"0"}},
+		},
+	}
+
+	for _, c := range cases {
+		if rows := querySQLite(t, outputPath, c.query); !reflect.DeepEqual(rows, c.rows) {
+			t.Errorf("%v returned %q, wanted %q", c.query, rows, c.rows)
+		}
+	}
+}
+
+func TestWriteDuplicateGroupsSQLite(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("../test_files", "tmp")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	outputPath := filepath.Join(tmpDir, "duplicates.sqlite")
+
+	err = WriteDuplicateGroups(outputPath, []dedupe.Group{
+		{Key: "<a@x>", Messages: []string{"one.msg", "three.msg"}},
+	}, "sqlite", ESBulkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]string{{"<a@x>", "one.msg"}, {"<a@x>", "three.msg"}}
+	if rows := querySQLite(t, outputPath, "SELECT key, message FROM duplicates"); !reflect.DeepEqual(rows, want) {
+		t.Errorf("Received %q, wanted %q", rows, want)
+	}
+}
@@ -0,0 +1,169 @@
+package output
+
+import (
+	"os"
+	"bufio"
+	"bytes"
+	"strings"
+	"path/filepath"
+	"net/mail"
+	"net/textproto"
+	"text/template"
+	"encoding/json"
+	"github.com/asgaines/msgextract/parse"
+)
+
+// TemplateFuncs are the helper functions available to templates
+var TemplateFuncs = template.FuncMap{
+	"json": templateJSON,
+	"csvquote": func(value string) string {
+		return `"` + strings.Replace(value, `"`, `""`, -1) + `"`
+	},
+	"sqlquote": func(value string) string {
+		return "'" + strings.Replace(value, "'", "''", -1) + "'"
+	},
+	"date": templateDate,
+	"truncate": templateTruncate,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"decode": parse.DecodeHeader,
+}
+
+// Templates lay out the output: the header and footer once, if given, and
+// the message template for every message
+type Templates struct {
+	header *template.Template
+	message *template.Template
+	footer *template.Template
+}
+
+// TemplateMessage is what the message template is executed with
+type TemplateMessage struct {
+	// Position of the message in the output, from 0
+	Index int
+	// Output fields by name, and the archive entry as "message"
+	Fields map[string]string
+	// Every occurrence of every header field
+	Header textproto.MIMEHeader
+	Attachments []parse.Attachment
+	URLs []parse.URL
+}
+
+// TemplateSummary is what the header and footer templates are executed with
+type TemplateSummary struct {
+	// Names of the output fields
+	Fields []string
+	// Number of messages written, zero in the header
+	Count int
+}
+
+// ParseTemplates reads the templates from their files; headerPath and
+// footerPath may be empty
+func ParseTemplates(messagePath, headerPath, footerPath string) (*Templates, error) {
+	var templates Templates
+	var err error
+
+	read := func(path string) *template.Template {
+		if path == "" || err != nil {
+			return nil
+		}
+		// ParseFiles names the template after the base name of the file
+		var t *template.Template
+		t, err = template.New(filepath.Base(path)).Funcs(TemplateFuncs).Option("missingkey=zero").ParseFiles(path)
+		return t
+	}
+
+	templates.message = read(messagePath)
+	templates.header = read(headerPath)
+	templates.footer = read(footerPath)
+	if err != nil {
+		return nil, err
+	}
+	return &templates, nil
+}
+
+// TemplateWriter executes templates for the messages as they arrive
+type TemplateWriter struct {
+	file *os.File
+	writer *bufio.Writer
+	templates *Templates
+	fields []string
+	count int
+}
+
+func NewTemplateWriter(outputPath string, fields []string, templates *Templates) (*TemplateWriter, error) {
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &TemplateWriter{file: file, writer: bufio.NewWriter(file), templates: templates, fields: fields}
+	if templates.header != nil {
+		if err := templates.header.Execute(w.writer, TemplateSummary{Fields: fields}); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func (w *TemplateWriter) Write(message Message) error {
+	data := TemplateMessage{
+		Index: w.count,
+		Fields: map[string]string{"message": message.Headers["message"]},
+		Header: parse.MIMEHeaderFromLines(message.HeaderLines),
+		Attachments: message.Attachments,
+		URLs: message.URLs,
+	}
+	for _, field := range w.fields {
+		data.Fields[field] = message.Headers[field]
+	}
+
+	w.count++
+	return w.templates.message.Execute(w.writer, data)
+}
+
+func (w *TemplateWriter) Close() error {
+	var err error
+	if w.templates.footer != nil {
+		err = w.templates.footer.Execute(w.writer, TemplateSummary{Fields: w.fields, Count: w.count})
+	}
+	if flushErr := w.writer.Flush(); err == nil {
+		err = flushErr
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// templateJSON encodes a value as JSON, e.g. a quoted and escaped string
+func templateJSON(value interface{}) (string, error) {
+	var encoded bytes.Buffer
+	encoder := json.NewEncoder(&encoded)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(encoded.String(), "\n"), nil
+}
+
+// templateDate formats an RFC 5322 date with a Go layout, e.g.
+// {{date "2006-01-02" .Fields.Date}}, or returns nothing when it does not
+// parse
+func templateDate(layout, value string) string {
+	date, err := mail.ParseDate(value)
+	if err != nil {
+		return ""
+	}
+	return date.Format(layout)
+}
+
+// templateTruncate keeps the first n characters of a value
+func templateTruncate(n int, value string) string {
+	runes := []rune(value)
+	if len(runes) <= n {
+		return value
+	}
+	return string(runes[:n])
+}
@@ -0,0 +1,108 @@
+package output
+
+import (
+	"os"
+	"testing"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+func TestTemplateFuncs(t *testing.T) {
+	cases := []struct {
+		template string
+		expected string
+	}{
+		{`{{json .}}`, `"Café \"<b>\"\n"`},
+		{`{{csvquote .}}`, `"Café ""<b>""` + "\n" + `"`},
+		{`{{sqlquote "O'Brien"}}`, `'O''Brien'`},
+		{`{{date "2006-01-02 15:04 MST" "Fri, 1 Apr 2011 16:17:41 +0200"}}`, "2011-04-01 16:17 +0200"},
+		{`{{date "2006-01-02" "yesterday"}}`, ""},
+		{`{{truncate 4 .}}`, "Café"},
+		{`{{truncate 40 .}}`, "Café \"<b>\"\n"},
+		{`{{lower "Café"}} {{upper "Café"}}`, "café CAFÉ"},
+		{`{{decode "=?utf-8?q?Caf=C3=A9?= lunch"}}`, "Café lunch"},
+	}
+
+	for _, c := range cases {
+		tmpl, err := template.New("test").Funcs(TemplateFuncs).Parse(c.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var actual strings.Builder
+		if err := tmpl.Execute(&actual, "Café \"<b>\"\n"); err != nil {
+			t.Errorf("%v: %v", c.template, err)
+		}
+		if actual.String() != c.expected {
+			t.Errorf("%v = %q, expected %q", c.template, actual.String(), c.expected)
+		}
+	}
+}
+
+func TestTemplateWriter(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("../test_files", "tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	files := map[string]string{
+		"header.tmpl": "{{range .Fields}}{{.}};{{end}}\n",
+		"message.tmpl": "{{.Index}} {{.Fields.message}} {{.Fields.Subject}} {{.Fields.Unset}}" +
+			"{{range .Header.Received}} [{{.}}]{{end}}{{range .Attachments}} {{.Filename}}{{end}}\n",
+		"footer.tmpl": "{{.Count}} messages\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(tmpDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	templates, err := ParseTemplates(filepath.Join(tmpDir, "message.tmpl"),
+		filepath.Join(tmpDir, "header.tmpl"), filepath.Join(tmpDir, "footer.tmpl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(tmpDir, "output.txt")
+	writer, err := NewTemplateWriter(path, []string{"From", "Subject"}, templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteAll(writer, sqliteMessages); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "From;Subject;\n" +
+		"0 msgs/darty.msg Cuit Vapeur 29.90 euros  [from a by b] [from c by d] promo.pdf\n" +
+		"1 msgs/lunch.msg =?utf-8?q?Caf=C3=A9?= lunch \n" +
+		"2 messages\n"
+
+	actual, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(actual) != expected {
+		t.Errorf("output %q, expected %q", actual, expected)
+	}
+}
+
+func TestParseTemplatesError(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("../test_files", "tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "bad.tmpl")
+	ioutil.WriteFile(path, []byte("{{.Fields.Subject"), 0644)
+
+	if _, err := ParseTemplates(path, "", ""); err == nil {
+		t.Error("unclosed action accepted")
+	}
+	if _, err := ParseTemplates(filepath.Join(tmpDir, "missing.tmpl"), "", ""); err == nil {
+		t.Error("missing template accepted")
+	}
+}
@@ -1,48 +1,307 @@
 package output
 
 import (
+	"io"
 	"os"
-	"log"
+	"fmt"
+	"bufio"
+	"strconv"
 	"strings"
+	"path/filepath"
 	"encoding/json"
+	"github.com/asgaines/msgextract/parse"
+	"github.com/asgaines/msgextract/thread"
+	"github.com/asgaines/msgextract/dedupe"
 )
 
+// Message is everything gathered about a single MSG file
+type Message struct {
+	// Header and derived fields, keyed by field name
+	Headers map[string]string
+	// Raw header lines, for formats keeping every occurrence of a field
+	HeaderLines []string
+	// Attachments carried by the message. Nil unless attachments were
+	// inventoried, in which case messages without any hold an empty slice
+	Attachments []parse.Attachment
+	// Links found in the body, nil unless they were extracted
+	URLs []parse.URL
+}
+
 func WriteFields(outputPath string,
 		parsedHeaders []map[string]string,
 		fields []string,
-		format string) {
-	writer, err := os.Create(outputPath)
+		format string) error {
+	var messages []Message
+	for _, headers := range parsedHeaders {
+		messages = append(messages, Message{Headers: headers})
+	}
+
+	return WriteMessages(outputPath, messages, fields, format)
+}
+
+func WriteMessages(outputPath string,
+		messages []Message,
+		fields []string,
+		format string) error {
+	var writer MessageWriter
+	var err error
+	switch format {
+	case "sqlite":
+		return WriteSQLite(outputPath, messages, fields, false)
+	case "html":
+		return WriteHTML(outputPath, messages, fields)
+	case "json", "tsv":
+		return writeFile(outputPath, messages, fields, format)
+	case "parquet":
+		writer, err = NewParquetWriter(outputPath, fields, ParquetOptions{})
+	case "arrow", "arrows":
+		writer, err = NewArrowWriter(outputPath, fields, ArrowOptions{Stream: format == "arrows"})
+	case "avro":
+		writer, err = NewAvroWriter(outputPath, fields, AvroOptions{})
+	case "xml":
+		writer, err = NewXMLWriter(outputPath, fields)
+	case "xlsx":
+		writer, err = NewXLSXWriter(outputPath, fields)
+	case "es-bulk":
+		writer, err = NewESBulkWriter(outputPath, fields, ESBulkOptions{})
+	case "jsonl":
+		writer, err = NewJSONLFileWriter(outputPath, fields, 0)
+	default:
+		return fmt.Errorf("unknown format %v", format)
+	}
+	if err != nil {
+		return err
+	}
+	return WriteAll(writer, messages)
+}
+
+// writeFile writes json or tsv output, with the attachments and links of
+// tsv output in files of their own
+func writeFile(outputPath string, messages []Message, fields []string, format string) error {
+	file, err := os.Create(outputPath)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	defer writer.Close()
+	writer := bufio.NewWriter(file)
 
 	switch format {
 	case "json":
 		// Create new slice of maps to store required data
-		var allFieldHeaders []map[string]string
+		var allFieldHeaders []map[string]interface{}
 
-		for _, headers := range parsedHeaders {
-			fieldHeaders := make(map[string]string)
+		for _, message := range messages {
+			allFieldHeaders = append(allFieldHeaders, jsonRecord(message, fields))
+		}
+		err = json.NewEncoder(writer).Encode(allFieldHeaders)
+	case "tsv":
+		var rows [][]string
+		for _, message := range messages {
+			var content []string
 
 			for _, field := range fields {
-				fieldHeaders[field] = headers[field]
+				content = append(content, message.Headers[field])
 			}
-			allFieldHeaders = append(allFieldHeaders, fieldHeaders)
+			rows = append(rows, content)
 		}
-		json.NewEncoder(writer).Encode(allFieldHeaders)
-	case "tsv":
-		// Write description of fields on first line (table header)
-		writer.WriteString(strings.Join(fields, "\t") + "\n")
+		err = writeRows(writer, fields, rows)
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || format != "tsv" {
+		return err
+	}
 
-		for _, headers := range parsedHeaders {
-			var content []string
+	if hasAttachments(messages) {
+		if err := writeAttachmentsTSV(filepath.Join(filepath.Dir(outputPath), "attachments.tsv"), messages); err != nil {
+			return err
+		}
+	}
+	if hasURLs(messages) {
+		return writeURLsTSV(filepath.Join(filepath.Dir(outputPath), "urls.tsv"), messages)
+	}
+	return nil
+}
 
-			for _, field := range fields {
-				content = append(content, headers[field])
+// jsonRecord holds the fields of the message, with its attachments and
+// links when those were gathered
+func jsonRecord(message Message, fields []string) map[string]interface{} {
+	record := make(map[string]interface{})
+
+	for _, field := range fields {
+		record[field] = message.Headers[field]
+	}
+	if message.Attachments != nil {
+		record["attachments"] = message.Attachments
+	}
+	if message.URLs != nil {
+		record["urls"] = message.URLs
+	}
+	return record
+}
+
+// WriteAll writes the messages and closes the writer, even when writing
+// fails
+func WriteAll(writer MessageWriter, messages []Message) error {
+	var err error
+	for _, message := range messages {
+		if err = writer.Write(message); err != nil {
+			break
+		}
+	}
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// WriteThreadTree writes the threads as nested JSON objects, replies listed
+// under the message they answer
+func WriteThreadTree(outputPath string, roots []*thread.Container) error {
+	writer, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(roots)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// WriteDuplicateGroups reports the sets of messages found to be duplicates,
+// as an array of groups in JSON or one line or row per message in the other
+// formats. es-bulk reports go where esOptions say, as the output of the run
+// does
+func WriteDuplicateGroups(outputPath string, groups []dedupe.Group, format string, esOptions ESBulkOptions) error {
+	var messages []Message
+	for _, group := range groups {
+		for _, message := range group.Messages {
+			messages = append(messages, Message{Headers: map[string]string{"key": group.Key, "message": message}})
+		}
+	}
+
+	switch format {
+	case "sqlite":
+		return writeDuplicatesSQLite(outputPath, groups)
+	case "es-bulk":
+		writer, err := NewESBulkWriter(outputPath, []string{"key", "message"}, esOptions)
+		if err != nil {
+			return err
+		}
+		return WriteAll(writer, messages)
+	case "json":
+		writer, err := os.Create(outputPath)
+		if err != nil {
+			return err
+		}
+
+		err = json.NewEncoder(writer).Encode(groups)
+		if closeErr := writer.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	case "tsv":
+		var rows [][]string
+		for _, group := range groups {
+			for _, message := range group.Messages {
+				rows = append(rows, []string{group.Key, message})
 			}
-			writer.WriteString(strings.Join(content, "\t") + "\n")
 		}
+
+		return writeTSV(outputPath, []string{"key", "message"}, rows)
+	}
+	return WriteMessages(outputPath, messages, []string{"key", "message"}, format)
+}
+
+// hasAttachments reports whether attachments were inventoried at all
+func hasAttachments(messages []Message) bool {
+	for _, message := range messages {
+		if message.Attachments != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// hasURLs reports whether links were extracted at all
+func hasURLs(messages []Message) bool {
+	for _, message := range messages {
+		if message.URLs != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// writeAttachmentsTSV lists the attachments of all messages, one per line
+func writeAttachmentsTSV(outputPath string, messages []Message) error {
+	var rows [][]string
+
+	for _, message := range messages {
+		for _, attachment := range message.Attachments {
+			rows = append(rows, []string{
+				attachment.Message,
+				attachment.Filename,
+				attachment.DeclaredType,
+				attachment.SniffedType,
+				strconv.FormatInt(attachment.Size, 10),
+				attachment.MD5,
+				attachment.SHA256,
+				attachment.Path,
+			})
+		}
+	}
+
+	return writeTSV(outputPath, parse.AttachmentFields, rows)
+}
+
+// writeURLsTSV lists the links of all messages in long format, one per line
+func writeURLsTSV(outputPath string, messages []Message) error {
+	var rows [][]string
+
+	for _, message := range messages {
+		for _, u := range message.URLs {
+			rows = append(rows, []string{u.Message, u.URL, u.Domain, u.Wrapped})
+		}
+	}
+
+	return writeTSV(outputPath, parse.URLFields, rows)
+}
+
+func writeTSV(outputPath string, columns []string, rows [][]string) error {
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+
+	err = writeRows(writer, columns, rows)
+	if err == nil {
+		err = writer.Flush()
 	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
 
+// writeRows writes the description of the columns on the first line (table
+// header), then a line per row
+func writeRows(writer io.StringWriter, columns []string, rows [][]string) error {
+	if _, err := writer.WriteString(strings.Join(columns, "\t") + "\n"); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if _, err := writer.WriteString(strings.Join(row, "\t") + "\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
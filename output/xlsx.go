@@ -0,0 +1,266 @@
+package output
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"bufio"
+	"strconv"
+	"strings"
+	"archive/zip"
+)
+
+// Rows of a worksheet, the header included, beyond which Excel refuses to
+// open it
+var xlsxMaxRows = 1048576
+
+// Characters a cell holds at most
+const xlsxMaxCellLength = 32767
+
+// Styles of the cells, by their index in cellXfs
+const (
+	xlsxDateStyle = 1
+	xlsxHeaderStyle = 2
+)
+
+const xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+<Default Extension="xml" ContentType="application/xml"/>
+<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>
+<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>
+%s</Types>
+`
+
+const xlsxRootRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>
+</Relationships>
+`
+
+const xlsxWorkbook = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<sheets>
+%s</sheets>
+</workbook>
+`
+
+const xlsxWorkbookRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+%s<Relationship Id="rIdStyles" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>
+</Relationships>
+`
+
+// Default style, dates and the bold header row
+const xlsxStyles = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+<numFmts count="1"><numFmt numFmtId="164" formatCode="yyyy-mm-dd hh:mm:ss"/></numFmts>
+<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>
+<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>
+<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>
+<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>
+<cellXfs count="3">
+<xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>
+<xf numFmtId="164" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>
+<xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/>
+</cellXfs>
+</styleSheet>
+`
+
+// XLSXWriter streams messages to an Excel workbook, a row per message under
+// a frozen, filterable header row. Dates are date cells in UTC, whole
+// numbers number cells and the rest text, several occurrences of a header
+// being put on separate lines. Rows past the limit of Excel go to further
+// sheets, each with its own header row
+type XLSXWriter struct {
+	file *os.File
+	archive *zip.Writer
+	sheet *bufio.Writer
+	columns []column
+	sheets int
+	// Rows of the current sheet, the header included
+	rows int
+}
+
+func NewXLSXWriter(outputPath string, fields []string) (*XLSXWriter, error) {
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &XLSXWriter{file: file, archive: zip.NewWriter(file), columns: columnsFor(fields)}
+	if err := w.startSheet(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// startSheet begins the next worksheet with its column widths and header row
+func (w *XLSXWriter) startSheet() error {
+	w.sheets++
+	entry, err := w.archive.Create(fmt.Sprintf("xl/worksheets/sheet%d.xml", w.sheets))
+	if err != nil {
+		return err
+	}
+	w.sheet = bufio.NewWriter(entry)
+
+	w.sheet.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n" +
+		`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` + "\n" +
+		`<sheetViews><sheetView workbookViewId="0"><pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/></sheetView></sheetViews>` + "\n" +
+		"<cols>")
+	for i, c := range w.columns {
+		fmt.Fprintf(w.sheet, `<col min="%d" max="%d" width="%d" customWidth="1"/>`, i + 1, i + 1, c.xlsxWidth())
+	}
+	w.sheet.WriteString("</cols>\n<sheetData>\n")
+
+	w.rows = 1
+	w.sheet.WriteString(`<row r="1">`)
+	for i, c := range w.columns {
+		w.stringCell(i, c.name, xlsxHeaderStyle)
+	}
+	_, err = w.sheet.WriteString("</row>\n")
+	return err
+}
+
+// xlsxWidth is the width of the column, in characters, chosen before any
+// value is known as rows are streamed
+func (c column) xlsxWidth() int {
+	switch {
+	case c.kind == timestampColumn:
+		return 20
+	case c.name == "Subject" || c.required:
+		return 50
+	case isHeaderField(c.name):
+		return 35
+	case len(c.name) + 4 > 12:
+		return len(c.name) + 4
+	}
+	return 12
+}
+
+// endSheet closes the current worksheet, filtering on every column
+func (w *XLSXWriter) endSheet() error {
+	w.sheet.WriteString("</sheetData>\n")
+	fmt.Fprintf(w.sheet, `<autoFilter ref="A1:%s%d"/>`, xlsxColumn(len(w.columns) - 1), w.rows)
+	w.sheet.WriteString("\n</worksheet>\n")
+	return w.sheet.Flush()
+}
+
+func (w *XLSXWriter) Write(message Message) error {
+	if w.rows == xlsxMaxRows {
+		if err := w.endSheet(); err != nil {
+			return err
+		}
+		if err := w.startSheet(); err != nil {
+			return err
+		}
+	}
+	w.rows++
+
+	fmt.Fprintf(w.sheet, `<row r="%d">`, w.rows)
+	for i, c := range w.columns {
+		switch c.kind {
+		case timestampColumn:
+			if date, ok := c.timestamp(message); ok {
+				// Days since 1899-12-30, the epoch of Excel
+				serial := float64(date.Unix()) / 86400 + 25569
+				w.numberCell(i, strconv.FormatFloat(serial, 'f', -1, 64), xlsxDateStyle)
+			} else if values := c.values(message); len(values) > 0 {
+				w.stringCell(i, values[0], 0)
+			}
+		case repeatedColumn:
+			if values := c.values(message); len(values) > 0 {
+				w.stringCell(i, strings.Join(values, "\n"), 0)
+			}
+		default:
+			value, ok := c.value(message)
+			if !ok || value == "" {
+				continue
+			}
+			if n, err := strconv.ParseInt(value, 10, 64); err == nil && strconv.FormatInt(n, 10) == value {
+				w.numberCell(i, value, 0)
+			} else {
+				w.stringCell(i, value, 0)
+			}
+		}
+	}
+	_, err := w.sheet.WriteString("</row>\n")
+	return err
+}
+
+func (w *XLSXWriter) numberCell(column int, value string, style int) {
+	fmt.Fprintf(w.sheet, `<c r="%s%d"`, xlsxColumn(column), w.rows)
+	if style != 0 {
+		fmt.Fprintf(w.sheet, ` s="%d"`, style)
+	}
+	w.sheet.WriteString("><v>" + value + "</v></c>")
+}
+
+// stringCell writes text inline, sparing a shared strings table, cut at the
+// length a cell holds
+func (w *XLSXWriter) stringCell(column int, value string, style int) {
+	if runes := []rune(value); len(runes) > xlsxMaxCellLength {
+		value = string(runes[:xlsxMaxCellLength])
+	}
+
+	fmt.Fprintf(w.sheet, `<c r="%s%d" t="inlineStr"`, xlsxColumn(column), w.rows)
+	if style != 0 {
+		fmt.Fprintf(w.sheet, ` s="%d"`, style)
+	}
+	w.sheet.WriteString(`><is><t xml:space="preserve">` + xmlEscape(value) + "</t></is></c>")
+}
+
+// Close ends the last sheet and writes the parts describing the workbook
+func (w *XLSXWriter) Close() error {
+	err := w.endSheet()
+
+	var sheets, rels, types strings.Builder
+	for i := 1; i <= w.sheets; i++ {
+		name := "Messages"
+		if i > 1 {
+			name = fmt.Sprintf("Messages %d", i)
+		}
+		fmt.Fprintf(&sheets, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`+"\n", name, i, i)
+		fmt.Fprintf(&rels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`+"\n", i, i)
+		fmt.Fprintf(&types, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`+"\n", i)
+	}
+
+	parts := []struct {
+		name string
+		content string
+	}{
+		{"[Content_Types].xml", fmt.Sprintf(xlsxContentTypes, types.String())},
+		{"_rels/.rels", xlsxRootRels},
+		{"xl/workbook.xml", fmt.Sprintf(xlsxWorkbook, sheets.String())},
+		{"xl/_rels/workbook.xml.rels", fmt.Sprintf(xlsxWorkbookRels, rels.String())},
+		{"xl/styles.xml", xlsxStyles},
+	}
+	for _, part := range parts {
+		if err != nil {
+			break
+		}
+		var entry io.Writer
+		entry, err = w.archive.Create(part.name)
+		if err == nil {
+			_, err = io.WriteString(entry, part.content)
+		}
+	}
+
+	if closeErr := w.archive.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// xlsxColumn names a column by its index from 0: A to Z, then AA and on
+func xlsxColumn(index int) string {
+	name := ""
+	for index++; index > 0; index = (index - 1) / 26 {
+		name = string(rune('A' + (index - 1) % 26)) + name
+	}
+	return name
+}
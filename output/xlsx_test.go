@@ -0,0 +1,167 @@
+package output
+
+import (
+	"os"
+	"fmt"
+	"reflect"
+	"testing"
+	"io/ioutil"
+	"archive/zip"
+	"path/filepath"
+	"encoding/xml"
+)
+
+type xlsxSheet struct {
+	Pane struct {
+		YSplit int `xml:"ySplit,attr"`
+		State string `xml:"state,attr"`
+	} `xml:"sheetViews>sheetView>pane"`
+	Rows []struct {
+		Cells []struct {
+			Ref string `xml:"r,attr"`
+			Type string `xml:"t,attr"`
+			Style int `xml:"s,attr"`
+			Value string `xml:"v"`
+			Text string `xml:"is>t"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+	AutoFilter struct {
+		Ref string `xml:"ref,attr"`
+	} `xml:"autoFilter"`
+}
+
+// readXLSX returns the names of the sheets and, for each, its pane, auto
+// filter and cells as "ref type style value"
+func readXLSX(t *testing.T, path string) ([]string, []xlsxSheet) {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+
+	parts := map[string]*zip.File{}
+	for _, file := range archive.File {
+		parts[file.Name] = file
+	}
+	for _, name := range []string{"[Content_Types].xml", "_rels/.rels", "xl/_rels/workbook.xml.rels", "xl/styles.xml"} {
+		if parts[name] == nil {
+			t.Errorf("missing part %v", name)
+		}
+	}
+
+	decode := func(name string, v interface{}) {
+		file := parts[name]
+		if file == nil {
+			t.Fatalf("missing part %v", name)
+		}
+		reader, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+		if err := xml.NewDecoder(reader).Decode(v); err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+	}
+
+	var workbook struct {
+		Sheets []struct {
+			Name string `xml:"name,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	decode("xl/workbook.xml", &workbook)
+
+	var names []string
+	var sheets []xlsxSheet
+	for i, sheet := range workbook.Sheets {
+		names = append(names, sheet.Name)
+		var s xlsxSheet
+		decode(fmt.Sprintf("xl/worksheets/sheet%d.xml", i + 1), &s)
+		sheets = append(sheets, s)
+	}
+	return names, sheets
+}
+
+func TestXLSXWriter(t *testing.T) {
+	messages := append(sqliteMessages, Message{
+		Headers: map[string]string{
+			"message": "msgs/raw.msg",
+			"part_count": "2",
+			"thread_id": "007",
+		},
+		HeaderLines: []string{
+			"Date: Mon, 4 Apr 2011 18:00:00 +0200",
+			"Subject: Caf\xe9\x01",
+		},
+	})
+	fields := []string{"Date", "Subject", "Received", "part_count", "thread_id"}
+
+	defer func(max int) { xlsxMaxRows = max }(xlsxMaxRows)
+	xlsxMaxRows = 3
+
+	tmpDir, err := ioutil.TempDir("../test_files", "tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "output.xlsx")
+	writer, err := NewXLSXWriter(path, fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteAll(writer, messages); err != nil {
+		t.Fatal(err)
+	}
+
+	names, sheets := readXLSX(t, path)
+	if !reflect.DeepEqual(names, []string{"Messages", "Messages 2"}) {
+		t.Fatalf("sheets %v", names)
+	}
+
+	header := []string{"A1 inlineStr 2 message", "B1 inlineStr 2 Date", "C1 inlineStr 2 Subject",
+		"D1 inlineStr 2 Received", "E1 inlineStr 2 part_count", "F1 inlineStr 2 thread_id"}
+	expected := [][]string{
+		append(header,
+			"A2 inlineStr 0 msgs/darty.msg",
+			"C2 inlineStr 0 Cuit Vapeur 29.90 euros",
+			"D2 inlineStr 0 from a by b\nfrom c by d",
+			"A3 inlineStr 0 msgs/lunch.msg",
+			"C3 inlineStr 0 =?utf-8?q?Caf=C3=A9?= lunch"),
+		append(header,
+			"A2 inlineStr 0 msgs/raw.msg",
+			"B2  1 40637.666666666664",
+			"C2 inlineStr 0 Caf�␁",
+			"E2  0 2",
+			"F2 inlineStr 0 007"),
+	}
+	filters := []string{"A1:F3", "A1:F2"}
+
+	for i, sheet := range sheets {
+		var cells []string
+		for _, row := range sheet.Rows {
+			for _, c := range row.Cells {
+				cells = append(cells, fmt.Sprintf("%v %v %d %v%v", c.Ref, c.Type, c.Style, c.Value, c.Text))
+			}
+		}
+		if !reflect.DeepEqual(cells, expected[i]) {
+			t.Errorf("sheet %d: cells %q, expected %q", i + 1, cells, expected[i])
+		}
+		if sheet.Pane.YSplit != 1 || sheet.Pane.State != "frozen" {
+			t.Errorf("sheet %d: pane %+v", i + 1, sheet.Pane)
+		}
+		if sheet.AutoFilter.Ref != filters[i] {
+			t.Errorf("sheet %d: filter on %v, expected %v", i + 1, sheet.AutoFilter.Ref, filters[i])
+		}
+	}
+}
+
+func TestXLSXColumn(t *testing.T) {
+	cases := map[int]string{0: "A", 25: "Z", 26: "AA", 51: "AZ", 52: "BA", 701: "ZZ", 702: "AAA"}
+
+	for index, expected := range cases {
+		if actual := xlsxColumn(index); actual != expected {
+			t.Errorf("xlsxColumn(%d) = %v, expected %v", index, actual, expected)
+		}
+	}
+}
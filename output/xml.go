@@ -0,0 +1,176 @@
+package output
+
+import (
+	"os"
+	"bufio"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+	"encoding/xml"
+)
+
+// XMLSchema describes the documents written by XMLWriter
+const XMLSchema = `<?xml version="1.0" encoding="UTF-8"?>
+<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema" elementFormDefault="qualified">
+  <xs:annotation>
+    <xs:documentation>
+      Messages extracted by msgextract. Characters XML 1.0 does not allow,
+      such as control characters found in raw headers, are replaced by their
+      Unicode control pictures (U+0001 by U+2401) and bytes that are not
+      UTF-8 by U+FFFD.
+    </xs:documentation>
+  </xs:annotation>
+
+  <xs:element name="messages">
+    <xs:complexType>
+      <xs:sequence>
+        <xs:element name="message" type="message" minOccurs="0" maxOccurs="unbounded"/>
+      </xs:sequence>
+    </xs:complexType>
+  </xs:element>
+
+  <xs:complexType name="message">
+    <xs:sequence>
+      <xs:choice minOccurs="0" maxOccurs="unbounded">
+        <!-- Every occurrence of an output header, in the order of the message -->
+        <xs:element name="header" type="namedValue"/>
+        <!-- Derived field, e.g. part_count -->
+        <xs:element name="field" type="namedValue"/>
+      </xs:choice>
+      <xs:element name="attachment" type="attachment" minOccurs="0" maxOccurs="unbounded"/>
+      <xs:element name="url" type="url" minOccurs="0" maxOccurs="unbounded"/>
+    </xs:sequence>
+    <!-- Archive entry of the message -->
+    <xs:attribute name="entry" type="xs:string" use="required"/>
+  </xs:complexType>
+
+  <xs:complexType name="namedValue">
+    <xs:simpleContent>
+      <xs:extension base="xs:string">
+        <xs:attribute name="name" type="xs:string" use="required"/>
+      </xs:extension>
+    </xs:simpleContent>
+  </xs:complexType>
+
+  <xs:complexType name="attachment">
+    <xs:attribute name="filename" type="xs:string" use="required"/>
+    <xs:attribute name="declared_type" type="xs:string" use="required"/>
+    <xs:attribute name="sniffed_type" type="xs:string" use="required"/>
+    <xs:attribute name="size" type="xs:long" use="required"/>
+    <xs:attribute name="md5" type="xs:string" use="required"/>
+    <xs:attribute name="sha256" type="xs:string" use="required"/>
+    <xs:attribute name="path" type="xs:string" use="required"/>
+  </xs:complexType>
+
+  <xs:complexType name="url">
+    <xs:simpleContent>
+      <xs:extension base="xs:string">
+        <xs:attribute name="domain" type="xs:string" use="required"/>
+        <!-- Link as found in the body, when it was rewritten -->
+        <xs:attribute name="wrapped" type="xs:string"/>
+      </xs:extension>
+    </xs:simpleContent>
+  </xs:complexType>
+</xs:schema>
+`
+
+// XMLWriter streams messages to an XML document of the form
+//
+//	<messages>
+//	  <message entry="msgs/a.msg">
+//	    <header name="Subject">...</header>
+//	    <field name="part_count">2</field>
+//	    <attachment filename="..." .../>
+//	    <url domain="...">...</url>
+//	  </message>
+//	</messages>
+//
+// described by XMLSchema
+type XMLWriter struct {
+	file *os.File
+	writer *bufio.Writer
+	columns []column
+}
+
+func NewXMLWriter(outputPath string, fields []string) (*XMLWriter, error) {
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &XMLWriter{file: file, writer: bufio.NewWriter(file), columns: columnsFor(fields)}
+	w.writer.WriteString(xml.Header + "<messages>\n")
+	return w, nil
+}
+
+func (w *XMLWriter) Write(message Message) error {
+	for _, c := range w.columns {
+		switch {
+		case c.required:
+			value, _ := c.value(message)
+			w.writer.WriteString("  <message entry=\"" + xmlEscape(value) + "\">\n")
+		case c.kind == stringColumn:
+			if value, ok := c.value(message); ok {
+				w.writer.WriteString("    <field name=\"" + xmlEscape(c.name) + "\">" + xmlEscape(value) + "</field>\n")
+			}
+		default:
+			for _, value := range c.values(message) {
+				w.writer.WriteString("    <header name=\"" + xmlEscape(c.name) + "\">" + xmlEscape(value) + "</header>\n")
+			}
+		}
+	}
+
+	for _, a := range message.Attachments {
+		w.writer.WriteString("    <attachment" +
+			xmlAttribute("filename", a.Filename) +
+			xmlAttribute("declared_type", a.DeclaredType) +
+			xmlAttribute("sniffed_type", a.SniffedType) +
+			xmlAttribute("size", strconv.FormatInt(a.Size, 10)) +
+			xmlAttribute("md5", a.MD5) +
+			xmlAttribute("sha256", a.SHA256) +
+			xmlAttribute("path", a.Path) + "/>\n")
+	}
+
+	for _, u := range message.URLs {
+		w.writer.WriteString("    <url" + xmlAttribute("domain", u.Domain))
+		if u.Wrapped != "" {
+			w.writer.WriteString(xmlAttribute("wrapped", u.Wrapped))
+		}
+		w.writer.WriteString(">" + xmlEscape(u.URL) + "</url>\n")
+	}
+
+	_, err := w.writer.WriteString("  </message>\n")
+	return err
+}
+
+func (w *XMLWriter) Close() error {
+	w.writer.WriteString("</messages>\n")
+	err := w.writer.Flush()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func xmlAttribute(name, value string) string {
+	return " " + name + "=\"" + xmlEscape(value) + "\""
+}
+
+// xmlEscape escapes markup, tabs and line breaks as character references,
+// replacing characters XML 1.0 does not allow at all: C0 controls by their
+// control pictures, U+FFFE, U+FFFF and invalid UTF-8 by U+FFFD
+func xmlEscape(value string) string {
+	legal := strings.Map(func(r rune) rune {
+		switch {
+		case r < 0x20 && r != '\t' && r != '\n' && r != '\r':
+			return 0x2400 + r
+		case r == 0xFFFE || r == 0xFFFF:
+			return utf8.RuneError
+		}
+		return r
+	}, validUTF8(value))
+
+	var escaped strings.Builder
+	xml.EscapeText(&escaped, []byte(legal))
+	return escaped.String()
+}
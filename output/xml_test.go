@@ -0,0 +1,141 @@
+package output
+
+import (
+	"io"
+	"os"
+	"reflect"
+	"testing"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"encoding/xml"
+)
+
+type xmlNamedValue struct {
+	Name string `xml:"name,attr"`
+	Value string `xml:",chardata"`
+}
+
+type xmlMessage struct {
+	Entry string `xml:"entry,attr"`
+	Headers []xmlNamedValue `xml:"header"`
+	Fields []xmlNamedValue `xml:"field"`
+	Attachments []xmlAttachment `xml:"attachment"`
+	URLs []xmlURL `xml:"url"`
+}
+
+type xmlAttachment struct {
+	Filename string `xml:"filename,attr"`
+	Size int64 `xml:"size,attr"`
+}
+
+type xmlURL struct {
+	Domain string `xml:"domain,attr"`
+	URL string `xml:",chardata"`
+}
+
+func TestXMLWriter(t *testing.T) {
+	messages := append(sqliteMessages, Message{
+		Headers: map[string]string{
+			"message": "msgs/raw.msg",
+			"part_count": "2",
+		},
+		HeaderLines: []string{
+			"Subject: Caf\xe9 \x01\x1b[0m & <b>",
+		},
+	})
+	fields := []string{"From", "Subject", "Received", "message", "part_count"}
+
+	expected := []xmlMessage{
+		{
+			Entry: "msgs/darty.msg",
+			Headers: []xmlNamedValue{
+				{"From", `"Darty" <infos@Contact-Darty.com>`},
+				{"Subject", "Cuit Vapeur 29.90 euros"},
+				{"Received", "from a by b"},
+				{"Received", "from c by d"},
+			},
+			Attachments: []xmlAttachment{{"promo.pdf", 54}},
+			URLs: []xmlURL{{"www.darty.com", "http://www.darty.com/promo"}},
+		},
+		{
+			Entry: "msgs/lunch.msg",
+			Headers: []xmlNamedValue{
+				{"From", "hermione@example.com"},
+				{"Subject", "=?utf-8?q?Caf=C3=A9?= lunch"},
+			},
+		},
+		{
+			Entry: "msgs/raw.msg",
+			Headers: []xmlNamedValue{
+				{"Subject", "Caf� ␁␛[0m & <b>"},
+			},
+			Fields: []xmlNamedValue{
+				{"part_count", "2"},
+			},
+		},
+	}
+
+	tmpDir, err := ioutil.TempDir("../test_files", "tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "output.xml")
+	writer, err := NewXMLWriter(path, fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteAll(writer, messages); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var document struct {
+		XMLName xml.Name `xml:"messages"`
+		Messages []xmlMessage `xml:"message"`
+	}
+	if err := xml.Unmarshal(data, &document); err != nil {
+		t.Fatalf("%v in\n%s", err, data)
+	}
+	if !reflect.DeepEqual(document.Messages, expected) {
+		t.Errorf("messages %+v, expected %+v", document.Messages, expected)
+	}
+}
+
+func TestXMLEscape(t *testing.T) {
+	cases := []struct {
+		value string
+		expected string
+	}{
+		{"plain", "plain"},
+		{`"a" <b> & 'c'`, "&#34;a&#34; &lt;b&gt; &amp; &#39;c&#39;"},
+		{"tab\tline\ncarriage\r", "tab&#x9;line&#xA;carriage&#xD;"},
+		{"nul\x00bell\x07esc\x1b", "nul␀bell␇esc␛"},
+		{"￾￿", "��"},
+		{"latin1 \xe9", "latin1 �"},
+	}
+
+	for _, c := range cases {
+		if actual := xmlEscape(c.value); actual != c.expected {
+			t.Errorf("xmlEscape(%q) = %q, expected %q", c.value, actual, c.expected)
+		}
+	}
+}
+
+func TestXMLSchema(t *testing.T) {
+	decoder := xml.NewDecoder(strings.NewReader(XMLSchema))
+	for {
+		if _, err := decoder.Token(); err != nil {
+			if err != io.EOF {
+				t.Error(err)
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package parse
+
+import (
+	"regexp"
+	"net/mail"
+)
+
+// Addresses in fields which fail to parse as a whole
+var addressPattern = regexp.MustCompile(`[^\s<>"',;:()]+@[^\s<>"',;:()]+`)
+
+// Addresses parses an address list such as the value of To, decoding the
+// display names. When mailers got the syntax wrong, whatever looks like an
+// address is picked out instead
+func Addresses(value string) []*mail.Address {
+	if list, err := mail.ParseAddressList(value); err == nil {
+		for _, address := range list {
+			address.Name = DecodeHeader(address.Name)
+		}
+		return list
+	}
+
+	var list []*mail.Address
+	for _, address := range addressPattern.FindAllString(value, -1) {
+		list = append(list, &mail.Address{Address: address})
+	}
+	return list
+}
@@ -0,0 +1,92 @@
+package parse
+
+import (
+	"io"
+	"mime"
+	"strings"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+)
+
+// Columns of the tabular attachment output, matching the JSON keys
+var AttachmentFields = []string{"message", "filename", "declared_type", "sniffed_type", "size", "md5", "sha256", "path"}
+
+// Attachment describes a file carried by a message
+type Attachment struct {
+	// Reference to the message carrying the attachment (its archive entry)
+	Message string `json:"message"`
+	Filename string `json:"filename"`
+	// Media type claimed by the Content-Type header
+	DeclaredType string `json:"declared_type"`
+	// Media type detected from the leading bytes of the content
+	SniffedType string `json:"sniffed_type"`
+	// Decoded size in bytes
+	Size int64 `json:"size"`
+	MD5 string `json:"md5"`
+	SHA256 string `json:"sha256"`
+	// Where the content was extracted to, if it was
+	Path string `json:"path"`
+}
+
+// Filename of the part from either its Content-Disposition or, as used by
+// older mailers, the name parameter of its Content-Type. RFC 2231 parameter
+// continuations and RFC 2047 encoded-words are both decoded
+func (p Part) Filename() string {
+	var filename string
+
+	// mime.ParseMediaType reassembles RFC 2231 continuations
+	if _, params, err := mime.ParseMediaType(p.Header.Get("Content-Disposition")); err == nil {
+		filename = params["filename"]
+	}
+	if filename == "" {
+		filename = p.Params["name"]
+	}
+
+	// Encoded-words are not allowed in quoted strings, yet commonly found there
+	return strings.TrimSpace(DecodeHeader(filename))
+}
+
+// IsAttachment reports whether the part is an attachment rather than
+// message text: it is either declared as such or carries a filename
+func (p Part) IsAttachment() bool {
+	disposition, _, _ := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+	return disposition == "attachment" || p.Filename() != ""
+}
+
+// NewAttachment consumes the decoded body of the part, sizing, hashing and
+// sniffing its content on the fly
+func NewAttachment(message string, part Part, body io.Reader) (Attachment, error) {
+	attachment := Attachment{
+		Message: message,
+		Filename: part.Filename(),
+		DeclaredType: part.MediaType,
+	}
+
+	md5Hash := md5.New()
+	sha256Hash := sha256.New()
+	hashes := io.MultiWriter(md5Hash, sha256Hash)
+
+	// http.DetectContentType considers at most the first 512 bytes
+	head := make([]byte, 512)
+	n, err := io.ReadFull(body, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return attachment, err
+	}
+	head = head[:n]
+	hashes.Write(head)
+
+	rest, err := io.Copy(hashes, body)
+	if err != nil {
+		return attachment, err
+	}
+
+	// Drop parameters such as charset, leaving the bare media type
+	attachment.SniffedType, _, _ = mime.ParseMediaType(http.DetectContentType(head))
+	attachment.Size = int64(n) + rest
+	attachment.MD5 = hex.EncodeToString(md5Hash.Sum(nil))
+	attachment.SHA256 = hex.EncodeToString(sha256Hash.Sum(nil))
+
+	return attachment, nil
+}
@@ -0,0 +1,125 @@
+package parse
+
+import (
+	"io"
+	"testing"
+	"reflect"
+)
+
+func TestPartFilename(t *testing.T) {
+	cases := []struct {
+		lines []string
+		filename string
+		isAttachment bool
+	}{
+		{
+			[]string{"Content-Type: text/plain"},
+			"",
+			false,
+		},
+		{
+			[]string{"Content-Disposition: attachment"},
+			"",
+			true,
+		},
+		{
+			[]string{"Content-Disposition: inline; filename=\"logo.png\""},
+			"logo.png",
+			true,
+		},
+		{
+			[]string{"Content-Type: application/pdf; name=report.pdf"},
+			"report.pdf",
+			true,
+		},
+		{
+			[]string{
+				"Content-Type: application/pdf; name=ignored.pdf",
+				"Content-Disposition: attachment; filename=report.pdf",
+			},
+			"report.pdf",
+			true,
+		},
+		{
+			[]string{
+				"Content-Disposition: attachment;",
+				"\tfilename*0*=utf-8''caf%C3%A9%20;",
+				"\tfilename*1=\"menu.pdf\"",
+			},
+			"café menu.pdf",
+			true,
+		},
+		{
+			[]string{"Content-Disposition: attachment; filename*=utf-8''%E2%82%AC.txt"},
+			"€.txt",
+			true,
+		},
+		{
+			[]string{"Content-Disposition: attachment; filename=\"=?iso-8859-1?q?re=E7u.png?=\""},
+			"reçu.png",
+			true,
+		},
+		{
+			[]string{"Content-Type: image/png; name=\"=?utf-8?b?cmXDp3UucG5n?=\""},
+			"reçu.png",
+			true,
+		},
+	}
+
+	for _, c := range cases {
+		part := newPart(MIMEHeaderFromLines(c.lines), 0, "text/plain")
+
+		if out := part.Filename(); out != c.filename {
+			t.Errorf("%v returned filename %q, wanted %q", c.lines, out, c.filename)
+		}
+
+		if out := part.IsAttachment(); out != c.isAttachment {
+			t.Errorf("%v returned attachment %v, wanted %v", c.lines, out, c.isAttachment)
+		}
+	}
+}
+
+func TestNewAttachment(t *testing.T) {
+	headerLines, body := splitMessage(readMessageFile(t, "../test_files/msgs/multipart.msg"))
+
+	var attachments []Attachment
+	_, err := WalkMIME(headerLines, body, func(part Part, body io.Reader) error {
+		if !part.IsAttachment() {
+			return nil
+		}
+
+		attachment, err := NewAttachment("multipart.msg", part, body)
+		attachments = append(attachments, attachment)
+		return err
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	want := []Attachment{
+		{
+			"multipart.msg",
+			"café menu.pdf",
+			"application/pdf",
+			"application/pdf",
+			54,
+			"c187743d96b1fc5915cfc1e6a6b5a306",
+			"3a321354e9231a5c8b78f4961c5f12fcbc9c11dc1c519be13cdc4e6b63153f1d",
+			"",
+		},
+		{
+			"multipart.msg",
+			"reçu.png",
+			"application/octet-stream",
+			"image/png",
+			70,
+			"8aba6b0bb8249a98fdc668d61c5ac7bd",
+			"332615009d8a31f99b18d6811014e60ba3dd9e43403783066146bb5a563c003f",
+			"",
+		},
+	}
+
+	if !reflect.DeepEqual(attachments, want) {
+		t.Errorf("Received %v, wanted %v", attachments, want)
+	}
+}
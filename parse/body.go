@@ -0,0 +1,213 @@
+package parse
+
+import (
+	"io"
+	"html"
+	"strings"
+	"unicode"
+	"io/ioutil"
+	"unicode/utf8"
+)
+
+// Output fields produced by Body.Fields, in display order
+var BodyFields = []string{"body_text", "body_html", "snippet"}
+
+// Elements whose content is never displayed
+var hiddenElements = map[string]bool{
+	"head": true,
+	"script": true,
+	"style": true,
+	"title": true,
+}
+
+// Elements which start a new line when rendered
+var blockElements = map[string]bool{
+	"address": true, "article": true, "blockquote": true, "br": true,
+	"dd": true, "div": true, "dl": true, "dt": true, "footer": true,
+	"form": true, "h1": true, "h2": true, "h3": true, "h4": true,
+	"h5": true, "h6": true, "header": true, "hr": true, "li": true,
+	"ol": true, "p": true, "pre": true, "section": true, "table": true,
+	"tr": true, "ul": true,
+}
+
+var newlines = strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ")
+
+// Body collects the readable text of a message as its parts are walked
+type Body struct {
+	text []string
+	html []string
+	// Charsets of parts which could not be decoded from them
+	unknownCharsets []string
+}
+
+// AddPart keeps the content of text/plain and text/html parts, converted to
+// UTF-8. Attachments and other media types are left unread
+func (b *Body) AddPart(part Part, body io.Reader) error {
+	if part.IsAttachment() || (part.MediaType != "text/plain" && part.MediaType != "text/html") {
+		return nil
+	}
+
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if !KnownCharset(part.Charset()) {
+		b.unknownCharsets = append(b.unknownCharsets, part.Charset())
+	}
+	decoded := ToUTF8(part.Charset(), content)
+
+	if part.MediaType == "text/html" {
+		b.html = append(b.html, decoded)
+	} else {
+		b.text = append(b.text, decoded)
+	}
+
+	return nil
+}
+
+// Text of the message: its plain text parts or, lacking any, its rendered
+// HTML parts
+func (b *Body) Text() string {
+	if len(b.text) > 0 {
+		return tidyText(strings.Join(b.text, "\n"))
+	}
+
+	var rendered []string
+	for _, content := range b.html {
+		rendered = append(rendered, HTMLToText(content))
+	}
+	return tidyText(strings.Join(rendered, "\n"))
+}
+
+// UnknownCharsets lists the charsets of the parts added which ToUTF8 does
+// not know, their content having been taken as UTF-8
+func (b *Body) UnknownCharsets() []string {
+	return b.unknownCharsets
+}
+
+func (b *Body) HTML() string {
+	return strings.Join(b.html, "\n")
+}
+
+// Fields flattens the body into output fields. The snippet holds the first
+// snippetLength characters of the text, with all whitespace collapsed.
+// Newlines are escaped as they are in header values
+func (b *Body) Fields(snippetLength int) map[string]string {
+	text := b.Text()
+
+	snippet := strings.Join(strings.Fields(text), " ")
+	if utf8.RuneCountInString(snippet) > snippetLength {
+		snippet = string([]rune(snippet)[:snippetLength])
+	}
+
+	return map[string]string{
+		"body_text": escapeWhitespace(text),
+		"body_html": escapeWhitespace(b.HTML()),
+		"snippet": snippet,
+	}
+}
+
+// HTMLToText renders HTML as plain text: tags are dropped, block elements
+// break lines, table cells are spaced apart and character references are
+// unescaped. Hidden content such as scripts and styles is left out
+func HTMLToText(content string) string {
+	var text strings.Builder
+
+	// Name of the hidden element being skipped, if any
+	var hiding string
+
+	for len(content) > 0 {
+		start := strings.Index(content, "<")
+		if start == -1 {
+			start = len(content)
+		}
+
+		if hiding == "" {
+			// Line breaks in the source are mere whitespace to HTML
+			text.WriteString(html.UnescapeString(newlines.Replace(content[:start])))
+		}
+		content = content[start:]
+		if content == "" {
+			break
+		}
+
+		// Comments may contain '>', so run to their own terminator
+		if strings.HasPrefix(content, "<!--") {
+			end := strings.Index(content, "-->")
+			if end == -1 {
+				break
+			}
+			content = content[end + 3:]
+			continue
+		}
+
+		end := strings.Index(content, ">")
+		if end == -1 {
+			break
+		}
+		name, closing := tagName(content[1:end])
+		content = content[end + 1:]
+
+		switch {
+		case hiding != "":
+			// Documents missing </head> still show their body
+			if (closing && name == hiding) || (hiding == "head" && name == "body") {
+				hiding = ""
+			}
+		case hiddenElements[name] && !closing:
+			hiding = name
+		case blockElements[name]:
+			text.WriteString("\n")
+		case name == "td" || name == "th":
+			text.WriteString(" ")
+		}
+	}
+
+	return text.String()
+}
+
+// tagName extracts the lower-cased element name from the inside of a tag
+func tagName(tag string) (string, bool) {
+	closing := strings.HasPrefix(tag, "/")
+	tag = strings.TrimPrefix(tag, "/")
+
+	end := strings.IndexFunc(tag, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '/'
+	})
+	if end != -1 {
+		tag = tag[:end]
+	}
+
+	return strings.ToLower(tag), closing
+}
+
+// tidyText collapses runs of spaces within lines and of blank lines between
+// them, which rendering and quoted-printable tabs leave plenty of
+func tidyText(text string) string {
+	var lines []string
+	blank := true
+
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.Join(strings.Fields(line), " ")
+
+		if line == "" {
+			// Keep a single blank line between paragraphs
+			if !blank {
+				lines = append(lines, "")
+			}
+			blank = true
+			continue
+		}
+
+		lines = append(lines, line)
+		blank = false
+	}
+
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+func escapeWhitespace(value string) string {
+	value = strings.Replace(value, "\r\n", "\n", -1)
+	value = strings.Replace(value, "\t", " ", -1)
+	return strings.Replace(value, "\n", "\\n", -1)
+}
@@ -0,0 +1,209 @@
+package parse
+
+import (
+	"testing"
+	"reflect"
+	"strings"
+)
+
+func TestHTMLToText(t *testing.T) {
+	cases := []struct {
+		in string
+		want string
+	}{
+		{"plain", "plain"},
+		{"<p>One</p><p>Two</p>", "\nOne\n\nTwo\n"},
+		{"Line<br>break<BR/>again", "Line\nbreak\nagain"},
+		{"wrapped\nsource", "wrapped source"},
+		{"<td>a</td><td>b</td>", " a  b "},
+		{"gr&acirc;ce &agrave; ce lien&nbsp;!", "grâce à ce lien !"},
+		{"<head><title>Hidden</title></head><body>Shown</body>", "Shown"},
+		{"<head><title>Unclosed head</title><body>Shown</body>", "Shown"},
+		{"<style>p {color: red}</style><script>if (a > b) {}</script>Text", "Text"},
+		{"<!-- a > b -->Text", "Text"},
+		{"<a href=\"http://example.com\">link</a>", "link"},
+		{"Unterminated <b", "Unterminated "},
+	}
+
+	for _, c := range cases {
+		if out := HTMLToText(c.in); out != c.want {
+			t.Errorf("%q returned %q, wanted %q", c.in, out, c.want)
+		}
+	}
+}
+
+func TestBodyFields(t *testing.T) {
+	cases := []struct {
+		raw string
+		snippetLength int
+		fields map[string]string
+	}{
+		{
+			readMessageFile(t, "../test_files/msgs/multipart.msg"),
+			200,
+			map[string]string{
+				"body_text": "Café menu for Friday: http://example.com/menu\\nSee you there.\\n\\nDon't forget the receipt.",
+				"body_html": "<html><body><p>Café menu for <b>Friday</b></p><a href=\"http://example.com/menu\">See the menu</a></body></html>",
+				"snippet": "Café menu for Friday: http://example.com/menu See you there. Don't forget the receipt.",
+			},
+		},
+		{
+			readMessageFile(t, "../test_files/msgs/multipart.msg"),
+			4,
+			map[string]string{
+				"body_text": "Café menu for Friday: http://example.com/menu\\nSee you there.\\n\\nDon't forget the receipt.",
+				"body_html": "<html><body><p>Café menu for <b>Friday</b></p><a href=\"http://example.com/menu\">See the menu</a></body></html>",
+				"snippet": "Café",
+			},
+		},
+		{
+			"Content-Type: text/html; charset=windows-1252\n" +
+				"Content-Transfer-Encoding: quoted-printable\n\n" +
+				"<p>=93Quoted=94</p>=09<p>Second=\n paragraph</p>\n",
+			100,
+			map[string]string{
+				"body_text": "“Quoted”\\n\\nSecond paragraph",
+				"body_html": "<p>“Quoted”</p> <p>Second paragraph</p>\\n",
+				"snippet": "“Quoted” Second paragraph",
+			},
+		},
+		{
+			"Subject: Empty\n",
+			100,
+			map[string]string{"body_text": "", "body_html": "", "snippet": ""},
+		},
+	}
+
+	for _, c := range cases {
+		headerLines, body := splitMessage(c.raw)
+
+		var collected Body
+		if _, err := WalkMIME(headerLines, body, collected.AddPart); err != nil {
+			t.Error(err)
+		}
+
+		if out := collected.Fields(c.snippetLength); !reflect.DeepEqual(out, c.fields) {
+			t.Errorf("%q returned %q, wanted %q", c.raw, out, c.fields)
+		}
+	}
+}
+
+func TestBodyLeavesAttachmentsUnread(t *testing.T) {
+	headerLines, body := splitMessage("Content-Type: text/plain\nContent-Disposition: attachment; filename=notes.txt\n\nNotes\n")
+
+	var collected Body
+	if _, err := WalkMIME(headerLines, body, collected.AddPart); err != nil {
+		t.Error(err)
+	}
+
+	if text := collected.Text(); text != "" {
+		t.Errorf("Attachment read into body text %q", text)
+	}
+}
+
+func TestToUTF8(t *testing.T) {
+	cases := []struct {
+		charset string
+		in string
+		want string
+	}{
+		{"utf-8", "Café", "Café"},
+		{"UTF8", "Caf\xe9", "Caf�"},
+		{"iso-8859-1", "Caf\xe9", "Café"},
+		{" Latin1 ", "Caf\xe9", "Café"},
+		{"us-ascii", "\x93quotes\x94", "“quotes”"},
+		{"windows-1252", "\x80 \x81", "€ \ufffd"},
+		{"iso-8859-15", "\xa4 \xbd", "€ œ"},
+		{"koi8-r", "\xf0\xd2\xc9\xd7\xc5\xd4", "Привет"},
+		{"iso-8859-2", "\xbf\xf3\xb3w", "żółw"},
+		{"Shift_JIS", "\x82\xb1\x82\xf1\x82\xc9\x82\xbf\x82\xcd", "こんにちは"},
+		{"gb2312", "\xc4\xe3\xba\xc3", "你好"},
+		{"x-unknown", "Café", "Café"},
+		{"x-unknown", "Caf\xe9", "Caf�"},
+		{"", "plain", "plain"},
+	}
+
+	for _, c := range cases {
+		if out := ToUTF8(c.charset, []byte(c.in)); out != c.want {
+			t.Errorf("%q in %v returned %q, wanted %q", c.in, c.charset, out, c.want)
+		}
+	}
+
+	if !KnownCharset("ISO-8859-15") || !KnownCharset("koi8-r") || KnownCharset("x-unknown") || KnownCharset("iso-2022-kr") {
+		t.Error("KnownCharset disagrees with ToUTF8")
+	}
+}
+
+func TestCharsetReader(t *testing.T) {
+	decoder := strings.NewReader("caf\xe9")
+
+	reader, err := charsetReader("windows-1252", decoder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := new(strings.Builder)
+	if _, err := reader.(*strings.Reader).WriteTo(content); err != nil {
+		t.Error(err)
+	}
+	if content.String() != "café" {
+		t.Errorf("Received %q, wanted %q", content.String(), "café")
+	}
+
+	if _, err := charsetReader("x-unknown", decoder); err == nil {
+		t.Error("Unhandled charset did not return an error")
+	}
+}
+
+func TestBodyFieldsUndeclared(t *testing.T) {
+	cases := []struct {
+		path string
+		snippet string
+		html string
+	}{
+		// Quoted-printable HTML without a Content-Transfer-Encoding
+		{
+			"../test_files/msgs/return_x-orig_received.msg",
+			"A S p o n s o r e d M e s s a g e f r o m B e l i e f n e t Unsubscribe instructions are at the bott",
+			"<!DOCTYPE HTML PUBLIC \"-//W3C//DTD HTML 4.01 Transitional//EN\" \"http://www.w3.org/TR/html4/loose.dtd\">",
+		},
+		// HTML without a Content-Type
+		{
+			"../test_files/msgs/subject_date_from.msg",
+			"Si cet email ne s'affiche pas correctement, vous pouvez le visualiser grâce à ce lien. Nintendo 3DS ",
+			"<html>\\n<head>",
+		},
+	}
+
+	for _, c := range cases {
+		headerLines, body := splitMessage(readMessageFile(t, c.path))
+
+		var collected Body
+		if _, err := WalkMIME(headerLines, body, collected.AddPart); err != nil {
+			t.Error(err)
+		}
+
+		fields := collected.Fields(100)
+		if fields["snippet"] != c.snippet {
+			t.Errorf("%v: snippet %q, wanted %q", c.path, fields["snippet"], c.snippet)
+		}
+		if !strings.HasPrefix(fields["body_html"], c.html) {
+			t.Errorf("%v: body_html starts %.120q, wanted %q", c.path, fields["body_html"], c.html)
+		}
+		if text := fields["body_text"]; strings.Contains(text, "=3D") || strings.Contains(text, "=\\n") || strings.Contains(text, "<") {
+			t.Errorf("%v: body_text holds raw content %.200q", c.path, text)
+		}
+	}
+}
+
+func TestBodyUnknownCharsets(t *testing.T) {
+	headerLines, body := splitMessage("Content-Type: text/plain; charset=x-unknown\n\nCaf\xe9\n")
+
+	var collected Body
+	if _, err := WalkMIME(headerLines, body, collected.AddPart); err != nil {
+		t.Error(err)
+	}
+
+	if charsets := collected.UnknownCharsets(); !reflect.DeepEqual(charsets, []string{"x-unknown"}) {
+		t.Errorf("Unknown charsets %q", charsets)
+	}
+}
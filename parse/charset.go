@@ -0,0 +1,74 @@
+package parse
+
+import (
+	"io"
+	"fmt"
+	"mime"
+	"strings"
+	"io/ioutil"
+	"unicode/utf8"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// lookupCharset finds the decoder of a charset by the labels browsers know,
+// as per https://encoding.spec.whatwg.org/#names-and-labels. iso-8859-1 and
+// us-ascii are decoded as windows-1252, as browsers do, since mailers
+// routinely mislabel it. Labels of charsets browsers refuse to decode are
+// unknown here too
+func lookupCharset(charset string) (encoding.Encoding, bool) {
+	if strings.TrimSpace(charset) == "" {
+		return nil, false
+	}
+	enc, err := htmlindex.Get(strings.TrimSpace(charset))
+	if err != nil || enc == encoding.Replacement {
+		return nil, false
+	}
+	return enc, true
+}
+
+// KnownCharset reports whether ToUTF8 can decode the charset
+func KnownCharset(charset string) bool {
+	_, ok := lookupCharset(charset)
+	return ok
+}
+
+// ToUTF8 converts content from the given charset. Content in unknown
+// charsets, which KnownCharset tells apart, is taken as UTF-8; invalid
+// sequences become U+FFFD either way
+func ToUTF8(charset string, content []byte) string {
+	if enc, ok := lookupCharset(charset); ok {
+		if decoded, err := enc.NewDecoder().Bytes(content); err == nil {
+			return string(decoded)
+		}
+	}
+
+	if utf8.Valid(content) {
+		return string(content)
+	}
+	return strings.ToValidUTF8(string(content), string(utf8.RuneError))
+}
+
+// charsetReader lets mime.WordDecoder decode the charsets known to ToUTF8
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	if !KnownCharset(charset) {
+		return nil, fmt.Errorf("unhandled charset %q", charset)
+	}
+
+	content, err := ioutil.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.NewReader(ToUTF8(charset, content)), nil
+}
+
+// DecodeHeader decodes the RFC 2047 encoded-words of a header value, e.g.
+// "=?iso-8859-1?q?caf=E9?=". Values which fail to decode are returned as is
+func DecodeHeader(value string) string {
+	decoder := mime.WordDecoder{CharsetReader: charsetReader}
+	if decoded, err := decoder.DecodeHeader(value); err == nil {
+		return decoded
+	}
+	return value
+}
@@ -0,0 +1,321 @@
+package parse
+
+import (
+	"io"
+	"fmt"
+	"mime"
+	"bufio"
+	"strconv"
+	"unicode"
+	"strings"
+	"io/ioutil"
+	"net/textproto"
+	"encoding/base64"
+	"mime/multipart"
+	"mime/quotedprintable"
+)
+
+// Output fields produced by PartSummary.Fields, in display order
+var PartSummaryFields = []string{"part_count", "part_types", "part_depth", "part_size"}
+
+// Part describes a single entity in the MIME tree of a message
+type Part struct {
+	Header textproto.MIMEHeader
+	// Lower-cased media type (e.g. "text/html", "multipart/mixed")
+	MediaType string
+	// Parameters of the Content-Type header (e.g. "charset", "boundary")
+	Params map[string]string
+	// Lower-cased Content-Transfer-Encoding (e.g. "base64")
+	Encoding string
+	// Nesting level of the part, the message itself being at depth 0
+	Depth int
+}
+
+// Charset of the part, defaulting to us-ascii as per
+// https://tools.ietf.org/html/rfc2045#section-5.2
+func (p Part) Charset() string {
+	if charset := p.Params["charset"]; charset != "" {
+		return strings.ToLower(charset)
+	}
+	return "us-ascii"
+}
+
+// PartSummary describes the shape of a message's MIME tree
+type PartSummary struct {
+	// Number of entities in the tree, including the message itself
+	Count int
+	// Media type of every entity, in the order they were walked
+	Types []string
+	// Deepest nesting level reached
+	Depth int
+	// Total decoded size in bytes of all leaf part bodies
+	Size int64
+}
+
+func (s PartSummary) Fields() map[string]string {
+	return map[string]string{
+		"part_count": strconv.Itoa(s.Count),
+		"part_types": strings.Join(s.Types, ","),
+		"part_depth": strconv.Itoa(s.Depth),
+		"part_size": strconv.FormatInt(s.Size, 10),
+	}
+}
+
+// PartFunc is called for every leaf part of a message with its body, decoded
+// from its Content-Transfer-Encoding. The body is only valid until PartFunc
+// returns; whatever is left unread is still counted towards the size
+type PartFunc func(part Part, body io.Reader) error
+
+// WalkMIME streams through the body of a message, descending into multipart
+// and message/rfc822 entities. Bodies are never held in memory as a whole.
+// partFn may be nil when only the summary is of interest. On error, the
+// summary describes the parts walked so far
+func WalkMIME(headerLines []string, body io.Reader, partFn PartFunc) (PartSummary, error) {
+	walker := mimeWalker{partFn: partFn}
+	err := walker.walk(MIMEHeaderFromLines(headerLines), body, 0, "text/plain")
+	return walker.summary, err
+}
+
+// HeaderField is a single occurrence of a header field, its continuation
+// lines unfolded
+type HeaderField struct {
+	// Canonical name, e.g. "Message-Id"
+	Name string
+	Value string
+}
+
+// HeaderFields lists the header fields in the order they occur, keeping
+// every occurrence
+func HeaderFields(lines []string) []HeaderField {
+	var fields []HeaderField
+
+	for _, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+
+		if unicode.IsSpace(rune(line[0])) {
+			// Continuation of the previous field
+			if len(fields) > 0 {
+				fields[len(fields) - 1].Value += " " + strings.TrimSpace(line)
+			}
+			continue
+		}
+
+		splitIndex := strings.Index(line, ":")
+		if splitIndex == -1 {
+			continue
+		}
+
+		fields = append(fields, HeaderField{
+			Name: textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(line[:splitIndex])),
+			Value: strings.TrimSpace(line[splitIndex + 1:]),
+		})
+	}
+
+	return fields
+}
+
+// MIMEHeaderFromLines is the counterpart of MapFromHeaderLines which keeps
+// every occurrence of a header field under its canonical key
+func MIMEHeaderFromLines(lines []string) textproto.MIMEHeader {
+	header := make(textproto.MIMEHeader)
+
+	for _, field := range HeaderFields(lines) {
+		header.Add(field.Name, field.Value)
+	}
+
+	return header
+}
+
+type mimeWalker struct {
+	partFn PartFunc
+	summary PartSummary
+}
+
+func (w *mimeWalker) walk(header textproto.MIMEHeader, body io.Reader, depth int, defaultType string) error {
+	part := newPart(header, depth, defaultType)
+
+	// Leaf text parts may lack the headers saying what they hold
+	if strings.HasPrefix(part.MediaType, "text/") && (header.Get("Content-Type") == "" || part.Encoding == "") {
+		buffered := bufio.NewReaderSize(body, sniffLength)
+		head, _ := buffered.Peek(sniffLength)
+		part = sniffPart(part, head)
+		body = buffered
+	}
+
+	w.summary.Count++
+	w.summary.Types = append(w.summary.Types, part.MediaType)
+	if depth > w.summary.Depth {
+		w.summary.Depth = depth
+	}
+
+	switch {
+	case strings.HasPrefix(part.MediaType, "multipart/"):
+		boundary := part.Params["boundary"]
+		if boundary == "" {
+			return fmt.Errorf("%v part at depth %v has no boundary", part.MediaType, depth)
+		}
+
+		// Parts of a digest are messages unless stated otherwise, as per
+		// https://tools.ietf.org/html/rfc2046#section-5.1.5
+		childType := "text/plain"
+		if part.MediaType == "multipart/digest" {
+			childType = "message/rfc822"
+		}
+
+		multipartReader := multipart.NewReader(body, boundary)
+		for {
+			// Raw parts leave the transfer encoding for decode to handle
+			child, err := multipartReader.NextRawPart()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			if err = w.walk(child.Header, child, depth + 1, childType); err != nil {
+				return err
+			}
+		}
+	case part.MediaType == "message/rfc822":
+		reader := bufio.NewReader(decode(part.Encoding, body))
+
+		nestedHeader, err := textproto.NewReader(reader).ReadMIMEHeader()
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		return w.walk(nestedHeader, reader, depth + 1, "text/plain")
+	default:
+		counter := &countingReader{reader: decode(part.Encoding, body)}
+
+		if w.partFn != nil {
+			if err := w.partFn(part, counter); err != nil {
+				return err
+			}
+		}
+
+		// Drain the remainder so the part is sized in full
+		_, err := io.Copy(ioutil.Discard, counter)
+		w.summary.Size += counter.count
+		return err
+	}
+}
+
+func newPart(header textproto.MIMEHeader, depth int, defaultType string) Part {
+	part := Part{
+		Header: header,
+		MediaType: defaultType,
+		Params: map[string]string{},
+		Encoding: strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))),
+		Depth: depth,
+	}
+
+	if contentType := header.Get("Content-Type"); contentType != "" {
+		// Malformed parameters still yield the media type
+		mediaType, params, _ := mime.ParseMediaType(contentType)
+		if mediaType != "" {
+			part.MediaType = mediaType
+		}
+		if params != nil {
+			part.Params = params
+		}
+	}
+
+	return part
+}
+
+// Bytes of a part looked at to tell what it holds when its headers do not
+const sniffLength = 4096
+
+// sniffPart fills in what the headers of a text part leave out from the
+// start of its body: quoted-printable escapes and soft line breaks mean it
+// was encoded, as do many mailers without saying so, and an <html> or
+// <body> tag means it is HTML
+func sniffPart(part Part, head []byte) Part {
+	if part.Encoding == "" && looksQuotedPrintable(head) {
+		part.Encoding = "quoted-printable"
+	}
+	if part.Header.Get("Content-Type") == "" {
+		lower := strings.ToLower(string(head))
+		if strings.Contains(lower, "<html") || strings.Contains(lower, "<body") {
+			part.MediaType = "text/html"
+		}
+	}
+	return part
+}
+
+// looksQuotedPrintable is whether every '=' in head starts an escape such
+// as =3D or a soft line break, there being at least one
+func looksQuotedPrintable(head []byte) bool {
+	found := false
+	for i := 0; i < len(head); i++ {
+		if head[i] != '=' {
+			continue
+		}
+		rest := head[i + 1:]
+		switch {
+		case len(rest) < 2:
+			// Cut short by the end of what was looked at
+		case rest[0] == '\n' || (rest[0] == '\r' && rest[1] == '\n'):
+		case isUpperHex(rest[0]) && isUpperHex(rest[1]):
+		default:
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+func isUpperHex(b byte) bool {
+	return ('0' <= b && b <= '9') || ('A' <= b && b <= 'F')
+}
+
+// decode wraps body to undo the given Content-Transfer-Encoding.
+// 7bit, 8bit, binary and unknown encodings are passed through untouched
+func decode(encoding string, body io.Reader) io.Reader {
+	switch encoding {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &whitespaceStripper{reader: body})
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	}
+	return body
+}
+
+// whitespaceStripper drops the spaces and tabs some mailers leave in base64
+// bodies; base64.NewDecoder only skips line breaks
+type whitespaceStripper struct {
+	reader io.Reader
+}
+
+func (s *whitespaceStripper) Read(p []byte) (int, error) {
+	for {
+		n, err := s.reader.Read(p)
+
+		kept := 0
+		for _, b := range p[:n] {
+			if b != ' ' && b != '\t' {
+				p[kept] = b
+				kept++
+			}
+		}
+
+		// Avoid reporting an empty read while data remains
+		if kept > 0 || err != nil {
+			return kept, err
+		}
+	}
+}
+
+type countingReader struct {
+	reader io.Reader
+	count int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.count += int64(n)
+	return n, err
+}
@@ -0,0 +1,207 @@
+package parse
+
+import (
+	"io"
+	"bufio"
+	"strings"
+	"testing"
+	"reflect"
+	"io/ioutil"
+	"net/textproto"
+)
+
+// splitMessage separates raw message text into header lines and body
+func splitMessage(raw string) ([]string, io.Reader) {
+	reader := bufio.NewReader(strings.NewReader(raw))
+
+	var headerLines []string
+	for {
+		line, err := reader.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" || err != nil {
+			break
+		}
+		headerLines = append(headerLines, line)
+	}
+
+	return headerLines, reader
+}
+
+func readMessageFile(t *testing.T, path string) string {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(raw)
+}
+
+func TestWalkMIME(t *testing.T) {
+	cases := []struct {
+		raw string
+		summary PartSummary
+	}{
+		{
+			"Subject: No content type\n\nHello\n",
+			PartSummary{1, []string{"text/plain"}, 0, 6},
+		},
+		{
+			"Subject: Header only\n",
+			PartSummary{1, []string{"text/plain"}, 0, 0},
+		},
+		{
+			"Content-Type: text/plain\nContent-Transfer-Encoding: base64\n\naGVs bG8=\n",
+			PartSummary{1, []string{"text/plain"}, 0, 5},
+		},
+		{
+			"Content-Type: text/plain\nContent-Transfer-Encoding: quoted-printable\n\nCaf=E9=\n\n",
+			PartSummary{1, []string{"text/plain"}, 0, 5},
+		},
+		{
+			"Content-Type: TEXT/HTML;\n\tcharset=\"iso-8859-1\"\n\n<p></p>",
+			PartSummary{1, []string{"text/html"}, 0, 7},
+		},
+		{
+			"Content-Type: multipart/digest; boundary=b\n\n--b\n\nSubject: inner\n\nhi\n--b--\n",
+			PartSummary{3, []string{"multipart/digest", "message/rfc822", "text/plain"}, 2, 2},
+		},
+		{
+			readMessageFile(t, "../test_files/msgs/multipart.msg"),
+			PartSummary{
+				9,
+				[]string{
+					"multipart/mixed",
+					"multipart/alternative",
+					"text/plain",
+					"text/html",
+					"application/pdf",
+					"message/rfc822",
+					"multipart/mixed",
+					"text/plain",
+					"application/octet-stream",
+				},
+				3,
+				322,
+			},
+		},
+	}
+
+	for _, c := range cases {
+		headerLines, body := splitMessage(c.raw)
+
+		summary, err := WalkMIME(headerLines, body, nil)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if !reflect.DeepEqual(summary, c.summary) {
+			t.Errorf("%q returned %v, wanted %v", c.raw, summary, c.summary)
+		}
+	}
+}
+
+func TestWalkMIMEMissingBoundary(t *testing.T) {
+	headerLines, body := splitMessage("Content-Type: multipart/mixed\n\n--b\n\nhi\n--b--\n")
+
+	summary, err := WalkMIME(headerLines, body, nil)
+	if err == nil {
+		t.Error("Multipart message without boundary did not return an error")
+	}
+
+	if summary.Count != 1 {
+		t.Errorf("Summary counted %v parts, wanted 1", summary.Count)
+	}
+}
+
+func TestWalkMIMEPartBodies(t *testing.T) {
+	headerLines, body := splitMessage(readMessageFile(t, "../test_files/msgs/multipart.msg"))
+
+	var parts []string
+	_, err := WalkMIME(headerLines, body, func(part Part, body io.Reader) error {
+		// Leave the attachments unread
+		if !strings.HasPrefix(part.MediaType, "text/") {
+			return nil
+		}
+
+		content, err := ioutil.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		parts = append(parts, part.Charset() + " " + string(content))
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	want := []string{
+		"iso-8859-1 Caf\xe9 menu for Friday: http://example.com/menu\nSee you there.\n",
+		"utf-8 <html><body><p>Café menu for <b>Friday</b></p><a href=\"http://example.com/menu\">See the menu</a></body></html>",
+		"us-ascii Don't forget the receipt.\n",
+	}
+
+	if !reflect.DeepEqual(parts, want) {
+		t.Errorf("Walked text parts %q, wanted %q", parts, want)
+	}
+}
+
+func TestMIMEHeaderFromLines(t *testing.T) {
+	cases := []struct {
+		lines []string
+		header textproto.MIMEHeader
+	}{
+		{
+			[]string{"content-type: text/plain"},
+			textproto.MIMEHeader{"Content-Type": {"text/plain"}},
+		},
+		{
+			[]string{"Line with no header key", "\tstray continuation"},
+			textproto.MIMEHeader{},
+		},
+		{
+			[]string{
+				"Received: from a",
+				"\tby b",
+				"Received: from c",
+			},
+			textproto.MIMEHeader{"Received": {"from a by b", "from c"}},
+		},
+	}
+
+	for _, c := range cases {
+		if out := MIMEHeaderFromLines(c.lines); !reflect.DeepEqual(out, c.header) {
+			t.Errorf("%v returned %v, wanted %v", c.lines, out, c.header)
+		}
+	}
+}
+
+func TestSniffPart(t *testing.T) {
+	cases := []struct {
+		raw string
+		mediaType string
+		encoding string
+	}{
+		{"Subject: Plain\n\nx = y, 2+2=4\n", "text/plain", ""},
+		{"Subject: Soft break\n\nA long line=\nwrapped\n", "text/plain", "quoted-printable"},
+		{"Subject: Escapes\n\n<HTML><p class=3D\"a\">=E9</p>\n", "text/html", "quoted-printable"},
+		{"Subject: Lower case escape\n\n<body>=e9 =3d\n", "text/html", ""},
+		{"Content-Type: text/plain\n\n<html>Shown as is</html>\n", "text/plain", ""},
+		{"Content-Transfer-Encoding: 8bit\n\nx=3D\n", "text/plain", "8bit"},
+	}
+
+	for _, c := range cases {
+		headerLines, body := splitMessage(c.raw)
+
+		var part Part
+		_, err := WalkMIME(headerLines, body, func(p Part, body io.Reader) error {
+			part = p
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+
+		if part.MediaType != c.mediaType || part.Encoding != c.encoding {
+			t.Errorf("%q read as %v in %q, wanted %v in %q", c.raw, part.MediaType, part.Encoding, c.mediaType, c.encoding)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package parse
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"net/url"
+	"encoding/base64"
+)
+
+// Columns of the tabular URL output, matching the JSON keys
+var URLFields = []string{"message", "url", "domain", "wrapped"}
+
+// Links written out in text
+var textURLPattern = regexp.MustCompile(`(?i)\b(?:https?://|ftp://|www\.)[^\s<>"'` + "`" + `]+`)
+
+// Links in href and src attributes, quoted or not
+var attributeURLPattern = regexp.MustCompile(`(?i)\b(?:href|src)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+
+// Embedded link of Proofpoint URLDefense v3, followed by its replaced bytes
+var urlDefenseV3Pattern = regexp.MustCompile(`v3/__(.+?)__;(.*?)!`)
+
+// Placeholders in URLDefense v3 links: '*' for one replaced byte, '**' and a
+// run-length character for several
+var urlDefenseV3Token = regexp.MustCompile(`\*(\*.)?`)
+
+// URL is a link found in the body of a message
+type URL struct {
+	// Reference to the message carrying the link (its archive entry)
+	Message string `json:"message"`
+	// Link after unwrapping any rewriter
+	URL string `json:"url"`
+	// Host the link leads to
+	Domain string `json:"domain"`
+	// Link as found in the body, when it was rewritten by a security gateway
+	Wrapped string `json:"wrapped"`
+}
+
+// URLs lists the distinct links found in the text and HTML of the message,
+// in order of appearance. Links rewritten by Outlook SafeLinks, Proofpoint
+// URLDefense and Mimecast are unwrapped
+func (b *Body) URLs(message string) []URL {
+	var found []string
+
+	for _, text := range b.text {
+		found = append(found, TextURLs(text)...)
+	}
+	for _, content := range b.html {
+		found = append(found, HTMLURLs(content)...)
+		found = append(found, TextURLs(HTMLToText(content))...)
+	}
+
+	urls := []URL{}
+	seen := make(map[string]bool)
+
+	for _, link := range found {
+		unwrapped, domain := UnwrapURL(link)
+		if seen[unwrapped] {
+			continue
+		}
+		seen[unwrapped] = true
+
+		u := URL{Message: message, URL: unwrapped, Domain: domain}
+		if unwrapped != link {
+			u.Wrapped = link
+		}
+		urls = append(urls, u)
+	}
+
+	return urls
+}
+
+// TextURLs finds the links written out in plain text. Links cut short by a
+// quoted-printable soft line break, an '=' ending their line, are left out
+// since the rest of them cannot be told apart from the next line
+func TextURLs(text string) []string {
+	var urls []string
+
+	for _, bounds := range textURLPattern.FindAllStringIndex(text, -1) {
+		match := text[bounds[0]:bounds[1]]
+		rest := text[bounds[1]:]
+		if strings.HasSuffix(match, "=") && (strings.HasPrefix(rest, "\n") || strings.HasPrefix(rest, "\r\n")) {
+			continue
+		}
+
+		// Sentence punctuation and closing brackets rarely belong to the link
+		match = strings.TrimRight(match, ".,;:!?)]}")
+		if strings.HasPrefix(strings.ToLower(match), "www.") {
+			match = "http://" + match
+		}
+		urls = append(urls, match)
+	}
+
+	return urls
+}
+
+// HTMLURLs finds the web links in the href and src attributes of HTML,
+// skipping mailto:, cid: and other schemes
+func HTMLURLs(content string) []string {
+	var urls []string
+
+	for _, match := range attributeURLPattern.FindAllStringSubmatch(content, -1) {
+		// Only one of the quoting alternatives matched
+		value := html.UnescapeString(strings.TrimSpace(match[1] + match[2] + match[3]))
+
+		lower := strings.ToLower(value)
+		if strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") || strings.HasPrefix(lower, "ftp://") {
+			urls = append(urls, value)
+		}
+	}
+
+	return urls
+}
+
+// UnwrapURL recovers the original link from those rewritten by security
+// gateways, returning it with the domain it leads to. Mimecast links only
+// carry the destination domain, so they are kept as they are
+func UnwrapURL(link string) (string, string) {
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return link, ""
+	}
+	host := strings.ToLower(parsed.Hostname())
+
+	var unwrapped string
+
+	switch {
+	case strings.HasSuffix(host, ".safelinks.protection.outlook.com"):
+		unwrapped = parsed.Query().Get("url")
+	case host == "urldefense.proofpoint.com" && strings.HasPrefix(parsed.Path, "/v1/"):
+		unwrapped = parsed.Query().Get("u")
+	case host == "urldefense.proofpoint.com" && strings.HasPrefix(parsed.Path, "/v2/"):
+		// '-' stands in for '%' and '_' for '/'
+		encoded := strings.NewReplacer("-", "%", "_", "/").Replace(parsed.Query().Get("u"))
+		unwrapped, _ = url.QueryUnescape(encoded)
+	case host == "urldefense.com" && strings.HasPrefix(parsed.Path, "/v3/"):
+		unwrapped = unwrapURLDefenseV3(link)
+	case host == "mimecast.com" || strings.HasSuffix(host, ".mimecast.com") || strings.HasSuffix(host, ".mimecastprotect.com"):
+		if domain := parsed.Query().Get("domain"); domain != "" {
+			return link, strings.ToLower(domain)
+		}
+	}
+
+	// Rewriters may be nested, e.g. a forwarded SafeLink behind URLDefense
+	if unwrapped != "" && unwrapped != link {
+		if inner, domain := UnwrapURL(unwrapped); domain != "" {
+			return inner, domain
+		}
+	}
+
+	return link, host
+}
+
+// unwrapURLDefenseV3 restores the characters URLDefense v3 replaced with
+// placeholders, which are carried base64 encoded after the embedded link
+func unwrapURLDefenseV3(link string) string {
+	match := urlDefenseV3Pattern.FindStringSubmatch(link)
+	if match == nil {
+		return ""
+	}
+	embedded := match[1]
+
+	replaced, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(match[2], "="))
+	if err != nil {
+		return ""
+	}
+	replacements := []rune(string(replaced))
+
+	var invalid bool
+	unwrapped := urlDefenseV3Token.ReplaceAllStringFunc(embedded, func(token string) string {
+		// Run lengths count up from 2 along A-Z, a-z, 0-9, '-' and '_'
+		length := 1
+		if len(token) == 3 {
+			length = strings.IndexByte("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_", token[2]) + 2
+			if length < 2 {
+				invalid = true
+				return token
+			}
+		}
+
+		if length > len(replacements) {
+			invalid = true
+			return token
+		}
+		run := string(replacements[:length])
+		replacements = replacements[length:]
+		return run
+	})
+
+	if invalid {
+		return ""
+	}
+	return unwrapped
+}
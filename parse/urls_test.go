@@ -0,0 +1,206 @@
+package parse
+
+import (
+	"testing"
+	"reflect"
+	"strings"
+)
+
+func TestTextURLs(t *testing.T) {
+	cases := []struct {
+		text string
+		urls []string
+	}{
+		{"No links here", nil},
+		{"Menu at http://example.com/menu.", []string{"http://example.com/menu"}},
+		{"(see https://example.com/a?b=c), or", []string{"https://example.com/a?b=c"}},
+		{"Visit www.example.com!", []string{"http://www.example.com"}},
+		{"ftp://files.example.com/x <https://example.com>", []string{"ftp://files.example.com/x", "https://example.com"}},
+		{"Cut short http://www.=\nexample.com/a and http://example.com/b?c=\r\nd", nil},
+		{"Query http://example.com/?a= ends", []string{"http://example.com/?a="}},
+	}
+
+	for _, c := range cases {
+		if out := TextURLs(c.text); !reflect.DeepEqual(out, c.urls) {
+			t.Errorf("%q returned %v, wanted %v", c.text, out, c.urls)
+		}
+	}
+}
+
+func TestHTMLURLs(t *testing.T) {
+	cases := []struct {
+		html string
+		urls []string
+	}{
+		{
+			`<a href="http://contact-darty.com/_c.aspx?i=385774&amp;ue=10000">`,
+			[]string{"http://contact-darty.com/_c.aspx?i=385774&ue=10000"},
+		},
+		{
+			`<IMG SRC='https://example.com/pix.gif'><a href=http://example.com/bare>`,
+			[]string{"https://example.com/pix.gif", "http://example.com/bare"},
+		},
+		{
+			`<a href="mailto:ron@example.com"><img src="cid:logo"><a href="#top">`,
+			nil,
+		},
+	}
+
+	for _, c := range cases {
+		if out := HTMLURLs(c.html); !reflect.DeepEqual(out, c.urls) {
+			t.Errorf("%q returned %v, wanted %v", c.html, out, c.urls)
+		}
+	}
+}
+
+func TestUnwrapURL(t *testing.T) {
+	cases := []struct {
+		link string
+		url string
+		domain string
+	}{
+		{
+			"http://Example.com/path",
+			"http://Example.com/path",
+			"example.com",
+		},
+		{
+			"https://nam02.safelinks.protection.outlook.com/?url=https%3A%2F%2Fexample.com%2Fpath%3Fa%3D1&data=02%7C01&reserved=0",
+			"https://example.com/path?a=1",
+			"example.com",
+		},
+		{
+			"https://urldefense.proofpoint.com/v1/url?u=http://www.example.com/&k=abc",
+			"http://www.example.com/",
+			"www.example.com",
+		},
+		{
+			"https://urldefense.proofpoint.com/v2/url?u=https-3A__example.com_path-3Fa-3D1&d=DwMF&c=x",
+			"https://example.com/path?a=1",
+			"example.com",
+		},
+		{
+			"https://urldefense.com/v3/__https://www.example.com/path?a=1*b=2__;Jg!!ABCD$",
+			"https://www.example.com/path?a=1&b=2",
+			"www.example.com",
+		},
+		{
+			"https://urldefense.com/v3/__https://example.com/**Aabc__;Li4!!ABCD$",
+			"https://example.com/..abc",
+			"example.com",
+		},
+		{
+			// More placeholders than replaced bytes
+			"https://urldefense.com/v3/__https://example.com/*a*b*__;Li4!!ABCD$",
+			"https://urldefense.com/v3/__https://example.com/*a*b*__;Li4!!ABCD$",
+			"urldefense.com",
+		},
+		{
+			"https://urldefense.proofpoint.com/v2/url?u=https-3A__nam02.safelinks.protection.outlook.com_-3Furl-3Dhttps-253A-252F-252Fexample.com&d=x",
+			"https://example.com",
+			"example.com",
+		},
+		{
+			"https://protect-eu.mimecast.com/s/AbCdEf?domain=Example.com",
+			"https://protect-eu.mimecast.com/s/AbCdEf?domain=Example.com",
+			"example.com",
+		},
+	}
+
+	for _, c := range cases {
+		if out, domain := UnwrapURL(c.link); out != c.url || domain != c.domain {
+			t.Errorf("%v returned %v %v, wanted %v %v", c.link, out, domain, c.url, c.domain)
+		}
+	}
+}
+
+func TestBodyURLs(t *testing.T) {
+	raw := "Content-Type: multipart/alternative; boundary=b\n\n" +
+		"--b\nContent-Type: text/plain\n\n" +
+		"Menu: http://example.com/menu\n" +
+		"Order: https://nam02.safelinks.protection.outlook.com/?url=https%3A%2F%2Fexample.com%2Forder&data=1\n" +
+		"--b\nContent-Type: text/html\n\n" +
+		"<a href=\"http://example.com/menu\">http://example.com/menu</a><img src=\"http://example.com/logo.png\">\n" +
+		"--b--\n"
+
+	headerLines, body := splitMessage(raw)
+
+	var collected Body
+	if _, err := WalkMIME(headerLines, body, collected.AddPart); err != nil {
+		t.Error(err)
+	}
+
+	want := []URL{
+		{"lunch.msg", "http://example.com/menu", "example.com", ""},
+		{
+			"lunch.msg",
+			"https://example.com/order",
+			"example.com",
+			"https://nam02.safelinks.protection.outlook.com/?url=https%3A%2F%2Fexample.com%2Forder&data=1",
+		},
+		{"lunch.msg", "http://example.com/logo.png", "example.com", ""},
+	}
+
+	if out := collected.URLs("lunch.msg"); !reflect.DeepEqual(out, want) {
+		t.Errorf("Received %v, wanted %v", out, want)
+	}
+
+	var empty Body
+	if out := empty.URLs("empty.msg"); out == nil || len(out) != 0 {
+		t.Errorf("Received %v, wanted empty list", out)
+	}
+}
+
+func TestBodyURLsUndeclaredEncoding(t *testing.T) {
+	cases := []struct {
+		path string
+		count int
+		// Some of the links, in full
+		urls []string
+	}{
+		{
+			"../test_files/msgs/return_x-orig_received.msg",
+			31,
+			[]string{
+				"http://bnimg1.beliefnet.com/ads/beliefnet/beliefnetlogo-1.gif",
+				"http://www.beliefnet.com/media/spacer.gif",
+				"http://bnimg1.beliefnet.com/ads/chcknsp/110402c1_01.jpg",
+				"http://www.beliefnet.com/about/privacy.asp",
+			},
+		},
+		{
+			"../test_files/msgs/subject_date_from.msg",
+			129,
+			[]string{
+				"http://contact-darty.com/_v.aspx?i=385774&ue=10000&m=322",
+				"http://mm.cache.coltfrance.com/Darty_CRM/img/mailing/00322/darty_02.jpg",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		headerLines, body := splitMessage(readMessageFile(t, c.path))
+
+		var collected Body
+		if _, err := WalkMIME(headerLines, body, collected.AddPart); err != nil {
+			t.Error(err)
+		}
+
+		found := map[string]bool{}
+		urls := collected.URLs(c.path)
+		for _, u := range urls {
+			found[u.URL] = true
+			if strings.HasSuffix(u.URL, "=") || strings.Contains(u.URL, "=3D") {
+				t.Errorf("%v: broken link %q", c.path, u.URL)
+			}
+		}
+		if len(urls) != c.count {
+			t.Errorf("%v: %v links, wanted %v", c.path, len(urls), c.count)
+		}
+		for _, link := range c.urls {
+			if !found[link] {
+				t.Errorf("%v: %q not found", c.path, link)
+			}
+		}
+	}
+}
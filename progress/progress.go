@@ -0,0 +1,341 @@
+package progress
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"sync"
+	"time"
+	"strings"
+	"sync/atomic"
+	"encoding/json"
+)
+
+// Modes of reporting: a display when writing to a terminal, a display
+// whatever the output, none, or a JSON event per line
+const (
+	Auto = "auto"
+	Always = "always"
+	Never = "never"
+	JSON = "json"
+)
+
+var Modes = map[string]bool{
+	Auto: true,
+	Always: true,
+	Never: true,
+	JSON: true,
+}
+
+// Phases of an extraction: the gzipped archive is unpacked, measured in
+// bytes of it read, then the tar archive is walked, measured in bytes of it
+// walked, then whatever was held back is written out. An archive which
+// cannot be read ends the extraction as failed instead
+const (
+	Unpacking = "unpacking"
+	Extracting = "extracting"
+	Writing = "writing"
+	Done = "done"
+	Failed = "failed"
+)
+
+// Event is how far an extraction went, as reported in JSON
+type Event struct {
+	Time time.Time `json:"time"`
+	Phase string `json:"phase"`
+	Bytes int64 `json:"bytes"`
+	TotalBytes int64 `json:"total_bytes"`
+	Messages int64 `json:"messages"`
+	MessagesPerSecond float64 `json:"messages_per_second"`
+	// Estimate of the seconds left in the phase, once there is one
+	ETASeconds float64 `json:"eta_seconds,omitempty"`
+	Skipped int64 `json:"skipped"`
+	Failed int64 `json:"failed"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	// Messages read from the archive waiting to be output
+	QueueDepth int `json:"queue_depth"`
+	// Time spent unpacking, parsing and writing out, once done
+	StageSeconds map[string]float64 `json:"stage_seconds,omitempty"`
+	// Why the archive could not be read, once failed, e.g. gzip or tar
+	FailureReason string `json:"failure_reason,omitempty"`
+}
+
+// Reporter reports how far an extraction went every interval. Counters are
+// safe to update from any goroutine, and a nil Reporter reports nothing
+type Reporter struct {
+	out io.Writer
+	json bool
+	interval time.Duration
+
+	bytes int64
+	messages int64
+	skipped int64
+	failed int64
+
+	mu sync.Mutex
+	phase string
+	total int64
+	// Bytes done when the phase started, e.g. when resuming
+	phaseBytes int64
+	phaseStart time.Time
+	start time.Time
+	// When messages started coming
+	extractStart time.Time
+	// Length of the display line last drawn
+	drawn int
+	queue func() int
+	stageSeconds map[string]float64
+	failureReason string
+
+	stop chan struct{}
+	stopped chan struct{}
+}
+
+// New starts reporting to out in the mode given, returning nil if there is
+// nothing to report. Auto only reports to a terminal
+func New(mode string, out *os.File, interval time.Duration) *Reporter {
+	switch mode {
+	case Never:
+		return nil
+	case Auto:
+		info, err := out.Stat()
+		if err != nil || info.Mode() & os.ModeCharDevice == 0 {
+			return nil
+		}
+	}
+
+	now := time.Now()
+	r := &Reporter{
+		out: out,
+		json: mode == JSON,
+		interval: interval,
+		phase: Unpacking,
+		phaseStart: now,
+		start: now,
+		stop: make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+func (r *Reporter) run() {
+	defer close(r.stopped)
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.report(r.event(time.Now()))
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Phase starts the next phase, of total bytes of which done are done
+func (r *Reporter) Phase(phase string, done, total int64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.phase = phase
+	r.total = total
+	r.phaseBytes = done
+	r.phaseStart = time.Now()
+	if phase == Extracting {
+		r.extractStart = r.phaseStart
+	}
+	atomic.StoreInt64(&r.bytes, done)
+}
+
+// SetBytes sets the bytes of the phase done so far
+func (r *Reporter) SetBytes(done int64) {
+	if r != nil {
+		atomic.StoreInt64(&r.bytes, done)
+	}
+}
+
+// Message counts a message output
+func (r *Reporter) Message() {
+	if r != nil {
+		atomic.AddInt64(&r.messages, 1)
+	}
+}
+
+// Skip counts a message left out, by a filter or as a duplicate
+func (r *Reporter) Skip() {
+	if r != nil {
+		atomic.AddInt64(&r.skipped, 1)
+	}
+}
+
+// Fail counts a message which could not be read whole
+func (r *Reporter) Fail() {
+	if r != nil {
+		atomic.AddInt64(&r.failed, 1)
+	}
+}
+
+// SetQueue gives the length of the queue of messages to be output
+func (r *Reporter) SetQueue(queue func() int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.queue = queue
+}
+
+// SetStageSeconds sets the time spent in each stage, for the last report
+func (r *Reporter) SetStageSeconds(seconds map[string]float64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stageSeconds = seconds
+}
+
+// Finish stops reporting, with a last report of the extraction done
+func (r *Reporter) Finish() {
+	r.end(Done, "")
+}
+
+// Abort stops reporting, with a last report of the extraction failed as
+// the archive could not be read for the reason given
+func (r *Reporter) Abort(reason string) {
+	r.end(Failed, reason)
+}
+
+func (r *Reporter) end(phase, failureReason string) {
+	if r == nil {
+		return
+	}
+	close(r.stop)
+	<-r.stopped
+
+	r.mu.Lock()
+	r.phase = phase
+	r.failureReason = failureReason
+	r.mu.Unlock()
+	r.report(r.event(time.Now()))
+	if !r.json {
+		fmt.Fprintln(r.out)
+	}
+}
+
+// Log returns a writer for log messages, clearing the display off the line
+// before each, to be drawn again below
+func (r *Reporter) Log(out io.Writer) io.Writer {
+	if r == nil || r.json {
+		return out
+	}
+	return logWriter{r, out}
+}
+
+type logWriter struct {
+	r *Reporter
+	out io.Writer
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	w.r.mu.Lock()
+	defer w.r.mu.Unlock()
+	w.r.clear()
+	return w.out.Write(p)
+}
+
+func (r *Reporter) event(now time.Time) Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e := Event{
+		Time: now.UTC(),
+		Phase: r.phase,
+		Bytes: atomic.LoadInt64(&r.bytes),
+		TotalBytes: r.total,
+		Messages: atomic.LoadInt64(&r.messages),
+		Skipped: atomic.LoadInt64(&r.skipped),
+		Failed: atomic.LoadInt64(&r.failed),
+		ElapsedSeconds: now.Sub(r.start).Seconds(),
+	}
+	if r.queue != nil {
+		e.QueueDepth = r.queue()
+	}
+	if r.phase == Done {
+		e.StageSeconds = r.stageSeconds
+	}
+	e.FailureReason = r.failureReason
+	if seconds := now.Sub(r.extractStart).Seconds(); !r.extractStart.IsZero() && seconds > 0 {
+		e.MessagesPerSecond = float64(e.Messages) / seconds
+	}
+
+	// The rate of the phase so far, which ought to hold for the rest
+	phaseSeconds := now.Sub(r.phaseStart).Seconds()
+	if done := e.Bytes - r.phaseBytes; done > 0 && r.total > e.Bytes && r.phase != Done && r.phase != Failed {
+		e.ETASeconds = float64(r.total - e.Bytes) * phaseSeconds / float64(done)
+	}
+	return e
+}
+
+func (r *Reporter) report(e Event) {
+	if r.json {
+		line, err := json.Marshal(e)
+		if err == nil {
+			r.out.Write(append(line, '\n'))
+		}
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clear()
+	line := Format(e)
+	fmt.Fprint(r.out, line)
+	r.drawn = len(line)
+}
+
+// clear blanks the display line, returning to its start
+func (r *Reporter) clear() {
+	if r.drawn > 0 {
+		fmt.Fprintf(r.out, "\r%v\r", strings.Repeat(" ", r.drawn))
+		r.drawn = 0
+	}
+}
+
+// Format lays the event out on a line, e.g.
+// extracting 52.3 MiB/120.0 MiB (43%) 40210 messages, 1234 msg/s ETA 1m12s, 3 skipped, 0 failed
+func Format(e Event) string {
+	var b strings.Builder
+	b.WriteString(e.Phase)
+	if e.TotalBytes > 0 {
+		fmt.Fprintf(&b, " %v/%v (%v%%)", formatBytes(e.Bytes), formatBytes(e.TotalBytes), e.Bytes * 100 / e.TotalBytes)
+	}
+	fmt.Fprintf(&b, " %v messages, %.0f msg/s", e.Messages, e.MessagesPerSecond)
+	if e.ETASeconds > 0 {
+		fmt.Fprintf(&b, " ETA %v", (time.Duration(e.ETASeconds) * time.Second).Round(time.Second))
+	}
+	if e.Phase == Done || e.Phase == Failed {
+		fmt.Fprintf(&b, " in %v", (time.Duration(e.ElapsedSeconds * float64(time.Second))).Round(time.Second))
+	}
+	fmt.Fprintf(&b, ", %v skipped, %v failed", e.Skipped, e.Failed)
+	if e.FailureReason != "" {
+		fmt.Fprintf(&b, ", archive unreadable (%v)", e.FailureReason)
+	}
+	return b.String()
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1 << 30:
+		return fmt.Sprintf("%.1f GiB", float64(n) / (1 << 30))
+	case n >= 1 << 20:
+		return fmt.Sprintf("%.1f MiB", float64(n) / (1 << 20))
+	case n >= 1 << 10:
+		return fmt.Sprintf("%.1f KiB", float64(n) / (1 << 10))
+	}
+	return fmt.Sprintf("%v B", n)
+}
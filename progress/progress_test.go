@@ -0,0 +1,109 @@
+package progress
+
+import (
+	"os"
+	"time"
+	"bufio"
+	"testing"
+	"io/ioutil"
+	"encoding/json"
+)
+
+func TestFormat(t *testing.T) {
+	cases := []struct {
+		event Event
+		line string
+	}{
+		{
+			Event{Phase: Unpacking, Bytes: 512, TotalBytes: 2048},
+			"unpacking 512 B/2.0 KiB (25%) 0 messages, 0 msg/s, 0 skipped, 0 failed",
+		},
+		{
+			Event{Phase: Extracting, Bytes: 3 << 20, TotalBytes: 12 << 20, Messages: 40210, MessagesPerSecond: 1234.4, ETASeconds: 72.6, Skipped: 3},
+			"extracting 3.0 MiB/12.0 MiB (25%) 40210 messages, 1234 msg/s ETA 1m12s, 3 skipped, 0 failed",
+		},
+		{
+			Event{Phase: Done, Messages: 2, MessagesPerSecond: 2, ElapsedSeconds: 61.2, Failed: 1},
+			"done 2 messages, 2 msg/s in 1m1s, 0 skipped, 1 failed",
+		},
+		{
+			Event{Phase: Failed, Bytes: 1024, TotalBytes: 2048, ElapsedSeconds: 3, FailureReason: "tar"},
+			"failed 1.0 KiB/2.0 KiB (50%) 0 messages, 0 msg/s in 3s, 0 skipped, 0 failed, archive unreadable (tar)",
+		},
+	}
+
+	for _, tc := range cases {
+		if line := Format(tc.event); line != tc.line {
+			t.Errorf("formatted %q, expected %q", line, tc.line)
+		}
+	}
+}
+
+func TestReporterJSON(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("../test_files", "tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	out, err := ioutil.TempFile(tmpDir, "progress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	// Not a terminal
+	if r := New(Auto, out, time.Millisecond); r != nil {
+		t.Errorf("reporting to a file in auto mode")
+	}
+
+	r := New(JSON, out, 10 * time.Millisecond)
+	r.SetBytes(100)
+	r.Phase(Extracting, 200, 1000)
+	r.Message()
+	r.Message()
+	r.Skip()
+	r.Fail()
+	r.SetBytes(600)
+	r.SetQueue(func() int { return 3 })
+	time.Sleep(50 * time.Millisecond)
+	r.SetStageSeconds(map[string]float64{"unpack": 1.5})
+	r.Finish()
+
+	out.Seek(0, 0)
+	var events []Event
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, e)
+	}
+	if len(events) < 2 {
+		t.Fatalf("%v events", len(events))
+	}
+
+	if e := events[0]; e.Phase != Extracting || e.Bytes != 600 || e.TotalBytes != 1000 || e.ETASeconds <= 0 || e.QueueDepth != 3 || e.StageSeconds != nil {
+		t.Errorf("first event %+v", e)
+	}
+	last := events[len(events) - 1]
+	if last.Phase != Done || last.Messages != 2 || last.Skipped != 1 || last.Failed != 1 || last.ETASeconds != 0 || last.MessagesPerSecond <= 0 || last.StageSeconds["unpack"] != 1.5 || last.FailureReason != "" {
+		t.Errorf("last event %+v", last)
+	}
+
+	// Ending on an unreadable archive
+	out.Truncate(0)
+	out.Seek(0, 0)
+	r = New(JSON, out, time.Hour)
+	r.Phase(Extracting, 0, 1000)
+	r.Abort("tar")
+	out.Seek(0, 0)
+	var e Event
+	if err := json.NewDecoder(out).Decode(&e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Phase != Failed || e.FailureReason != "tar" || e.ETASeconds != 0 {
+		t.Errorf("failed event %+v", e)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"log"
+	"flag"
+	"time"
+	"context"
+	"syscall"
+	"net/http"
+	"os/signal"
+	"github.com/asgaines/msgextract/server"
+)
+
+// How long requests under way are given to finish on shutdown
+const shutdownTimeout = 30 * time.Second
+
+// serve runs the HTTP API until interrupted, then stops taking requests
+// and lets those under way finish
+func serve(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s serve [opt args]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	var config server.Config
+	addr := flags.String("addr", ":8080", "Address to listen on")
+	flags.Int64Var(&config.MaxUploadSize, "max-upload-size", 1 << 30, "Largest archive accepted in a request body, in bytes")
+	flags.IntVar(&config.MaxConcurrent, "max-concurrent", 0, "Archives extracted at once (default the number of CPUs)")
+	flags.StringVar(&config.ArchiveDir, "archive-dir", "", "Directory archives may be referenced from by path with archive=, instead of uploaded")
+	flags.StringVar(&config.WorkDir, "work-dir", "", "Directory keeping the archives and results of jobs (default a temporary directory)")
+	flags.DurationVar(&config.JobTTL, "job-ttl", time.Hour, "How long the result of a finished job is kept")
+	pprofAddr := flags.String("pprof-addr", "", "Address to serve runtime profiles on under /debug/pprof/, e.g. localhost:6060 (default none)")
+	flags.Parse(args)
+
+	api, err := server.New(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	serveDebug("", nil, *pprofAddr)
+
+	httpServer := &http.Server{Addr: *addr, Handler: api, ReadHeaderTimeout: 10 * time.Second}
+	// HTTP/2 without TLS carries the gRPC calls
+	httpServer.Protocols = new(http.Protocols)
+	httpServer.Protocols.SetHTTP1(true)
+	httpServer.Protocols.SetUnencryptedHTTP2(true)
+
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+
+		// Reported as not ready while requests under way finish
+		api.Drain()
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := httpServer.Shutdown(ctx); err != nil {
+			log.Print(err)
+		}
+		close(stopped)
+	}()
+
+	log.Printf("serving on %v", *addr)
+	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		api.Close()
+		log.Fatal(err)
+	}
+	<-stopped
+
+	if err := api.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"io"
+	"context"
+	"strings"
+	"net/http"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"github.com/asgaines/msgextract/parse"
+	"github.com/asgaines/msgextract/output"
+	"github.com/asgaines/msgextract/filter"
+	"github.com/asgaines/msgextract/msgextractpb"
+)
+
+//go:generate buf generate --template buf.gen.yaml --path msgextract.proto .
+
+// isGRPC tells gRPC calls from requests to the HTTP API
+func isGRPC(r *http.Request) bool {
+	return r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// newGRPCServer serves the Extractor service of msgextract.proto, taking
+// the calls handed over by ServeHTTP
+func newGRPCServer(s *Server) *grpc.Server {
+	server := grpc.NewServer()
+	msgextractpb.RegisterExtractorServer(server, &extractor{s: s})
+	return server
+}
+
+// extractor answers the Extract RPC: the archive arrives in the chunks of a
+// stream of requests, the first of which also says what to extract, and the
+// messages go back as a stream as they are extracted
+type extractor struct {
+	msgextractpb.UnimplementedExtractorServer
+	s *Server
+}
+
+func (e *extractor) Extract(stream msgextractpb.Extractor_ExtractServer) error {
+	s := e.s
+	if s.isDraining() {
+		return status.Error(codes.Unavailable, "draining")
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+		defer func() { <-s.slots }()
+	default:
+		return status.Error(codes.Unavailable, "too many extractions under way")
+	}
+
+	archive := &grpcArchive{stream: stream, limit: s.config.MaxUploadSize}
+	first, err := archive.next()
+	if err == io.EOF {
+		return status.Error(codes.InvalidArgument, "no request")
+	} else if err != nil {
+		return err
+	}
+
+	var req request
+	if first.Where != "" {
+		if req.where, err = filter.Parse(first.Where); err != nil {
+			return status.Errorf(codes.InvalidArgument, "where: %v", err)
+		}
+	}
+
+	writer := &grpcWriter{stream: stream, fields: first.Fields, includeHeaders: first.IncludeHeaders}
+	_, err = s.extract(stream.Context(), archive, req, writer)
+	return grpcStatus(stream.Context(), err)
+}
+
+// grpcStatus is the status ending a call which returned err
+func grpcStatus(ctx context.Context, err error) error {
+	if _, ok := status.FromError(err); ok {
+		// No error, or one with a status already
+		return err
+	}
+	if ctx.Err() != nil {
+		return status.FromContextError(ctx.Err()).Err()
+	}
+	// The archive could not be read
+	return status.Error(codes.InvalidArgument, err.Error())
+}
+
+// grpcArchive reads the archive from the chunks of the requests of a call
+type grpcArchive struct {
+	stream msgextractpb.Extractor_ExtractServer
+	// Bytes of archive allowed, and read so far
+	limit int64
+	read int64
+	// What is left of the last chunk
+	chunk []byte
+}
+
+// next receives the following request, keeping its chunk
+func (a *grpcArchive) next() (*msgextractpb.ExtractRequest, error) {
+	req, err := a.stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+
+	a.read += int64(len(req.Chunk))
+	if a.read > a.limit {
+		return nil, status.Errorf(codes.ResourceExhausted, "archive larger than %v bytes", a.limit)
+	}
+	a.chunk = req.Chunk
+	return req, nil
+}
+
+func (a *grpcArchive) Read(p []byte) (int, error) {
+	for len(a.chunk) == 0 {
+		if _, err := a.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, a.chunk)
+	a.chunk = a.chunk[n:]
+	return n, nil
+}
+
+// grpcWriter sends each message as a Message of the response stream
+type grpcWriter struct {
+	stream msgextractpb.Extractor_ExtractServer
+	// Fields asked for, all when empty
+	fields []string
+	includeHeaders bool
+}
+
+func (g *grpcWriter) Write(message output.Message) error {
+	m := &msgextractpb.Message{Name: validUTF8(message.Headers["message"]), Fields: map[string]string{}}
+
+	for field, value := range message.Headers {
+		if field != "message" && len(g.fields) == 0 {
+			m.Fields[validUTF8(field)] = validUTF8(value)
+		}
+	}
+	for _, field := range g.fields {
+		if value, ok := message.Headers[field]; ok {
+			m.Fields[validUTF8(field)] = validUTF8(value)
+		}
+	}
+
+	if g.includeHeaders {
+		for _, header := range parse.HeaderFields(message.HeaderLines) {
+			m.Headers = append(m.Headers, &msgextractpb.Header{Name: validUTF8(header.Name), Value: validUTF8(header.Value)})
+		}
+	}
+
+	return g.stream.Send(m)
+}
+
+func (g *grpcWriter) Close() error {
+	return nil
+}
+
+// validUTF8 replaces invalid UTF-8, which protobuf strings may not hold
+func validUTF8(s string) string {
+	return strings.ToValidUTF8(s, "�")
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"os"
+	"io"
+	"bytes"
+	"testing"
+	"net/http"
+	"io/ioutil"
+	"context"
+	"strings"
+	"net/http/httptest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/grpc/credentials/insecure"
+	"github.com/asgaines/msgextract/msgextractpb"
+)
+
+// newGRPCTestServer serves the server over HTTP/2 without TLS, returning a
+// client speaking it
+func newGRPCTestServer(t *testing.T, config Config) (*Server, *httptest.Server, *http.Client) {
+	tmpDir, err := ioutil.TempDir("../test_files", "tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.WorkDir = tmpDir
+
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+
+	server := httptest.NewUnstartedServer(s)
+	server.Config.Protocols = protocols
+	server.Start()
+	t.Cleanup(func() {
+		server.Close()
+		s.Close()
+		os.RemoveAll(tmpDir)
+	})
+
+	return s, server, &http.Client{Transport: &http.Transport{Protocols: protocols}}
+}
+
+// TestGRPCExtract calls the server with grpc-go through the stubs generated
+// from msgextract.proto, as clients do
+func TestGRPCExtract(t *testing.T) {
+	s, server, httpClient := newGRPCTestServer(t, Config{})
+
+	conn, err := grpc.NewClient(strings.TrimPrefix(server.URL, "http://"), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := msgextractpb.NewExtractorClient(conn)
+
+	gzipped := readFile(t, gzippedArchive)
+	darty := "test_files/msgs/subject_date_from.msg"
+	subject := "Cuit Vapeur 29.90 euros, Nintendo 3DS 239 euros, GPS TOM TOM 139 euros... decouvrez VITE tous les bons plans du weekend !"
+
+	cases := []struct {
+		name string
+		first *msgextractpb.ExtractRequest
+		archive []byte
+		messages []*msgextractpb.Message
+		code codes.Code
+		message string
+	}{
+		{
+			name: "fields and headers asked for",
+			first: &msgextractpb.ExtractRequest{Fields: []string{"Subject", "Missing"}, Where: `has(Subject)`, IncludeHeaders: true},
+			archive: gzipped,
+			messages: []*msgextractpb.Message{{
+				Name: darty,
+				Fields: map[string]string{"Subject": subject},
+				Headers: []*msgextractpb.Header{
+					{Name: "From", Value: `"Darty" <infos@contact-darty.com>`},
+					{Name: "Subject", Value: subject},
+					{Name: "Date", Value: "01 Apr 2011 16:17:41 +0200"},
+				},
+			}},
+			code: codes.OK,
+		},
+		{
+			name: "every field",
+			first: &msgextractpb.ExtractRequest{Where: `From.domain == "contact-darty.com"`},
+			archive: gzipped,
+			messages: []*msgextractpb.Message{{
+				Name: darty,
+				Fields: map[string]string{"From": `"Darty" <infos@contact-darty.com>`, "Subject": subject, "Date": "01 Apr 2011 16:17:41 +0200"},
+			}},
+			code: codes.OK,
+		},
+		{
+			name: "status message escaped",
+			first: &msgextractpb.ExtractRequest{Where: "Subject =~ /(%41 café/"},
+			archive: gzipped,
+			code: codes.InvalidArgument,
+			message: "where: column 12: invalid regex: error parsing regexp: missing closing ): `(%41 café`",
+		},
+		{
+			name: "not an archive",
+			first: &msgextractpb.ExtractRequest{},
+			archive: bytes.Repeat([]byte("not a tar archive\n"), 100),
+			code: codes.InvalidArgument,
+			message: "archive/tar: invalid tar header",
+		},
+		{
+			name: "empty archive",
+			first: &msgextractpb.ExtractRequest{},
+			code: codes.OK,
+		},
+		{
+			name: "no request",
+			code: codes.InvalidArgument,
+			message: "no request",
+		},
+	}
+
+	for _, c := range cases {
+		messages, err := clientExtract(client, c.first, c.archive, 1000)
+
+		if st := status.Convert(err); st.Code() != c.code || c.message != "" && st.Message() != c.message {
+			t.Errorf("%v: status %v %q, expected %v %q", c.name, st.Code(), st.Message(), c.code, c.message)
+		}
+		if len(messages) != len(c.messages) {
+			t.Errorf("%v: streamed %v, expected %v", c.name, messages, c.messages)
+			continue
+		}
+		for i := range messages {
+			if !proto.Equal(messages[i], c.messages[i]) {
+				t.Errorf("%v: streamed %v, expected %v", c.name, messages[i], c.messages[i])
+			}
+		}
+	}
+
+	// Archives too large end the call once over the limit
+	s.config.MaxUploadSize = 5000
+	if _, err := clientExtract(client, &msgextractpb.ExtractRequest{}, readFile(t, tarArchive), 10000); status.Code(err) != codes.ResourceExhausted || status.Convert(err).Message() != "archive larger than 5000 bytes" {
+		t.Errorf("too large: %v", err)
+	}
+
+	// Unknown methods and full servers refuse calls
+	if err := conn.Invoke(context.Background(), "/msgextract.Extractor/Other", &msgextractpb.ExtractRequest{}, &msgextractpb.Message{}); status.Code(err) != codes.Unimplemented {
+		t.Errorf("unknown method: %v", err)
+	}
+	for i := 0; i < cap(s.slots); i++ {
+		s.slots <- struct{}{}
+	}
+	if _, err := clientExtract(client, &msgextractpb.ExtractRequest{}, gzipped, 1000); status.Code(err) != codes.Unavailable {
+		t.Errorf("busy: %v", err)
+	}
+	for i := 0; i < cap(s.slots); i++ {
+		<-s.slots
+	}
+
+	// The HTTP API shares the address, over HTTP/2 too
+	response, err := httpClient.Get(server.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.ProtoMajor != 2 || response.StatusCode != 200 {
+		t.Errorf("HTTP API: %v %v", response.Proto, response.Status)
+	}
+
+	s.Drain()
+	if _, err := clientExtract(client, &msgextractpb.ExtractRequest{}, gzipped, 1000); status.Code(err) != codes.Unavailable {
+		t.Errorf("draining: %v", err)
+	}
+}
+
+// clientExtract streams the archive in chunks of the size given after the
+// first request, returning the messages streamed back
+func clientExtract(client msgextractpb.ExtractorClient, first *msgextractpb.ExtractRequest, archive []byte, size int) ([]*msgextractpb.Message, error) {
+	stream, err := client.Extract(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	// The server may end the call before reading every request, failing
+	// sends with io.EOF, the status coming with the responses. Without a
+	// first request, none is sent
+	var requests []*msgextractpb.ExtractRequest
+	if first != nil {
+		requests = append(requests, first)
+		for ; len(archive) > size; archive = archive[size:] {
+			requests = append(requests, &msgextractpb.ExtractRequest{Chunk: archive[:size]})
+		}
+		requests = append(requests, &msgextractpb.ExtractRequest{Chunk: archive})
+	}
+	for _, request := range requests {
+		if err := stream.Send(request); err != nil {
+			break
+		}
+	}
+	stream.CloseSend()
+
+	var messages []*msgextractpb.Message
+	for {
+		message, err := stream.Recv()
+		if err == io.EOF {
+			return messages, nil
+		} else if err != nil {
+			return messages, err
+		}
+		messages = append(messages, message)
+	}
+}
@@ -0,0 +1,377 @@
+package server
+
+import (
+	"io"
+	"os"
+	"log"
+	"fmt"
+	"time"
+	"context"
+	"strings"
+	"net/http"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+	"github.com/asgaines/msgextract/output"
+)
+
+// Format describes the result of jobs in an output format
+type Format struct {
+	Extension string
+	ContentType string
+}
+
+// Formats jobs write their result in, streamed as messages are extracted
+var Formats = map[string]Format{
+	"jsonl": {"jsonl", "application/x-ndjson"},
+	"parquet": {"parquet", "application/vnd.apache.parquet"},
+	"arrow": {"arrow", "application/vnd.apache.arrow.file"},
+	"arrows": {"arrows", "application/vnd.apache.arrow.stream"},
+	"avro": {"avro", "application/avro"},
+	"xml": {"xml", "application/xml"},
+	"xlsx": {"xlsx", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"},
+	"es-bulk": {"ndjson", "application/x-ndjson"},
+}
+
+// Statuses of a job
+const (
+	Queued = "queued"
+	Running = "running"
+	Done = "done"
+	Failed = "failed"
+	Canceled = "canceled"
+)
+
+// job is an extraction run in the background, its archive and result kept
+// in a directory of its own. Its exported fields are its status, guarded
+// by the server's mutex
+type job struct {
+	ID string `json:"id"`
+	Status string `json:"status"`
+	Format string `json:"format"`
+	Fields []string `json:"fields"`
+	Messages int `json:"messages"`
+	Error string `json:"error,omitempty"`
+	Created time.Time `json:"created"`
+	Finished *time.Time `json:"finished,omitempty"`
+
+	dir string
+	request request
+	cancel context.CancelFunc
+}
+
+// handleJobs starts a job, saving an uploaded archive first. It answers
+// 202 Accepted with the status of the job, located at /jobs/{id}
+func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.isDraining() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+
+	req, err := parseRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.expireJobs()
+
+	id, err := newJobID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	dir := filepath.Join(s.config.WorkDir, id)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The body is gone once answered, so the job works on a copy
+	archive, status, err := s.openArchive(r, req.archive)
+	if err == nil && req.archive == "" {
+		err = saveArchive(archive, filepath.Join(dir, "archive"))
+		status = errorStatus(err)
+	}
+	if archive != nil {
+		archive.Close()
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{
+		ID: id,
+		Status: Queued,
+		Format: req.format,
+		Fields: req.fields,
+		Created: time.Now().UTC(),
+		dir: dir,
+		request: req,
+		cancel: cancel,
+	}
+
+	s.mu.Lock()
+	if s.draining {
+		s.mu.Unlock()
+		cancel()
+		os.RemoveAll(dir)
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	s.jobs[id] = j
+	s.running.Add(1)
+	s.mu.Unlock()
+
+	go s.run(ctx, j)
+
+	w.Header().Set("Location", "/jobs/" + id)
+	s.writeJob(w, j, http.StatusAccepted)
+}
+
+// handleJob answers the status or result of a job, or cancels it
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	result := strings.HasSuffix(id, "/result")
+	id = strings.TrimSuffix(id, "/result")
+
+	s.mu.Lock()
+	j := s.jobs[id]
+	s.mu.Unlock()
+	if j == nil || strings.Contains(id, "/") {
+		http.Error(w, "no such job", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && result:
+		s.serveResult(w, r, j)
+	case r.Method == "GET":
+		s.writeJob(w, j, http.StatusOK)
+	case r.Method == "DELETE" && !result:
+		s.deleteJob(j)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		if result {
+			w.Header().Set("Allow", "GET")
+		} else {
+			w.Header().Set("Allow", "GET, DELETE")
+		}
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// writeJob answers with the status of the job as JSON
+func (s *Server) writeJob(w http.ResponseWriter, j *job, status int) {
+	s.mu.Lock()
+	content, err := json.Marshal(j)
+	s.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(content, '\n'))
+}
+
+// serveResult answers with the output of a job once done
+func (s *Server) serveResult(w http.ResponseWriter, r *http.Request, j *job) {
+	s.mu.Lock()
+	status := j.Status
+	s.mu.Unlock()
+	if status != Done {
+		http.Error(w, fmt.Sprintf("job is %v", status), http.StatusConflict)
+		return
+	}
+
+	format := Formats[j.Format]
+	file, err := os.Open(resultPath(j))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", format.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%v.%v"`, j.ID, format.Extension))
+	http.ServeContent(w, r, "", time.Time{}, file)
+}
+
+// deleteJob cancels the job and forgets it. Its directory is removed now
+// if the job is over, or else once it stops
+func (s *Server) deleteJob(j *job) {
+	j.cancel()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.jobs, j.ID)
+	if j.Finished != nil {
+		os.RemoveAll(j.dir)
+	}
+}
+
+// expireJobs forgets the jobs finished for longer than they are kept
+func (s *Server) expireJobs() {
+	s.mu.Lock()
+	var expired []*job
+	for _, j := range s.jobs {
+		if j.Finished != nil && time.Since(*j.Finished) > s.config.JobTTL {
+			expired = append(expired, j)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, j := range expired {
+		s.deleteJob(j)
+	}
+}
+
+// run waits for a turn to extract, then writes the result of the job
+func (s *Server) run(ctx context.Context, j *job) {
+	defer s.running.Done()
+
+	var count int
+	var err error
+	select {
+	case s.slots <- struct{}{}:
+		s.setStatus(j, Running)
+		count, err = s.extractJob(ctx, j)
+		<-s.slots
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	// The archive is of no more use
+	os.Remove(filepath.Join(j.dir, "archive"))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	finished := time.Now().UTC()
+	j.Finished = &finished
+	j.Messages = count
+	switch {
+	case err == nil:
+		j.Status = Done
+	case ctx.Err() != nil:
+		j.Status = Canceled
+	default:
+		log.Printf("job %v: %v", j.ID, err)
+		j.Status = Failed
+		j.Error = err.Error()
+	}
+
+	// Deleted while running
+	if s.jobs[j.ID] != j {
+		os.RemoveAll(j.dir)
+	}
+}
+
+func (s *Server) setStatus(j *job, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j.Status = status
+}
+
+// extractJob writes the messages of the job's archive to its result
+func (s *Server) extractJob(ctx context.Context, j *job) (int, error) {
+	archivePath := filepath.Join(j.dir, "archive")
+	if j.request.archive != "" {
+		var err error
+		if archivePath, err = s.archivePath(j.request.archive); err != nil {
+			return 0, err
+		}
+	}
+
+	archive, err := os.Open(archivePath)
+	if err != nil {
+		return 0, err
+	}
+	defer archive.Close()
+
+	writer, err := newWriter(j.Format, resultPath(j), j.Fields, j.request.index)
+	if err != nil {
+		return 0, err
+	}
+	return s.extract(ctx, archive, j.request, writer)
+}
+
+func resultPath(j *job) string {
+	return filepath.Join(j.dir, "result." + Formats[j.Format].Extension)
+}
+
+// newWriter creates the output of a job in the format, es-bulk actions
+// naming the index given or else the default one
+func newWriter(format, outputPath string, fields []string, index string) (output.MessageWriter, error) {
+	var writer output.MessageWriter
+	var err error
+
+	switch format {
+	case "jsonl":
+		var file *os.File
+		if file, err = os.Create(outputPath); err == nil {
+			writer = jsonlFile{output.NewJSONLWriter(file, fields), file}
+		}
+	case "parquet":
+		writer, err = output.NewParquetWriter(outputPath, fields, output.ParquetOptions{})
+	case "arrow", "arrows":
+		writer, err = output.NewArrowWriter(outputPath, fields, output.ArrowOptions{Stream: format == "arrows"})
+	case "avro":
+		writer, err = output.NewAvroWriter(outputPath, fields, output.AvroOptions{})
+	case "xml":
+		writer, err = output.NewXMLWriter(outputPath, fields)
+	case "xlsx":
+		writer, err = output.NewXLSXWriter(outputPath, fields)
+	case "es-bulk":
+		writer, err = output.NewESBulkWriter(outputPath, fields, output.ESBulkOptions{Index: index})
+	default:
+		err = fmt.Errorf("unknown format %q", format)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+// jsonlFile is JSON Lines output closing its file
+type jsonlFile struct {
+	*output.JSONLWriter
+	file *os.File
+}
+
+func (f jsonlFile) Close() error {
+	return f.file.Close()
+}
+
+// saveArchive copies the uploaded archive to a file
+func saveArchive(archive io.Reader, archivePath string) error {
+	file, err := os.Create(archivePath)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(file, archive)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func newJobID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
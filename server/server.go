@@ -0,0 +1,500 @@
+package server
+
+import (
+	"io"
+	"os"
+	"log"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+	"errors"
+	"context"
+	"runtime"
+	"strconv"
+	"strings"
+	"net/http"
+	"io/ioutil"
+	"path/filepath"
+	"github.com/asgaines/msgextract/unpack"
+	"github.com/asgaines/msgextract/parse"
+	"github.com/asgaines/msgextract/output"
+	"github.com/asgaines/msgextract/filter"
+	"github.com/asgaines/msgextract/metrics"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultFields are output when a request names none, as on the command line
+var DefaultFields = []string{"Date", "From", "Subject"}
+
+// Config limits the server. Zero values choose the defaults
+type Config struct {
+	// Largest archive accepted in a request body, 1 GiB by default
+	MaxUploadSize int64
+	// Archives extracted at once, the number of CPUs by default. Further
+	// streaming requests are refused, further jobs wait their turn
+	MaxConcurrent int
+	// Directory archives may be referenced from by path, instead of being
+	// uploaded. None by default, allowing uploads only
+	ArchiveDir string
+	// Directory holding the archives and results of jobs, a new temporary
+	// directory by default
+	WorkDir string
+	// How long the result of a finished job is kept, 1 hour by default
+	JobTTL time.Duration
+}
+
+// Server extracts the header fields of uploaded or referenced archives,
+// either streaming them back as JSON Lines or as jobs whose result is
+// fetched once done:
+//
+//	POST /extract               stream the messages as JSON Lines
+//	POST /jobs                  start a job, answering with its status
+//	GET /jobs/{id}              status of the job
+//	GET /jobs/{id}/result       output of the finished job
+//	DELETE /jobs/{id}           cancel the job and remove its output
+//	GET /healthz                whether the server is up
+//	GET /readyz                 whether it takes requests
+//	GET /metrics                metrics of the extractions, for Prometheus
+//
+// Requests choose the fields and, for jobs, the format in their query:
+// fields=Date,From,message&format=parquet&where=From.domain=="example.com",
+// plus the index=mail for es-bulk jobs.
+// The archive, gzipped or not, is the request body, or given a directory
+// to reference archives from, its path under that directory in archive=
+type Server struct {
+	config Config
+	mux *http.ServeMux
+	// Holds a token for each extraction running
+	slots chan struct{}
+	// Whether the work directory was created, and is removed, by the server
+	ownWorkDir bool
+	registry *metrics.Registry
+	metrics *metrics.Pipeline
+	// Answers the gRPC calls, told from HTTP requests by their content type
+	grpc *grpc.Server
+
+	mu sync.Mutex
+	draining bool
+	jobs map[string]*job
+	// Jobs queued or running
+	running sync.WaitGroup
+}
+
+// request is what a request asks to extract
+type request struct {
+	fields []string
+	format string
+	where *filter.Expr
+	// Path of the archive under the archive directory, if not uploaded
+	archive string
+	// Index named in the actions of es-bulk output
+	index string
+}
+
+func New(config Config) (*Server, error) {
+	if config.MaxUploadSize <= 0 {
+		config.MaxUploadSize = 1 << 30
+	}
+	if config.MaxConcurrent <= 0 {
+		config.MaxConcurrent = runtime.NumCPU()
+	}
+	if config.JobTTL <= 0 {
+		config.JobTTL = time.Hour
+	}
+
+	s := &Server{
+		config: config,
+		mux: http.NewServeMux(),
+		slots: make(chan struct{}, config.MaxConcurrent),
+		jobs: map[string]*job{},
+		registry: metrics.NewRegistry(),
+	}
+	s.metrics = metrics.NewPipeline(s.registry)
+	s.grpc = newGRPCServer(s)
+
+	if s.config.WorkDir == "" {
+		workDir, err := ioutil.TempDir("", "msgextract")
+		if err != nil {
+			return nil, err
+		}
+		s.config.WorkDir = workDir
+		s.ownWorkDir = true
+	} else if err := os.MkdirAll(s.config.WorkDir, 0755); err != nil {
+		return nil, err
+	}
+
+	s.mux.HandleFunc("/extract", s.handleExtract)
+	s.mux.HandleFunc("/jobs", s.handleJobs)
+	s.mux.HandleFunc("/jobs/", s.handleJob)
+	s.mux.Handle("/metrics", s.registry)
+	s.mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok\n")
+	})
+	s.mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if s.isDraining() {
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "ready\n")
+	})
+
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if isGRPC(r) {
+		s.grpc.ServeHTTP(w, r)
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// Drain stops the server taking new extractions and reports it as not
+// ready, leaving those under way to finish
+func (s *Server) Drain() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.draining = true
+}
+
+func (s *Server) isDraining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+// Close drains the server, ends the gRPC calls left, cancels the jobs left
+// and waits for them, then removes the work directory if it was the
+// server's own
+func (s *Server) Close() error {
+	s.Drain()
+	s.grpc.Stop()
+
+	s.mu.Lock()
+	for _, j := range s.jobs {
+		j.cancel()
+	}
+	s.mu.Unlock()
+	s.running.Wait()
+
+	if s.ownWorkDir {
+		return os.RemoveAll(s.config.WorkDir)
+	}
+	return nil
+}
+
+// handleExtract streams the messages of the archive as JSON Lines, each
+// flushed as it is extracted. Whatever fails before the first message
+// answers with an error status; past it, the response ends early, the
+// error in the Msgextract-Error trailer. Msgextract-Count trails the number
+// of messages
+func (s *Server) handleExtract(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.isDraining() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+
+	req, err := parseRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.format != "jsonl" {
+		http.Error(w, fmt.Sprintf("/extract streams jsonl, start a job for %v", req.format), http.StatusBadRequest)
+		return
+	}
+
+	// Refuse rather than queue, the client holding a connection open
+	select {
+	case s.slots <- struct{}{}:
+		defer func() { <-s.slots }()
+	default:
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "too many extractions under way", http.StatusServiceUnavailable)
+		return
+	}
+
+	archive, status, err := s.openArchive(r, req.archive)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	defer archive.Close()
+
+	// Answer while the upload is still being read
+	http.NewResponseController(w).EnableFullDuplex()
+
+	stream := &jsonlStream{w: w}
+	count, err := s.extract(r.Context(), archive, req, output.NewJSONLWriter(stream, req.fields))
+	if err != nil && !stream.started {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	stream.start()
+	w.Header().Set("Msgextract-Count", strconv.Itoa(count))
+	if err != nil {
+		log.Printf("extract: %v", err)
+		w.Header().Set("Msgextract-Error", err.Error())
+	}
+}
+
+// jsonlStream answers with the lines written to it, flushing each
+type jsonlStream struct {
+	w http.ResponseWriter
+	started bool
+}
+
+// start sends the header of the response, once
+func (s *jsonlStream) start() {
+	if s.started {
+		return
+	}
+	s.started = true
+	s.w.Header().Set("Content-Type", "application/x-ndjson")
+	s.w.Header().Set("Trailer", "Msgextract-Count, Msgextract-Error")
+	s.w.WriteHeader(http.StatusOK)
+}
+
+func (s *jsonlStream) Write(p []byte) (int, error) {
+	s.start()
+	n, err := s.w.Write(p)
+	if flusher, ok := s.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
+
+// parseRequest reads the fields, format and filter asked for in the query
+func parseRequest(r *http.Request) (request, error) {
+	query := r.URL.Query()
+	req := request{fields: DefaultFields, format: "jsonl", archive: query.Get("archive")}
+
+	if fields := query.Get("fields"); fields != "" {
+		req.fields = nil
+		for _, field := range strings.Split(fields, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				req.fields = append(req.fields, field)
+			}
+		}
+	}
+
+	if format := query.Get("format"); format != "" {
+		if _, ok := Formats[format]; !ok {
+			return req, fmt.Errorf("unknown format %q", format)
+		}
+		req.format = format
+	}
+
+	if where := query.Get("where"); where != "" {
+		var err error
+		req.where, err = filter.Parse(where)
+		if err != nil {
+			return req, fmt.Errorf("where: %v", err)
+		}
+	}
+
+	if index := query.Get("index"); index != "" {
+		if req.format != "es-bulk" {
+			return req, fmt.Errorf("index is for es-bulk output, not %v", req.format)
+		}
+		// As Elasticsearch would refuse it when the output is posted
+		if index != strings.ToLower(index) || strings.ContainsAny(index, "\\/*?\"<>| ,#:") || strings.IndexAny(index[:1], "-_+.") == 0 {
+			return req, fmt.Errorf("invalid index %q", index)
+		}
+		req.index = index
+	}
+
+	return req, nil
+}
+
+// openArchive opens the archive referenced under the archive directory or
+// else the body of the request, limited in size. On failure it returns the
+// status to answer with
+func (s *Server) openArchive(r *http.Request, reference string) (io.ReadCloser, int, error) {
+	if reference == "" {
+		if r.ContentLength > s.config.MaxUploadSize {
+			return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("archive larger than %v bytes", s.config.MaxUploadSize)
+		}
+		return &limitedBody{ReadCloser: r.Body, limit: s.config.MaxUploadSize}, 0, nil
+	}
+
+	archivePath, err := s.archivePath(reference)
+	if err != nil {
+		return nil, http.StatusForbidden, err
+	}
+	file, err := os.Open(archivePath)
+	if os.IsNotExist(err) {
+		return nil, http.StatusNotFound, fmt.Errorf("no archive %v", reference)
+	} else if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return file, 0, nil
+}
+
+// limitedBody fails reading past the limit as http.MaxBytesReader does, but
+// leaves the response alone, the body being read while it is written
+type limitedBody struct {
+	io.ReadCloser
+	limit int64
+	read int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.read >= b.limit {
+		// Anything more is too much
+		var extra [1]byte
+		n, err := b.ReadCloser.Read(extra[:])
+		if n > 0 {
+			return 0, &http.MaxBytesError{Limit: b.limit}
+		}
+		return 0, err
+	}
+
+	if remaining := b.limit - b.read; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	return n, err
+}
+
+// archivePath resolves a reference to an archive, which cannot lead out of
+// the archive directory
+func (s *Server) archivePath(reference string) (string, error) {
+	if s.config.ArchiveDir == "" {
+		return "", errors.New("archives are not referenced by path on this server, upload them")
+	}
+	return filepath.Join(s.config.ArchiveDir, filepath.FromSlash(path.Clean("/" + reference))), nil
+}
+
+// errorStatus is the status answering an extraction which failed
+func errorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	// The archive could not be read
+	return http.StatusBadRequest
+}
+
+// header is an entry of an archive, passed on to be parsed and output
+type header struct {
+	name string
+	lines []string
+}
+
+// Entries read ahead of those being output
+const headerQueueSize = 256
+
+// extract writes the messages of the archive, gzipped or not, matching the
+// filter of the request, until the context is done. The archive is read as
+// the messages are output. It returns the number of messages written
+func (s *Server) extract(ctx context.Context, archive io.Reader, req request, writer output.MessageWriter) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	headers := make(chan header, headerQueueSize)
+	walked := make(chan error, 1)
+	var unpackTimings metrics.Timings
+	go func() {
+		defer close(headers)
+		walked <- s.walk(ctx, archive, headers, &unpackTimings)
+	}()
+
+	var timings metrics.Timings
+	var err error
+	count := 0
+	for h := range headers {
+		s.metrics.HeaderQueue.Add(-1)
+		if err != nil {
+			// Drained for the walk to end
+			continue
+		}
+		s.metrics.Messages.Inc()
+
+		parsed := time.Now()
+		message := output.Message{Headers: parse.MapFromHeaderLines(h.lines), HeaderLines: h.lines}
+		message.Headers["message"] = h.name
+		matched := true
+		if req.where != nil {
+			record := parse.MIMEHeaderFromLines(h.lines)
+			record.Set("message", h.name)
+			matched = req.where.Match(record)
+		}
+		timings.Parse += time.Since(parsed)
+		if !matched {
+			continue
+		}
+
+		written := time.Now()
+		if err = writer.Write(message); err != nil {
+			cancel()
+		} else {
+			count++
+		}
+		timings.Output += time.Since(written)
+	}
+
+	// Messages read before the walk failed are written all the same
+	if walkErr := <-walked; err == nil {
+		err = walkErr
+		if isParseFailure(walkErr) {
+			s.metrics.ParseFailures.With(metrics.FailureReason(walkErr)).Inc()
+		}
+	}
+
+	closed := time.Now()
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	timings.Output += time.Since(closed)
+
+	timings.Add(unpackTimings)
+	s.metrics.Finish(timings.Seconds(), err)
+	return count, err
+}
+
+// walk sends the entries of the archive through the channel, timing the
+// reading of the archive in between
+func (s *Server) walk(ctx context.Context, archive io.Reader, headers chan<- header, timings *metrics.Timings) error {
+	start := time.Now()
+	reader, err := unpack.Decompress(metrics.CountingReader{Reader: archive, Counter: s.metrics.BytesRead})
+	if err != nil {
+		return err
+	}
+
+	err = unpack.WalkReader(reader, func(name string, headerLines []string, body io.Reader) error {
+		timings.Unpack += time.Since(start)
+		defer func() { start = time.Now() }()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		s.metrics.HeaderQueue.Add(1)
+		select {
+		case headers <- header{name, headerLines}:
+			return nil
+		case <-ctx.Done():
+			s.metrics.HeaderQueue.Add(-1)
+			return ctx.Err()
+		}
+	})
+	timings.Unpack += time.Since(start)
+	return err
+}
+
+// isParseFailure tells whether the extraction failed for the archive
+// could not be read, rather than being canceled or over the size limit
+func isParseFailure(err error) bool {
+	var tooLarge *http.MaxBytesError
+	_, isStatus := status.FromError(err)
+	return err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) && !errors.As(err, &tooLarge) && !isStatus
+}
@@ -0,0 +1,407 @@
+package server
+
+import (
+	"os"
+	"io"
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+	"net/http"
+	"io/ioutil"
+	"encoding/json"
+	"archive/tar"
+	"net/http/httptest"
+)
+
+const (
+	gzippedArchive = "../test_files/targzs/testEmails.tar.gz"
+	tarArchive = "../test_files/tars/both.tar"
+)
+
+// newTestServer serves a server configured for the test, removing its work
+// directory at the end
+func newTestServer(t *testing.T, config Config) (*Server, *httptest.Server) {
+	tmpDir, err := ioutil.TempDir("../test_files", "tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.WorkDir = tmpDir
+
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(s)
+	t.Cleanup(func() {
+		server.Close()
+		s.Close()
+		os.RemoveAll(tmpDir)
+	})
+	return s, server
+}
+
+func readFile(t *testing.T, path string) []byte {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+// do sends the request, returning the response with its body read
+func do(t *testing.T, method, url string, body []byte) (*http.Response, string) {
+	request, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	content, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response, string(content)
+}
+
+// shortNamesArchive is a tar archive of entries named shorter than the
+// .msg suffix, and of entries which are not files, around a message
+func shortNamesArchive(t *testing.T) []byte {
+	var archive bytes.Buffer
+	writer := tar.NewWriter(&archive)
+	message := readFile(t, "../test_files/msgs/subject_date_from.msg")
+
+	entries := []struct {
+		header tar.Header
+		content []byte
+	}{
+		{tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755}, nil},
+		{tar.Header{Name: "a", Typeflag: tar.TypeReg, Mode: 0644, Size: 1}, []byte("a")},
+		{tar.Header{Name: "link.msg", Typeflag: tar.TypeSymlink, Linkname: "a.msg", Mode: 0777}, nil},
+		{tar.Header{Name: "a.msg", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(message))}, message},
+	}
+	for _, entry := range entries {
+		if err := writer.WriteHeader(&entry.header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := writer.Write(entry.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return archive.Bytes()
+}
+
+func TestExtract(t *testing.T) {
+	_, server := newTestServer(t, Config{ArchiveDir: "../test_files"})
+
+	darty := `{"From":"\"Darty\" \u003cinfos@contact-darty.com\u003e","message":"test/parsetar/msgs/subject_date_from.msg"}` + "\n"
+
+	cases := []struct {
+		name string
+		method string
+		query string
+		body []byte
+		status int
+		content string
+		count string
+	}{
+		{
+			name: "gzipped upload",
+			method: "POST",
+			query: "?fields=message,Subject",
+			body: readFile(t, gzippedArchive),
+			status: 200,
+			content: `{"Subject":"Cuit Vapeur 29.90 euros, Nintendo 3DS 239 euros, GPS TOM TOM 139 euros... decouvrez VITE tous les bons plans du weekend !","message":"test_files/msgs/subject_date_from.msg"}` + "\n" +
+				`{"Subject":"","message":"test_files/msgs/return_x-orig_received.msg"}` + "\n",
+			count: "2",
+		},
+		{
+			name: "filtered tar upload",
+			method: "POST",
+			query: `?fields=From,message&where=From.domain=="contact-darty.com"`,
+			body: readFile(t, tarArchive),
+			status: 200,
+			content: darty,
+			count: "1",
+		},
+		{
+			name: "short entry names",
+			method: "POST",
+			query: "?fields=From,message",
+			body: shortNamesArchive(t),
+			status: 200,
+			content: `{"From":"\"Darty\" \u003cinfos@contact-darty.com\u003e","message":"a.msg"}` + "\n",
+			count: "1",
+		},
+		{
+			name: "referenced archive",
+			method: "POST",
+			query: `?fields=From,message&archive=tars/both.tar&where=From.domain=="contact-darty.com"`,
+			status: 200,
+			content: darty,
+			count: "1",
+		},
+		{
+			name: "reference out of the archive directory",
+			method: "POST",
+			query: "?archive=../../unpack/unpack.go",
+			status: 404,
+			content: "no archive ../../unpack/unpack.go\n",
+		},
+		{
+			name: "not an archive",
+			method: "POST",
+			body: []byte(strings.Repeat("not a tar archive\n", 100)),
+			status: 400,
+			content: "archive/tar: invalid tar header\n",
+		},
+		{
+			name: "unknown format",
+			method: "POST",
+			query: "?format=pdf",
+			status: 400,
+			content: "unknown format \"pdf\"\n",
+		},
+		{
+			name: "format of jobs",
+			method: "POST",
+			query: "?format=parquet",
+			status: 400,
+			content: "/extract streams jsonl, start a job for parquet\n",
+		},
+		{
+			name: "index of other formats",
+			method: "POST",
+			query: "?index=mail",
+			status: 400,
+			content: "index is for es-bulk output, not jsonl\n",
+		},
+		{
+			name: "invalid index",
+			method: "POST",
+			query: "?format=es-bulk&index=Mail",
+			status: 400,
+			content: "invalid index \"Mail\"\n",
+		},
+		{
+			name: "bad filter",
+			method: "POST",
+			query: "?where=From ==",
+			status: 400,
+		},
+		{
+			name: "get",
+			method: "GET",
+			status: 405,
+			content: "method not allowed\n",
+		},
+	}
+
+	for _, c := range cases {
+		response, content := do(t, c.method, server.URL + "/extract" + strings.Replace(c.query, " ", "%20", -1), c.body)
+
+		if response.StatusCode != c.status {
+			t.Errorf("%v: status %v, expected %v: %v", c.name, response.StatusCode, c.status, content)
+		}
+		if c.content != "" && content != c.content {
+			t.Errorf("%v: answered %q, expected %q", c.name, content, c.content)
+		}
+		if c.count != "" && response.Trailer.Get("Msgextract-Count") != c.count {
+			t.Errorf("%v: count %q, expected %v", c.name, response.Trailer.Get("Msgextract-Count"), c.count)
+		}
+	}
+}
+
+func TestExtractLimits(t *testing.T) {
+	s, server := newTestServer(t, Config{MaxConcurrent: 1})
+
+	// Every slot taken
+	s.slots <- struct{}{}
+	response, _ := do(t, "POST", server.URL + "/extract", readFile(t, tarArchive))
+	if response.StatusCode != 503 || response.Header.Get("Retry-After") == "" {
+		t.Errorf("busy: status %v, Retry-After %q", response.StatusCode, response.Header.Get("Retry-After"))
+	}
+	<-s.slots
+
+	// No archives referenced by path
+	response, _ = do(t, "POST", server.URL + "/extract?archive=tars/both.tar", nil)
+	if response.StatusCode != 403 {
+		t.Errorf("reference: status %v, expected 403", response.StatusCode)
+	}
+
+	// Uploads too large are refused upfront, or cut short when their length
+	// is not told
+	s.config.MaxUploadSize = 20000
+	response, content := do(t, "POST", server.URL + "/extract", readFile(t, tarArchive))
+	if response.StatusCode != 413 || content != "archive larger than 20000 bytes\n" {
+		t.Errorf("too large: %v %v", response.StatusCode, content)
+	}
+
+	request, err := http.NewRequest("POST", server.URL + "/extract", io.MultiReader(bytes.NewReader(readFile(t, tarArchive))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunked, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(chunked.Body)
+	chunked.Body.Close()
+	if chunked.StatusCode != 200 || !strings.Contains(chunked.Trailer.Get("Msgextract-Error"), "request body too large") {
+		t.Errorf("chunked: status %v, error %q", chunked.StatusCode, chunked.Trailer.Get("Msgextract-Error"))
+	}
+}
+
+func TestHealth(t *testing.T) {
+	s, server := newTestServer(t, Config{})
+
+	for _, path := range []string{"/healthz", "/readyz"} {
+		if response, _ := do(t, "GET", server.URL + path, nil); response.StatusCode != 200 {
+			t.Errorf("%v: status %v", path, response.StatusCode)
+		}
+	}
+
+	s.Drain()
+	expected := map[string]int{"/healthz": 200, "/readyz": 503, "/extract": 503, "/jobs": 503}
+	for path, status := range expected {
+		method := "GET"
+		if path == "/extract" || path == "/jobs" {
+			method = "POST"
+		}
+		if response, _ := do(t, method, server.URL + path, nil); response.StatusCode != status {
+			t.Errorf("draining %v: status %v, expected %v", path, response.StatusCode, status)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	_, server := newTestServer(t, Config{})
+
+	archive := readFile(t, gzippedArchive)
+	do(t, "POST", server.URL + "/extract?where=has(Subject)", archive)
+	do(t, "POST", server.URL + "/extract", archive[:len(archive) / 2])
+
+	response, content := do(t, "GET", server.URL + "/metrics", nil)
+	if !strings.HasPrefix(response.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("content type %v", response.Header.Get("Content-Type"))
+	}
+
+	expected := []string{
+		"# TYPE msgextract_messages_processed_total counter",
+		// The first message of the truncated archive is read all the same
+		"msgextract_messages_processed_total 3",
+		`msgextract_parse_failures_total{reason="truncated"} 1`,
+		`msgextract_parse_failures_total{reason="gzip"} 0`,
+		`msgextract_archives_total{outcome="done"} 1`,
+		`msgextract_archives_total{outcome="failed"} 1`,
+		`msgextract_archive_stage_seconds_count{stage="unpack"} 2`,
+		`msgextract_archive_stage_seconds_bucket{stage="output",le="+Inf"} 2`,
+		"msgextract_header_queue_depth 0",
+	}
+	for _, line := range expected {
+		if !strings.Contains(content, line + "\n") {
+			t.Errorf("no %q in\n%v", line, content)
+		}
+	}
+	if !strings.Contains(content, "msgextract_bytes_read_total ") || strings.Contains(content, "msgextract_bytes_read_total 0\n") {
+		t.Errorf("no bytes read in\n%v", content)
+	}
+}
+
+// waitJob polls the job until it is over
+func waitJob(t *testing.T, url string) map[string]interface{} {
+	for i := 0; i < 500; i++ {
+		var status map[string]interface{}
+		_, content := do(t, "GET", url, nil)
+		if err := json.Unmarshal([]byte(content), &status); err != nil {
+			t.Fatalf("%v: %v", content, err)
+		}
+		if status["status"] != Queued && status["status"] != Running {
+			return status
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%v still running", url)
+	return nil
+}
+
+func TestJobs(t *testing.T) {
+	_, server := newTestServer(t, Config{ArchiveDir: "../test_files"})
+
+	cases := []struct {
+		query string
+		body []byte
+		contentType string
+		prefix string
+		// Also held in the result, if given
+		contains string
+		messages float64
+	}{
+		{"?format=parquet", readFile(t, gzippedArchive), "application/vnd.apache.parquet", "PAR1", "", 2},
+		{"?format=jsonl&fields=message", readFile(t, gzippedArchive), "application/x-ndjson", `{"message":"test_files/msgs/subject_date_from.msg"}`, "", 2},
+		{"?format=xlsx&archive=tars/both.tar", nil, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", "PK", "", 2},
+		{"?format=es-bulk&archive=tars/both.tar&where=has(Subject)", nil, "application/x-ndjson", `{"index":`, `"_index":"msgextract"`, 1},
+		{"?format=es-bulk&archive=tars/both.tar&index=mail-2011", nil, "application/x-ndjson", `{"index":`, `"_index":"mail-2011"`, 2},
+	}
+
+	for _, c := range cases {
+		response, content := do(t, "POST", server.URL + "/jobs" + c.query, c.body)
+		if response.StatusCode != 202 {
+			t.Fatalf("%v: status %v: %v", c.query, response.StatusCode, content)
+		}
+		location := server.URL + response.Header.Get("Location")
+
+		status := waitJob(t, location)
+		if status["status"] != Done || status["messages"] != c.messages {
+			t.Errorf("%v: job %v", c.query, status)
+		}
+
+		response, content = do(t, "GET", location + "/result", nil)
+		if response.StatusCode != 200 || response.Header.Get("Content-Type") != c.contentType || !strings.HasPrefix(content, c.prefix) || !strings.Contains(content, c.contains) {
+			t.Errorf("%v: result %v %v %.20q", c.query, response.StatusCode, response.Header.Get("Content-Type"), content)
+		}
+
+		if response, _ = do(t, "DELETE", location, nil); response.StatusCode != 204 {
+			t.Errorf("%v: delete status %v", c.query, response.StatusCode)
+		}
+		if response, _ = do(t, "GET", location, nil); response.StatusCode != 404 {
+			t.Errorf("%v: deleted job status %v", c.query, response.StatusCode)
+		}
+	}
+}
+
+func TestJobQueued(t *testing.T) {
+	s, server := newTestServer(t, Config{MaxConcurrent: 1})
+
+	// The job waits for the slot taken
+	s.slots <- struct{}{}
+	response, content := do(t, "POST", server.URL + "/jobs?format=avro", readFile(t, tarArchive))
+	if response.StatusCode != 202 {
+		t.Fatalf("status %v: %v", response.StatusCode, content)
+	}
+	location := server.URL + response.Header.Get("Location")
+
+	if response, content = do(t, "GET", location + "/result", nil); response.StatusCode != 409 || content != "job is queued\n" {
+		t.Errorf("result of queued job: %v %v", response.StatusCode, content)
+	}
+	<-s.slots
+
+	if status := waitJob(t, location); status["status"] != Done {
+		t.Errorf("job %v", status)
+	}
+
+	response, content = do(t, "POST", server.URL + "/jobs", []byte("not an archive"))
+	if response.StatusCode != 202 {
+		t.Fatalf("status %v: %v", response.StatusCode, content)
+	}
+	if status := waitJob(t, server.URL + response.Header.Get("Location")); status["status"] != Failed || status["error"] == "" {
+		t.Errorf("job of invalid archive %v", status)
+	}
+}
@@ -0,0 +1,612 @@
+package sieve
+
+import (
+	"fmt"
+	"time"
+	"regexp"
+	"strings"
+	"strconv"
+)
+
+// Extensions which may be required, beyond the base language
+var supportedExtensions = map[string]bool{
+	"fileinto": true,
+	"envelope": true,
+	"date": true,
+	"relational": true,
+	"imap4flags": true,
+	"copy": true,
+	"comparator-i;octet": true,
+	"comparator-i;ascii-casemap": true,
+	"comparator-i;ascii-numeric": true,
+}
+
+// Comparators of RFC 4790, by the extension needed to use them. The first
+// two are always available
+var comparators = map[string]string{
+	"i;octet": "",
+	"i;ascii-casemap": "",
+	"i;ascii-numeric": "comparator-i;ascii-numeric",
+}
+
+// Relations of RFC 5231
+var relations = map[string]bool{
+	"gt": true, "ge": true, "lt": true, "le": true, "eq": true, "ne": true,
+}
+
+// Tags shared by the tests comparing values, and whether a value follows
+var matchTags = map[string]bool{
+	"is": false,
+	"contains": false,
+	"matches": false,
+	"value": true,
+	"count": true,
+	"comparator": true,
+}
+
+// Date parts of RFC 5260
+var dateParts = map[string]bool{
+	"year": true, "month": true, "day": true, "date": true, "julian": true,
+	"hour": true, "minute": true, "second": true, "time": true,
+	"iso8601": true, "std11": true, "zone": true, "weekday": true,
+}
+
+var zonePattern = regexp.MustCompile(`^[+-][0-9]{4}$`)
+
+type compiler struct {
+	// Extensions named by require
+	required map[string]bool
+}
+
+func (c *compiler) require(extension string, n *node, what string) error {
+	if !c.required[extension] {
+		return &SyntaxError{Line: n.line, Msg: what + " needs require \"" + extension + "\""}
+	}
+	return nil
+}
+
+func errorAt(line int, format string, args ...interface{}) error {
+	return &SyntaxError{Line: line, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (c *compiler) compileCommands(nodes []*node, top bool) ([]statement, error) {
+	var statements []statement
+
+	// require is only allowed ahead of every other command
+	requiring := top
+
+	for i := 0; i < len(nodes); i++ {
+		n := nodes[i]
+
+		if n.name == "require" {
+			if !requiring {
+				return nil, errorAt(n.line, "require must come before any other command")
+			}
+			if err := c.compileRequire(n); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		requiring = false
+
+		switch n.name {
+		case "if":
+			conditional := &ifStatement{}
+			for {
+				condition, block, err := c.compileBranch(n)
+				if err != nil {
+					return nil, err
+				}
+				conditional.conditions = append(conditional.conditions, condition)
+				conditional.blocks = append(conditional.blocks, block)
+
+				if i + 1 == len(nodes) || nodes[i + 1].name != "elsif" {
+					break
+				}
+				i++
+				n = nodes[i]
+			}
+
+			if i + 1 < len(nodes) && nodes[i + 1].name == "else" {
+				i++
+				n = nodes[i]
+				if len(n.arguments) > 0 || len(n.tests) > 0 || !n.hasBlock {
+					return nil, errorAt(n.line, "else takes a block only")
+				}
+				block, err := c.compileCommands(n.block, false)
+				if err != nil {
+					return nil, err
+				}
+				conditional.otherwise = block
+			}
+
+			statements = append(statements, conditional)
+		case "elsif", "else":
+			return nil, errorAt(n.line, "%v without if", n.name)
+		default:
+			action, err := c.compileAction(n)
+			if err != nil {
+				return nil, err
+			}
+			statements = append(statements, action)
+		}
+	}
+
+	return statements, nil
+}
+
+func (c *compiler) compileRequire(n *node) error {
+	_, positional, err := tagged(n, nil)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 || positional[0].kind != argumentStrings || len(n.tests) > 0 || n.hasBlock {
+		return errorAt(n.line, "require takes a string list of extensions")
+	}
+
+	for _, extension := range positional[0].strings {
+		extension = strings.ToLower(extension)
+		if !supportedExtensions[extension] {
+			return errorAt(n.line, "unsupported extension %q", extension)
+		}
+		c.required[extension] = true
+	}
+	return nil
+}
+
+// compileBranch compiles the test and block of if or elsif
+func (c *compiler) compileBranch(n *node) (test, []statement, error) {
+	if len(n.arguments) > 0 || len(n.tests) != 1 || !n.hasBlock {
+		return nil, nil, errorAt(n.line, "%v takes a test and a block", n.name)
+	}
+
+	condition, err := c.compileTest(n.tests[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := c.compileCommands(n.block, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	return condition, block, nil
+}
+
+func (c *compiler) compileAction(n *node) (statement, error) {
+	if n.hasBlock || len(n.tests) > 0 {
+		return nil, errorAt(n.line, "%v takes neither a test nor a block", n.name)
+	}
+
+	switch n.name {
+	case "stop", "discard":
+		if len(n.arguments) > 0 {
+			return nil, errorAt(n.line, "%v takes no arguments", n.name)
+		}
+		if n.name == "stop" {
+			return stopStatement{}, nil
+		}
+		return actionStatement{action: "discard"}, nil
+	case "keep", "fileinto", "redirect":
+		spec := map[string]bool{}
+		if n.name != "keep" {
+			spec["copy"] = false
+		}
+		if n.name != "redirect" {
+			spec["flags"] = true
+		}
+
+		tags, positional, err := tagged(n, spec)
+		if err != nil {
+			return nil, err
+		}
+
+		action := actionStatement{action: n.name}
+
+		if n.name == "keep" {
+			if len(positional) != 0 {
+				return nil, errorAt(n.line, "keep takes no positional arguments")
+			}
+		} else {
+			if n.name == "fileinto" {
+				if err := c.require("fileinto", n, "fileinto"); err != nil {
+					return nil, err
+				}
+			}
+			if len(positional) != 1 {
+				return nil, errorAt(n.line, "%v takes a single string", n.name)
+			}
+			if action.target, err = single(positional[0], n.name); err != nil {
+				return nil, err
+			}
+		}
+
+		if _, ok := tags["copy"]; ok {
+			if err := c.require("copy", n, ":copy"); err != nil {
+				return nil, err
+			}
+			action.copy = true
+		}
+
+		if flags, ok := tags["flags"]; ok {
+			if err := c.require("imap4flags", n, ":flags"); err != nil {
+				return nil, err
+			}
+			if flags.kind != argumentStrings {
+				return nil, errorAt(n.line, ":flags takes a string list")
+			}
+			action.flags = splitFlags(flags.strings)
+			action.hasFlags = true
+		}
+
+		return action, nil
+	case "setflag", "addflag", "removeflag":
+		if err := c.require("imap4flags", n, n.name); err != nil {
+			return nil, err
+		}
+		_, positional, err := tagged(n, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(positional) == 2 {
+			return nil, errorAt(n.line, "%v on a variable needs the variables extension, which is unsupported", n.name)
+		}
+		if len(positional) != 1 || positional[0].kind != argumentStrings {
+			return nil, errorAt(n.line, "%v takes a string list of flags", n.name)
+		}
+		return flagStatement{operation: n.name, flags: splitFlags(positional[0].strings)}, nil
+	}
+
+	return nil, errorAt(n.line, "unknown command %q", n.name)
+}
+
+func (c *compiler) compileTest(n *node) (test, error) {
+	if n.hasBlock {
+		return nil, errorAt(n.line, "unexpected block")
+	}
+
+	switch n.name {
+	case "allof", "anyof", "not", "true", "false":
+		if len(n.arguments) > 0 {
+			return nil, errorAt(n.line, "%v takes no arguments", n.name)
+		}
+
+		var tests []test
+		for _, t := range n.tests {
+			compiled, err := c.compileTest(t)
+			if err != nil {
+				return nil, err
+			}
+			tests = append(tests, compiled)
+		}
+
+		switch n.name {
+		case "allof":
+			if len(tests) == 0 {
+				return nil, errorAt(n.line, "allof takes a list of tests")
+			}
+			return allOf(tests), nil
+		case "anyof":
+			if len(tests) == 0 {
+				return nil, errorAt(n.line, "anyof takes a list of tests")
+			}
+			return anyOf(tests), nil
+		case "not":
+			if len(tests) != 1 {
+				return nil, errorAt(n.line, "not takes a single test")
+			}
+			return notTest{tests[0]}, nil
+		}
+
+		if len(tests) > 0 {
+			return nil, errorAt(n.line, "%v takes no tests", n.name)
+		}
+		return constantTest(n.name == "true"), nil
+	}
+
+	if len(n.tests) > 0 {
+		return nil, errorAt(n.line, "%v takes no tests", n.name)
+	}
+
+	switch n.name {
+	case "header", "address", "envelope":
+		spec := copySpec(matchTags)
+		if n.name != "header" {
+			spec["all"] = false
+			spec["localpart"] = false
+			spec["domain"] = false
+		}
+
+		tags, positional, err := tagged(n, spec)
+		if err != nil {
+			return nil, err
+		}
+		m, err := c.compileMatcher(n, tags)
+		if err != nil {
+			return nil, err
+		}
+		if len(positional) != 2 || positional[0].kind != argumentStrings || positional[1].kind != argumentStrings {
+			return nil, errorAt(n.line, "%v takes a string list of fields and a string list of keys", n.name)
+		}
+		names, keys := positional[0].strings, positional[1].strings
+
+		if n.name == "header" {
+			return headerTest{names: names, keys: keys, matcher: m}, nil
+		}
+
+		if n.name == "envelope" {
+			if err := c.require("envelope", n, "envelope"); err != nil {
+				return nil, err
+			}
+			for i, name := range names {
+				names[i] = strings.ToLower(name)
+				if envelopeHeaders[names[i]] == nil {
+					return nil, errorAt(n.line, "unknown envelope part %q, expected from or to", name)
+				}
+			}
+		}
+
+		part, err := oneOf(n, tags, "all", "all", "localpart", "domain")
+		if err != nil {
+			return nil, err
+		}
+		return addressTest{names: names, keys: keys, part: part, envelope: n.name == "envelope", matcher: m}, nil
+	case "exists":
+		_, positional, err := tagged(n, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(positional) != 1 || positional[0].kind != argumentStrings {
+			return nil, errorAt(n.line, "exists takes a string list of fields")
+		}
+		return existsTest{names: positional[0].strings}, nil
+	case "size":
+		tags, positional, err := tagged(n, map[string]bool{"over": false, "under": false})
+		if err != nil {
+			return nil, err
+		}
+		comparison, err := oneOf(n, tags, "", "over", "under")
+		if err != nil {
+			return nil, err
+		}
+		if comparison == "" || len(positional) != 1 || positional[0].kind != argumentNumber {
+			return nil, errorAt(n.line, "size takes :over or :under and a number")
+		}
+		return sizeTest{over: comparison == "over", limit: positional[0].number}, nil
+	case "date", "currentdate":
+		if err := c.require("date", n, n.name); err != nil {
+			return nil, err
+		}
+
+		spec := copySpec(matchTags)
+		spec["zone"] = true
+		if n.name == "date" {
+			spec["originalzone"] = false
+		}
+
+		tags, positional, err := tagged(n, spec)
+		if err != nil {
+			return nil, err
+		}
+		m, err := c.compileMatcher(n, tags)
+		if err != nil {
+			return nil, err
+		}
+
+		t := dateTest{matcher: m, location: time.Local}
+
+		if _, ok := tags["originalzone"]; ok {
+			if _, ok := tags["zone"]; ok {
+				return nil, errorAt(n.line, ":zone and :originalzone exclude each other")
+			}
+			t.location = nil
+		}
+		if zone, ok := tags["zone"]; ok {
+			value, err := single(zone, ":zone")
+			if err != nil {
+				return nil, err
+			}
+			if t.location, err = parseZone(value); err != nil {
+				return nil, errorAt(n.line, "%v", err)
+			}
+		}
+
+		want := 3
+		if n.name == "currentdate" {
+			want = 2
+		}
+		if len(positional) != want {
+			return nil, errorAt(n.line, "%v takes %d string arguments", n.name, want)
+		}
+		for _, a := range positional {
+			if a.kind != argumentStrings {
+				return nil, errorAt(a.line, "%v takes string arguments, found %v", n.name, a)
+			}
+		}
+
+		if n.name == "date" {
+			if t.header, err = single(positional[0], "date header"); err != nil {
+				return nil, err
+			}
+			positional = positional[1:]
+		} else {
+			t.current = true
+		}
+
+		if t.part, err = single(positional[0], "date part"); err != nil {
+			return nil, err
+		}
+		t.part = strings.ToLower(t.part)
+		if !dateParts[t.part] {
+			return nil, errorAt(n.line, "unknown date part %q", t.part)
+		}
+		t.keys = positional[1].strings
+
+		return t, nil
+	case "hasflag":
+		if err := c.require("imap4flags", n, "hasflag"); err != nil {
+			return nil, err
+		}
+		tags, positional, err := tagged(n, copySpec(matchTags))
+		if err != nil {
+			return nil, err
+		}
+		m, err := c.compileMatcher(n, tags)
+		if err != nil {
+			return nil, err
+		}
+		if len(positional) == 2 {
+			return nil, errorAt(n.line, "hasflag on a variable needs the variables extension, which is unsupported")
+		}
+		if len(positional) != 1 || positional[0].kind != argumentStrings {
+			return nil, errorAt(n.line, "hasflag takes a string list of flags")
+		}
+		return hasflagTest{keys: splitFlags(positional[0].strings), matcher: m}, nil
+	}
+
+	return nil, errorAt(n.line, "unknown test %q", n.name)
+}
+
+// compileMatcher reads the comparator and match type of a test
+func (c *compiler) compileMatcher(n *node, tags map[string]argument) (matcher, error) {
+	m := matcher{comparator: "i;ascii-casemap"}
+
+	var err error
+	if m.matchType, err = oneOf(n, tags, "is", "is", "contains", "matches", "value", "count"); err != nil {
+		return matcher{}, err
+	}
+
+	if m.matchType == "value" || m.matchType == "count" {
+		if err := c.require("relational", n, ":" + m.matchType); err != nil {
+			return matcher{}, err
+		}
+		relation, err := single(tags[m.matchType], ":" + m.matchType)
+		if err != nil {
+			return matcher{}, err
+		}
+		m.relation = strings.ToLower(relation)
+		if !relations[m.relation] {
+			return matcher{}, errorAt(n.line, "unknown relation %q, expected gt, ge, lt, le, eq or ne", relation)
+		}
+	}
+
+	if comparator, ok := tags["comparator"]; ok {
+		name, err := single(comparator, ":comparator")
+		if err != nil {
+			return matcher{}, err
+		}
+		m.comparator = strings.ToLower(name)
+
+		extension, known := comparators[m.comparator]
+		if !known {
+			return matcher{}, errorAt(n.line, "unsupported comparator %q", name)
+		}
+		if extension != "" {
+			if err := c.require(extension, n, "comparator " + m.comparator); err != nil {
+				return matcher{}, err
+			}
+		}
+	}
+
+	if m.comparator == "i;ascii-numeric" && (m.matchType == "contains" || m.matchType == "matches") {
+		return matcher{}, errorAt(n.line, "comparator i;ascii-numeric does not support :%v", m.matchType)
+	}
+
+	return m, nil
+}
+
+// tagged separates the tagged arguments allowed by spec, which tells
+// whether a value follows each tag, from the positional ones following them
+func tagged(n *node, spec map[string]bool) (map[string]argument, []argument, error) {
+	tags := make(map[string]argument)
+	arguments := n.arguments
+
+	for len(arguments) > 0 && arguments[0].kind == argumentTag {
+		tag := arguments[0]
+		arguments = arguments[1:]
+
+		takesValue, ok := spec[tag.tag]
+		if !ok {
+			return nil, nil, errorAt(tag.line, "unknown tag :%v for %v", tag.tag, n.name)
+		}
+		if _, repeated := tags[tag.tag]; repeated {
+			return nil, nil, errorAt(tag.line, "tag :%v given twice", tag.tag)
+		}
+
+		if !takesValue {
+			tags[tag.tag] = tag
+			continue
+		}
+		if len(arguments) == 0 || arguments[0].kind == argumentTag {
+			return nil, nil, errorAt(tag.line, "tag :%v takes a value", tag.tag)
+		}
+		tags[tag.tag] = arguments[0]
+		arguments = arguments[1:]
+	}
+
+	for _, a := range arguments {
+		if a.kind == argumentTag {
+			return nil, nil, errorAt(a.line, "tag :%v must come before the positional arguments of %v", a.tag, n.name)
+		}
+	}
+
+	return tags, arguments, nil
+}
+
+// oneOf returns which of the mutually exclusive tags was given, if any
+func oneOf(n *node, tags map[string]argument, fallback string, options ...string) (string, error) {
+	chosen := ""
+	for _, option := range options {
+		if _, ok := tags[option]; !ok {
+			continue
+		}
+		if chosen != "" {
+			return "", errorAt(n.line, ":%v and :%v exclude each other", chosen, option)
+		}
+		chosen = option
+	}
+
+	if chosen == "" {
+		return fallback, nil
+	}
+	return chosen, nil
+}
+
+// single reads an argument which must be a lone string
+func single(a argument, what string) (string, error) {
+	if a.kind != argumentStrings || a.isList || len(a.strings) != 1 {
+		return "", errorAt(a.line, "%v takes a string, found %v", what, a)
+	}
+	return a.strings[0], nil
+}
+
+func copySpec(spec map[string]bool) map[string]bool {
+	copied := make(map[string]bool, len(spec))
+	for tag, takesValue := range spec {
+		copied[tag] = takesValue
+	}
+	return copied
+}
+
+// parseZone reads a time zone offset such as "+0100"
+func parseZone(zone string) (*time.Location, error) {
+	if !zonePattern.MatchString(zone) {
+		return nil, fmt.Errorf("invalid zone %q, expected +hhmm or -hhmm", zone)
+	}
+
+	hours, _ := strconv.Atoi(zone[1:3])
+	minutes, _ := strconv.Atoi(zone[3:5])
+	offset := hours * 3600 + minutes * 60
+	if zone[0] == '-' {
+		offset = -offset
+	}
+
+	return time.FixedZone(zone, offset), nil
+}
+
+// splitFlags separates flags given several to a string, e.g. "\\Seen \\Flagged"
+func splitFlags(lists []string) []string {
+	var flags []string
+	for _, list := range lists {
+		flags = append(flags, strings.Fields(list)...)
+	}
+	return flags
+}
@@ -0,0 +1,258 @@
+package sieve
+
+import (
+	"fmt"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenTag
+	tokenNumber
+	tokenString
+	// One of [ ] ( ) { } , ;
+	tokenPunct
+)
+
+type token struct {
+	kind tokenKind
+	// Identifier, tag without its colon, punctuation or decoded string
+	text string
+	number int64
+	line int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of script"
+	case tokenTag:
+		return ":" + t.text
+	case tokenNumber:
+		return fmt.Sprint(t.number)
+	case tokenString:
+		return fmt.Sprintf("string %q", t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// Quantifiers of numbers, e.g. 100K
+var quantifiers = map[byte]int64{
+	'K': 1 << 10,
+	'M': 1 << 20,
+	'G': 1 << 30,
+}
+
+type lexer struct {
+	script string
+	pos int
+	line int
+}
+
+// lex splits the script into tokens as described in RFC 5228 section 2,
+// ending with tokenEOF
+func lex(script string) ([]token, error) {
+	l := lexer{script: script, line: 1}
+	var tokens []token
+
+	for {
+		t, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+		if t.kind == tokenEOF {
+			return tokens, nil
+		}
+	}
+}
+
+func (l *lexer) errorf(format string, args ...interface{}) error {
+	return &SyntaxError{Line: l.line, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (l *lexer) next() (token, error) {
+	if err := l.skipSpace(); err != nil {
+		return token{}, err
+	}
+	if l.pos >= len(l.script) {
+		return token{kind: tokenEOF, line: l.line}, nil
+	}
+
+	c := l.script[l.pos]
+	switch {
+	case strings.IndexByte("[](){},;", c) != -1:
+		l.pos++
+		return token{kind: tokenPunct, text: string(c), line: l.line}, nil
+	case c == '"':
+		return l.quoted()
+	case c == ':':
+		l.pos++
+		name := l.identifier()
+		if name == "" {
+			return token{}, l.errorf("expected tag name after ':'")
+		}
+		return token{kind: tokenTag, text: strings.ToLower(name), line: l.line}, nil
+	case isDigit(c):
+		return l.number()
+	case isLetter(c) || c == '_':
+		line := l.line
+		name := l.identifier()
+		if strings.EqualFold(name, "text") && l.pos < len(l.script) && l.script[l.pos] == ':' {
+			l.pos++
+			return l.multiline(line)
+		}
+		return token{kind: tokenIdent, text: strings.ToLower(name), line: line}, nil
+	}
+
+	return token{}, l.errorf("unexpected character %q", c)
+}
+
+// skipSpace passes over whitespace and both kinds of comments
+func (l *lexer) skipSpace() error {
+	for l.pos < len(l.script) {
+		switch c := l.script[l.pos]; {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			l.pos++
+		case c == '#':
+			for l.pos < len(l.script) && l.script[l.pos] != '\n' {
+				l.pos++
+			}
+		case strings.HasPrefix(l.script[l.pos:], "/*"):
+			end := strings.Index(l.script[l.pos + 2:], "*/")
+			if end == -1 {
+				return l.errorf("unterminated comment")
+			}
+			comment := l.script[l.pos:l.pos + 2 + end + 2]
+			l.line += strings.Count(comment, "\n")
+			l.pos += len(comment)
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (l *lexer) identifier() string {
+	start := l.pos
+	for l.pos < len(l.script) && (isLetter(l.script[l.pos]) || isDigit(l.script[l.pos]) || l.script[l.pos] == '_') {
+		l.pos++
+	}
+	return l.script[start:l.pos]
+}
+
+func (l *lexer) number() (token, error) {
+	var number int64
+	for l.pos < len(l.script) && isDigit(l.script[l.pos]) {
+		number = number * 10 + int64(l.script[l.pos] - '0')
+		if number > 1 << 40 {
+			return token{}, l.errorf("number too large")
+		}
+		l.pos++
+	}
+
+	if l.pos < len(l.script) {
+		if quantifier, ok := quantifiers[upper(l.script[l.pos])]; ok {
+			number *= quantifier
+			l.pos++
+		}
+	}
+
+	return token{kind: tokenNumber, number: number, line: l.line}, nil
+}
+
+// quoted reads a string in double quotes, in which a backslash escapes the
+// character following it
+func (l *lexer) quoted() (token, error) {
+	line := l.line
+	var text strings.Builder
+
+	for l.pos++; l.pos < len(l.script); l.pos++ {
+		c := l.script[l.pos]
+		switch c {
+		case '"':
+			l.pos++
+			return token{kind: tokenString, text: text.String(), line: line}, nil
+		case '\\':
+			l.pos++
+			if l.pos == len(l.script) {
+				break
+			}
+			c = l.script[l.pos]
+		}
+		if c == '\n' {
+			l.line++
+		}
+		text.WriteByte(c)
+	}
+
+	return token{}, &SyntaxError{Line: line, Msg: "unterminated string"}
+}
+
+// multiline reads the lines following "text:" up to a line holding a single
+// dot. Lines starting with a dot have it doubled
+func (l *lexer) multiline(line int) (token, error) {
+	// Only whitespace and a comment may follow on the line of "text:"
+	for l.pos < len(l.script) && (l.script[l.pos] == ' ' || l.script[l.pos] == '\t') {
+		l.pos++
+	}
+	if l.pos < len(l.script) && l.script[l.pos] == '#' {
+		for l.pos < len(l.script) && l.script[l.pos] != '\n' {
+			l.pos++
+		}
+	}
+	if strings.HasPrefix(l.script[l.pos:], "\r\n") {
+		l.pos++
+	}
+	if l.pos == len(l.script) || l.script[l.pos] != '\n' {
+		return token{}, l.errorf("expected end of line after text:")
+	}
+	l.pos++
+	l.line++
+
+	var lines []string
+	for l.pos < len(l.script) {
+		end := strings.IndexByte(l.script[l.pos:], '\n')
+		if end == -1 {
+			end = len(l.script) - l.pos
+		}
+		current := strings.TrimSuffix(l.script[l.pos:l.pos + end], "\r")
+		l.pos += end
+		if l.pos < len(l.script) {
+			l.pos++
+			l.line++
+		}
+
+		if current == "." {
+			text := strings.Join(lines, "\r\n")
+			if len(lines) > 0 {
+				text += "\r\n"
+			}
+			return token{kind: tokenString, text: text, line: line}, nil
+		}
+		lines = append(lines, strings.TrimPrefix(current, "."))
+	}
+
+	return token{}, &SyntaxError{Line: line, Msg: "unterminated text: block, expected a line holding a single '.'"}
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func upper(c byte) byte {
+	if c >= 'a' && c <= 'z' {
+		return c - 'a' + 'A'
+	}
+	return c
+}
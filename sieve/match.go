@@ -0,0 +1,179 @@
+package sieve
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// matcher compares the values of a test with its keys
+type matcher struct {
+	// i;octet, i;ascii-casemap or i;ascii-numeric
+	comparator string
+	// is, contains, matches, value or count
+	matchType string
+	// Relation of value and count: gt, ge, lt, le, eq or ne
+	relation string
+}
+
+// match reports whether any of the values matches any of the keys or, for
+// :count, whether the number of values does
+func (m matcher) match(values, keys []string) bool {
+	if m.matchType == "count" {
+		count := strconv.Itoa(len(values))
+		for _, key := range keys {
+			if m.relate(m.compare(count, key)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, value := range values {
+		for _, key := range keys {
+			if m.matchOne(value, key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (m matcher) matchOne(value, key string) bool {
+	switch m.matchType {
+	case "contains":
+		value, key = m.fold(value), m.fold(key)
+		return strings.Contains(value, key)
+	case "matches":
+		return wildcard(m.fold(value), m.fold(key))
+	case "value":
+		return m.relate(m.compare(value, key))
+	}
+	return m.compare(value, key) == 0
+}
+
+func (m matcher) relate(cmp int) bool {
+	switch m.relation {
+	case "gt":
+		return cmp > 0
+	case "ge":
+		return cmp >= 0
+	case "lt":
+		return cmp < 0
+	case "le":
+		return cmp <= 0
+	case "ne":
+		return cmp != 0
+	}
+	return cmp == 0
+}
+
+// compare orders the strings as the comparator does
+func (m matcher) compare(a, b string) int {
+	if m.comparator == "i;ascii-numeric" {
+		return compareNumeric(a, b)
+	}
+	return strings.Compare(m.fold(a), m.fold(b))
+}
+
+// fold maps ASCII letters to lower case for i;ascii-casemap, leaving other
+// characters alone as RFC 4790 requires
+func (m matcher) fold(s string) string {
+	if m.comparator != "i;ascii-casemap" {
+		return s
+	}
+
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, s)
+}
+
+// compareNumeric orders strings by the number they start with. Strings not
+// starting with a digit stand for positive infinity
+func compareNumeric(a, b string) int {
+	a, aNumber := leadingDigits(a)
+	b, bNumber := leadingDigits(b)
+
+	switch {
+	case !aNumber && !bNumber:
+		return 0
+	case !aNumber:
+		return 1
+	case !bNumber:
+		return -1
+	}
+
+	// Without leading zeros, longer numbers are larger
+	if len(a) != len(b) {
+		if len(a) < len(b) {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func leadingDigits(s string) (string, bool) {
+	end := 0
+	for end < len(s) && isDigit(s[end]) {
+		end++
+	}
+	if end == 0 {
+		return "", false
+	}
+
+	digits := strings.TrimLeft(s[:end], "0")
+	return digits, true
+}
+
+// wildcard matches the value against a pattern in which '*' stands for any
+// run of characters, '?' for a single one and a backslash escapes either
+func wildcard(value, pattern string) bool {
+	// Position in both after the latest '*', to backtrack to
+	star, resume := -1, 0
+
+	v, p := 0, 0
+	for v < len(value) {
+		if p < len(pattern) {
+			switch c := pattern[p]; c {
+			case '*':
+				star, resume = p, v
+				p++
+				continue
+			case '?':
+				_, size := utf8.DecodeRuneInString(value[v:])
+				v += size
+				p++
+				continue
+			case '\\':
+				if p + 1 < len(pattern) && value[v] == pattern[p + 1] {
+					v++
+					p += 2
+					continue
+				}
+			default:
+				if value[v] == c {
+					v++
+					p++
+					continue
+				}
+			}
+		}
+
+		// Mismatch: let the latest '*' swallow one more character
+		if star == -1 {
+			return false
+		}
+		_, size := utf8.DecodeRuneInString(value[resume:])
+		resume += size
+		v, p = resume, star + 1
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
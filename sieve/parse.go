@@ -0,0 +1,244 @@
+package sieve
+
+import (
+	"fmt"
+)
+
+// SyntaxError locates the first problem found in a script
+type SyntaxError struct {
+	Line int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+type argumentKind int
+
+const (
+	argumentTag argumentKind = iota
+	argumentNumber
+	argumentStrings
+)
+
+// argument of a command or test as written, before it is given a meaning
+type argument struct {
+	kind argumentKind
+	tag string
+	number int64
+	strings []string
+	// Written as a [list] rather than a single string
+	isList bool
+	line int
+}
+
+func (a argument) String() string {
+	switch a.kind {
+	case argumentTag:
+		return ":" + a.tag
+	case argumentNumber:
+		return fmt.Sprint(a.number)
+	}
+	if a.isList {
+		return "string list"
+	}
+	return "string"
+}
+
+// node is a command or test as written
+type node struct {
+	name string
+	line int
+	arguments []argument
+	tests []*node
+	// Commands within the braces of a control command
+	block []*node
+	hasBlock bool
+}
+
+type parser struct {
+	tokens []token
+	pos int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) isPunct(text string) bool {
+	t := p.peek()
+	return t.kind == tokenPunct && t.text == text
+}
+
+func (p *parser) expect(text string) error {
+	if !p.isPunct(text) {
+		return p.errorf(p.peek(), "expected %q, found %v", text, p.peek())
+	}
+	p.next()
+	return nil
+}
+
+func (p *parser) errorf(at token, format string, args ...interface{}) error {
+	return &SyntaxError{Line: at.line, Msg: fmt.Sprintf(format, args...)}
+}
+
+// commands: *command, up to the end of the script or of a block
+func (p *parser) parseCommands() ([]*node, error) {
+	var commands []*node
+
+	for {
+		t := p.peek()
+		if t.kind == tokenEOF || (t.kind == tokenPunct && t.text == "}") {
+			return commands, nil
+		}
+
+		command, err := p.parseCommand()
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, command)
+	}
+}
+
+// command: identifier arguments (";" / block)
+func (p *parser) parseCommand() (*node, error) {
+	t := p.next()
+	if t.kind != tokenIdent {
+		return nil, p.errorf(t, "expected command, found %v", t)
+	}
+
+	command := &node{name: t.text, line: t.line}
+	if err := p.parseArguments(command); err != nil {
+		return nil, err
+	}
+
+	if p.isPunct("{") {
+		p.next()
+		block, err := p.parseCommands()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("}"); err != nil {
+			return nil, err
+		}
+		command.block = block
+		command.hasBlock = true
+		return command, nil
+	}
+
+	if !p.isPunct(";") {
+		return nil, p.errorf(p.peek(), "expected \";\" after %v, found %v", command.name, p.peek())
+	}
+	p.next()
+	return command, nil
+}
+
+// arguments: *argument [test / test-list]
+func (p *parser) parseArguments(n *node) error {
+	for {
+		t := p.peek()
+
+		switch {
+		case t.kind == tokenTag:
+			p.next()
+			n.arguments = append(n.arguments, argument{kind: argumentTag, tag: t.text, line: t.line})
+			continue
+		case t.kind == tokenNumber:
+			p.next()
+			n.arguments = append(n.arguments, argument{kind: argumentNumber, number: t.number, line: t.line})
+			continue
+		case t.kind == tokenString:
+			p.next()
+			n.arguments = append(n.arguments, argument{kind: argumentStrings, strings: []string{t.text}, line: t.line})
+			continue
+		case t.kind == tokenPunct && t.text == "[":
+			list, err := p.parseStringList()
+			if err != nil {
+				return err
+			}
+			n.arguments = append(n.arguments, list)
+			continue
+		case t.kind == tokenIdent:
+			test, err := p.parseTest()
+			if err != nil {
+				return err
+			}
+			n.tests = []*node{test}
+		case t.kind == tokenPunct && t.text == "(":
+			tests, err := p.parseTestList()
+			if err != nil {
+				return err
+			}
+			n.tests = tests
+		}
+
+		return nil
+	}
+}
+
+// string-list: "[" string *("," string) "]"
+func (p *parser) parseStringList() (argument, error) {
+	open := p.next()
+	list := argument{kind: argumentStrings, isList: true, line: open.line}
+
+	for {
+		t := p.next()
+		if t.kind != tokenString {
+			return argument{}, p.errorf(t, "expected string in list, found %v", t)
+		}
+		list.strings = append(list.strings, t.text)
+
+		if p.isPunct("]") {
+			p.next()
+			return list, nil
+		}
+		if err := p.expect(","); err != nil {
+			return argument{}, err
+		}
+	}
+}
+
+// test: identifier arguments
+func (p *parser) parseTest() (*node, error) {
+	t := p.next()
+	if t.kind != tokenIdent {
+		return nil, p.errorf(t, "expected test, found %v", t)
+	}
+
+	test := &node{name: t.text, line: t.line}
+	if err := p.parseArguments(test); err != nil {
+		return nil, err
+	}
+	return test, nil
+}
+
+// test-list: "(" test *("," test) ")"
+func (p *parser) parseTestList() ([]*node, error) {
+	p.next()
+
+	var tests []*node
+	for {
+		test, err := p.parseTest()
+		if err != nil {
+			return nil, err
+		}
+		tests = append(tests, test)
+
+		if p.isPunct(")") {
+			p.next()
+			return tests, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,452 @@
+package sieve
+
+import (
+	"time"
+	"strconv"
+	"strings"
+	"net/mail"
+	"net/textproto"
+	"github.com/asgaines/msgextract/parse"
+)
+
+// Output fields produced by Result.Fields, in display order
+var Fields = []string{"sieve_keep", "sieve_discard", "sieve_fileinto", "sieve_redirect", "sieve_flags"}
+
+// Headers standing in for the envelope, which archives do not keep. The
+// first one present is used
+var envelopeHeaders = map[string][]string{
+	"from": {"Return-Path"},
+	"to": {"X-Original-To", "Delivered-To", "Envelope-To"},
+}
+
+// Script is a parsed Sieve script
+type Script struct {
+	statements []statement
+}
+
+// Result lists the actions a script took on a message
+type Result struct {
+	// Whether the message is kept in the inbox, explicitly or implicitly
+	Keep bool
+	// Whether discard was executed, cancelling the implicit keep
+	Discard bool
+	// Folders the message is filed into
+	FileInto []string
+	// Addresses the message is redirected to
+	Redirect []string
+	// IMAP flags set on the kept or filed message
+	Flags []string
+}
+
+// Parse reads a script written in Sieve (RFC 5228) with the envelope,
+// fileinto, copy, relational (RFC 5231), date (RFC 5260) and imap4flags
+// (RFC 5232) extensions. A *SyntaxError locates the first problem found,
+// including any use of an extension that was not required
+func Parse(script string) (*Script, error) {
+	tokens, err := lex(script)
+	if err != nil {
+		return nil, err
+	}
+
+	p := parser{tokens: tokens}
+	nodes, err := p.parseCommands()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, p.errorf(t, "unexpected %v", t)
+	}
+
+	c := compiler{required: make(map[string]bool)}
+	statements, err := c.compileCommands(nodes, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Script{statements: statements}, nil
+}
+
+// Evaluate runs the script against the header of a message of the given
+// size in bytes
+func (s *Script) Evaluate(header textproto.MIMEHeader, size int64) Result {
+	e := evaluation{header: header, size: size, now: time.Now(), implicitKeep: true}
+	execute(s.statements, &e)
+
+	if e.implicitKeep {
+		e.keep(e.flags)
+	}
+	return e.result
+}
+
+// Fields flattens the result into output fields, lists being separated by
+// commas
+func (r Result) Fields() map[string]string {
+	return map[string]string{
+		"sieve_keep": strconv.FormatBool(r.Keep),
+		"sieve_discard": strconv.FormatBool(r.Discard),
+		"sieve_fileinto": strings.Join(r.FileInto, ","),
+		"sieve_redirect": strings.Join(r.Redirect, ","),
+		"sieve_flags": strings.Join(r.Flags, ","),
+	}
+}
+
+type evaluation struct {
+	header textproto.MIMEHeader
+	size int64
+	now time.Time
+	// Internal flag variable of imap4flags
+	flags []string
+	// Cancelled by discard and by fileinto or redirect without :copy
+	implicitKeep bool
+	result Result
+}
+
+func (e *evaluation) keep(flags []string) {
+	e.result.Keep = true
+	e.result.Flags = addFlags(e.result.Flags, flags)
+}
+
+// execute runs the statements, returning false once stop is reached
+func execute(statements []statement, e *evaluation) bool {
+	for _, s := range statements {
+		if !s.execute(e) {
+			return false
+		}
+	}
+	return true
+}
+
+type statement interface {
+	execute(e *evaluation) bool
+}
+
+type ifStatement struct {
+	conditions []test
+	blocks [][]statement
+	// Block of else, if any
+	otherwise []statement
+}
+
+func (s *ifStatement) execute(e *evaluation) bool {
+	for i, condition := range s.conditions {
+		if condition.eval(e) {
+			return execute(s.blocks[i], e)
+		}
+	}
+	return execute(s.otherwise, e)
+}
+
+type stopStatement struct{}
+
+func (stopStatement) execute(e *evaluation) bool {
+	return false
+}
+
+type actionStatement struct {
+	action string
+	// Folder or address
+	target string
+	copy bool
+	flags []string
+	hasFlags bool
+}
+
+func (s actionStatement) execute(e *evaluation) bool {
+	flags := e.flags
+	if s.hasFlags {
+		flags = s.flags
+	}
+
+	switch s.action {
+	case "keep":
+		e.keep(flags)
+		e.implicitKeep = false
+	case "discard":
+		e.result.Discard = true
+		e.implicitKeep = false
+	case "fileinto":
+		e.result.FileInto = addOnce(e.result.FileInto, s.target)
+		e.result.Flags = addFlags(e.result.Flags, flags)
+		e.implicitKeep = e.implicitKeep && s.copy
+	case "redirect":
+		e.result.Redirect = addOnce(e.result.Redirect, s.target)
+		e.implicitKeep = e.implicitKeep && s.copy
+	}
+	return true
+}
+
+type flagStatement struct {
+	operation string
+	flags []string
+}
+
+func (s flagStatement) execute(e *evaluation) bool {
+	switch s.operation {
+	case "setflag":
+		e.flags = addFlags(nil, s.flags)
+	case "addflag":
+		e.flags = addFlags(e.flags, s.flags)
+	case "removeflag":
+		var kept []string
+		for _, flag := range e.flags {
+			if !containsFold(s.flags, flag) {
+				kept = append(kept, flag)
+			}
+		}
+		e.flags = kept
+	}
+	return true
+}
+
+type test interface {
+	eval(e *evaluation) bool
+}
+
+type allOf []test
+
+func (t allOf) eval(e *evaluation) bool {
+	for _, operand := range t {
+		if !operand.eval(e) {
+			return false
+		}
+	}
+	return true
+}
+
+type anyOf []test
+
+func (t anyOf) eval(e *evaluation) bool {
+	for _, operand := range t {
+		if operand.eval(e) {
+			return true
+		}
+	}
+	return false
+}
+
+type notTest struct {
+	operand test
+}
+
+func (t notTest) eval(e *evaluation) bool {
+	return !t.operand.eval(e)
+}
+
+type constantTest bool
+
+func (t constantTest) eval(e *evaluation) bool {
+	return bool(t)
+}
+
+type headerTest struct {
+	names []string
+	keys []string
+	matcher matcher
+}
+
+func (t headerTest) eval(e *evaluation) bool {
+	var values []string
+	for _, name := range t.names {
+		for _, value := range e.header.Values(name) {
+			values = append(values, parse.DecodeHeader(value))
+		}
+	}
+	return t.matcher.match(values, t.keys)
+}
+
+type addressTest struct {
+	names []string
+	keys []string
+	// all, localpart or domain
+	part string
+	envelope bool
+	matcher matcher
+}
+
+func (t addressTest) eval(e *evaluation) bool {
+	var values []string
+
+	for _, name := range t.names {
+		fields := []string{name}
+		if t.envelope {
+			fields = envelopeHeaders[name]
+		}
+
+		for _, field := range fields {
+			found := e.header.Values(field)
+			for _, value := range found {
+				for _, address := range envelopeAddresses(value, t.envelope) {
+					values = append(values, addressPart(address, t.part))
+				}
+			}
+			if len(found) > 0 {
+				break
+			}
+		}
+	}
+
+	return t.matcher.match(values, t.keys)
+}
+
+// envelopeAddresses parses the addresses of a field. The null reverse-path
+// "<>" of bounces is kept as an empty address in the envelope
+func envelopeAddresses(value string, envelope bool) []string {
+	if envelope && strings.TrimSpace(value) == "<>" {
+		return []string{""}
+	}
+
+	var addresses []string
+	for _, address := range parse.Addresses(value) {
+		addresses = append(addresses, address.Address)
+	}
+	return addresses
+}
+
+func addressPart(address, part string) string {
+	at := strings.LastIndex(address, "@")
+
+	switch part {
+	case "localpart":
+		if at != -1 {
+			return address[:at]
+		}
+	case "domain":
+		if at != -1 {
+			return address[at + 1:]
+		}
+		return ""
+	}
+	return address
+}
+
+type existsTest struct {
+	names []string
+}
+
+func (t existsTest) eval(e *evaluation) bool {
+	for _, name := range t.names {
+		if len(e.header.Values(name)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+type sizeTest struct {
+	over bool
+	limit int64
+}
+
+func (t sizeTest) eval(e *evaluation) bool {
+	if t.over {
+		return e.size > t.limit
+	}
+	return e.size < t.limit
+}
+
+type dateTest struct {
+	// Header holding the date, unless current
+	header string
+	current bool
+	part string
+	// Zone the date is converted to, nil keeping its original zone
+	location *time.Location
+	keys []string
+	matcher matcher
+}
+
+func (t dateTest) eval(e *evaluation) bool {
+	date := e.now
+
+	if !t.current {
+		value := e.header.Get(t.header)
+		// The date of a Received header follows its last semicolon
+		if strings.EqualFold(t.header, "Received") {
+			value = value[strings.LastIndex(value, ";") + 1:]
+		}
+
+		var err error
+		if date, err = mail.ParseDate(strings.TrimSpace(value)); err != nil {
+			return false
+		}
+	}
+
+	if t.location != nil {
+		date = date.In(t.location)
+	}
+
+	return t.matcher.match([]string{datePart(date, t.part)}, t.keys)
+}
+
+// Epoch of the Modified Julian Day of the julian date part
+var julianEpoch = time.Date(1858, time.November, 17, 0, 0, 0, 0, time.UTC)
+
+func datePart(date time.Time, part string) string {
+	switch part {
+	case "year":
+		return date.Format("2006")
+	case "month":
+		return date.Format("01")
+	case "day":
+		return date.Format("02")
+	case "date":
+		return date.Format("2006-01-02")
+	case "julian":
+		day := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+		return strconv.Itoa(int(day.Sub(julianEpoch).Hours() / 24))
+	case "hour":
+		return date.Format("15")
+	case "minute":
+		return date.Format("04")
+	case "second":
+		return date.Format("05")
+	case "time":
+		return date.Format("15:04:05")
+	case "iso8601":
+		return date.Format("2006-01-02T15:04:05-07:00")
+	case "std11":
+		return date.Format("Mon, 02 Jan 2006 15:04:05 -0700")
+	case "zone":
+		return date.Format("-0700")
+	case "weekday":
+		return strconv.Itoa(int(date.Weekday()))
+	}
+	return ""
+}
+
+type hasflagTest struct {
+	keys []string
+	matcher matcher
+}
+
+func (t hasflagTest) eval(e *evaluation) bool {
+	return t.matcher.match(e.flags, t.keys)
+}
+
+// addFlags appends the flags not already present, regardless of case
+func addFlags(flags []string, added []string) []string {
+	for _, flag := range added {
+		if !containsFold(flags, flag) {
+			flags = append(flags, flag)
+		}
+	}
+	return flags
+}
+
+func addOnce(list []string, value string) []string {
+	for _, existing := range list {
+		if existing == value {
+			return list
+		}
+	}
+	return append(list, value)
+}
+
+func containsFold(list []string, value string) bool {
+	for _, existing := range list {
+		if strings.EqualFold(existing, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,230 @@
+package sieve
+
+import (
+	"reflect"
+	"testing"
+	"net/textproto"
+)
+
+var darty = textproto.MIMEHeader{
+	"Return-Path": {"<bounce@contact-darty.com>"},
+	"Delivered-To": {"ron@example.com"},
+	"Received": {
+		"from mx.example.com by mail.example.com; Fri, 01 Apr 2011 14:20:00 +0000",
+		"from out.contact-darty.com by mx.example.com; Fri, 01 Apr 2011 14:18:00 +0000",
+	},
+	"From": {`"Darty" <infos@Contact-Darty.com>`},
+	"To": {"ron@example.com, Harry Potter <harry@hogwarts.example>"},
+	"Subject": {"=?utf-8?q?Cuit_Vapeur_29.90_=E2=82=AC?= Nintendo 3DS"},
+	"Date": {"01 Apr 2011 16:17:41 +0200"},
+	"List-Id": {"<promo.contact-darty.com>"},
+	"X-Spam-Score": {"7"},
+}
+
+func TestEvaluate(t *testing.T) {
+	cases := []struct {
+		name string
+		script string
+		want Result
+	}{
+		{"implicit keep", ``, Result{Keep: true}},
+		{"discard", `discard;`, Result{Discard: true}},
+		{
+			"fileinto by address",
+			`require "fileinto";
+			if address :domain :is "from" "contact-darty.com" { fileinto "Promo"; }`,
+			Result{FileInto: []string{"Promo"}},
+		},
+		{
+			"fileinto copy",
+			`require ["fileinto", "copy"];
+			fileinto :copy "Archive";
+			fileinto :copy "Archive";`,
+			Result{Keep: true, FileInto: []string{"Archive"}},
+		},
+		{
+			"elsif and else",
+			`require "fileinto";
+			if header :contains "subject" "lunch" { fileinto "Lunch"; }
+			elsif header :contains "subject" "€" { fileinto "Euros"; }
+			else { fileinto "Other"; }`,
+			Result{FileInto: []string{"Euros"}},
+		},
+		{
+			"matches",
+			`if header :matches "subject" "cuit*29.90 ?*" { discard; }`,
+			Result{Discard: true},
+		},
+		{
+			"octet comparator",
+			`if header :comparator "i;octet" :contains "subject" "cuit" { discard; }`,
+			Result{Keep: true},
+		},
+		{
+			"anyof, allof and not",
+			`if allof (exists ["List-Id", "From"], not exists "X-Absent", anyof (false, true)) { redirect "spam@example.com"; }`,
+			Result{Redirect: []string{"spam@example.com"}},
+		},
+		{
+			"envelope",
+			`require "envelope";
+			if allof (envelope :localpart :is "from" "bounce", envelope :is "to" "ron@example.com") { stop; }
+			discard;`,
+			Result{Keep: true},
+		},
+		{
+			"relational count",
+			`require ["relational", "comparator-i;ascii-numeric"];
+			if address :count "eq" :comparator "i;ascii-numeric" "to" "2" { discard; }`,
+			Result{Discard: true},
+		},
+		{
+			"relational value",
+			`require ["relational", "comparator-i;ascii-numeric"];
+			if header :value "ge" :comparator "i;ascii-numeric" "X-Spam-Score" "5" { discard; }`,
+			Result{Discard: true},
+		},
+		{
+			"date with zone",
+			`require ["date", "relational"];
+			if allof (date :zone "+0000" "date" "hour" "14",
+			          date :originalzone "date" "zone" "+0200",
+			          date :value "ge" :zone "+0000" "date" "date" "2011-04-01",
+			          date :zone "-0500" "received" "time" "09:20:00",
+			          date :zone "+0000" "date" "weekday" "5",
+			          date :zone "+0000" "date" "julian" "55652") { discard; }`,
+			Result{Discard: true},
+		},
+		{
+			"currentdate",
+			`require ["date", "relational"];
+			if currentdate :value "gt" "year" "2011" { discard; }`,
+			Result{Discard: true},
+		},
+		{
+			"size",
+			`if size :over 10K { discard; } if size :under 2K { stop; } keep;`,
+			Result{Keep: true},
+		},
+		{
+			"flags",
+			`require ["imap4flags", "fileinto"];
+			setflag "\\Seen";
+			addflag ["$Promo \\Flagged", "\\seen"];
+			removeflag "\\Flagged";
+			if hasflag :is "$promo" { fileinto "Promo"; }
+			fileinto :flags "\\Answered" "Answered";
+			keep;`,
+			Result{Keep: true, FileInto: []string{"Promo", "Answered"}, Flags: []string{"\\Seen", "$Promo", "\\Answered"}},
+		},
+		{
+			"multi-line string",
+			"if header :is \"list-id\" text:\r\n<promo.contact-darty.com>\r\n.\r\n { discard; }",
+			Result{Keep: true},
+		},
+		{
+			"comments",
+			"# hash\n/* bracketed\n comment */ if true { discard; } # trailing",
+			Result{Discard: true},
+		},
+	}
+
+	for _, c := range cases {
+		script, err := Parse(c.script)
+		if err != nil {
+			t.Errorf("%v: %v", c.name, err)
+			continue
+		}
+
+		if result := script.Evaluate(darty, 4096); !reflect.DeepEqual(result, c.want) {
+			t.Errorf("%v: received %+v, wanted %+v", c.name, result, c.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := []struct {
+		script string
+		err string
+	}{
+		{`fileinto "Promo";`, `line 1: fileinto needs require "fileinto"`},
+		{`require "vacation";`, `line 1: unsupported extension "vacation"`},
+		{"keep;\nrequire \"fileinto\";", "line 2: require must come before any other command"},
+		{"if header :is \"from\" \"x\"\n{ discard; ", `line 2: expected "}", found end of script`},
+		{`discard`, `line 1: expected ";" after discard, found end of script`},
+		{`elsif true { keep; }`, "line 1: elsif without if"},
+		{`if header :over "from" "x" { keep; }`, "line 1: unknown tag :over for header"},
+		{`if header :is :contains "from" "x" { keep; }`, "line 1: :is and :contains exclude each other"},
+		{`if header :value "gt" "from" "x" { keep; }`, `line 1: :value needs require "relational"`},
+		{`require "relational"; if header :value "over" "from" "x" { keep; }`, `line 1: unknown relation "over", expected gt, ge, lt, le, eq or ne`},
+		{`if header :comparator "i;ascii-numeric" "from" "x" { keep; }`, `line 1: comparator i;ascii-numeric needs require "comparator-i;ascii-numeric"`},
+		{`if header :comparator "i;unicode" "from" "x" { keep; }`, `line 1: unsupported comparator "i;unicode"`},
+		{`require "date"; if date "date" "fortnight" "1" { keep; }`, `line 1: unknown date part "fortnight"`},
+		{`require "date"; if date :zone "CET" "date" "hour" "1" { keep; }`, `line 1: invalid zone "CET", expected +hhmm or -hhmm`},
+		{`require "envelope"; if envelope "cc" "x" { keep; }`, `line 1: unknown envelope part "cc", expected from or to`},
+		{`if size 10 { keep; }`, "line 1: size takes :over or :under and a number"},
+		{`if nosuch { keep; }`, `line 1: unknown test "nosuch"`},
+		{`vacation "away";`, `line 1: unknown command "vacation"`},
+		{`if header "from" :is "x" { keep; }`, "line 1: tag :is must come before the positional arguments of header"},
+		{"if header :is \"from\" \"x", "line 1: unterminated string"},
+		{"/* open", "line 1: unterminated comment"},
+		{"if true { keep; }\nif header :is \"list-id\" text:\nx\n", "line 2: unterminated text: block, expected a line holding a single '.'"},
+	}
+
+	for _, c := range cases {
+		_, err := Parse(c.script)
+		if err == nil {
+			t.Errorf("%v parsed, wanted %v", c.script, c.err)
+			continue
+		}
+		if err.Error() != c.err {
+			t.Errorf("%v returned %v, wanted %v", c.script, err, c.err)
+		}
+	}
+}
+
+func TestWildcard(t *testing.T) {
+	cases := []struct {
+		value string
+		pattern string
+		want bool
+	}{
+		{"", "", true},
+		{"", "*", true},
+		{"abc", "a*c", true},
+		{"abc", "a?c", true},
+		{"ac", "a?c", false},
+		{"é", "?", true},
+		{"a*c", `a\*c`, true},
+		{"abc", `a\*c`, false},
+		{"aXbXc", "*x*c", false},
+		{"aaab", "*a*b", true},
+		{"abcd", "*d*", true},
+	}
+
+	for _, c := range cases {
+		if got := wildcard(c.value, c.pattern); got != c.want {
+			t.Errorf("%q against %q returned %v, wanted %v", c.value, c.pattern, got, c.want)
+		}
+	}
+}
+
+func TestCompareNumeric(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"10", "9", 1},
+		{"007", "7", 0},
+		{"3 apples", "3", 0},
+		{"x", "1000", 1},
+		{"x", "y", 0},
+		{"", "0", 1},
+	}
+
+	for _, c := range cases {
+		if got := compareNumeric(c.a, c.b); got != c.want {
+			t.Errorf("%q and %q returned %v, wanted %v", c.a, c.b, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package state
+
+import (
+	"fmt"
+	"time"
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Tables of the store. Messages are known by their key, the kind of which
+// is kept in meta so that keys of different kinds are never compared
+const schema = `
+CREATE TABLE IF NOT EXISTS meta (
+	name TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS runs (
+	id INTEGER PRIMARY KEY,
+	archive TEXT NOT NULL,
+	time INTEGER NOT NULL,
+	new INTEGER NOT NULL,
+	skipped INTEGER NOT NULL,
+	pruned INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS messages (
+	key TEXT PRIMARY KEY,
+	first_run INTEGER NOT NULL REFERENCES runs(id),
+	last_seen INTEGER NOT NULL
+) WITHOUT ROWID;
+CREATE INDEX IF NOT EXISTS messages_last_seen ON messages(last_seen);
+`
+
+// Store is a SQLite file of the messages output by earlier runs, for a run
+// to only output new ones. What a run records is committed at its end, so
+// a run which fails leaves the store as it was
+type Store struct {
+	db *sql.DB
+	tx *sql.Tx
+	lookup *sql.Stmt
+	insert *sql.Stmt
+	touch *sql.Stmt
+	run int64
+	now int64
+	// Messages of this run new to the store, and seen before
+	New int
+	Skipped int
+}
+
+// Open opens the store, creating it if need be, and starts a run of an
+// extraction of the archive keying messages by keyKind. The store stays
+// locked against other runs until Commit or Close
+func Open(path, keyKind, archive string) (*Store, error) {
+	db, err := sql.Open("sqlite3", path + "?_txlock=immediate&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{db: db, now: time.Now().Unix()}
+
+	if err := s.begin(keyKind, archive); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return s, nil
+}
+
+func (s *Store) begin(keyKind, archive string) error {
+	var err error
+	if s.tx, err = s.db.Begin(); err != nil {
+		return err
+	}
+	if _, err := s.tx.Exec(schema); err != nil {
+		return err
+	}
+
+	var stored string
+	err = s.tx.QueryRow("SELECT value FROM meta WHERE name = 'key'").Scan(&stored)
+	if err == sql.ErrNoRows {
+		_, err = s.tx.Exec("INSERT INTO meta (name, value) VALUES ('key', ?)", keyKind)
+	} else if err == nil && stored != keyKind {
+		err = fmt.Errorf("messages are keyed by %v, not %v", stored, keyKind)
+	}
+	if err != nil {
+		return err
+	}
+
+	result, err := s.tx.Exec("INSERT INTO runs (archive, time, new, skipped, pruned) VALUES (?, ?, 0, 0, 0)", archive, s.now)
+	if err != nil {
+		return err
+	}
+	if s.run, err = result.LastInsertId(); err != nil {
+		return err
+	}
+
+	if s.lookup, err = s.tx.Prepare("SELECT 1 FROM messages WHERE key = ?"); err != nil {
+		return err
+	}
+	if s.insert, err = s.tx.Prepare("INSERT INTO messages (key, first_run, last_seen) VALUES (?, ?, ?)"); err != nil {
+		return err
+	}
+	s.touch, err = s.tx.Prepare("UPDATE messages SET last_seen = ? WHERE key = ?")
+	return err
+}
+
+// Seen tells whether the message was seen before, by an earlier run or
+// earlier in this one, recording it otherwise. Messages without a key are
+// never seen
+func (s *Store) Seen(key string) (bool, error) {
+	if key == "" {
+		s.New++
+		return false, nil
+	}
+
+	var found int
+	err := s.lookup.QueryRow(key).Scan(&found)
+	switch {
+	case err == sql.ErrNoRows:
+		s.New++
+		_, err = s.insert.Exec(key, s.run, s.now)
+		return false, err
+	case err != nil:
+		return false, err
+	}
+
+	s.Skipped++
+	_, err = s.touch.Exec(s.now, key)
+	return true, err
+}
+
+// Prune forgets the messages no run saw for maxAge, returning how many.
+// Those are output again should they turn up later
+func (s *Store) Prune(maxAge time.Duration) (int64, error) {
+	result, err := s.tx.Exec("DELETE FROM messages WHERE last_seen < ?", s.now - int64(maxAge / time.Second))
+	if err != nil {
+		return 0, err
+	}
+	pruned, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = s.tx.Exec("UPDATE runs SET pruned = pruned + ? WHERE id = ?", pruned, s.run)
+	return pruned, err
+}
+
+// Commit records the run, once its output is complete
+func (s *Store) Commit() error {
+	if _, err := s.tx.Exec("UPDATE runs SET new = ?, skipped = ? WHERE id = ?", s.New, s.Skipped, s.run); err != nil {
+		return err
+	}
+	err := s.tx.Commit()
+	s.tx = nil
+	return err
+}
+
+// Close closes the store, discarding the run unless committed
+func (s *Store) Close() error {
+	if s.tx != nil {
+		s.tx.Rollback()
+	}
+	return s.db.Close()
+}
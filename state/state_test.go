@@ -0,0 +1,109 @@
+package state
+
+import (
+	"os"
+	"time"
+	"testing"
+	"io/ioutil"
+	"path/filepath"
+)
+
+func newTestPath(t *testing.T) string {
+	tmpDir, err := ioutil.TempDir("../test_files", "tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	return filepath.Join(tmpDir, "state.db")
+}
+
+// run checks the keys against the store, returning those new to it
+func run(t *testing.T, path string, keys []string, commit bool) []string {
+	s, err := Open(path, "headers", "snapshot.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var fresh []string
+	for _, key := range keys {
+		seen, err := s.Seen(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !seen {
+			fresh = append(fresh, key)
+		}
+	}
+	if s.New != len(fresh) || s.Skipped != len(keys) - len(fresh) {
+		t.Errorf("counted %v new, %v skipped of %v", s.New, s.Skipped, keys)
+	}
+	if commit {
+		if err := s.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return fresh
+}
+
+func TestStore(t *testing.T) {
+	path := newTestPath(t)
+
+	cases := []struct {
+		name string
+		keys []string
+		commit bool
+		fresh []string
+	}{
+		{"first run", []string{"a", "b", "a", ""}, true, []string{"a", "b", ""}},
+		{"overlapping run", []string{"b", "c", ""}, true, []string{"c", ""}},
+		{"failed run", []string{"d"}, false, []string{"d"}},
+		{"after failed run", []string{"a", "d"}, true, []string{"d"}},
+	}
+
+	for _, tc := range cases {
+		fresh := run(t, path, tc.keys, tc.commit)
+		if len(fresh) != len(tc.fresh) {
+			t.Errorf("%v: new %q, expected %q", tc.name, fresh, tc.fresh)
+			continue
+		}
+		for i := range fresh {
+			if fresh[i] != tc.fresh[i] {
+				t.Errorf("%v: new %q, expected %q", tc.name, fresh, tc.fresh)
+				break
+			}
+		}
+	}
+
+	if _, err := Open(path, "content", "snapshot.tar.gz"); err == nil {
+		t.Errorf("no error for keys of another kind")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	path := newTestPath(t)
+	run(t, path, []string{"a", "b"}, true)
+
+	s, err := Open(path, "headers", "snapshot.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An hour later, a is seen again, unlike b
+	s.now += 3600
+	s.Seen("a")
+	pruned, err := s.Prune(30 * time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if pruned != 1 {
+		t.Errorf("pruned %v", pruned)
+	}
+
+	if fresh := run(t, path, []string{"a", "b"}, true); len(fresh) != 1 || fresh[0] != "b" {
+		t.Errorf("new after pruning %q", fresh)
+	}
+}
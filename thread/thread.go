@@ -0,0 +1,344 @@
+package thread
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"encoding/json"
+)
+
+// Output fields set by Annotate, in display order
+var Fields = []string{"thread_id", "parent_id", "depth"}
+
+// Message-IDs within References, In-Reply-To and Message-ID headers
+var idPattern = regexp.MustCompile(`<[^<>\s]+>`)
+
+// Reply and forward markers in English, German, Nordic, French and Italian
+// mailers, optionally counted (e.g. "Re[2]:")
+const replyMarker = `(?:re|fwd?|aw|wg|sv|vs|antw|tr|rif|r)\s*(?:\[\d+\])?\s*:`
+
+// Mailing list tag, e.g. "[team]"
+const listTag = `\[[^\]]*\]`
+
+var subjectPrefix = regexp.MustCompile(`(?i)^\s*(?:` + replyMarker + `|` + listTag + `)\s*`)
+
+var replySubject = regexp.MustCompile(`(?i)^\s*(?:` + listTag + `\s*)*` + replyMarker)
+
+// Container is a node of the thread tree. It holds a message of the archive
+// or, with nil Headers, one that was referenced without being present
+type Container struct {
+	// Message-ID, empty for nodes only grouping messages of the same subject
+	ID string
+	// Parsed headers of the message, shared with the record being output
+	Headers map[string]string
+	Parent *Container
+	Children []*Container
+}
+
+// Thread arranges the records into trees of replies following
+// https://www.jwz.org/doc/threading.html: messages are linked through their
+// References (or, lacking those, In-Reply-To) headers, then threads whose
+// roots share a subject are gathered. The roots are returned in the order
+// the records first mention them
+func Thread(records []map[string]string) []*Container {
+	t := threader{containers: make(map[string]*Container)}
+
+	for i, headers := range records {
+		id := firstID(header(headers, "Message-ID"))
+
+		// Messages lacking an ID, or reusing one, cannot be referenced
+		if existing := t.containers[id]; id == "" || (existing != nil && existing.Headers != nil) {
+			id = "<msgextract-" + strconv.Itoa(i) + "@localhost>"
+		}
+
+		container := t.get(id)
+		container.Headers = headers
+
+		// Each reference is taken as the parent of the following one,
+		// unless an earlier message already said otherwise
+		var parent *Container
+		for _, ref := range references(headers) {
+			refContainer := t.get(ref)
+			if parent != nil && refContainer.Parent == nil && !refContainer.isAncestorOf(parent) {
+				refContainer.setParent(parent)
+			}
+			parent = refContainer
+		}
+
+		// The message itself knows best who its parent is
+		container.setParent(nil)
+		if parent != nil && !container.isAncestorOf(parent) {
+			container.setParent(parent)
+		}
+	}
+
+	var roots []*Container
+	for _, container := range t.order {
+		if container.Parent == nil {
+			roots = append(roots, container)
+		}
+	}
+
+	return groupBySubject(prune(roots, true))
+}
+
+// Annotate sets the thread_id, parent_id and depth fields of every message
+// in the trees. thread_id is the Message-ID at the root of the thread;
+// parent_id the closest ancestor with a Message-ID, whether or not that
+// message is in the archive. depth counts those ancestors
+func Annotate(roots []*Container) {
+	for _, root := range roots {
+		annotate(root, root.threadID(), "", 0)
+	}
+}
+
+func annotate(container *Container, threadID, parentID string, depth int) {
+	if container.Headers != nil {
+		container.Headers["thread_id"] = threadID
+		container.Headers["parent_id"] = parentID
+		container.Headers["depth"] = strconv.Itoa(depth)
+	}
+
+	// Grouping nodes are invisible to their children
+	if container.ID != "" {
+		parentID = container.ID
+		depth++
+	}
+
+	for _, child := range container.Children {
+		annotate(child, threadID, parentID, depth)
+	}
+}
+
+// MarshalJSON renders the container with its descendants as nested objects
+func (c *Container) MarshalJSON() ([]byte, error) {
+	node := struct {
+		MessageID string `json:"message_id,omitempty"`
+		Message string `json:"message,omitempty"`
+		Subject string `json:"subject,omitempty"`
+		From string `json:"from,omitempty"`
+		Date string `json:"date,omitempty"`
+		// Set for messages referenced but not in the archive
+		Missing bool `json:"missing,omitempty"`
+		Children []*Container `json:"children,omitempty"`
+	}{
+		MessageID: c.ID,
+		Missing: c.Headers == nil && c.ID != "",
+		Children: c.Children,
+	}
+
+	if c.Headers != nil {
+		node.Message = c.Headers["message"]
+		node.Subject = header(c.Headers, "Subject")
+		node.From = header(c.Headers, "From")
+		node.Date = header(c.Headers, "Date")
+	}
+
+	return json.Marshal(node)
+}
+
+// NormalizeSubject strips reply and forward markers and list tags, so that
+// "Re: [team] AW: Lunch" and "lunch" compare equal
+func NormalizeSubject(subject string) string {
+	for {
+		stripped := subjectPrefix.ReplaceAllString(subject, "")
+		if stripped == subject {
+			break
+		}
+		subject = stripped
+	}
+
+	return strings.ToLower(strings.Join(strings.Fields(subject), " "))
+}
+
+type threader struct {
+	containers map[string]*Container
+	// Containers in order of creation, keeping the output stable
+	order []*Container
+}
+
+func (t *threader) get(id string) *Container {
+	if container, ok := t.containers[id]; ok {
+		return container
+	}
+
+	container := &Container{ID: id}
+	t.containers[id] = container
+	t.order = append(t.order, container)
+	return container
+}
+
+// isAncestorOf reports whether c is other or one of its ancestors, in which
+// case making c a child of other would close a loop
+func (c *Container) isAncestorOf(other *Container) bool {
+	for ancestor := other; ancestor != nil; ancestor = ancestor.Parent {
+		if ancestor == c {
+			return true
+		}
+	}
+	return false
+}
+
+// setParent moves the container under parent, or out of any tree when nil
+func (c *Container) setParent(parent *Container) {
+	if c.Parent != nil {
+		siblings := c.Parent.Children
+		for i, sibling := range siblings {
+			if sibling == c {
+				c.Parent.Children = append(siblings[:i:i], siblings[i + 1:]...)
+				break
+			}
+		}
+	}
+
+	c.Parent = parent
+	if parent != nil {
+		parent.Children = append(parent.Children, c)
+	}
+}
+
+func (c *Container) threadID() string {
+	if c.ID != "" || len(c.Children) == 0 {
+		return c.ID
+	}
+	return c.Children[0].threadID()
+}
+
+// subject of the message held, or of the first child for empty containers
+func (c *Container) subject() string {
+	if c.Headers != nil {
+		return header(c.Headers, "Subject")
+	}
+	if len(c.Children) > 0 {
+		return c.Children[0].subject()
+	}
+	return ""
+}
+
+func (c *Container) isReply() bool {
+	return replySubject.MatchString(c.subject())
+}
+
+// prune drops containers of absent messages, promoting their children.
+// Among the roots, such a container is kept to gather several children
+func prune(containers []*Container, isRoot bool) []*Container {
+	var kept []*Container
+
+	for _, container := range containers {
+		container.Children = prune(container.Children, false)
+
+		if container.Headers == nil {
+			if len(container.Children) == 0 {
+				continue
+			}
+
+			if !isRoot || len(container.Children) == 1 {
+				for _, child := range container.Children {
+					child.Parent = container.Parent
+				}
+				kept = append(kept, container.Children...)
+				continue
+			}
+		}
+
+		kept = append(kept, container)
+	}
+
+	return kept
+}
+
+// groupBySubject gathers the roots of threads about the same subject,
+// preferring an original message over replies as the common root
+func groupBySubject(roots []*Container) []*Container {
+	subjects := make(map[string]*Container)
+
+	for _, root := range roots {
+		subject := NormalizeSubject(root.subject())
+		if subject == "" {
+			continue
+		}
+
+		existing := subjects[subject]
+		if existing == nil ||
+				(root.Headers == nil && existing.Headers != nil) ||
+				(existing.Headers != nil && root.Headers != nil && existing.isReply() && !root.isReply()) {
+			subjects[subject] = root
+		}
+	}
+
+	for _, root := range roots {
+		subject := NormalizeSubject(root.subject())
+
+		existing := subjects[subject]
+		if subject == "" || existing == root {
+			continue
+		}
+
+		switch {
+		case existing.Headers == nil && root.Headers == nil:
+			// Both gather replies to an absent message
+			for _, child := range append([]*Container(nil), root.Children...) {
+				child.setParent(existing)
+			}
+		case existing.Headers == nil || (root.isReply() && !existing.isReply()):
+			root.setParent(existing)
+		default:
+			// Neither replies to the other, so they become siblings
+			// under a node of their own
+			group := &Container{}
+			existing.setParent(group)
+			root.setParent(group)
+			subjects[subject] = group
+		}
+	}
+
+	// Threads left at the top, new groups taking the place of their
+	// first member
+	var grouped []*Container
+	added := make(map[*Container]bool)
+
+	for _, root := range roots {
+		top := root
+		for top.Parent != nil {
+			top = top.Parent
+		}
+
+		// Emptied by having its children moved to another root
+		if added[top] || (top.Headers == nil && len(top.Children) == 0) {
+			continue
+		}
+		added[top] = true
+		grouped = append(grouped, top)
+	}
+
+	return grouped
+}
+
+// header looks the field up regardless of case, as mailers disagree on
+// spellings such as "Message-ID" and "Message-Id"
+func header(headers map[string]string, name string) string {
+	if value, ok := headers[name]; ok {
+		return value
+	}
+	for key, value := range headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+func firstID(value string) string {
+	return idPattern.FindString(value)
+}
+
+// references lists the ancestors of the message, oldest first
+func references(headers map[string]string) []string {
+	refs := idPattern.FindAllString(header(headers, "References"), -1)
+	if len(refs) == 0 {
+		if inReplyTo := firstID(header(headers, "In-Reply-To")); inReplyTo != "" {
+			refs = []string{inReplyTo}
+		}
+	}
+	return refs
+}
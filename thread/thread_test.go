@@ -0,0 +1,175 @@
+package thread
+
+import (
+	"testing"
+	"reflect"
+	"encoding/json"
+)
+
+// threadFields picks the fields set by Annotate out of each record
+func threadFields(records []map[string]string) [][]string {
+	var fields [][]string
+	for _, record := range records {
+		fields = append(fields, []string{record["thread_id"], record["parent_id"], record["depth"]})
+	}
+	return fields
+}
+
+func TestThreadAnnotate(t *testing.T) {
+	cases := []struct {
+		records []map[string]string
+		fields [][]string
+	}{
+		{
+			// Replies referencing the whole chain
+			[]map[string]string{
+				{"Message-ID": "<a@x>", "Subject": "Lunch"},
+				{"Message-ID": "<b@x>", "Subject": "Re: Lunch", "References": "<a@x>"},
+				{"Message-ID": "<c@x>", "Subject": "Re: Lunch", "References": "<a@x>\n <b@x>"},
+			},
+			[][]string{
+				{"<a@x>", "", "0"},
+				{"<a@x>", "<a@x>", "1"},
+				{"<a@x>", "<b@x>", "2"},
+			},
+		},
+		{
+			// Reply arriving before the original, spelling headers differently
+			[]map[string]string{
+				{"Message-Id": "<b@x>", "Subject": "Re: Lunch", "In-Reply-To": "<a@x> (Ron's message)"},
+				{"Message-ID": "<a@x>", "Subject": "Lunch"},
+			},
+			[][]string{
+				{"<a@x>", "<a@x>", "1"},
+				{"<a@x>", "", "0"},
+			},
+		},
+		{
+			// Siblings replying to a message absent from the archive
+			[]map[string]string{
+				{"Message-ID": "<b@x>", "Subject": "Re: Lunch", "References": "<a@x>"},
+				{"Message-ID": "<c@x>", "Subject": "Re: Lunch", "References": "<a@x>"},
+			},
+			[][]string{
+				{"<a@x>", "<a@x>", "1"},
+				{"<a@x>", "<a@x>", "1"},
+			},
+		},
+		{
+			// Lone reply to an absent message
+			[]map[string]string{
+				{"Message-ID": "<b@x>", "Subject": "Re: Dinner", "References": "<a@x>"},
+			},
+			[][]string{
+				{"<b@x>", "", "0"},
+			},
+		},
+		{
+			// No references, gathered by subject
+			[]map[string]string{
+				{"Message-ID": "<b@x>", "Subject": "AW: [team] Re[2]: Lunch"},
+				{"Message-ID": "<a@x>", "Subject": "Lunch"},
+				{"Message-ID": "<c@x>", "Subject": "Dinner"},
+			},
+			[][]string{
+				{"<a@x>", "<a@x>", "1"},
+				{"<a@x>", "", "0"},
+				{"<c@x>", "", "0"},
+			},
+		},
+		{
+			// Originals sharing a subject become siblings
+			[]map[string]string{
+				{"Message-ID": "<a@x>", "Subject": "Lunch"},
+				{"Message-ID": "<b@x>", "Subject": "[team] lunch"},
+			},
+			[][]string{
+				{"<a@x>", "", "0"},
+				{"<a@x>", "", "0"},
+			},
+		},
+		{
+			// References contradicting each other cannot close a loop
+			[]map[string]string{
+				{"Message-ID": "<a@x>", "Subject": "One", "References": "<b@x>"},
+				{"Message-ID": "<b@x>", "Subject": "Two", "References": "<a@x>"},
+			},
+			[][]string{
+				{"<b@x>", "<b@x>", "1"},
+				{"<b@x>", "", "0"},
+			},
+		},
+		{
+			// Missing and reused Message-IDs
+			[]map[string]string{
+				{"Subject": "One"},
+				{"Message-ID": "<a@x>", "Subject": "Two"},
+				{"Message-ID": "<a@x>", "Subject": "Three"},
+			},
+			[][]string{
+				{"<msgextract-0@localhost>", "", "0"},
+				{"<a@x>", "", "0"},
+				{"<msgextract-2@localhost>", "", "0"},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		Annotate(Thread(c.records))
+
+		if out := threadFields(c.records); !reflect.DeepEqual(out, c.fields) {
+			t.Errorf("%v returned %v, wanted %v", c.records, out, c.fields)
+		}
+	}
+}
+
+func TestNormalizeSubject(t *testing.T) {
+	cases := []struct {
+		in string
+		want string
+	}{
+		{"Lunch", "lunch"},
+		{"Re: Lunch", "lunch"},
+		{"RE:Re: re :  Lunch  menu", "lunch menu"},
+		{"Fwd: FW: Lunch", "lunch"},
+		{"AW: WG: SV: VS: Antw: TR: RIF: R: Lunch", "lunch"},
+		{"Re[3]: Lunch", "lunch"},
+		{"[team] Re: [team] Lunch", "lunch"},
+		{"Regarding lunch", "regarding lunch"},
+		{"Lunch: Friday", "lunch: friday"},
+		{"", ""},
+	}
+
+	for _, c := range cases {
+		if out := NormalizeSubject(c.in); out != c.want {
+			t.Errorf("%q returned %q, wanted %q", c.in, out, c.want)
+		}
+	}
+}
+
+func TestContainerMarshalJSON(t *testing.T) {
+	records := []map[string]string{
+		{"message": "b.msg", "Message-ID": "<b@x>", "Subject": "Re: Lunch", "References": "<a@x>"},
+		{"message": "c.msg", "Message-ID": "<c@x>", "Subject": "Re: Lunch", "References": "<a@x> <b@x>"},
+		{"message": "d.msg", "Message-ID": "<d@x>", "Subject": "Re: Lunch", "References": "<a@x>"},
+	}
+
+	tree, err := json.Marshal(Thread(records))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `[{"message_id":"<a@x>","missing":true,"children":[` +
+		`{"message_id":"<b@x>","message":"b.msg","subject":"Re: Lunch","children":[` +
+		`{"message_id":"<c@x>","message":"c.msg","subject":"Re: Lunch"}]},` +
+		`{"message_id":"<d@x>","message":"d.msg","subject":"Re: Lunch"}]}]`
+
+	// json.Marshal escapes angle brackets
+	var got, wanted interface{}
+	json.Unmarshal(tree, &got)
+	json.Unmarshal([]byte(want), &wanted)
+
+	if !reflect.DeepEqual(got, wanted) {
+		t.Errorf("Received %s, wanted %s", tree, want)
+	}
+}
@@ -11,12 +11,23 @@ import (
 )
 
 func Gzip(gzippedArchivePath, targetPath string) error {
+	return GzipProgress(gzippedArchivePath, targetPath, nil)
+}
+
+// GzipProgress unpacks the archive as Gzip does, calling readFn, if given,
+// with the number of bytes of the gzipped archive read so far as it goes
+func GzipProgress(gzippedArchivePath, targetPath string, readFn func(read int64)) error {
 	// Open the gzipped file for reading
-	reader, err := os.Open(gzippedArchivePath)
+	file, err := os.Open(gzippedArchivePath)
 	if err != nil {
 		return err
 	}
-	defer reader.Close()
+	defer file.Close()
+
+	var reader io.Reader = file
+	if readFn != nil {
+		reader = &countingReader{reader: file, readFn: readFn}
+	}
 
 	// Unpack the zipped reader into tar archive
 	archive, err := gzip.NewReader(reader)
@@ -37,7 +48,35 @@ func Gzip(gzippedArchivePath, targetPath string) error {
 	return err
 }
 
+// countingReader reports the bytes read through it
+type countingReader struct {
+	reader io.Reader
+	read int64
+	readFn func(read int64)
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.read += int64(n)
+	r.readFn(r.read)
+	return n, err
+}
+
+// WalkFunc is called for every MSG file in the archive with the entry name,
+// the lines of its header and a reader positioned at the start of its body.
+// The body reader is only valid until WalkFunc returns; whatever is left
+// unread is skipped
+type WalkFunc func(name string, headerLines []string, body io.Reader) error
+
 func Tar(tarPath string, headerChan chan []string) error {
+	return Walk(tarPath, func(name string, headerLines []string, body io.Reader) error {
+		// Feed lines through channel, leaving the body unread
+		headerChan <- headerLines
+		return nil
+	})
+}
+
+func Walk(tarPath string, walkFn WalkFunc) error {
 	// Open tar file for reading
 	reader, err := os.Open(tarPath)
 	if err != nil {
@@ -45,7 +84,53 @@ func Tar(tarPath string, headerChan chan []string) error {
 	}
 	defer reader.Close()
 
+	return WalkReader(reader, walkFn)
+}
+
+// WalkReader walks the tar archive read from reader, as Walk does for a
+// file, so an archive can be handled as it arrives
+func WalkReader(reader io.Reader, walkFn WalkFunc) error {
+	return walk(reader, nil, walkFn)
+}
+
+// Position is how far a walk went through a tar archive: the number of
+// entries walked, MSG files or not, and the offset at which the next entry
+// begins, from which a later walk can resume
+type Position struct {
+	Entries int `json:"entries"`
+	Offset int64 `json:"offset"`
+}
+
+// WalkFrom walks the tar archive as Walk does, starting at the position
+// given rather than at the first entry. Before walkFn is called for an
+// entry, position is moved past it
+func WalkFrom(tarPath string, position *Position, walkFn WalkFunc) error {
+	reader, err := os.Open(tarPath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	if _, err := reader.Seek(position.Offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	return walk(reader, func(tarHeader *tar.Header) error {
+		// The tar reader reads the file unbuffered, leaving it at the start
+		// of the entry's content, which is padded to whole blocks
+		start, err := reader.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		position.Entries++
+		position.Offset = start + (tarHeader.Size + 511) / 512 * 512
+		return nil
+	}, walkFn)
+}
 
+// walk walks the tar archive, calling entryFn, if given, with every entry
+// before its content is read
+func walk(reader io.Reader, entryFn func(*tar.Header) error, walkFn WalkFunc) error {
 	tarReader := tar.NewReader(reader)
 
 	// Iterate through all messages
@@ -57,33 +142,76 @@ func Tar(tarPath string, headerChan chan []string) error {
 			return err
 		}
 
-		// Only handle MSG files
-		if tarHeader.Name[len(tarHeader.Name) - 3:] != "msg" {
+		if entryFn != nil {
+			if err := entryFn(tarHeader); err != nil {
+				return err
+			}
+		}
+
+		// Only handle MSG files, skipping directories, links and the like
+		if tarHeader.Typeflag != tar.TypeReg || !strings.HasSuffix(tarHeader.Name, ".msg") {
 			continue
 		}
 
-		scanner := bufio.NewScanner(tarReader)
+		msgReader := bufio.NewReader(tarReader)
 
-		// Initialize new slice of strings to collect lines of the header
-		var headerLines []string
+		headerLines, err := readHeaderLines(msgReader)
+		if err != nil {
+			return err
+		}
 
-		// Load the slice with header lines
-		for scanner.Scan() {
-			line := scanner.Text()
-			// Formatting specified at https://tools.ietf.org/html/rfc2822
-			if strings.TrimSpace(line) == "" {
-				// End of header section
-				break
-			} else {
-				headerLines = append(headerLines, line)
-			}
+		// Remainder of the buffered reader is the message body
+		if err = walkFn(tarHeader.Name, headerLines, msgReader); err != nil {
+			return err
 		}
+	}
 
-		// Feed lines through channel
-		headerChan <- headerLines
+	return nil
+}
+
+// Decompress reads the gzipped archive from reader as a tar archive, or
+// passes it through when it is not gzipped
+func Decompress(reader io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(reader)
+
+	magic, err := buffered.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
 	}
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(buffered)
+	}
+	return buffered, nil
+}
 
-	return err
+// readHeaderLines consumes lines from reader up to and including the blank
+// line which ends the header section
+func readHeaderLines(reader *bufio.Reader) ([]string, error) {
+	// Initialize new slice of strings to collect lines of the header
+	var headerLines []string
+
+	// Load the slice with header lines
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		// Formatting specified at https://tools.ietf.org/html/rfc2822
+		if strings.TrimSpace(line) == "" {
+			// End of header section
+			break
+		}
+		headerLines = append(headerLines, line)
+
+		if err == io.EOF {
+			// Message consisted solely of a header
+			break
+		}
+	}
+
+	return headerLines, nil
 }
 
 func CreateArchiveName(tmpDir, gzippedPath string) string {
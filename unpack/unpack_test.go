@@ -3,6 +3,8 @@ package unpack
 import (
 	"testing"
 	"os"
+	"io"
+	"bufio"
 	"reflect"
 	"io/ioutil"
 	"path/filepath"
@@ -251,3 +253,155 @@ func TestCreateArchiveName(t *testing.T) {
 	}
 }
 
+
+func TestWalk(t *testing.T) {
+	tarDir := "../test_files/tars"
+
+	cases := []struct {
+		tarPath string
+		names []string
+		firstBodyLines []string
+	}{
+		{
+			filepath.Join(tarDir, "both.tar"),
+			[]string{
+				"test/parsetar/msgs/return_x-orig_received.msg",
+				"test/parsetar/msgs/subject_date_from.msg",
+			},
+			[]string{
+				"<!DOCTYPE HTML PUBLIC \"-//W3C//DTD HTML 4.01 Transitional//EN\" \"http://www.=",
+				"<html>",
+			},
+		},
+		{
+			filepath.Join(tarDir, "multipart.tar"),
+			[]string{"multipart/multipart.msg"},
+			[]string{"This is a multi-part message in MIME format."},
+		},
+	}
+
+	for _, c := range cases {
+		var names, firstBodyLines []string
+
+		err := Walk(c.tarPath, func(name string, headerLines []string, body io.Reader) error {
+			names = append(names, name)
+
+			scanner := bufio.NewScanner(body)
+			scanner.Scan()
+			firstBodyLines = append(firstBodyLines, scanner.Text())
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+
+		if !reflect.DeepEqual(names, c.names) {
+			t.Errorf("%v walked %v, wanted %v", c.tarPath, names, c.names)
+		}
+
+		if !reflect.DeepEqual(firstBodyLines, c.firstBodyLines) {
+			t.Errorf("%v bodies began with %q, wanted %q", c.tarPath, firstBodyLines, c.firstBodyLines)
+		}
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	cases := []struct {
+		path string
+		names int
+	}{
+		{"../test_files/targzs/testEmails.tar.gz", 2},
+		{"../test_files/tars/both.tar", 2},
+	}
+
+	for _, c := range cases {
+		file, err := os.Open(c.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+
+		reader, err := Decompress(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names := 0
+		err = WalkReader(reader, func(name string, headerLines []string, body io.Reader) error {
+			names++
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		if names != c.names {
+			t.Errorf("%v walked %v messages, wanted %v", c.path, names, c.names)
+		}
+	}
+}
+
+func TestWalkFrom(t *testing.T) {
+	tarPath := "../test_files/tars/both.tar"
+
+	// Positions after each entry
+	var position Position
+	var names []string
+	var positions []Position
+	err := WalkFrom(tarPath, &position, func(name string, headerLines []string, body io.Reader) error {
+		names = append(names, name)
+		positions = append(positions, position)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Position{{1, 12800}, {2, 59904}}
+	if !reflect.DeepEqual(positions, expected) {
+		t.Errorf("positions %v, expected %v", positions, expected)
+	}
+
+	// Resuming walks the entries left
+	for i, from := range positions {
+		var resumed []string
+		err := WalkFrom(tarPath, &from, func(name string, headerLines []string, body io.Reader) error {
+			resumed = append(resumed, name)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(resumed, names[i + 1:]) && len(resumed) + len(names[i + 1:]) > 0 {
+			t.Errorf("resumed from %v walked %v, expected %v", from, resumed, names[i + 1:])
+		}
+	}
+}
+
+func TestGzipProgress(t *testing.T) {
+	zippedPath := "../test_files/targzs/testEmails.tar.gz"
+	tmpDir, err := ioutil.TempDir("../test_files", "tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var calls int
+	var last int64
+	err = GzipProgress(zippedPath, CreateArchiveName(tmpDir, zippedPath), func(read int64) {
+		if read < last {
+			t.Errorf("read %v after %v", read, last)
+		}
+		calls++
+		last = read
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(zippedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls == 0 || last != info.Size() {
+		t.Errorf("%v calls, last reporting %v of %v bytes", calls, last, info.Size())
+	}
+}
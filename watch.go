@@ -0,0 +1,221 @@
+package main
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"log"
+	"flag"
+	"time"
+	"bytes"
+	"context"
+	"os/exec"
+	"strings"
+	"io/ioutil"
+	"syscall"
+	"os/signal"
+	"encoding/json"
+	"github.com/asgaines/msgextract/watch"
+	"github.com/asgaines/msgextract/metrics"
+	"github.com/asgaines/msgextract/progress"
+)
+
+// watchDir extracts the archives dropped into a directory until interrupted,
+// each by running msgextract with the options given after the directories
+func watchDir(args []string) {
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s watch [opt args] in-dir out-dir [extraction opt args]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	var config watch.Config
+	flags.StringVar(&config.DoneDir, "done-dir", "", "Directory extracted archives are moved to (default in-dir/done)")
+	flags.StringVar(&config.FailedDir, "failed-dir", "", "Directory archives which failed to extract are moved to (default in-dir/failed)")
+	flags.StringVar(&config.StatePath, "state", "", "File recording the archives handled, never extracted again (default out-dir/.msgextract-watch)")
+	flags.StringVar(&config.Extension, "ext", "", "Extension of outputs (default that of -format in the extraction options)")
+	flags.DurationVar(&config.Poll, "poll", 10 * time.Second, "How often in-dir is listed, besides being watched with inotify")
+	flags.DurationVar(&config.Settle, "settle", 5 * time.Second, "How long an archive must be left unchanged before it is extracted, unless inotify tells it was closed")
+	flags.BoolVar(&config.PollOnly, "poll-only", false, "Only list in-dir, e.g. on network filesystems written from other hosts")
+	metricsAddr := flags.String("metrics-addr", "", "Address to serve metrics of the extractions on under /metrics, e.g. :9100 (default none)")
+	tmpDir := flags.String("tmp-dir", "", "Directory extractions unpack archives under, in a directory of their own removed once done (default the system's temporary directory)")
+	pprofAddr := flags.String("pprof-addr", "", "Address to serve runtime profiles on under /debug/pprof/, e.g. localhost:6060 (default none)")
+	flags.Parse(args)
+
+	if flags.NArg() < 2 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	config.InDir = flags.Arg(0)
+	config.OutDir = flags.Arg(1)
+	extractArgs := flags.Args()[2:]
+	if config.Extension == "" {
+		config.Extension = formatExtension(extractArgs)
+	}
+
+	// Extractions report their progress to be followed in the metrics
+	var pipeline *metrics.Pipeline
+	if *metricsAddr != "" {
+		registry := metrics.NewRegistry()
+		pipeline = metrics.NewPipeline(registry)
+		extractArgs = append(extractArgs, "-progress=json", "-progress-interval=1s")
+		serveDebug(*metricsAddr, registry, *pprofAddr)
+	} else {
+		serveDebug("", nil, *pprofAddr)
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// A separate process per archive, so that one failing does not stop
+	// the others
+	config.Extract = func(ctx context.Context, archivePath, outputPath string) error {
+		// Removed however the extraction ends, even when it is killed
+		unpackDir, err := ioutil.TempDir(*tmpDir, "msgextract-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(unpackDir)
+
+		args := append(append([]string{}, extractArgs...), "-tmp-dir=" + unpackDir, archivePath, outputPath)
+		cmd := exec.CommandContext(ctx, executable, args...)
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+
+		var events *eventWriter
+		if pipeline != nil {
+			events = &eventWriter{pipeline: pipeline, out: os.Stderr}
+			if info, err := os.Stat(archivePath); err == nil {
+				events.archiveSize = info.Size()
+			}
+			cmd.Stderr = events
+		}
+
+		err = cmd.Run()
+		if events != nil {
+			if ctx.Err() != nil {
+				events.finish(ctx.Err())
+			} else {
+				events.finish(err)
+			}
+		}
+		return err
+	}
+
+	watcher, err := watch.New(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer watcher.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	log.Printf("watching %v", config.InDir)
+	if err := watcher.Run(ctx); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// eventWriter follows the progress events an extraction writes to stderr,
+// adding what it did to the metrics, and passes other lines on
+type eventWriter struct {
+	pipeline *metrics.Pipeline
+	out io.Writer
+	archiveSize int64
+	// Partial line left from the last write
+	pending []byte
+
+	// What the events so far added to the metrics
+	bytesRead int64
+	processed int64
+	failed int64
+	queued int64
+	stageSeconds map[string]float64
+}
+
+func (w *eventWriter) Write(p []byte) (int, error) {
+	w.pending = append(w.pending, p...)
+	for {
+		end := bytes.IndexByte(w.pending, '\n')
+		if end < 0 {
+			return len(p), nil
+		}
+		w.line(w.pending[:end + 1])
+		w.pending = w.pending[end + 1:]
+	}
+}
+
+func (w *eventWriter) line(line []byte) {
+	var e progress.Event
+	if !bytes.HasPrefix(line, []byte("{")) || json.Unmarshal(line, &e) != nil || e.Phase == "" {
+		w.out.Write(line)
+		return
+	}
+
+	// The whole archive is read once unpacked
+	bytesRead := w.archiveSize
+	if e.Phase == progress.Unpacking {
+		bytesRead = e.Bytes
+	}
+	if bytesRead > w.bytesRead {
+		w.pipeline.BytesRead.Add(bytesRead - w.bytesRead)
+		w.bytesRead = bytesRead
+	}
+
+	if processed := e.Messages + e.Skipped; processed > w.processed {
+		w.pipeline.Messages.Add(processed - w.processed)
+		w.processed = processed
+	}
+	// Messages failed on their MIME structure, and archives which could not
+	// be read at all, by why
+	if e.Failed > w.failed {
+		w.pipeline.ParseFailures.With(metrics.MIME).Add(e.Failed - w.failed)
+		w.failed = e.Failed
+	}
+	if e.FailureReason != "" {
+		w.pipeline.ParseFailures.With(e.FailureReason).Inc()
+	}
+	w.pipeline.HeaderQueue.Add(int64(e.QueueDepth) - w.queued)
+	w.queued = int64(e.QueueDepth)
+
+	if e.StageSeconds != nil {
+		w.stageSeconds = e.StageSeconds
+	}
+}
+
+// finish records the extraction, which ended with err
+func (w *eventWriter) finish(err error) {
+	if len(w.pending) > 0 {
+		w.line(append(w.pending, '\n'))
+		w.pending = nil
+	}
+	w.pipeline.HeaderQueue.Add(-w.queued)
+	w.queued = 0
+	w.pipeline.Finish(w.stageSeconds, err)
+}
+
+// formatExtension is the extension of the output of the extraction options
+func formatExtension(args []string) string {
+	format := "json"
+	for i, arg := range args {
+		name := strings.TrimLeft(arg, "-")
+		if name == arg {
+			continue
+		}
+		switch {
+		case name == "template" || strings.HasPrefix(name, "template="):
+			return "txt"
+		case strings.HasPrefix(name, "format="):
+			format = strings.TrimPrefix(name, "format=")
+		case name == "format" && i + 1 < len(args):
+			format = args[i + 1]
+		}
+	}
+
+	if format == "es-bulk" {
+		return "ndjson"
+	}
+	return format
+}
@@ -0,0 +1,62 @@
+package watch
+
+import (
+	"os"
+	"bytes"
+	"context"
+	"unsafe"
+	"syscall"
+)
+
+// notify sends the names of the files in dir closed after writing, or moved
+// into it, until ctx is done. An empty name tells events were lost
+func notify(ctx context.Context, dir string) (<-chan string, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	if _, err := syscall.InotifyAddWatch(fd, dir, syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("inotify_add_watch", err)
+	}
+
+	// Non-blocking, reads wait in the runtime poller and end when the file
+	// is closed
+	file := os.NewFile(uintptr(fd), "inotify")
+	go func() {
+		<-ctx.Done()
+		file.Close()
+	}()
+
+	names := make(chan string)
+	go func() {
+		buffer := make([]byte, 64 * (syscall.SizeofInotifyEvent + syscall.NAME_MAX + 1))
+		for {
+			n, err := file.Read(buffer)
+			if err != nil {
+				return
+			}
+
+			for offset := 0; offset + syscall.SizeofInotifyEvent <= n; {
+				event := (*syscall.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+				name := buffer[offset + syscall.SizeofInotifyEvent:offset + syscall.SizeofInotifyEvent + int(event.Len)]
+				offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+				var sent string
+				if event.Mask & syscall.IN_Q_OVERFLOW == 0 {
+					// Names are padded with NULs
+					sent = string(bytes.TrimRight(name, "\x00"))
+					if sent == "" {
+						continue
+					}
+				}
+				select {
+				case names <- sent:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return names, nil
+}
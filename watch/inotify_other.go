@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package watch
+
+import (
+	"errors"
+	"context"
+)
+
+// notify is left to polling where inotify is missing
+func notify(ctx context.Context, dir string) (<-chan string, error) {
+	return nil, errors.New("inotify is only available on Linux")
+}
@@ -0,0 +1,351 @@
+package watch
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+	"bufio"
+	"errors"
+	"context"
+	"strings"
+	"io/ioutil"
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+)
+
+// Outcomes of an archive, naming the folders archives are moved to
+const (
+	Done = "done"
+	Failed = "failed"
+)
+
+// Suffixes of the archives picked up
+var Suffixes = []string{".tar.gz", ".tgz"}
+
+// ExtractFunc extracts the archive into the output file, stopping when ctx
+// is done
+type ExtractFunc func(ctx context.Context, archivePath, outputPath string) error
+
+// Config of a Watcher
+type Config struct {
+	// Directory archives are dropped into, and outputs written to
+	InDir string
+	OutDir string
+	// Where archives are moved once extracted, or not (default InDir/done
+	// and InDir/failed)
+	DoneDir string
+	FailedDir string
+	// File recording the archives handled (default OutDir/.msgextract-watch)
+	StatePath string
+	// Extension of outputs, without the dot
+	Extension string
+	// How often InDir is listed (default 10s), and how long an archive
+	// must be left unchanged before it is taken as written (default 5s),
+	// unless inotify told it was closed after writing
+	Poll time.Duration
+	Settle time.Duration
+	// Only list InDir, as inotify does not see writes from other hosts to
+	// network filesystems
+	PollOnly bool
+	Extract ExtractFunc
+}
+
+// Watcher extracts the archives dropped into a directory, once each
+type Watcher struct {
+	config Config
+	// Outcomes of the archives handled, by their SHA-256
+	handled map[string]string
+	state *os.File
+	// Archives seen in InDir, by name
+	pending map[string]*candidate
+}
+
+// candidate is an archive possibly still being written
+type candidate struct {
+	size int64
+	modTime time.Time
+	// Since when it is unchanged
+	since time.Time
+	// Whether it was closed after writing, or moved in, since
+	closed bool
+}
+
+// New prepares the directories, reading the archives handled before
+func New(config Config) (*Watcher, error) {
+	if config.Extract == nil {
+		return nil, errors.New("watch: no extraction")
+	}
+	if config.DoneDir == "" {
+		config.DoneDir = filepath.Join(config.InDir, Done)
+	}
+	if config.FailedDir == "" {
+		config.FailedDir = filepath.Join(config.InDir, Failed)
+	}
+	if config.StatePath == "" {
+		config.StatePath = filepath.Join(config.OutDir, ".msgextract-watch")
+	}
+	if config.Poll <= 0 {
+		config.Poll = 10 * time.Second
+	}
+	if config.Settle <= 0 {
+		config.Settle = 5 * time.Second
+	}
+
+	if info, err := os.Stat(config.InDir); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("%v is not a directory", config.InDir)
+	}
+	for _, dir := range []string{config.OutDir, config.DoneDir, config.FailedDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	w := &Watcher{config: config, handled: map[string]string{}, pending: map[string]*candidate{}}
+	if err := w.readState(); err != nil {
+		return nil, err
+	}
+
+	var err error
+	w.state, err = os.OpenFile(config.StatePath, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// readState reads the lines of the state file: the SHA-256 of an archive,
+// its outcome and its name, separated by tabs
+func (w *Watcher) readState() error {
+	file, err := os.Open(w.config.StatePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// A line cut short by a crash is ignored
+		columns := strings.SplitN(scanner.Text(), "\t", 3)
+		if len(columns) == 3 && len(columns[0]) == sha256.Size * 2 && (columns[1] == Done || columns[1] == Failed) {
+			w.handled[columns[0]] = columns[1]
+		}
+	}
+	return scanner.Err()
+}
+
+// Run extracts the archives in InDir, and those dropped into it, until ctx
+// is done. An extraction under way is then stopped, leaving its archive to
+// the next run
+func (w *Watcher) Run(ctx context.Context) error {
+	var written <-chan string
+	if !w.config.PollOnly {
+		var err error
+		written, err = notify(ctx, w.config.InDir)
+		if err != nil {
+			log.Printf("watch: polling %v: %v", w.config.InDir, err)
+		}
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case name := <-written:
+			// An empty name tells events were lost
+			if name != "" {
+				w.closed(name)
+			}
+		case <-timer.C:
+		}
+
+		next, err := w.scan(ctx)
+		if err != nil {
+			return err
+		}
+		timer.Stop()
+		timer = time.NewTimer(next)
+	}
+}
+
+// closed marks the archive as written, once inotify told it was closed
+// after writing or moved in
+func (w *Watcher) closed(name string) {
+	info, err := os.Stat(filepath.Join(w.config.InDir, name))
+	if err != nil || !isArchive(name, info) {
+		return
+	}
+	w.pending[name] = &candidate{size: info.Size(), modTime: info.ModTime(), since: time.Now(), closed: true}
+}
+
+// scan lists InDir, extracting the archives written, and returns how long
+// to wait before listing it again
+func (w *Watcher) scan(ctx context.Context) (time.Duration, error) {
+	infos, err := ioutil.ReadDir(w.config.InDir)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	next := w.config.Poll
+	present := map[string]bool{}
+	var ready []string
+	for _, info := range infos {
+		name := info.Name()
+		if !isArchive(name, info) {
+			continue
+		}
+		present[name] = true
+
+		c, ok := w.pending[name]
+		if !ok || c.size != info.Size() || !c.modTime.Equal(info.ModTime()) {
+			c = &candidate{size: info.Size(), modTime: info.ModTime(), since: now}
+			w.pending[name] = c
+		}
+
+		if wait := c.since.Add(w.config.Settle).Sub(now); c.closed || wait <= 0 {
+			ready = append(ready, name)
+		} else if wait < next {
+			next = wait
+		}
+	}
+
+	// Forget archives removed before being extracted
+	for name := range w.pending {
+		if !present[name] {
+			delete(w.pending, name)
+		}
+	}
+
+	sort.Strings(ready)
+	for _, name := range ready {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := w.handle(ctx, name); err != nil {
+			return 0, err
+		}
+		delete(w.pending, name)
+	}
+	return next, nil
+}
+
+// isArchive tells archives to extract from other files, skipping hidden
+// ones as those are usually still being written
+func isArchive(name string, info os.FileInfo) bool {
+	if !info.Mode().IsRegular() || strings.HasPrefix(name, ".") {
+		return false
+	}
+	return archiveSuffix(name) != ""
+}
+
+func archiveSuffix(name string) string {
+	for _, suffix := range Suffixes {
+		if strings.HasSuffix(name, suffix) {
+			return suffix
+		}
+	}
+	return ""
+}
+
+// handle extracts the archive unless it was before, records its outcome
+// then moves it out of InDir. Only failures to record outcomes or move
+// archives are returned, as they would have it extracted again
+func (w *Watcher) handle(ctx context.Context, name string) error {
+	archivePath := filepath.Join(w.config.InDir, name)
+	hash, err := fileHash(archivePath)
+	if err != nil {
+		log.Printf("watch: %v: %v", name, err)
+		return nil
+	}
+
+	outcome, ok := w.handled[hash]
+	if ok {
+		log.Printf("watch: %v was %v before, not extracting it again", name, outcome)
+		return w.move(name, hash, outcome)
+	}
+
+	outcome = Done
+	outputPath := uniquePath(w.config.OutDir, strings.TrimSuffix(name, archiveSuffix(name)), "." + w.config.Extension, hash)
+	// Written under a hidden name, for the output to appear complete
+	partPath := filepath.Join(w.config.OutDir, "." + filepath.Base(outputPath) + ".part")
+
+	start := time.Now()
+	err = w.config.Extract(ctx, archivePath, partPath)
+	if ctx.Err() != nil {
+		os.Remove(partPath)
+		return nil
+	}
+	if err == nil {
+		err = os.Rename(partPath, outputPath)
+	}
+	if err != nil {
+		os.Remove(partPath)
+		outcome = Failed
+		log.Printf("watch: %v: %v", name, err)
+	} else {
+		log.Printf("watch: extracted %v into %v in %v", name, outputPath, time.Since(start).Round(time.Millisecond))
+	}
+
+	if err := w.record(hash, outcome, name); err != nil {
+		return err
+	}
+	return w.move(name, hash, outcome)
+}
+
+// record appends the outcome of the archive to the state file
+func (w *Watcher) record(hash, outcome, name string) error {
+	if _, err := fmt.Fprintf(w.state, "%v\t%v\t%v\n", hash, outcome, name); err != nil {
+		return err
+	}
+	w.handled[hash] = outcome
+	return w.state.Sync()
+}
+
+// move moves the archive to the folder of its outcome
+func (w *Watcher) move(name, hash, outcome string) error {
+	dir := w.config.DoneDir
+	if outcome == Failed {
+		dir = w.config.FailedDir
+	}
+	suffix := archiveSuffix(name)
+	return os.Rename(filepath.Join(w.config.InDir, name), uniquePath(dir, strings.TrimSuffix(name, suffix), suffix, hash))
+}
+
+// uniquePath is the path of base and suffix in dir or, when taken by
+// another file, with the start of the hash added to base
+func uniquePath(dir, base, suffix, hash string) string {
+	path := filepath.Join(dir, base + suffix)
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return path
+	}
+	return filepath.Join(dir, base + "-" + hash[:12] + suffix)
+}
+
+func fileHash(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Close closes the state file
+func (w *Watcher) Close() error {
+	return w.state.Close()
+}
@@ -0,0 +1,193 @@
+package watch
+
+import (
+	"os"
+	"time"
+	"errors"
+	"context"
+	"strings"
+	"testing"
+	"io/ioutil"
+	"path/filepath"
+)
+
+const gzippedArchive = "../test_files/targzs/testEmails.tar.gz"
+
+// testWatcher runs a watcher over directories made for the test, counting
+// the extractions
+type testWatcher struct {
+	*Watcher
+	inDir string
+	outDir string
+	extracted chan string
+	stop func()
+	stopped chan error
+}
+
+func newTestConfig(t *testing.T) Config {
+	tmpDir, err := ioutil.TempDir("../test_files", "tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+
+	inDir := filepath.Join(tmpDir, "in")
+	if err := os.Mkdir(inDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return Config{
+		InDir: inDir,
+		OutDir: filepath.Join(tmpDir, "out"),
+		Extension: "json",
+		Poll: 20 * time.Millisecond,
+		Settle: 100 * time.Millisecond,
+	}
+}
+
+// start runs a watcher whose extraction fails for archives named bad and
+// blocks for those named slow
+func start(t *testing.T, config Config) *testWatcher {
+	extracted := make(chan string, 10)
+	config.Extract = func(ctx context.Context, archivePath, outputPath string) error {
+		name := filepath.Base(archivePath)
+		extracted <- name
+		if strings.HasPrefix(name, "bad") {
+			return errors.New("exit status 1")
+		}
+		if strings.HasPrefix(name, "slow") {
+			ioutil.WriteFile(outputPath, []byte("partial"), 0644)
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return ioutil.WriteFile(outputPath, []byte(name), 0644)
+	}
+
+	w, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	tw := &testWatcher{Watcher: w, inDir: config.InDir, outDir: config.OutDir, extracted: extracted, stop: cancel, stopped: make(chan error, 1)}
+	go func() { tw.stopped <- w.Run(ctx) }()
+	t.Cleanup(tw.close)
+	return tw
+}
+
+func (tw *testWatcher) close() {
+	if tw.stop != nil {
+		tw.stop()
+		<-tw.stopped
+		tw.Close()
+		tw.stop = nil
+	}
+}
+
+// drop writes the archive into the directory watched, in two parts, the
+// variant making its content differ from other archives
+func drop(t *testing.T, dir, name, variant string) {
+	content, err := ioutil.ReadFile(gzippedArchive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content = append(content, variant...)
+	file, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	file.Write(content[:len(content) / 2])
+	time.Sleep(30 * time.Millisecond)
+	file.Write(content[len(content) / 2:])
+}
+
+// waitFile waits for a file matching the pattern to exist
+func waitFile(t *testing.T, pattern string) {
+	for i := 0; i < 300; i++ {
+		if matches, _ := filepath.Glob(pattern); len(matches) > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no %v", pattern)
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestWatch(t *testing.T) {
+	for _, pollOnly := range []bool{false, true} {
+		config := newTestConfig(t)
+		config.PollOnly = pollOnly
+		// Archives there already are extracted first
+		drop(t, config.InDir, "first.tar.gz", "first")
+		w := start(t, config)
+
+		drop(t, w.inDir, "april.tar.gz", "april")
+		drop(t, w.inDir, "bad.tgz", "bad")
+		ioutil.WriteFile(filepath.Join(w.inDir, "notes.txt"), nil, 0644)
+		ioutil.WriteFile(filepath.Join(w.inDir, ".hidden.tar.gz"), nil, 0644)
+
+		waitFile(t, filepath.Join(w.inDir, "done", "april.tar.gz"))
+		waitFile(t, filepath.Join(w.inDir, "failed", "bad.tgz"))
+		waitFile(t, filepath.Join(w.inDir, "done", "first.tar.gz"))
+
+		if content, err := ioutil.ReadFile(filepath.Join(w.outDir, "april.json")); err != nil || string(content) != "april.tar.gz" {
+			t.Errorf("poll only %v: output %q, %v", pollOnly, content, err)
+		}
+		outputs, _ := filepath.Glob(filepath.Join(w.outDir, "*.json"))
+		if len(outputs) != 2 {
+			t.Errorf("poll only %v: outputs %v", pollOnly, outputs)
+		}
+		for _, name := range []string{"notes.txt", ".hidden.tar.gz"} {
+			if !exists(filepath.Join(w.inDir, name)) {
+				t.Errorf("poll only %v: %v moved", pollOnly, name)
+			}
+		}
+		if len(w.extracted) != 3 {
+			t.Errorf("poll only %v: %v extractions", pollOnly, len(w.extracted))
+		}
+	}
+}
+
+func TestWatchRestart(t *testing.T) {
+	config := newTestConfig(t)
+	w := start(t, config)
+	drop(t, w.inDir, "april.tar.gz", "april")
+	waitFile(t, filepath.Join(w.inDir, "done", "april.tar.gz"))
+	<-w.extracted
+
+	// Extractions under way when stopped are left to the next run
+	drop(t, w.inDir, "slow.tar.gz", "slow")
+	<-w.extracted
+	w.close()
+	if !exists(filepath.Join(w.inDir, "slow.tar.gz")) || exists(filepath.Join(w.outDir, ".slow.json.part")) {
+		t.Errorf("stopped extraction not left to the next run")
+	}
+	os.Remove(filepath.Join(w.inDir, "slow.tar.gz"))
+
+	// The same archive is not extracted again, whatever its name
+	w = start(t, config)
+	drop(t, w.inDir, "april-copy.tar.gz", "april")
+	drop(t, w.inDir, "april.tar.gz", "april")
+	waitFile(t, filepath.Join(w.inDir, "done", "april-copy.tar.gz"))
+	waitFile(t, filepath.Join(w.inDir, "done", "april-" + strings.Repeat("?", 12) + ".tar.gz"))
+	if len(w.extracted) != 0 {
+		t.Errorf("extracted %v again", <-w.extracted)
+	}
+}
+
+func TestNew(t *testing.T) {
+	config := newTestConfig(t)
+	if _, err := New(config); err == nil {
+		t.Errorf("no error without extraction")
+	}
+
+	config.Extract = func(context.Context, string, string) error { return nil }
+	config.InDir = filepath.Join(config.InDir, "missing")
+	if _, err := New(config); err == nil {
+		t.Errorf("no error for a missing directory")
+	}
+}